@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/logger"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+	"github.com/nerfthisdev/go-backend-test-task/internal/repository"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	commandTimeout = 10 * time.Minute
+)
+
+// app holds the dependencies shared by the server and the admin commands.
+type app struct {
+	cfg    config.Config
+	logger *zap.Logger
+	db     *pgxpool.Pool
+
+	resetRepo   *repository.PasswordResetRepository
+	emailRepo   *repository.EmailVerificationRepository
+	loginRepo   *repository.EmailLoginRepository
+	mfaRepo     *repository.MFARepository
+	passkeyRepo *repository.WebAuthnRepository
+
+	realms map[string]*realm
+}
+
+// realm holds the services of one realm. Its repositories only see the
+// users, sessions, roles, organizations and audit log of the realm, its
+// tokens are signed with the key of the realm and its admin API takes the
+// admin token of the realm.
+type realm struct {
+	name string
+	cfg  config.Config
+
+	tokenRepo  *repository.TokenRepository
+	userRepo   *repository.UserRepository
+	orgRepo    *repository.OrganizationRepository
+	roleRepo   *repository.RoleRepository
+	auditRepo  *repository.AuditRepository
+	keyRepo    *repository.APIKeyRepository
+	clientRepo *repository.OAuthClientRepository
+
+	jwtService     *auth.JWTService
+	authService    *auth.AuthService
+	passkeyService *auth.PasskeyService
+	oauthService   *auth.OAuthService
+	adminAuth      *middleware.AdminAuth
+}
+
+// ApplyConfig hands the settings of the realm to its services.
+func (r *realm) ApplyConfig(cfg config.Config) {
+	cfg = cfg.ForRealm(r.name)
+	r.jwtService.ApplyConfig(cfg)
+	r.authService.ApplyConfig(cfg)
+	r.passkeyService.ApplyConfig(cfg)
+	r.oauthService.ApplyConfig(cfg)
+	r.adminAuth.ApplyConfig(cfg)
+}
+
+func newApp(ctx context.Context) (*app, error) {
+	// init config
+	cfg, err := config.InitConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	zapLogger := logger.GetLogger()
+
+	initCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	dbpool, err := repository.InitDB(initCtx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to db: %w", err)
+	}
+
+	a := &app{
+		cfg:         cfg,
+		logger:      &zapLogger,
+		db:          dbpool,
+		resetRepo:   repository.NewPasswordResetRepository(dbpool),
+		emailRepo:   repository.NewEmailVerificationRepository(dbpool),
+		loginRepo:   repository.NewEmailLoginRepository(dbpool),
+		mfaRepo:     repository.NewMFARepository(dbpool),
+		passkeyRepo: repository.NewWebAuthnRepository(dbpool),
+		realms:      make(map[string]*realm),
+	}
+	for _, name := range cfg.RealmNames() {
+		a.realms[name] = a.newRealm(name)
+	}
+
+	return a, nil
+}
+
+func (a *app) newRealm(name string) *realm {
+	cfg := a.cfg.ForRealm(name)
+	logger := a.logger
+	if name != config.DefaultRealm {
+		logger = logger.With(zap.String("realm", name))
+	}
+
+	r := &realm{
+		name:       name,
+		cfg:        cfg,
+		tokenRepo:  repository.NewTokenRepository(a.db, name),
+		userRepo:   repository.NewUserRepository(a.db, name),
+		orgRepo:    repository.NewOrganizationRepository(a.db, name),
+		roleRepo:   repository.NewRoleRepository(a.db, name),
+		auditRepo:  repository.NewAuditRepository(a.db, name),
+		keyRepo:    repository.NewAPIKeyRepository(a.db, name),
+		clientRepo: repository.NewOAuthClientRepository(a.db, name),
+	}
+	r.jwtService = auth.NewJwtService(cfg)
+	r.authService = auth.NewAuthService(r.tokenRepo, r.jwtService, r.userRepo, r.auditRepo, a.resetRepo, a.emailRepo, a.loginRepo, a.mfaRepo, r.roleRepo, r.orgRepo, r.keyRepo, cfg, logger)
+	r.passkeyService = auth.NewPasskeyService(r.authService, r.userRepo, a.passkeyRepo, cfg, logger)
+	r.oauthService = auth.NewOAuthService(r.authService, r.clientRepo, cfg, logger)
+	r.adminAuth = middleware.NewAdminAuth(logger, cfg.AdminToken)
+	return r
+}
+
+// realm returns the named realm, the default realm if name is empty.
+func (a *app) realm(name string) (*realm, error) {
+	if name == "" {
+		name = config.DefaultRealm
+	}
+	r, ok := a.realms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown realm %q", name)
+	}
+	return r, nil
+}
+
+func (a *app) Close() {
+	a.db.Close()
+}
+
+// withApp runs an admin command with a connected app and a bounded context.
+func withApp(fn func(ctx context.Context, a *app) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	a, err := newApp(ctx)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	return fn(ctx, a)
+}
+
+// withRealm runs an admin command against the named realm.
+func withRealm(name string, fn func(ctx context.Context, r *realm) error) error {
+	return withApp(func(ctx context.Context, a *app) error {
+		r, err := a.realm(name)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, r)
+	})
+}
+
+// cliActor names the operator in audit entries written by admin commands.
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+func parseGUIDFlag(value string) (uuid.UUID, error) {
+	if value == "" {
+		return uuid.Nil, errors.New("-guid is required")
+	}
+	guid, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid guid: %w", err)
+	}
+	return guid, nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func subcommand(args []string, valid ...string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing subcommand, expected one of %v", valid)
+	}
+	for _, v := range valid {
+		if args[0] == v {
+			return args[0], args[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown subcommand %q, expected one of %v", args[0], valid)
+}
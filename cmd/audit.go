@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/audit"
+)
+
+func runAudit(args []string) error {
+	_, args, err := subcommand(args, "verify")
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("audit verify")
+	realmFlag := fs.String("realm", "", "realm whose chain is verified, the default realm if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withRealm(*realmFlag, func(ctx context.Context, r *realm) error {
+		checked, breaks, err := audit.VerifyChain(ctx, r.auditRepo)
+		if err != nil {
+			return fmt.Errorf("failed to verify audit chain: %w", err)
+		}
+
+		for _, b := range breaks {
+			fmt.Printf("entry %d: %s\n", b.ID, b.Reason)
+		}
+		fmt.Printf("checked %d entries, found %d breaks\n", checked, len(breaks))
+
+		if len(breaks) > 0 {
+			return fmt.Errorf("audit chain is broken")
+		}
+		return nil
+	})
+}
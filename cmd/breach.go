@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/password"
+)
+
+func runBreach(args []string) error {
+	_, args, err := subcommand(args, "build")
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("breach build")
+	in := fs.String("in", "", "HIBP SHA1:COUNT file or directory of range files")
+	out := fs.String("out", "", "bloom filter file to write")
+	fpRate := fs.Float64("fp", 0.001, "false positive rate")
+	minCount := fs.Int("min-count", 1, "skip hashes seen fewer times")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" || *out == "" {
+		return fmt.Errorf("-in and -out are required")
+	}
+
+	filter, n, err := password.BuildBloomFilter(*in, *fpRate, *minCount)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomicFunc(*out, func(f *os.File) error {
+		_, err := filter.WriteTo(f)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *out, err)
+	}
+
+	fmt.Printf("wrote bloom filter with %d hashes to %s\n", n, *out)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+)
+
+func runKeys(args []string) error {
+	sub, args, err := subcommand(args, "list", "rotate")
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("keys " + sub)
+	realmFlag := fs.String("realm", "", "realm whose key is rotated, the default realm if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.InitConfig()
+	if err != nil {
+		return err
+	}
+
+	source := "JWT_SECRET"
+	secretFile := os.Getenv("JWT_SECRET_FILE")
+	if secretFile != "" {
+		source = "JWT_SECRET_FILE " + secretFile
+	}
+
+	switch sub {
+	case "list":
+		fmt.Printf("current: %s (from %s)\n", auth.KeyID(cfg.JWTSecret), source)
+		for _, realm := range cfg.Realms {
+			source := "the config file"
+			if realm.JWTSecretFile != "" {
+				source = "jwt_secret_file " + realm.JWTSecretFile
+			}
+			fmt.Printf("realm %s: %s (from %s)\n", realm.Name, auth.KeyID(realm.JWTSecret), source)
+		}
+		return nil
+
+	case "rotate":
+		if *realmFlag != "" && *realmFlag != config.DefaultRealm {
+			i := slices.IndexFunc(cfg.Realms, func(realm config.RealmConfig) bool { return realm.Name == *realmFlag })
+			if i < 0 {
+				return fmt.Errorf("unknown realm %q", *realmFlag)
+			}
+			realm := cfg.Realms[i]
+			if realm.JWTSecretFile == "" {
+				return fmt.Errorf("keys rotate needs jwt_secret_file in realm %s, the secret in the config file can not be rewritten", realm.Name)
+			}
+			cfg = cfg.ForRealm(realm.Name)
+			secretFile = realm.JWTSecretFile
+		}
+
+		// running servers watch the secret file, pick up the new key and keep
+		// accepting tokens signed with the old one until they expire
+		if secretFile == "" {
+			return fmt.Errorf("keys rotate needs JWT_SECRET_FILE, the secret in %s can not be rewritten", source)
+		}
+
+		secret, err := auth.GenerateSigningSecret()
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(secretFile, []byte(secret+"\n")); err != nil {
+			return fmt.Errorf("failed to write %s: %w", secretFile, err)
+		}
+
+		fmt.Printf("previous: %s\ncurrent:  %s\n", auth.KeyID(cfg.JWTSecret), auth.KeyID(secret))
+		fmt.Printf("tokens signed with the previous key stay valid for up to %s\n", cfg.AccessTTL)
+		return nil
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicFunc(path, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+func writeFileAtomicFunc(path string, write func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
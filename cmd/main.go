@@ -1,26 +1,29 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"time"
-
-	_ "github.com/nerfthisdev/go-backend-test-task/docs" // swagger docs
-	httpSwagger "github.com/swaggo/http-swagger"
 
 	"github.com/joho/godotenv"
-	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
-	"github.com/nerfthisdev/go-backend-test-task/internal/config"
-	"github.com/nerfthisdev/go-backend-test-task/internal/handler"
-	"github.com/nerfthisdev/go-backend-test-task/internal/logger"
-	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
-	"github.com/nerfthisdev/go-backend-test-task/internal/repository"
-	"go.uber.org/zap"
 )
 
-const defaultTimeout = 5 * time.Second
+const usage = `usage: auth-service <command> [arguments]
+
+commands:
+  serve [-skip-migrations]               start the http server (default)
+  migrate up|down [-steps n]|status|force <version>
+  user create [-guid guid] | get|reset-mfa -guid guid | purge-guests|purge-deleted
+       disable|activate|delete -guid guid [-reason text] | lock -guid guid [-reason text] [-for duration]
+  session list [-guid guid] | revoke -guid guid | revoke -session id
+  keys list | rotate [-realm name]
+  token mint -guid guid [-user-agent ua] [-scope scope] | inspect [-realm name] <token>
+  audit verify [-realm name]
+  breach build -in corpus -out filter [-fp rate] [-min-count n]
+
+user, session and token mint take -realm name to act on a realm other
+than the default one.
+`
 
 // @title           Go Backend Test Task API
 // @version         1.0
@@ -29,76 +32,38 @@ const defaultTimeout = 5 * time.Second
 // @securityDefinitions.apikey BearerAuth
 // @in              header
 // @name            Authorization
+// @securityDefinitions.apikey AdminToken
+// @in              header
+// @name            X-Admin-Token
 func main() {
 	// init env
 	if err := godotenv.Load(); err != nil {
-		log.Fatal(err.Error())
+		log.Println("no .env file loaded:", err.Error())
 	}
 
-	// init config
-	cfg := config.InitConfig()
-
-	// init context
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
-
-	defer cancel()
-
-	logger := logger.GetLogger()
-
-	dbpool, err := repository.InitDB(ctx, cfg)
-	if err != nil {
-		logger.Fatal("failed to connect to db", zap.Error(err))
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
 	}
 
-	logger.Info("successfully connected to db")
-
-	defer dbpool.Close()
-
-	tokenRepo := repository.NewTokenRepository(dbpool)
-	userRepo := repository.NewUserRepository(dbpool)
-
-	if err = repository.RunMigrations(dbpool, "migrations"); err != nil {
-		logger.Fatal("failed to run migrations", zap.Error(err))
-	}
-
-	accessTTL, err := time.ParseDuration(cfg.AccessTTL)
-	if err != nil {
-		logger.Fatal("invalid ACCESS_TOKEN_TTL", zap.Error(err))
+	commands := map[string]func(args []string) error{
+		"serve":   runServe,
+		"migrate": runMigrate,
+		"user":    runUser,
+		"session": runSession,
+		"keys":    runKeys,
+		"token":   runToken,
+		"audit":   runAudit,
+		"breach":  runBreach,
 	}
 
-	jwtService := auth.NewJwtService(cfg.JWTSecret, accessTTL)
-
-	authService := auth.NewAuthService(tokenRepo, jwtService, userRepo, &logger)
-
-	authHandler := handler.NewAuthHandler(authService)
-
-	router := http.NewServeMux()
-	router.HandleFunc("POST /api/v1/auth", authHandler.Authorize)
-	router.Handle(
-		"POST /api/v1/refresh",
-		middleware.Auth(&logger, jwtService, tokenRepo, http.HandlerFunc(authHandler.Refresh)),
-	)
-	router.Handle(
-		"GET /api/v1/me",
-		middleware.Auth(&logger, jwtService, tokenRepo, http.HandlerFunc(authHandler.Me)),
-	)
-
-	router.Handle(
-		"POST /api/v1/deauthorize",
-		middleware.Auth(&logger, jwtService, tokenRepo, http.HandlerFunc(authHandler.Deauthorize)),
-	)
-
-	router.Handle("/swagger/", httpSwagger.WrapHandler)
-
-	port := ":" + os.Getenv("HTTP_PORT")
-	server := http.Server{
-		Addr:    port,
-		Handler: router,
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	logger.Info("starting server on ", zap.String("port", port))
-	if err := server.ListenAndServe(); err != nil {
-		logger.Fatal("failed to start server ", zap.String("reason", err.Error()))
+	if err := run(args); err != nil {
+		log.Fatal(err.Error())
 	}
 }
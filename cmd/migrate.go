@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/repository"
+)
+
+func runMigrate(args []string) error {
+	sub, args, err := subcommand(args, "up", "down", "status", "force")
+	if err != nil {
+		return err
+	}
+
+	return withApp(func(ctx context.Context, a *app) error {
+		switch sub {
+		case "up":
+			if err := repository.RunMigrations(ctx, a.db); err != nil {
+				return err
+			}
+
+		case "down":
+			fs := newFlagSet("migrate down")
+			steps := fs.Int("steps", 1, "number of migrations to roll back")
+			if err := fs.Parse(args); err != nil {
+				return err
+			}
+			if *steps < 1 {
+				return fmt.Errorf("-steps must be positive")
+			}
+			if err := repository.RollbackMigrations(ctx, a.db, *steps); err != nil {
+				return err
+			}
+
+		case "force":
+			if len(args) != 1 {
+				return fmt.Errorf("usage: migrate force <version>")
+			}
+			version, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid version: %w", err)
+			}
+			if err := repository.ForceMigrationVersion(ctx, a.db, version); err != nil {
+				return err
+			}
+		}
+
+		version, dirty, err := repository.MigrationVersion(ctx, a.db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version: %d\ndirty: %t\n", version, dirty)
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// realmPrefix selects a realm by path, /realms/<name>/api/v1/... is
+// served as /api/v1/... by the realm.
+const realmPrefix = "/realms/"
+
+// realmRouter hands each request to the routes of its realm. The Host
+// header is checked first, then the path prefix. Requests claimed by no
+// realm go to the default realm.
+type realmRouter struct {
+	fallback http.Handler
+	byHost   map[string]http.Handler
+	byName   map[string]http.Handler
+}
+
+func newRealmRouter(fallback http.Handler) *realmRouter {
+	return &realmRouter{
+		fallback: fallback,
+		byHost:   make(map[string]http.Handler),
+		byName:   make(map[string]http.Handler),
+	}
+}
+
+func (rr *realmRouter) add(name string, hosts []string, h http.Handler) {
+	rr.byName[name] = h
+	for _, host := range hosts {
+		rr.byHost[strings.ToLower(host)] = h
+	}
+}
+
+func (rr *realmRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := rr.byHost[strings.ToLower(host)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	if rest, ok := strings.CutPrefix(r.URL.Path, realmPrefix); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		h, ok := rr.byName[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.StripPrefix(realmPrefix+name, h).ServeHTTP(w, r)
+		return
+	}
+
+	rr.fallback.ServeHTTP(w, r)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// echoRealm answers with its name and the path it was handed.
+func echoRealm(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.URL.Path)
+	})
+}
+
+func TestRealmRouter(t *testing.T) {
+	router := newRealmRouter(echoRealm("default"))
+	router.add("a", []string{"A.example.com"}, echoRealm("a"))
+	router.add("b", nil, echoRealm("b"))
+
+	for _, tc := range []struct {
+		host, path string
+		want       string
+		wantStatus int
+	}{
+		{host: "auth.example.com", path: "/api/v1/me", want: "default /api/v1/me"},
+		{host: "a.example.com", path: "/api/v1/me", want: "a /api/v1/me"},
+		{host: "A.EXAMPLE.COM:8443", path: "/api/v1/me", want: "a /api/v1/me"},
+		{host: "auth.example.com", path: "/realms/b/api/v1/me", want: "b /api/v1/me"},
+		{host: "auth.example.com", path: "/realms/a/api/v1/me", want: "a /api/v1/me"},
+		// the host wins over the path, realm b can not be reached through the host of realm a
+		{host: "a.example.com", path: "/realms/b/api/v1/me", want: "a /realms/b/api/v1/me"},
+		{host: "auth.example.com", path: "/realms/c/api/v1/me", wantStatus: http.StatusNotFound},
+		{host: "auth.example.com", path: "/realmsb/api/v1/me", want: "default /realmsb/api/v1/me"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		wantStatus := tc.wantStatus
+		if wantStatus == 0 {
+			wantStatus = http.StatusOK
+		}
+		if rec.Code != wantStatus {
+			t.Errorf("%s%s: status %d, want %d", tc.host, tc.path, rec.Code, wantStatus)
+			continue
+		}
+		if tc.want != "" && rec.Body.String() != tc.want {
+			t.Errorf("%s%s: served by %q, want %q", tc.host, tc.path, rec.Body.String(), tc.want)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	_ "github.com/nerfthisdev/go-backend-test-task/docs" // swagger docs
+	httpSwagger "github.com/swaggo/http-swagger"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/handler"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+	"github.com/nerfthisdev/go-backend-test-task/internal/repository"
+	"go.uber.org/zap"
+)
+
+func runServe(args []string) error {
+	fs := newFlagSet("serve")
+	skipMigrations := fs.Bool("skip-migrations", false, "do not apply pending migrations on startup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	a, err := newApp(ctx)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	logger := a.logger
+	logger.Info("successfully connected to db")
+
+	if a.cfg.AutoMigrate && !*skipMigrations {
+		if err = repository.RunMigrations(ctx, a.db); err != nil {
+			logger.Fatal("failed to run migrations", zap.Error(err))
+		}
+	} else {
+		logger.Info("skipping migrations on startup")
+	}
+
+	rateLimiter := middleware.NewRateLimiter(a.cfg.RateLimit)
+
+	targets := []config.Reloadable{rateLimiter}
+	for _, name := range a.cfg.RealmNames() {
+		targets = append(targets, a.realms[name])
+		go a.realms[name].oauthService.PurgePeriodically(ctx)
+		if a.realms[name].cfg.IDTokenSigningKey == "" {
+			logger.Warn("no ID token signing key configured, ID tokens are signed with a temporary key and fail to verify after a restart", zap.String("realm", name))
+		}
+	}
+
+	realms := newRealmRouter(realmRoutes(a.realms[config.DefaultRealm], logger, rateLimiter))
+	for _, rc := range a.cfg.Realms {
+		realms.add(rc.Name, rc.Hosts, realmRoutes(a.realms[rc.Name], logger, rateLimiter))
+	}
+
+	reloader := config.NewReloader(logger, a.cfg, targets...)
+	go reloader.Watch(ctx)
+
+	router := http.NewServeMux()
+	router.Handle("/swagger/", httpSwagger.WrapHandler)
+	router.Handle("/", realms)
+
+	port := ":" + a.cfg.Port
+	server := http.Server{
+		Addr:    port,
+		Handler: router,
+	}
+
+	logger.Info("starting server on ", zap.String("port", port), zap.Strings("realms", a.cfg.RealmNames()))
+	if err := server.ListenAndServe(); err != nil {
+		logger.Fatal("failed to start server ", zap.String("reason", err.Error()))
+	}
+	return nil
+}
+
+// realmRoutes registers the API of one realm. Rate limits are shared by
+// all realms.
+func realmRoutes(r *realm, logger *zap.Logger, rateLimiter *middleware.RateLimiter) http.Handler {
+	tokenRepo := r.tokenRepo
+	jwtService := r.jwtService
+	authService := r.authService
+	passkeyService := r.passkeyService
+	oauthService := r.oauthService
+	adminAuth := r.adminAuth
+
+	authHandler := handler.NewAuthHandler(authService, r.cfg.StepUpMaxAge)
+	passkeyHandler := handler.NewPasskeyHandler(passkeyService)
+	adminHandler := handler.NewAdminHandler(authService)
+	oauthHandler := handler.NewOAuthHandler(authService, oauthService)
+
+	router := http.NewServeMux()
+	router.Handle("POST /api/v1/auth", rateLimiter.Wrap(http.HandlerFunc(authHandler.Authorize)))
+	router.Handle("POST /api/v1/register", rateLimiter.Wrap(http.HandlerFunc(authHandler.Register)))
+	router.Handle("POST /api/v1/login", rateLimiter.Wrap(http.HandlerFunc(authHandler.Login)))
+	router.Handle("POST /api/v1/login/mfa", rateLimiter.Wrap(http.HandlerFunc(authHandler.LoginMFA)))
+	router.Handle("POST /api/v1/login/email", rateLimiter.Wrap(http.HandlerFunc(authHandler.RequestEmailLogin)))
+	router.Handle("POST /api/v1/login/email/verify", rateLimiter.Wrap(http.HandlerFunc(authHandler.VerifyEmailLogin)))
+	router.Handle(
+		"POST /api/v1/refresh",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireSession(http.HandlerFunc(authHandler.Refresh)))),
+	)
+	router.Handle(
+		"GET /api/v1/me",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeProfile, http.HandlerFunc(authHandler.Me))),
+	)
+	router.Handle(
+		"PATCH /api/v1/me",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.UpdateMe))),
+	)
+
+	router.Handle(
+		"DELETE /api/v1/me",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount,
+				middleware.RequireAuthLevel(r.cfg.StepUpMaxAge, domain.ACRSingleFactor, http.HandlerFunc(authHandler.DeleteMe)))),
+	)
+	router.Handle(
+		"POST /api/v1/me/upgrade",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.Upgrade)))),
+	)
+	router.Handle(
+		"POST /api/v1/reauthenticate",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireSession(
+				middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.Reauthenticate))))),
+	)
+
+	router.Handle(
+		"POST /api/v1/token/downscope",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService, http.HandlerFunc(authHandler.Downscope))),
+	)
+
+	router.Handle(
+		"POST /api/v1/deauthorize",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.Deauthorize))),
+	)
+
+	router.Handle("POST /api/v1/email/verify/send", rateLimiter.Wrap(http.HandlerFunc(authHandler.SendEmailVerification)))
+	router.Handle("POST /api/v1/email/verify", rateLimiter.Wrap(http.HandlerFunc(authHandler.VerifyEmail)))
+	router.Handle("POST /api/v1/password/forgot", rateLimiter.Wrap(http.HandlerFunc(authHandler.ForgotPassword)))
+	router.Handle("POST /api/v1/password/reset", rateLimiter.Wrap(http.HandlerFunc(authHandler.ResetPassword)))
+	router.Handle(
+		"POST /api/v1/password/change",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.ChangePassword)))),
+	)
+
+	router.Handle(
+		"POST /api/v1/mfa/totp",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.EnrollTOTP))),
+	)
+	router.Handle(
+		"POST /api/v1/mfa/totp/confirm",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.ConfirmTOTP)))),
+	)
+	router.Handle(
+		"POST /api/v1/mfa/recovery-codes",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.RegenerateRecoveryCodes)))),
+	)
+
+	router.Handle(
+		"POST /api/v1/webauthn/register/begin",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(passkeyHandler.BeginRegistration))),
+	)
+	router.Handle(
+		"POST /api/v1/webauthn/register/finish",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(passkeyHandler.FinishRegistration)))),
+	)
+	router.Handle("POST /api/v1/webauthn/login/begin", rateLimiter.Wrap(http.HandlerFunc(passkeyHandler.BeginLogin)))
+	router.Handle("POST /api/v1/webauthn/login/finish", rateLimiter.Wrap(http.HandlerFunc(passkeyHandler.FinishLogin)))
+	router.Handle(
+		"GET /api/v1/webauthn/credentials",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(passkeyHandler.ListCredentials))),
+	)
+	router.Handle(
+		"DELETE /api/v1/webauthn/credentials/{id}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(passkeyHandler.DeleteCredential))),
+	)
+
+	router.Handle(
+		"GET /api/v1/me/api-keys",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.ListAPIKeys))),
+	)
+	router.Handle(
+		"POST /api/v1/me/api-keys",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.CreateAPIKey)))),
+	)
+	router.Handle(
+		"DELETE /api/v1/me/api-keys/{id}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.RevokeAPIKey))),
+	)
+
+	router.Handle(
+		"POST /api/v1/invitations/accept",
+		rateLimiter.Wrap(http.HandlerFunc(authHandler.AcceptInvitationAndLogin)),
+	)
+	router.Handle(
+		"POST /api/v1/me/invitations/accept",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.AcceptInvitation)))),
+	)
+	router.Handle(
+		"POST /api/v1/orgs/switch",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService, http.HandlerFunc(authHandler.SwitchOrganization))),
+	)
+	router.Handle(
+		"GET /api/v1/orgs",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.ListOrganizations))),
+	)
+	router.Handle(
+		"POST /api/v1/orgs",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.CreateOrganization))),
+	)
+	router.Handle(
+		"GET /api/v1/orgs/{id}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.GetOrganization))),
+	)
+	router.Handle(
+		"DELETE /api/v1/orgs/{id}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.DeleteOrganization))),
+	)
+	router.Handle(
+		"GET /api/v1/orgs/{id}/members",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.ListMembers))),
+	)
+	router.Handle(
+		"PUT /api/v1/orgs/{id}/members/{guid}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.UpdateMember))),
+	)
+	router.Handle(
+		"DELETE /api/v1/orgs/{id}/members/{guid}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.RemoveMember))),
+	)
+	router.Handle(
+		"GET /api/v1/orgs/{id}/invitations",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.ListInvitations))),
+	)
+	router.Handle(
+		"POST /api/v1/orgs/{id}/invitations",
+		rateLimiter.Wrap(middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.InviteMember)))),
+	)
+	router.Handle(
+		"DELETE /api/v1/orgs/{id}/invitations/{invitation}",
+		middleware.Auth(logger, jwtService, tokenRepo, authService,
+			middleware.RequireScope(domain.ScopeAccount, http.HandlerFunc(authHandler.RevokeInvitation))),
+	)
+
+	router.Handle(
+		"GET /api/v1/admin/audit",
+		adminAuth.Wrap(http.HandlerFunc(adminHandler.AuditLog)),
+	)
+	router.Handle(
+		"PUT /api/v1/admin/users/{guid}/status",
+		adminAuth.Wrap(http.HandlerFunc(adminHandler.SetUserStatus)),
+	)
+	router.Handle("GET /api/v1/admin/permissions", adminAuth.Wrap(http.HandlerFunc(adminHandler.ListPermissions)))
+	router.Handle("POST /api/v1/admin/permissions", adminAuth.Wrap(http.HandlerFunc(adminHandler.CreatePermission)))
+	router.Handle("DELETE /api/v1/admin/permissions/{name}", adminAuth.Wrap(http.HandlerFunc(adminHandler.DeletePermission)))
+	router.Handle("GET /api/v1/admin/roles", adminAuth.Wrap(http.HandlerFunc(adminHandler.ListRoles)))
+	router.Handle("POST /api/v1/admin/roles", adminAuth.Wrap(http.HandlerFunc(adminHandler.CreateRole)))
+	router.Handle("GET /api/v1/admin/roles/{name}", adminAuth.Wrap(http.HandlerFunc(adminHandler.GetRole)))
+	router.Handle("PUT /api/v1/admin/roles/{name}", adminAuth.Wrap(http.HandlerFunc(adminHandler.UpdateRole)))
+	router.Handle("DELETE /api/v1/admin/roles/{name}", adminAuth.Wrap(http.HandlerFunc(adminHandler.DeleteRole)))
+	router.Handle("GET /api/v1/admin/users/{guid}/roles", adminAuth.Wrap(http.HandlerFunc(adminHandler.UserRoles)))
+	router.Handle("PUT /api/v1/admin/users/{guid}/roles/{role}", adminAuth.Wrap(http.HandlerFunc(adminHandler.AssignRole)))
+	router.Handle("DELETE /api/v1/admin/users/{guid}/roles/{role}", adminAuth.Wrap(http.HandlerFunc(adminHandler.UnassignRole)))
+	router.Handle("GET /api/v1/admin/clients", adminAuth.Wrap(http.HandlerFunc(oauthHandler.ListClients)))
+	router.Handle("POST /api/v1/admin/clients", adminAuth.Wrap(http.HandlerFunc(oauthHandler.CreateClient)))
+	router.Handle("GET /api/v1/admin/clients/{id}", adminAuth.Wrap(http.HandlerFunc(oauthHandler.GetClient)))
+	router.Handle("DELETE /api/v1/admin/clients/{id}", adminAuth.Wrap(http.HandlerFunc(oauthHandler.DeleteClient)))
+	router.Handle("POST /api/v1/admin/clients/{id}/secret", adminAuth.Wrap(http.HandlerFunc(oauthHandler.RotateClientSecret)))
+
+	// OAuth 2.0 protocol endpoints, outside of the versioned API
+	router.Handle("GET /oauth/authorize", http.HandlerFunc(oauthHandler.Authorize))
+	router.Handle("POST /oauth/authorize", rateLimiter.Wrap(http.HandlerFunc(oauthHandler.AuthorizeSubmit)))
+	router.Handle("POST /oauth/token", rateLimiter.Wrap(http.HandlerFunc(oauthHandler.Token)))
+	router.Handle("POST /oauth/device_authorization", rateLimiter.Wrap(http.HandlerFunc(oauthHandler.DeviceAuthorization)))
+	router.Handle("GET /oauth/device", rateLimiter.Wrap(http.HandlerFunc(oauthHandler.Device)))
+	router.Handle("POST /oauth/device", rateLimiter.Wrap(http.HandlerFunc(oauthHandler.DeviceSubmit)))
+
+	// OpenID Connect
+	router.Handle("GET /.well-known/openid-configuration", http.HandlerFunc(oauthHandler.Discovery))
+	router.Handle("GET /oauth/jwks", http.HandlerFunc(oauthHandler.JWKS))
+	userInfo := middleware.Auth(logger, jwtService, tokenRepo, authService,
+		middleware.RequireScope(domain.ScopeOpenID, http.HandlerFunc(oauthHandler.UserInfo)))
+	router.Handle("GET /oauth/userinfo", userInfo)
+	router.Handle("POST /oauth/userinfo", userInfo)
+
+	return router
+}
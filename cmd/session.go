@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func runSession(args []string) error {
+	sub, args, err := subcommand(args, "list", "revoke")
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("session " + sub)
+	guidFlag := fs.String("guid", "", "user GUID")
+	sessionFlag := fs.String("session", "", "session id")
+	realmFlag := fs.String("realm", "", "realm of the sessions, the default realm if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var guid *uuid.UUID
+	if *guidFlag != "" {
+		parsed, err := parseGUIDFlag(*guidFlag)
+		if err != nil {
+			return err
+		}
+		guid = &parsed
+	}
+
+	if sub == "revoke" && (guid == nil) == (*sessionFlag == "") {
+		return fmt.Errorf("session revoke needs exactly one of -guid or -session")
+	}
+
+	return withRealm(*realmFlag, func(ctx context.Context, r *realm) error {
+		switch sub {
+		case "list":
+			sessions, err := r.authService.ListSessions(ctx, guid)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "GUID\tSESSION\tIP\tUSER AGENT\tCREATED\tEXPIRES")
+			for _, s := range sessions {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					s.GUID, s.SessionID, s.IP, s.UserAgent,
+					s.CreatedAt.Format(time.RFC3339), s.ExpiresAt.Format(time.RFC3339),
+				)
+			}
+			return w.Flush()
+
+		case "revoke":
+			if guid != nil {
+				if err := r.authService.RevokeUserSessions(ctx, cliActor(), *guid); err != nil {
+					return err
+				}
+				fmt.Printf("sessions of %s revoked\n", guid)
+				return nil
+			}
+
+			if err := r.authService.RevokeSession(ctx, cliActor(), *sessionFlag); err != nil {
+				return err
+			}
+			fmt.Printf("session %s revoked\n", *sessionFlag)
+		}
+		return nil
+	})
+}
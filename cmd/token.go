@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+func runToken(args []string) error {
+	sub, args, err := subcommand(args, "mint", "inspect")
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "mint":
+		fs := newFlagSet("token mint")
+		guidFlag := fs.String("guid", "", "user GUID")
+		userAgent := fs.String("user-agent", "auth-service-cli", "user agent the session is bound to")
+		scope := fs.String("scope", "", "space separated scope, all allowed scopes if empty")
+		realmFlag := fs.String("realm", "", "realm of the user, the default realm if empty")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		guid, err := parseGUIDFlag(*guidFlag)
+		if err != nil {
+			return err
+		}
+
+		// minting goes through the regular authorization, so the session is
+		// real and shows up in the audit log
+		return withRealm(*realmFlag, func(ctx context.Context, r *realm) error {
+			pair, err := r.authService.Authorize(ctx, &guid, domain.ParseScope(*scope), *userAgent, "cli")
+			if err != nil {
+				return err
+			}
+			return printJSON(pair)
+		})
+
+	case "inspect":
+		fs := newFlagSet("token inspect")
+		realmFlag := fs.String("realm", config.DefaultRealm, "realm whose key validates the token")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: token inspect [-realm name] <token>")
+		}
+		return inspectToken(*realmFlag, fs.Arg(0))
+	}
+	return nil
+}
+
+func inspectToken(realm, token string) error {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	cfg, err := config.InitConfig()
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(cfg.RealmNames(), realm) {
+		return fmt.Errorf("unknown realm %q", realm)
+	}
+	cfg = cfg.ForRealm(realm)
+
+	status := "valid"
+	if _, err := auth.NewJwtService(cfg).ValidateAccessToken(token); err != nil {
+		status = "invalid: " + err.Error()
+	}
+
+	return printJSON(map[string]any{
+		"header": parsed.Header,
+		"claims": parsed.Claims,
+		"status": status,
+	})
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+func runUser(args []string) error {
+	sub, args, err := subcommand(args, "create", "get", "disable", "lock", "activate", "delete", "reset-mfa", "purge-guests", "purge-deleted")
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("user " + sub)
+	guidFlag := fs.String("guid", "", "user GUID")
+	reason := fs.String("reason", "", "reason recorded with a status change")
+	lockFor := fs.Duration("for", 0, "how long to lock the user, 0 locks until activated")
+	realmFlag := fs.String("realm", "", "realm of the user, the default realm if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch sub {
+	case "purge-guests":
+		return withRealm(*realmFlag, func(ctx context.Context, r *realm) error {
+			n, err := r.authService.PurgeGuests(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d guests purged\n", n)
+			return nil
+		})
+
+	case "purge-deleted":
+		return withRealm(*realmFlag, func(ctx context.Context, r *realm) error {
+			n, err := r.authService.PurgeDeletedUsers(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d deleted users purged\n", n)
+			return nil
+		})
+	}
+
+	var guid uuid.UUID
+	if sub == "create" && *guidFlag == "" {
+		guid = uuid.New()
+	} else if guid, err = parseGUIDFlag(*guidFlag); err != nil {
+		return err
+	}
+
+	return withRealm(*realmFlag, func(ctx context.Context, r *realm) error {
+		switch sub {
+		case "create":
+			if err := r.authService.CreateUser(ctx, cliActor(), guid); err != nil {
+				return err
+			}
+			fmt.Println(guid)
+			return nil
+
+		case "disable":
+			if err := r.authService.DisableUser(ctx, cliActor(), guid, *reason); err != nil {
+				return err
+			}
+
+		case "lock":
+			var until *time.Time
+			if *lockFor > 0 {
+				t := time.Now().Add(*lockFor)
+				until = &t
+			}
+			if err := r.authService.LockUser(ctx, cliActor(), guid, *reason, until); err != nil {
+				return err
+			}
+
+		case "activate":
+			if err := r.authService.ActivateUser(ctx, cliActor(), guid, *reason); err != nil {
+				return err
+			}
+
+		case "delete":
+			if err := r.authService.DeleteUser(ctx, cliActor(), guid, *reason); err != nil {
+				return err
+			}
+			fmt.Printf("user %s deleted, it can be activated again until it is purged\n", guid)
+			return nil
+
+		case "reset-mfa":
+			if err := r.authService.ResetMFA(ctx, cliActor(), guid); err != nil {
+				return err
+			}
+			fmt.Printf("mfa of user %s reset\n", guid)
+			return nil
+		}
+
+		user, err := r.authService.GetUser(ctx, guid)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("guid:     %s\n", user.GUID)
+		fmt.Printf("username: %s\n", user.Username)
+		fmt.Printf("name:     %s\n", user.DisplayName)
+		fmt.Printf("email:    %s\n", user.Email)
+		fmt.Printf("guest:    %t\n", user.Guest)
+		if user.Verified() {
+			fmt.Printf("verified: %s\n", user.VerifiedAt.Format(time.RFC3339))
+		} else {
+			fmt.Println("verified: no")
+		}
+		fmt.Printf("created:  %s\n", user.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("status:   %s\n", user.Status)
+		if user.StatusChangedAt != nil {
+			fmt.Printf("since:    %s\n", user.StatusChangedAt.Format(time.RFC3339))
+		}
+		if user.StatusReason != "" {
+			fmt.Printf("reason:   %s\n", user.StatusReason)
+		}
+		if user.Status == domain.UserLocked {
+			if user.LockedUntil != nil {
+				fmt.Printf("until:    %s\n", user.LockedUntil.Format(time.RFC3339))
+			} else {
+				fmt.Println("until:    activated")
+			}
+		}
+		return nil
+	})
+}
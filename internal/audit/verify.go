@@ -0,0 +1,58 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+const verifyBatchSize = 1000
+
+// ChainBreak describes an entry whose link to the chain does not hold.
+type ChainBreak struct {
+	ID     int64
+	Reason string
+}
+
+// VerifyChain walks the audit log of a realm from the oldest entry and
+// checks that every entry points at its predecessor and that its stored
+// hash matches the recomputed one. It returns the number of checked entries.
+func VerifyChain(ctx context.Context, repo domain.AuditRepository) (int, []ChainBreak, error) {
+	var (
+		checked  int
+		breaks   []ChainBreak
+		prevHash string
+		lastID   int64
+	)
+
+	for {
+		entries, err := repo.AuditChain(ctx, lastID, verifyBatchSize)
+		if err != nil {
+			return checked, breaks, err
+		}
+
+		for _, entry := range entries {
+			if entry.PrevHash != prevHash {
+				breaks = append(breaks, ChainBreak{
+					ID:     entry.ID,
+					Reason: fmt.Sprintf("prev_hash %q does not match previous entry hash %q", entry.PrevHash, prevHash),
+				})
+			}
+			if computed := entry.ComputeHash(); computed != entry.Hash {
+				breaks = append(breaks, ChainBreak{
+					ID:     entry.ID,
+					Reason: fmt.Sprintf("stored hash %q does not match computed hash %q", entry.Hash, computed),
+				})
+			}
+
+			prevHash = entry.Hash
+			lastID = entry.ID
+			checked++
+		}
+
+		if len(entries) < verifyBatchSize {
+			return checked, breaks, nil
+		}
+	}
+}
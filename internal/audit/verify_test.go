@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// chainRepo serves a fixed audit log to VerifyChain.
+type chainRepo struct {
+	domain.AuditRepository
+
+	entries []domain.AuditEntry
+}
+
+func (r chainRepo) AuditChain(ctx context.Context, afterID int64, limit int) ([]domain.AuditEntry, error) {
+	var entries []domain.AuditEntry
+	for _, entry := range r.entries {
+		if entry.ID > afterID && len(entries) < limit {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// testChain returns a valid chain of n entries, linked the way the
+// repository appends them.
+func testChain(n int) []domain.AuditEntry {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]domain.AuditEntry, n)
+	var prevHash string
+	for i := range entries {
+		entry := domain.AuditEntry{
+			ID:        int64(i + 1),
+			GUID:      uuid.New(),
+			EventType: domain.AuditEventRefresh,
+			Actor:     "actor",
+			IP:        "192.0.2.1",
+			UserAgent: "test-agent",
+			Details:   map[string]string{"session_id": uuid.NewString()},
+			CreatedAt: created.Add(time.Duration(i) * time.Second),
+			PrevHash:  prevHash,
+		}
+		entry.Hash = entry.ComputeHash()
+		prevHash = entry.Hash
+		entries[i] = entry
+	}
+	return entries
+}
+
+func verify(t *testing.T, entries []domain.AuditEntry) (int, []ChainBreak) {
+	t.Helper()
+
+	checked, breaks, err := VerifyChain(context.Background(), chainRepo{entries: entries})
+	if err != nil {
+		t.Fatalf("VerifyChain: %v", err)
+	}
+	return checked, breaks
+}
+
+// brokenIDs returns the IDs of the entries reported, once each.
+func brokenIDs(breaks []ChainBreak) []int64 {
+	var ids []int64
+	for _, b := range breaks {
+		if len(ids) == 0 || ids[len(ids)-1] != b.ID {
+			ids = append(ids, b.ID)
+		}
+	}
+	return ids
+}
+
+func TestVerifyChainAcceptsAValidChain(t *testing.T) {
+	// more entries than a batch, the link has to hold across batches
+	entries := testChain(verifyBatchSize + 10)
+
+	checked, breaks := verify(t, entries)
+	if checked != len(entries) {
+		t.Errorf("checked %d entries, want %d", checked, len(entries))
+	}
+	if len(breaks) != 0 {
+		t.Errorf("breaks = %+v, want none", breaks)
+	}
+
+	if checked, breaks := verify(t, nil); checked != 0 || len(breaks) != 0 {
+		t.Errorf("empty log: checked %d, breaks %+v", checked, breaks)
+	}
+}
+
+func TestVerifyChainDetectsTampering(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func([]domain.AuditEntry) []domain.AuditEntry
+		want   []int64
+	}{
+		{
+			name: "modified row",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				entries[2].Actor = "someone else"
+				return entries
+			},
+			want: []int64{3},
+		},
+		{
+			name: "modified row with a recomputed hash",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				entries[2].Details = nil
+				entries[2].Hash = entries[2].ComputeHash()
+				return entries
+			},
+			want: []int64{4},
+		},
+		{
+			name: "deleted row",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				return append(entries[:2], entries[3:]...)
+			},
+			want: []int64{4},
+		},
+		{
+			name: "deleted first row",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				return entries[1:]
+			},
+			want: []int64{2},
+		},
+		{
+			name: "reordered rows",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				// the IDs are swapped too, the log is read in ID order
+				entries[1], entries[2] = entries[2], entries[1]
+				entries[1].ID, entries[2].ID = entries[2].ID, entries[1].ID
+				return entries
+			},
+			want: []int64{2, 3, 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := tc.tamper(testChain(5))
+
+			checked, breaks := verify(t, entries)
+			if checked != len(entries) {
+				t.Errorf("checked %d entries, want %d", checked, len(entries))
+			}
+			if got := brokenIDs(breaks); !slices.Equal(got, tc.want) {
+				t.Errorf("broken entries = %v (%+v), want %v", got, breaks, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Admin operations. Every change is recorded in the audit log on behalf
+// of actor, which names the admin or tool that requested it.
+
+func (s *AuthService) CreateUser(ctx context.Context, actor string, guid uuid.UUID) error {
+	if err := s.users.CreateUser(ctx, guid, false); err != nil {
+		s.logger.Error("failed to create user", zap.Error(err))
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, guid, "user_create", nil)
+	return nil
+}
+
+func (s *AuthService) GetUser(ctx context.Context, guid uuid.UUID) (domain.User, error) {
+	return s.users.GetUser(ctx, guid)
+}
+
+// DisableUser forbids the user from obtaining new tokens and revokes its sessions.
+func (s *AuthService) DisableUser(ctx context.Context, actor string, guid uuid.UUID, reason string) error {
+	return s.setUserStatus(ctx, actor, guid, domain.UserDisabled, reason, nil, "user_disable")
+}
+
+// LockUser disables the user until the given time, or until it is
+// activated again if until is nil.
+func (s *AuthService) LockUser(ctx context.Context, actor string, guid uuid.UUID, reason string, until *time.Time) error {
+	return s.setUserStatus(ctx, actor, guid, domain.UserLocked, reason, until, "user_lock")
+}
+
+// ActivateUser lifts a disable or lock, and restores a deleted user that
+// has not been purged yet.
+func (s *AuthService) ActivateUser(ctx context.Context, actor string, guid uuid.UUID, reason string) error {
+	return s.setUserStatus(ctx, actor, guid, domain.UserActive, reason, nil, "user_activate")
+}
+
+// DeleteUser soft-deletes the user, it is purged after the retention window.
+func (s *AuthService) DeleteUser(ctx context.Context, actor string, guid uuid.UUID, reason string) error {
+	return s.setUserStatus(ctx, actor, guid, domain.UserDeleted, reason, nil, "user_delete")
+}
+
+// ResetMFA removes the second factor of a user who lost it. The user can
+// log in with the password alone and enrol again.
+func (s *AuthService) ResetMFA(ctx context.Context, actor string, guid uuid.UUID) error {
+	if _, err := s.users.GetUser(ctx, guid); err != nil {
+		return err
+	}
+	if err := s.mfa.DeleteMFA(ctx, guid); err != nil {
+		s.logger.Error("failed to reset mfa", zap.Error(err))
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, guid, "mfa_reset", nil)
+	return nil
+}
+
+func (s *AuthService) ListSessions(ctx context.Context, guid *uuid.UUID) ([]domain.RefreshToken, error) {
+	return s.repo.ListSessions(ctx, guid)
+}
+
+// RevokeUserSessions revokes every session of the user.
+func (s *AuthService) RevokeUserSessions(ctx context.Context, actor string, guid uuid.UUID) error {
+	return s.revoke(ctx, guid, actor, "revoked by admin", "", "")
+}
+
+func (s *AuthService) RevokeSession(ctx context.Context, actor, sessionID string) error {
+	guid, err := s.repo.DeleteSession(ctx, sessionID)
+	if err != nil {
+		s.logger.Error("failed to revoke session", zap.Error(err))
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventRevoke,
+		Actor:     actor,
+		Details: map[string]string{
+			"reason":     "revoked by admin",
+			"session_id": sessionID,
+		},
+	})
+	return nil
+}
+
+// AuditLog returns a page of the audit log. The query itself is recorded
+// as an admin action.
+func (s *AuthService) AuditLog(ctx context.Context, actor, ip string, filter domain.AuditFilter) ([]domain.AuditEntry, error) {
+	details := map[string]string{"action": "audit_query"}
+	if filter.GUID != nil {
+		details["guid"] = filter.GUID.String()
+	}
+	if filter.EventType != "" {
+		details["event_type"] = string(filter.EventType)
+	}
+	s.recordAudit(ctx, domain.AuditEntry{
+		EventType: domain.AuditEventAdminAction,
+		Actor:     actor,
+		IP:        ip,
+		Details:   details,
+	})
+
+	entries, err := s.audit.ListAuditEntries(ctx, filter)
+	if err != nil {
+		s.logger.Error("failed to query audit log", zap.Error(err))
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *AuthService) recordAdminAction(ctx context.Context, actor string, guid uuid.UUID, action string, details map[string]string) {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details["action"] = action
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventAdminAction,
+		Actor:     actor,
+		Details:   details,
+	})
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxAPIKeys bounds the number of keys a user can hold.
+	maxAPIKeys = 50
+	// apiKeyTouchInterval limits how often the last use of a key is
+	// written, a busy key would otherwise update its row on every request.
+	apiKeyTouchInterval = time.Minute
+	// apiKeyPrefixLength is the length of the lookup prefix in hex.
+	apiKeyPrefixLength = 12
+)
+
+// ErrTooManyAPIKeys is returned when a user already holds maxAPIKeys.
+var ErrTooManyAPIKeys = errors.New("too many api keys")
+
+// API keys look like gbt_<prefix>_<secret>. The prefix is stored in clear
+// to find the key, the whole key only as a hash.
+
+func newAPIKey() (key, prefix string, err error) {
+	p := make([]byte, apiKeyPrefixLength/2)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(p)
+	return domain.APIKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret), prefix, nil
+}
+
+// apiKeyLookupPrefix returns the lookup prefix of key, false if key is
+// not shaped like an API key.
+func apiKeyLookupPrefix(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, domain.APIKeyPrefix)
+	if !ok || len(rest) <= apiKeyPrefixLength || rest[apiKeyPrefixLength] != '_' {
+		return "", false
+	}
+	return rest[:apiKeyPrefixLength], true
+}
+
+func validateName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > 100 || strings.TrimSpace(name) != name || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return &ValidationError{Field: "name", Message: "must be 1 to 100 characters without surrounding spaces or control characters"}
+	}
+	return nil
+}
+
+// CreateAPIKey creates an API key for guid and returns it together with
+// the key itself, which is not stored and can not be shown again. The
+// scope must lie within current, the scope of the token the request was
+// made with, and empty means all of current. expiresIn 0 picks the
+// longest lifetime allowed.
+func (s *AuthService) CreateAPIKey(ctx context.Context, guid uuid.UUID, name string, scope, current []string, expiresIn time.Duration, userAgent, ip string) (domain.APIKey, string, error) {
+	settings := s.settings.Load()
+
+	if err := validateName(name); err != nil {
+		return domain.APIKey{}, "", err
+	}
+	if len(scope) == 0 {
+		scope = current
+	}
+	if len(scope) == 0 || !domain.ScopeSubset(scope, current) {
+		return domain.APIKey{}, "", ErrInvalidScope
+	}
+	if err := s.checkNarrowedScope(ctx, guid, scope, nil); err != nil {
+		return domain.APIKey{}, "", err
+	}
+
+	if expiresIn < 0 || (settings.apiKeyMaxTTL > 0 && expiresIn > settings.apiKeyMaxTTL) {
+		return domain.APIKey{}, "", &ValidationError{Field: "expires_in", Message: "must not be negative or exceed the maximum lifetime of api keys"}
+	}
+	if expiresIn == 0 {
+		expiresIn = settings.apiKeyMaxTTL
+	}
+
+	existing, err := s.apiKeys.ListAPIKeys(ctx, guid)
+	if err != nil {
+		s.logger.Error("failed to list api keys", zap.Error(err))
+		return domain.APIKey{}, "", err
+	}
+	if len(existing) >= maxAPIKeys {
+		return domain.APIKey{}, "", ErrTooManyAPIKeys
+	}
+
+	plain, prefix, err := newAPIKey()
+	if err != nil {
+		return domain.APIKey{}, "", err
+	}
+
+	now := time.Now()
+	key := domain.APIKey{
+		ID:        uuid.New(),
+		GUID:      guid,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hashOpaqueToken(plain),
+		Scope:     scope,
+		CreatedAt: now,
+	}
+	if expiresIn > 0 {
+		expiresAt := now.Add(expiresIn)
+		key.ExpiresAt = &expiresAt
+	}
+
+	if err := s.apiKeys.StoreAPIKey(ctx, key); err != nil {
+		s.logger.Error("failed to store api key", zap.Error(err))
+		return domain.APIKey{}, "", err
+	}
+
+	details := map[string]string{
+		"action": "create",
+		"key_id": key.ID.String(),
+		"prefix": prefix,
+		"scope":  domain.FormatScope(scope),
+	}
+	if key.ExpiresAt != nil {
+		details["expires_at"] = key.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventAPIKey,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+
+	return key, plain, nil
+}
+
+func (s *AuthService) ListAPIKeys(ctx context.Context, guid uuid.UUID) ([]domain.APIKey, error) {
+	keys, err := s.apiKeys.ListAPIKeys(ctx, guid)
+	if err != nil {
+		s.logger.Error("failed to list api keys", zap.Error(err))
+	}
+	return keys, err
+}
+
+// RevokeAPIKey deletes an API key of guid, it stops working immediately.
+func (s *AuthService) RevokeAPIKey(ctx context.Context, guid, id uuid.UUID, userAgent, ip string) error {
+	if err := s.apiKeys.DeleteAPIKey(ctx, guid, id); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to delete api key", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventAPIKey,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"action": "revoke", "key_id": id.String()},
+	})
+	return nil
+}
+
+// AuthenticateAPIKey implements domain.APIKeyAuthenticator. Scopes the
+// user lost since the key was created are dropped from the key.
+func (s *AuthService) AuthenticateAPIKey(ctx context.Context, plain, ip string) (domain.APIKey, error) {
+	prefix, ok := apiKeyLookupPrefix(plain)
+	if !ok {
+		return domain.APIKey{}, domain.ErrNotFound
+	}
+
+	key, err := s.apiKeys.GetAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to get api key", zap.Error(err))
+		}
+		return domain.APIKey{}, err
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashOpaqueToken(plain)), []byte(key.KeyHash)) != 1 || key.Expired(now) {
+		return domain.APIKey{}, domain.ErrNotFound
+	}
+
+	allowed, err := s.allowedScopes(ctx, key.GUID)
+	if err != nil {
+		return domain.APIKey{}, err
+	}
+	key.Scope = domain.IntersectScope(key.Scope, allowed)
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.apiKeys.TouchAPIKey(ctx, key.ID, ip); err != nil {
+			s.logger.Warn("failed to record api key use", zap.Error(err))
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,388 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// The authorization code flow (RFC 6749 section 4.1) with PKCE (RFC 7636).
+// Users log in at the authorization endpoint, the client gets a code for
+// the session and exchanges it at the token endpoint. Sessions started
+// this way are normal sessions bound to the client.
+
+const (
+	// authorizationCodeTTL is how long a client has to exchange a code.
+	authorizationCodeTTL = time.Minute
+	// PKCEMethodS256 is the only code_challenge_method accepted, plain
+	// would give nothing over not using PKCE once the request leaks.
+	PKCEMethodS256 = "S256"
+	// refreshTokenSeparator joins the session and the refresh token in the
+	// refresh tokens handed to clients, the token endpoint has no access
+	// token to take the session from.
+	refreshTokenSeparator = "."
+	// maxNonceLength bounds the OpenID Connect nonce, it is stored with
+	// the code.
+	maxNonceLength = 512
+)
+
+// Errors of the authorization endpoint sent back to the client.
+const (
+	// OAuthAccessDenied is reported to the client when the user denies it.
+	OAuthAccessDenied = "access_denied"
+	// OAuthLoginRequired answers prompt=none, there is no login session
+	// at the authorization endpoint the request could be answered from.
+	OAuthLoginRequired = "login_required"
+)
+
+var (
+	// ErrUnknownClient and ErrInvalidRedirectURI fail an authorization
+	// request that can not be sent back to the client, the user has to
+	// be shown the error instead.
+	ErrUnknownClient      = errors.New("unknown client")
+	ErrInvalidRedirectURI = errors.New("redirect_uri is not registered for the client")
+
+	// pkceVerifierPattern is the code_verifier of RFC 7636 section 4.1.
+	pkceVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+	// pkceChallengePattern is a base64url encoded SHA-256 hash.
+	pkceChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+)
+
+// AuthorizationRequest holds the parameters of an authorization request.
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce and Prompt are the OpenID Connect parameters. The nonce is
+	// echoed in the ID token.
+	Nonce  string
+	Prompt string
+}
+
+// AuthorizationPrompt is a checked authorization request, what the user
+// is asked to consent to.
+type AuthorizationPrompt struct {
+	Request AuthorizationRequest
+	Client  domain.OAuthClient
+	// RedirectURI is where the response goes, the registered one if the
+	// request named none.
+	RedirectURI string
+	// Scope is the requested scope, all scopes of the client if it
+	// requested none.
+	Scope []string
+}
+
+// ValidateAuthorizationRequest checks an authorization request. An
+// *OAuthError is sent to the redirect URI of the returned prompt, other
+// errors mean the redirect URI can not be trusted.
+func (o *OAuthService) ValidateAuthorizationRequest(ctx context.Context, req AuthorizationRequest) (AuthorizationPrompt, error) {
+	client, err := o.clients.GetClient(ctx, req.ClientID)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return AuthorizationPrompt{}, ErrUnknownClient
+		}
+		o.logger.Error("failed to get client", zap.Error(err))
+		return AuthorizationPrompt{}, err
+	}
+
+	prompt := AuthorizationPrompt{Request: req, Client: client, RedirectURI: req.RedirectURI}
+	switch {
+	case req.RedirectURI == "" && len(client.RedirectURIs) == 1:
+		prompt.RedirectURI = client.RedirectURIs[0]
+	case !slices.Contains(client.RedirectURIs, req.RedirectURI):
+		return AuthorizationPrompt{}, ErrInvalidRedirectURI
+	}
+
+	if req.ResponseType != "code" {
+		return prompt, oauthError("unsupported_response_type", "only response_type code is supported")
+	}
+	if !slices.Contains(client.GrantTypes, domain.GrantAuthorizationCode) {
+		return prompt, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+	if req.CodeChallengeMethod != PKCEMethodS256 || !pkceChallengePattern.MatchString(req.CodeChallenge) {
+		return prompt, oauthError(OAuthInvalidRequest, "a code_challenge with code_challenge_method S256 is required")
+	}
+
+	if len(req.Nonce) > maxNonceLength {
+		return prompt, oauthError(OAuthInvalidRequest, fmt.Sprintf("nonce must be at most %d characters", maxNonceLength))
+	}
+	if slices.Contains(strings.Fields(req.Prompt), "none") {
+		return prompt, oauthError(OAuthLoginRequired, "the user has to log in")
+	}
+
+	prompt.Scope = req.Scope
+	if len(prompt.Scope) == 0 {
+		prompt.Scope = client.Scopes
+	} else if !domain.ScopeSubset(prompt.Scope, client.Scopes) {
+		return prompt, oauthError(OAuthInvalidScope, "scope exceeds the scopes of the client")
+	}
+	return prompt, nil
+}
+
+// IssueAuthorizationCode issues a code for a user who authenticated with
+// the methods in amr and consented to the prompt.
+func (o *OAuthService) IssueAuthorizationCode(ctx context.Context, prompt AuthorizationPrompt, guid uuid.UUID, amr []string) (string, error) {
+	user, err := o.auth.users.GetUser(ctx, guid)
+	if err != nil {
+		o.logger.Error("failed to get user", zap.Error(err))
+		return "", err
+	}
+	if err := user.CheckActive(); err != nil {
+		return "", err
+	}
+
+	code, codeHash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = o.clients.StoreAuthorizationCode(ctx, domain.AuthorizationCode{
+		CodeHash:      codeHash,
+		ClientID:      prompt.Client.ID,
+		GUID:          guid,
+		RedirectURI:   prompt.Request.RedirectURI,
+		Scope:         prompt.Scope,
+		CodeChallenge: prompt.Request.CodeChallenge,
+		Nonce:         prompt.Request.Nonce,
+		AMR:           amr,
+		AuthTime:      now,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(authorizationCodeTTL),
+	})
+	if err != nil {
+		o.logger.Error("failed to store authorization code", zap.Error(err))
+		return "", err
+	}
+	return code, nil
+}
+
+// verifyPKCE checks a code_verifier against an S256 code_challenge.
+func verifyPKCE(verifier, challenge string) bool {
+	if !pkceVerifierPattern.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// ExchangeAuthorizationCode runs the authorization code grant and starts
+// a session of the user for the client. A code used a second time ends
+// the session started with it, the code has leaked.
+func (o *OAuthService) ExchangeAuthorizationCode(ctx context.Context, client domain.OAuthClient, code, redirectURI, verifier, userAgent, ip string) (OAuthTokens, error) {
+	if !slices.Contains(client.GrantTypes, domain.GrantAuthorizationCode) {
+		return OAuthTokens{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+
+	stored, err := o.clients.UseAuthorizationCode(ctx, hashOpaqueToken(code))
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return OAuthTokens{}, oauthError(OAuthInvalidGrant, "invalid authorization code")
+		}
+		o.logger.Error("failed to use authorization code", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+
+	if stored.UsedAt != nil {
+		o.logger.Warn("authorization code used twice", zap.String("client_id", stored.ClientID), zap.String("guid", stored.GUID.String()))
+		o.revokeClientSessionsSince(ctx, stored.GUID, stored.ClientID, *stored.UsedAt, "authorization code replayed", userAgent, ip)
+		return OAuthTokens{}, oauthError(OAuthInvalidGrant, "invalid authorization code")
+	}
+	if stored.ClientID != client.ID || time.Now().After(stored.ExpiresAt) || stored.RedirectURI != redirectURI {
+		return OAuthTokens{}, oauthError(OAuthInvalidGrant, "invalid authorization code")
+	}
+	if !verifyPKCE(verifier, stored.CodeChallenge) {
+		return OAuthTokens{}, oauthError(OAuthInvalidGrant, "code_verifier does not match the code_challenge")
+	}
+
+	pair, err := o.auth.issueTokens(ctx, &stored.GUID, domain.RefreshToken{
+		AMR:      stored.AMR,
+		AuthTime: stored.AuthTime,
+		Scope:    stored.Scope,
+		ClientID: client.ID,
+	}, userAgent, ip)
+	if err != nil {
+		return OAuthTokens{}, grantError(err)
+	}
+
+	o.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      stored.GUID,
+		EventType: domain.AuditEventAuthorize,
+		Actor:     stored.GUID.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"session_id": pair.sessionID,
+			"client_id":  client.ID,
+			"amr":        strings.Join(stored.AMR, " "),
+			"scope":      domain.FormatScope(stored.Scope),
+		},
+	})
+
+	return o.sessionTokens(client, pair, stored.AMR, stored.AuthTime, stored.Nonce)
+}
+
+// RefreshClientSession runs the refresh token grant for a session of a
+// client. Unlike Refresh it is not bound to the user agent, confidential
+// clients refresh from their backend. A non nil scope narrows the session.
+func (o *OAuthService) RefreshClientSession(ctx context.Context, client domain.OAuthClient, refreshToken string, scope []string, userAgent, ip string) (OAuthTokens, error) {
+	if !slices.Contains(client.GrantTypes, domain.GrantRefreshToken) {
+		return OAuthTokens{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+
+	invalid := oauthError(OAuthInvalidGrant, "invalid refresh token")
+	sessionID, token, ok := strings.Cut(refreshToken, refreshTokenSeparator)
+	if !ok {
+		return OAuthTokens{}, invalid
+	}
+
+	stored, err := o.auth.repo.GetSession(ctx, sessionID)
+	if err != nil || stored.ClientID != client.ID || time.Now().After(stored.ExpiresAt) {
+		return OAuthTokens{}, invalid
+	}
+	guid := stored.GUID
+	decoded, err := o.auth.tokens.DecodeBase64(token)
+	if err != nil || !o.auth.tokens.CompareRefreshToken(decoded, stored.TokenHash) {
+		o.logger.Warn("refresh token mismatch", zap.String("client_id", client.ID), zap.String("guid", guid.String()))
+		return OAuthTokens{}, invalid
+	}
+
+	if scope == nil {
+		scope = stored.Scope
+	} else if err := o.auth.checkNarrowedScope(ctx, guid, scope, stored.Scope); err != nil {
+		return OAuthTokens{}, oauthError(OAuthInvalidScope, "scope exceeds the scope of the session")
+	}
+
+	// the new session is added next to the old one, deleting the old one
+	// first keeps a refresh token from being used twice
+	if _, err := o.auth.repo.DeleteSession(ctx, sessionID); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return OAuthTokens{}, invalid
+		}
+		o.logger.Error("failed to replace client session", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+
+	pair, err := o.auth.issueTokens(ctx, &guid, domain.RefreshToken{
+		AMR:      stored.AMR,
+		AuthTime: stored.AuthTime,
+		Scope:    scope,
+		OrgID:    stored.OrgID,
+		ClientID: client.ID,
+	}, userAgent, ip)
+	if err != nil {
+		return OAuthTokens{}, grantError(err)
+	}
+
+	details := map[string]string{
+		"previous_session_id": stored.SessionID,
+		"session_id":          pair.sessionID,
+		"previous_ip":         stored.IP,
+		"client_id":           client.ID,
+	}
+	if scope != nil {
+		details["scope"] = domain.FormatScope(scope)
+	}
+	o.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventRefresh,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+
+	return o.sessionTokens(client, pair, stored.AMR, stored.AuthTime, "")
+}
+
+// revokeClientSessionsSince ends the sessions of the user with the client
+// started at or after since, the sessions of other clients and the one of
+// the user are kept.
+func (o *OAuthService) revokeClientSessionsSince(ctx context.Context, guid uuid.UUID, clientID string, since time.Time, reason, userAgent, ip string) {
+	sessions, err := o.auth.repo.ListSessions(ctx, &guid)
+	if err != nil {
+		o.logger.Error("failed to list sessions", zap.Error(err))
+		return
+	}
+	for _, session := range sessions {
+		if session.ClientID == clientID && !session.CreatedAt.Before(since) {
+			o.auth.revokeSession(ctx, guid, session.SessionID, clientID, reason, userAgent, ip)
+		}
+	}
+}
+
+// sessionTokens hands the tokens of a session to its client. The refresh
+// token is prefixed with the session. Sessions granted the openid scope get
+// an ID token as well, with nonce only when the code is exchanged.
+func (o *OAuthService) sessionTokens(client domain.OAuthClient, pair issuedTokens, amr []string, authTime time.Time, nonce string) (OAuthTokens, error) {
+	tokens := OAuthTokens{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.sessionID + refreshTokenSeparator + pair.RefreshToken,
+		ExpiresAt:    time.Now().Add(o.settings.Load().accessTTL),
+		Scope:        domain.ParseScope(pair.Scope),
+	}
+	if !slices.Contains(tokens.Scope, domain.ScopeOpenID) {
+		return tokens, nil
+	}
+
+	idToken, err := o.auth.tokens.GenerateIDToken(domain.IDClaims{
+		GUID:        pair.guid,
+		ClientID:    client.ID,
+		Nonce:       nonce,
+		AuthTime:    authTime,
+		AMR:         amr,
+		ACR:         domain.ACRForAMR(amr),
+		AccessToken: pair.AccessToken,
+	})
+	if err != nil {
+		o.logger.Error("failed to generate id token", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+	tokens.IDToken = idToken
+	return tokens, nil
+}
+
+// PurgeAuthorizationCodes deletes expired authorization codes. Used codes
+// are kept until they expire, a replay is detected until then.
+func (o *OAuthService) PurgeAuthorizationCodes(ctx context.Context) (int64, error) {
+	n, err := o.clients.PurgeAuthorizationCodes(ctx, time.Now())
+	if err != nil {
+		o.logger.Error("failed to purge authorization codes", zap.Error(err))
+		return 0, err
+	}
+	if n > 0 {
+		o.logger.Info("purged expired authorization codes", zap.Int64("count", n))
+	}
+	return n, nil
+}
+
+// PurgePeriodically runs the purges of the AuthService and
+// PurgeAuthorizationCodes every purgeInterval until ctx is done.
+func (o *OAuthService) PurgePeriodically(ctx context.Context) {
+	purgePeriodically(ctx, o.auth.PurgeGuests, o.auth.PurgeDeletedUsers, o.PurgeAuthorizationCodes)
+}
+
+// grantError turns the errors of issueTokens about the user into
+// invalid_grant, the user can no longer be issued tokens.
+func grantError(err error) error {
+	var userErr *domain.UserStatusError
+	if errors.As(err, &userErr) || errors.Is(err, domain.ErrEmailNotVerified) || errors.Is(err, domain.ErrUserDisabled) {
+		return oauthError(OAuthInvalidGrant, fmt.Sprintf("user can not be issued tokens: %v", err))
+	}
+	return err
+}
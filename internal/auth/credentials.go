@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/mailer"
+	"github.com/nerfthisdev/go-backend-test-task/internal/password"
+	"go.uber.org/zap"
+)
+
+// maxPasswordLength caps passwords before any hashing, whatever the policy says.
+const maxPasswordLength = 1024
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,64}$`)
+
+// ValidationError is returned for input that can be corrected by the client.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return &ValidationError{Field: "username", Message: "must be 3 to 64 letters, digits, dots, dashes or underscores"}
+	}
+	return nil
+}
+
+func validateDisplayName(name string) error {
+	if utf8.RuneCountInString(name) > 100 || strings.TrimSpace(name) != name {
+		return &ValidationError{Field: "display_name", Message: "must be at most 100 characters without surrounding spaces"}
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return &ValidationError{Field: "display_name", Message: "must not contain control characters"}
+		}
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 254 {
+		return &ValidationError{Field: "email", Message: "must be a plain email address"}
+	}
+	return nil
+}
+
+// checkNewPassword applies the password policy and the breached password
+// check. identifiers are the account values the password must not contain.
+func (s *AuthService) checkNewPassword(newPassword string, identifiers ...string) error {
+	settings := s.settings.Load()
+
+	if err := settings.passwordPolicy.Check(newPassword, identifiers...); err != nil {
+		return &ValidationError{Field: "password", Message: err.Error()}
+	}
+
+	breached, err := settings.breached.Breached(newPassword)
+	if err != nil {
+		// the corpus is a safety net, an unreadable range file must not block users
+		s.logger.Error("failed to check breached passwords", zap.Error(err))
+		return nil
+	}
+	if breached {
+		return &ValidationError{Field: "password", Message: password.ErrBreached.Error()}
+	}
+	return nil
+}
+
+// Register creates a user with a username, an optional email and display
+// name and a password, mails a verification if an email is given and logs
+// the user in. If verified emails are required, the email is mandatory and
+// Register returns ErrEmailNotVerified once the user is created.
+//
+// With verified emails required, a taken username or email answers the
+// same ErrEmailNotVerified, so registration can not be used to find out
+// who has an account: past the insert of the user, the work is done in
+// the background. Otherwise a new user is logged in right away, which can
+// not be faked for a taken username, and ErrAlreadyExists is returned.
+// That is accepted, usernames are not secret and the endpoint is rate
+// limited.
+func (s *AuthService) Register(ctx context.Context, username, email, displayName, password, userAgent, ip string) (domain.TokenPair, error) {
+	if err := validateUsername(username); err != nil {
+		return domain.TokenPair{}, err
+	}
+	if email == "" && s.settings.Load().requireVerifiedEmail {
+		return domain.TokenPair{}, &ValidationError{Field: "email", Message: "is required"}
+	}
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			return domain.TokenPair{}, err
+		}
+	}
+	if err := validateDisplayName(displayName); err != nil {
+		return domain.TokenPair{}, err
+	}
+	if err := s.checkNewPassword(password, username, email); err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	hash, err := hashPassword(password, s.settings.Load().argon2)
+	if err != nil {
+		s.logger.Error("failed to hash password", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	guid := uuid.New()
+	err = s.users.CreateUserWithPassword(ctx, guid, username, email, displayName, hash)
+	if err != nil && !errors.Is(err, domain.ErrAlreadyExists) {
+		s.logger.Error("failed to create user", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+	if s.settings.Load().requireVerifiedEmail {
+		go s.finishRegistration(guid, username, email, err == nil, userAgent, ip)
+		return domain.TokenPair{}, domain.ErrEmailNotVerified
+	}
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventRegister,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"username": username},
+	})
+
+	if email != "" {
+		if err := s.sendEmailVerification(ctx, guid, email); err != nil {
+			s.logger.Error("failed to send email verification", zap.String("guid", guid.String()), zap.Error(err))
+		}
+	}
+
+	return s.authorize(ctx, &guid, []string{domain.AMRPassword}, nil, userAgent, ip)
+}
+
+// finishRegistration audits a new user and mails the verification of its
+// email. For a taken username or email it mails the owner of the email a
+// notice instead. It runs detached from the request, so it has its own
+// deadline.
+func (s *AuthService) finishRegistration(guid uuid.UUID, username, email string, created bool, userAgent, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	if created {
+		s.recordAudit(ctx, domain.AuditEntry{
+			GUID:      guid,
+			EventType: domain.AuditEventRegister,
+			Actor:     guid.String(),
+			IP:        ip,
+			UserAgent: userAgent,
+			Details:   map[string]string{"username": username},
+		})
+		if err := s.sendEmailVerification(ctx, guid, email); err != nil {
+			s.logger.Error("failed to send email verification", zap.String("guid", guid.String()), zap.Error(err))
+		}
+		return
+	}
+
+	// only the username may be taken, then nobody owns the email
+	owner, err := s.users.GetUserByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to look up user for registration notice", zap.Error(err))
+		}
+		return
+	}
+
+	settings := s.settings.Load()
+	msg := mailer.Message{
+		To:      owner.Email,
+		Subject: "Registration with your email",
+		Body: fmt.Sprintf(
+			"Someone tried to register a new account at %s with this email address, "+
+				"which already belongs to your account. If it was you, log in instead "+
+				"or reset your password. Otherwise you can ignore this email.\n",
+			settings.publicHost,
+		),
+	}
+	if err := settings.mailer.Send(ctx, msg); err != nil {
+		s.logger.Error("failed to send registration notice", zap.String("guid", owner.GUID.String()), zap.Error(err))
+	}
+}
+
+// Login verifies the username and password and issues a new token pair,
+// or returns an MFARequiredError if the user enrolled a second factor.
+// Unknown users, users without a password and wrong passwords all fail
+// with ErrInvalidCredentials after the same amount of work.
+func (s *AuthService) Login(ctx context.Context, username, password, userAgent, ip string) (domain.TokenPair, error) {
+	guid, amr, err := s.AuthenticatePassword(ctx, username, password, userAgent, ip)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	return s.authorize(ctx, &guid, amr, nil, userAgent, ip)
+}
+
+// AuthenticatePassword is Login without starting a session, for flows
+// that issue their tokens later. It returns the user and the methods
+// used, or an MFARequiredError to be continued with AuthenticateMFA.
+func (s *AuthService) AuthenticatePassword(ctx context.Context, username, password, userAgent, ip string) (uuid.UUID, []string, error) {
+	user, err := s.verifyCredentials(ctx, username, password)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidCredentials) {
+			s.recordAudit(ctx, domain.AuditEntry{
+				GUID:      user.GUID,
+				EventType: domain.AuditEventLoginFailed,
+				Actor:     username,
+				IP:        ip,
+				UserAgent: userAgent,
+			})
+		}
+		return uuid.Nil, nil, err
+	}
+
+	amr := []string{domain.AMRPassword}
+	if err := s.requireMFA(ctx, user.GUID, amr); err != nil {
+		return uuid.Nil, nil, err
+	}
+	return user.GUID, amr, nil
+}
+
+func (s *AuthService) verifyCredentials(ctx context.Context, username, password string) (domain.User, error) {
+	settings := s.settings.Load()
+
+	if len(password) > maxPasswordLength {
+		return domain.User{}, domain.ErrInvalidCredentials
+	}
+
+	user, err := s.users.GetUserByUsername(ctx, username)
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		s.logger.Error("failed to look up user", zap.Error(err))
+		return domain.User{}, err
+	}
+
+	encoded := user.PasswordHash
+	if !user.HasPassword() {
+		encoded = settings.dummyPasswordHash
+	}
+
+	ok, params, err := verifyPassword(password, encoded)
+	if err != nil {
+		s.logger.Error("failed to verify password", zap.String("guid", user.GUID.String()), zap.Error(err))
+		return user, domain.ErrInvalidCredentials
+	}
+	if !ok || !user.HasPassword() {
+		return user, domain.ErrInvalidCredentials
+	}
+
+	if params != settings.argon2 {
+		if hash, err := hashPassword(password, settings.argon2); err == nil {
+			if err := s.users.UpdatePasswordHash(ctx, user.GUID, hash); err != nil {
+				s.logger.Warn("failed to upgrade password hash", zap.Error(err))
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// ChangePassword replaces the password of a logged in user after checking
+// the current one.
+func (s *AuthService) ChangePassword(ctx context.Context, guid uuid.UUID, currentPassword, newPassword, userAgent, ip string) error {
+	user, err := s.users.GetUser(ctx, guid)
+	if err != nil {
+		return err
+	}
+	if !user.HasPassword() {
+		return domain.ErrInvalidCredentials
+	}
+
+	if _, err := s.verifyCredentials(ctx, user.Username, currentPassword); err != nil {
+		return err
+	}
+	if err := s.checkNewPassword(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(newPassword, s.settings.Load().argon2)
+	if err != nil {
+		s.logger.Error("failed to hash password", zap.Error(err))
+		return err
+	}
+	if err := s.users.UpdatePasswordHash(ctx, guid, hash); err != nil {
+		s.logger.Error("failed to update password", zap.Error(err))
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventPasswordChange,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+	})
+	return nil
+}
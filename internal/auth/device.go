@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// The device authorization grant (RFC 8628). A device without a browser
+// shows a short user code, the user enters it on another device, logs in
+// and approves. Meanwhile the device polls the token endpoint with its
+// device code until it gets a normal session of the user.
+
+const (
+	// deviceCodeTTL is how long the user has to enter the code.
+	deviceCodeTTL = 10 * time.Minute
+	// devicePollInterval is the interval devices start with, slow_down
+	// adds deviceSlowDownStep to it (RFC 8628 section 3.5).
+	devicePollInterval = 5 * time.Second
+	deviceSlowDownStep = 5 * time.Second
+	// userCodeCharset has no vowels, so codes do not spell words, and no
+	// characters that are easily confused (RFC 8628 section 6.1).
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+	// userCodeAttempts bounds the retries on a collision of user codes.
+	userCodeAttempts = 3
+)
+
+// Errors of the device grant at the token endpoint (RFC 8628 section 3.5).
+const (
+	OAuthAuthorizationPending = "authorization_pending"
+	OAuthSlowDown             = "slow_down"
+	OAuthExpiredToken         = "expired_token"
+)
+
+// ErrUnknownUserCode is returned for user codes that are unknown, expired
+// or already decided.
+var ErrUnknownUserCode = errors.New("unknown or expired user code")
+
+// DeviceCodes is the device authorization response.
+type DeviceCodes struct {
+	DeviceCode string
+	// UserCode is formatted for display, XXXX-XXXX.
+	UserCode                string
+	VerificationURI         string
+	VerificationURIComplete string
+	ExpiresAt               time.Time
+	Interval                time.Duration
+}
+
+// DevicePrompt is what the user is asked to approve.
+type DevicePrompt struct {
+	UserCode string
+	Client   domain.OAuthClient
+	Scope    []string
+}
+
+// newUserCode returns a random user code in its normalized form.
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeCharset)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeCharset[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// NormalizeUserCode uppercases a user code as typed and drops separators.
+func NormalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z':
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// FormatUserCode splits a normalized user code in two halves.
+func FormatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// AuthorizeDevice starts a device authorization for client. An empty scope
+// asks for all scopes of the client.
+func (o *OAuthService) AuthorizeDevice(ctx context.Context, client domain.OAuthClient, scope []string) (DeviceCodes, error) {
+	if !slices.Contains(client.GrantTypes, domain.GrantDeviceCode) {
+		return DeviceCodes{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+	if len(scope) == 0 {
+		scope = client.Scopes
+	} else if !domain.ScopeSubset(scope, client.Scopes) {
+		return DeviceCodes{}, oauthError(OAuthInvalidScope, "scope exceeds the scopes of the client")
+	}
+
+	deviceCode, deviceCodeHash, err := newOpaqueToken()
+	if err != nil {
+		return DeviceCodes{}, err
+	}
+
+	now := time.Now()
+	device := domain.DeviceAuthorization{
+		DeviceCodeHash: deviceCodeHash,
+		ClientID:       client.ID,
+		Scope:          scope,
+		Interval:       devicePollInterval,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(deviceCodeTTL),
+	}
+	for attempt := 0; ; attempt++ {
+		if device.UserCode, err = newUserCode(); err != nil {
+			return DeviceCodes{}, err
+		}
+		err = o.clients.StoreDeviceAuthorization(ctx, device)
+		if !errors.Is(err, domain.ErrAlreadyExists) || attempt == userCodeAttempts {
+			break
+		}
+	}
+	if err != nil {
+		o.logger.Error("failed to store device authorization", zap.Error(err))
+		return DeviceCodes{}, err
+	}
+
+	verificationURI := o.settings.Load().endpoints.VerificationURI
+	return DeviceCodes{
+		DeviceCode:              deviceCode,
+		UserCode:                FormatUserCode(device.UserCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + FormatUserCode(device.UserCode),
+		ExpiresAt:               device.ExpiresAt,
+		Interval:                device.Interval,
+	}, nil
+}
+
+// LookupDevice finds the pending authorization of a user code as typed.
+func (o *OAuthService) LookupDevice(ctx context.Context, userCode string) (DevicePrompt, error) {
+	device, err := o.clients.GetDeviceAuthorization(ctx, NormalizeUserCode(userCode))
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return DevicePrompt{}, ErrUnknownUserCode
+		}
+		o.logger.Error("failed to get device authorization", zap.Error(err))
+		return DevicePrompt{}, err
+	}
+	if device.Status != domain.DevicePending || time.Now().After(device.ExpiresAt) {
+		return DevicePrompt{}, ErrUnknownUserCode
+	}
+
+	client, err := o.clients.GetClient(ctx, device.ClientID)
+	if err != nil {
+		o.logger.Error("failed to get client", zap.Error(err))
+		return DevicePrompt{}, err
+	}
+	return DevicePrompt{UserCode: device.UserCode, Client: client, Scope: device.Scope}, nil
+}
+
+// ApproveDevice lets the device of prompt start a session of a user who
+// authenticated with the methods in amr.
+func (o *OAuthService) ApproveDevice(ctx context.Context, prompt DevicePrompt, guid uuid.UUID, amr []string) error {
+	user, err := o.auth.users.GetUser(ctx, guid)
+	if err != nil {
+		o.logger.Error("failed to get user", zap.Error(err))
+		return err
+	}
+	if err := user.CheckActive(); err != nil {
+		return err
+	}
+	return o.decideDevice(ctx, prompt, domain.DeviceApproved, guid, amr)
+}
+
+// DenyDevice makes the next poll of the device fail with access_denied.
+func (o *OAuthService) DenyDevice(ctx context.Context, prompt DevicePrompt) error {
+	return o.decideDevice(ctx, prompt, domain.DeviceDenied, uuid.Nil, nil)
+}
+
+func (o *OAuthService) decideDevice(ctx context.Context, prompt DevicePrompt, status domain.DeviceStatus, guid uuid.UUID, amr []string) error {
+	var userGUID *uuid.UUID
+	if status == domain.DeviceApproved {
+		userGUID = &guid
+	}
+	err := o.clients.DecideDeviceAuthorization(ctx, prompt.UserCode, status, userGUID, amr, time.Now())
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return ErrUnknownUserCode
+		}
+		o.logger.Error("failed to decide device authorization", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ExchangeDeviceCode runs the device code grant. Until the user decided it
+// answers authorization_pending, or slow_down to a device polling faster
+// than its interval. An approval adds a session of the device next to the
+// ones the user already has.
+func (o *OAuthService) ExchangeDeviceCode(ctx context.Context, client domain.OAuthClient, deviceCode, userAgent, ip string) (OAuthTokens, error) {
+	if !slices.Contains(client.GrantTypes, domain.GrantDeviceCode) {
+		return OAuthTokens{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+
+	deviceCodeHash := hashOpaqueToken(deviceCode)
+	device, err := o.clients.PollDeviceAuthorization(ctx, deviceCodeHash)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return OAuthTokens{}, oauthError(OAuthInvalidGrant, "invalid device code")
+		}
+		o.logger.Error("failed to poll device authorization", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+	if device.ClientID != client.ID {
+		return OAuthTokens{}, oauthError(OAuthInvalidGrant, "invalid device code")
+	}
+
+	now := time.Now()
+	if now.After(device.ExpiresAt) {
+		return OAuthTokens{}, oauthError(OAuthExpiredToken, "the device code has expired")
+	}
+
+	switch device.Status {
+	case domain.DeviceDenied:
+		return OAuthTokens{}, oauthError(OAuthAccessDenied, "the user denied the authorization")
+	case domain.DevicePending:
+		if device.LastPolledAt != nil && now.Sub(*device.LastPolledAt) < device.Interval {
+			if err := o.clients.SetDevicePollInterval(ctx, deviceCodeHash, device.Interval+deviceSlowDownStep); err != nil {
+				o.logger.Error("failed to slow down device", zap.Error(err))
+			}
+			return OAuthTokens{}, oauthError(OAuthSlowDown, "poll less often")
+		}
+		return OAuthTokens{}, oauthError(OAuthAuthorizationPending, "the user has not decided yet")
+	}
+
+	pair, err := o.auth.issueTokens(ctx, &device.GUID, domain.RefreshToken{
+		AMR:      device.AMR,
+		AuthTime: device.AuthTime,
+		Scope:    device.Scope,
+		ClientID: client.ID,
+	}, userAgent, ip)
+	if err != nil {
+		return OAuthTokens{}, grantError(err)
+	}
+
+	o.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      device.GUID,
+		EventType: domain.AuditEventAuthorize,
+		Actor:     device.GUID.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"session_id": pair.sessionID,
+			"client_id":  client.ID,
+			"grant_type": domain.GrantDeviceCode,
+			"amr":        strings.Join(device.AMR, " "),
+			"scope":      domain.FormatScope(device.Scope),
+		},
+	})
+
+	return o.sessionTokens(client, pair, device.AMR, device.AuthTime, "")
+}
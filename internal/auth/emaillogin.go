@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/mailer"
+	"go.uber.org/zap"
+)
+
+const (
+	// emailLoginResendInterval is how long a user has to wait before
+	// another login mail is sent.
+	emailLoginResendInterval = time.Minute
+	maxEmailLoginAttempts    = 5
+)
+
+// ErrInvalidEmailLogin is returned for wrong, used and expired login links
+// and codes alike, and for ones used from another user agent.
+var ErrInvalidEmailLogin = errors.New("invalid or expired login")
+
+// RequestEmailLogin mails a login link and a 6-digit code to the user
+// owning email. Like ForgotPassword it does not reveal whether such a user
+// exists, past the lookup of the user the work is done in the background.
+// Only the user agent that asked can use the link or the code.
+func (s *AuthService) RequestEmailLogin(ctx context.Context, email, userAgent, ip string) error {
+	user, err := s.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, domain.ErrNotFound) || (err == nil && !user.Active()) {
+		return nil
+	}
+	if err != nil {
+		s.logger.Error("failed to look up user for email login", zap.Error(err))
+		return err
+	}
+
+	go s.sendEmailLogin(user, userAgent, ip)
+	return nil
+}
+
+// sendEmailLogin stores a login of user and mails its link and code,
+// unless one was sent within emailLoginResendInterval. It runs detached
+// from the request, so it has its own deadline.
+func (s *AuthService) sendEmailLogin(user domain.User, userAgent, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	settings := s.settings.Load()
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		s.logger.Error("failed to generate email login token", zap.Error(err))
+		return
+	}
+	code, err := newVerificationCode()
+	if err != nil {
+		s.logger.Error("failed to generate email login code", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	err = s.emailLogins.StoreEmailLogin(ctx, domain.EmailLogin{
+		GUID:      user.GUID,
+		Email:     user.Email,
+		TokenHash: tokenHash,
+		CodeHash:  hashUserCode(user.GUID, code),
+		UserAgent: userAgent,
+		CreatedAt: now,
+		ExpiresAt: now.Add(settings.emailLoginTTL),
+	}, now.Add(-emailLoginResendInterval))
+	if errors.Is(err, domain.ErrAlreadyExists) {
+		s.logger.Info("email login requested again too soon", zap.String("guid", user.GUID.String()))
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to store email login", zap.Error(err))
+		return
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      user.GUID,
+		EventType: domain.AuditEventEmailLogin,
+		Actor:     user.GUID.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"step": "requested"},
+	})
+
+	link := settings.publicHost + "/login/email?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf(
+			"Open %s to log in, or enter this code:\n\n%s\n\n"+
+				"The link and the code expire in %s, can be used once and only "+
+				"in the browser you requested them from. "+
+				"If you did not try to log in, you can ignore this email.\n",
+			link, code, settings.emailLoginTTL,
+		),
+	}
+	if err := settings.mailer.Send(ctx, msg); err != nil {
+		s.logger.Error("failed to send email login", zap.String("guid", user.GUID.String()), zap.Error(err))
+	}
+}
+
+// LoginWithEmailToken exchanges the token of a login link for tokens, or
+// an MFA challenge if the user enrolled a second factor.
+func (s *AuthService) LoginWithEmailToken(ctx context.Context, token, userAgent, ip string) (domain.TokenPair, error) {
+	login, err := s.emailLogins.ConsumeEmailLoginToken(ctx, hashOpaqueToken(token), userAgent)
+	if errors.Is(err, domain.ErrNotFound) {
+		s.logger.Warn("invalid email login token")
+		return domain.TokenPair{}, ErrInvalidEmailLogin
+	}
+	if err != nil {
+		s.logger.Error("failed to consume email login", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	return s.completeEmailLogin(ctx, login, "link", userAgent, ip)
+}
+
+// LoginWithEmailCode exchanges the mailed code for tokens. Every attempt
+// counts, after maxEmailLoginAttempts the code is spent.
+func (s *AuthService) LoginWithEmailCode(ctx context.Context, email, code, userAgent, ip string) (domain.TokenPair, error) {
+	user, err := s.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.TokenPair{}, ErrInvalidEmailLogin
+	}
+	if err != nil {
+		s.logger.Error("failed to look up user for email login", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	pending, err := s.emailLogins.AttemptEmailLogin(ctx, user.GUID, maxEmailLoginAttempts)
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.TokenPair{}, ErrInvalidEmailLogin
+	}
+	if err != nil {
+		s.logger.Error("failed to get email login", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	codeHash := hashUserCode(user.GUID, strings.TrimSpace(code))
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(pending.CodeHash)) != 1 || pending.UserAgent != userAgent {
+		s.logger.Warn("wrong email login code or user-agent",
+			zap.String("guid", user.GUID.String()),
+			zap.Int("attempts", pending.Attempts),
+		)
+		s.recordAudit(ctx, domain.AuditEntry{
+			GUID:      user.GUID,
+			EventType: domain.AuditEventLoginFailed,
+			Actor:     email,
+			IP:        ip,
+			UserAgent: userAgent,
+			Details:   map[string]string{"method": "email_code"},
+		})
+		return domain.TokenPair{}, ErrInvalidEmailLogin
+	}
+
+	err = s.emailLogins.ConsumeEmailLoginCode(ctx, user.GUID, codeHash)
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.TokenPair{}, ErrInvalidEmailLogin
+	}
+	if err != nil {
+		s.logger.Error("failed to consume email login", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	return s.completeEmailLogin(ctx, pending, "code", userAgent, ip)
+}
+
+// completeEmailLogin finishes a login that proved control of the inbox,
+// which also verifies the email if it is still the one of the user.
+func (s *AuthService) completeEmailLogin(ctx context.Context, login domain.EmailLogin, method, userAgent, ip string) (domain.TokenPair, error) {
+	user, err := s.users.GetUser(ctx, login.GUID)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	if !strings.EqualFold(user.Email, login.Email) {
+		s.logger.Warn("email changed since the login was requested", zap.String("guid", login.GUID.String()))
+		return domain.TokenPair{}, ErrInvalidEmailLogin
+	}
+	if !user.Verified() {
+		if err := s.markEmailVerified(ctx, user.GUID, login.Email, "login_"+method, userAgent, ip); err != nil {
+			return domain.TokenPair{}, err
+		}
+	}
+
+	return s.completeLogin(ctx, user.GUID, []string{domain.AMREmail}, userAgent, ip)
+}
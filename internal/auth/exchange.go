@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Token exchange (RFC 8693). A client, like an API gateway, swaps the
+// access token of a user for one restricted to the audiences it is
+// registered for. Support tools additionally name a user in
+// requested_subject, the subject token is then the one of the staff
+// member, who gets a short lived token of that user. Exchanged tokens are
+// client access tokens with an act claim, the user endpoints of this API
+// do not accept them, so they can not be used to take over the account.
+
+// maxImpersonationTTL bounds the tokens issued for impersonation.
+const maxImpersonationTTL = 15 * time.Minute
+
+// TokenExchangeRequest holds the parameters of a token exchange.
+type TokenExchangeRequest struct {
+	SubjectToken       string
+	SubjectTokenType   string
+	ActorToken         string
+	RequestedTokenType string
+	// RequestedSubject is the GUID of the user to impersonate.
+	RequestedSubject string
+	Audience         []string
+	Scope            []string
+}
+
+// exchangeSubject is the user a subject token was issued to.
+type exchangeSubject struct {
+	GUID      uuid.UUID
+	SessionID string
+	Scope     []string
+	ACR       string
+}
+
+// ExchangeToken runs the token exchange grant. The client has to be
+// registered for it and every audience has to be one of the client. A
+// plain exchange is granted at most the scope of the subject token within
+// the scopes of the client, the act claim names the client.
+//
+// Impersonation is further limited: the client needs the
+// domain.PermissionImpersonate scope, the staff member the permission
+// itself and a multi-factor session. Users holding the permission can not
+// be impersonated, the account scope is never granted and the token
+// expires after at most maxImpersonationTTL. Every exchange is audited.
+func (o *OAuthService) ExchangeToken(ctx context.Context, client domain.OAuthClient, req TokenExchangeRequest, userAgent, ip string) (OAuthTokens, error) {
+	if !slices.Contains(client.GrantTypes, domain.GrantTokenExchange) {
+		return OAuthTokens{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+	if req.RequestedTokenType != "" && req.RequestedTokenType != domain.TokenTypeAccessToken {
+		return OAuthTokens{}, oauthError(OAuthInvalidRequest, "only access tokens can be requested")
+	}
+	if req.ActorToken != "" {
+		return OAuthTokens{}, oauthError(OAuthInvalidRequest, "actor_token is not supported, the client or the subject token is the actor")
+	}
+
+	audience := req.Audience
+	if len(audience) == 0 {
+		audience = client.Audiences
+	} else if !domain.ScopeSubset(audience, client.Audiences) {
+		return OAuthTokens{}, oauthError(OAuthInvalidTarget, "audience is not allowed for the client")
+	}
+	if len(audience) == 0 {
+		return OAuthTokens{}, oauthError(OAuthInvalidTarget, "client has no audience to restrict the token to")
+	}
+
+	subject, err := o.exchangeSubject(ctx, req.SubjectToken, req.SubjectTokenType)
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+
+	if req.RequestedSubject != "" {
+		return o.impersonate(ctx, client, subject, req, audience, userAgent, ip)
+	}
+
+	allowed := domain.IntersectScope(subject.Scope, client.Scopes)
+	scope, err := exchangeScope(req.Scope, allowed)
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+
+	token, expiresAt, err := o.auth.tokens.GenerateClientAccessToken(domain.ClientClaims{
+		ClientID: client.ID,
+		Scope:    scope,
+		Audience: audience,
+		Subject:  subject.GUID.String(),
+		Actor:    client.ID,
+	})
+	if err != nil {
+		o.logger.Error("failed to sign exchanged token", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+
+	o.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      subject.GUID,
+		EventType: domain.AuditEventTokenExchange,
+		Actor:     client.ID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"client_id":  client.ID,
+			"session_id": subject.SessionID,
+			"audience":   strings.Join(audience, " "),
+			"scope":      domain.FormatScope(scope),
+		},
+	})
+
+	return OAuthTokens{AccessToken: token, ExpiresAt: expiresAt, Scope: scope, IssuedTokenType: domain.TokenTypeAccessToken}, nil
+}
+
+// impersonate issues a token of the requested subject to the staff member
+// the subject token belongs to.
+func (o *OAuthService) impersonate(ctx context.Context, client domain.OAuthClient, actor exchangeSubject, req TokenExchangeRequest, audience []string, userAgent, ip string) (OAuthTokens, error) {
+	// denied attempts are audited on the staff member
+	denied := func(reason string) (OAuthTokens, error) {
+		o.logger.Warn("impersonation denied",
+			zap.String("client_id", client.ID), zap.String("actor", actor.GUID.String()),
+			zap.String("subject", req.RequestedSubject), zap.String("reason", reason))
+		o.auth.recordAudit(ctx, domain.AuditEntry{
+			GUID:      actor.GUID,
+			EventType: domain.AuditEventImpersonate,
+			Actor:     actor.GUID.String(),
+			IP:        ip,
+			UserAgent: userAgent,
+			Details: map[string]string{
+				"client_id":         client.ID,
+				"requested_subject": req.RequestedSubject,
+				"denied":            reason,
+			},
+		})
+		return OAuthTokens{}, oauthError(OAuthInvalidGrant, reason)
+	}
+
+	if !slices.Contains(client.Scopes, domain.PermissionImpersonate) {
+		return OAuthTokens{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to impersonate users")
+	}
+	if actor.ACR != domain.ACRMultiFactor {
+		return denied("impersonation requires a multi-factor session")
+	}
+	_, actorPermissions, err := o.auth.roles.UserRoles(ctx, actor.GUID)
+	if err != nil {
+		o.logger.Error("failed to get user roles", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+	// a downscoped token can not impersonate even if its user could
+	if !slices.Contains(actorPermissions, domain.PermissionImpersonate) || !slices.Contains(actor.Scope, domain.PermissionImpersonate) {
+		return denied("subject token lacks the " + domain.PermissionImpersonate + " permission")
+	}
+
+	target, err := uuid.Parse(req.RequestedSubject)
+	if err != nil || target == actor.GUID {
+		return OAuthTokens{}, oauthError(OAuthInvalidRequest, "requested_subject must be the GUID of another user")
+	}
+	user, err := o.auth.users.GetUser(ctx, target)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return OAuthTokens{}, oauthError(OAuthInvalidRequest, "requested_subject is not a user")
+		}
+		o.logger.Error("failed to get user", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+	if err := user.CheckActive(); err != nil {
+		return denied("requested_subject can not be issued tokens")
+	}
+	_, targetPermissions, err := o.auth.roles.UserRoles(ctx, target)
+	if err != nil {
+		o.logger.Error("failed to get user roles", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+	if slices.Contains(targetPermissions, domain.PermissionImpersonate) {
+		return denied("users allowed to impersonate can not be impersonated")
+	}
+
+	allowed := slices.DeleteFunc(domain.IntersectScope(scopesFor(targetPermissions), client.Scopes), func(scope string) bool {
+		return scope == domain.ScopeAccount || scope == domain.PermissionImpersonate
+	})
+	scope, err := exchangeScope(req.Scope, allowed)
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+
+	token, expiresAt, err := o.auth.tokens.GenerateClientAccessToken(domain.ClientClaims{
+		ClientID: client.ID,
+		Scope:    scope,
+		Audience: audience,
+		Subject:  target.String(),
+		Actor:    actor.GUID.String(),
+		TTL:      maxImpersonationTTL,
+	})
+	if err != nil {
+		o.logger.Error("failed to sign impersonation token", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+
+	o.logger.Info("impersonation token issued",
+		zap.String("client_id", client.ID), zap.String("actor", actor.GUID.String()), zap.String("subject", target.String()))
+	o.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      target,
+		EventType: domain.AuditEventImpersonate,
+		Actor:     actor.GUID.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"client_id":        client.ID,
+			"actor_session_id": actor.SessionID,
+			"audience":         strings.Join(audience, " "),
+			"scope":            domain.FormatScope(scope),
+			"expires_at":       expiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+
+	return OAuthTokens{AccessToken: token, ExpiresAt: expiresAt, Scope: scope, IssuedTokenType: domain.TokenTypeAccessToken}, nil
+}
+
+// exchangeSubject validates a subject token. Only access tokens of live
+// sessions of this realm are accepted.
+func (o *OAuthService) exchangeSubject(ctx context.Context, token, tokenType string) (exchangeSubject, error) {
+	if tokenType != domain.TokenTypeAccessToken {
+		return exchangeSubject{}, oauthError(OAuthInvalidRequest, "subject_token_type must be "+domain.TokenTypeAccessToken)
+	}
+
+	invalid := oauthError(OAuthInvalidRequest, "invalid subject_token")
+	claims, err := o.auth.tokens.ValidateAccessToken(token)
+	if err != nil {
+		return exchangeSubject{}, invalid
+	}
+	sub, _ := claims["sub"].(string)
+	sessionID, _ := claims["jti"].(string)
+	guid, err := uuid.Parse(sub)
+	if err != nil || sessionID == "" {
+		return exchangeSubject{}, invalid
+	}
+
+	exists, err := o.auth.repo.SessionExists(ctx, sessionID)
+	if err != nil {
+		o.logger.Error("failed to check session", zap.Error(err))
+		return exchangeSubject{}, err
+	}
+	if !exists {
+		return exchangeSubject{}, invalid
+	}
+
+	scope, _ := claims["scope"].(string)
+	acr, _ := claims["acr"].(string)
+	return exchangeSubject{GUID: guid, SessionID: sessionID, Scope: domain.ParseScope(scope), ACR: acr}, nil
+}
+
+// exchangeScope checks the requested scope against what the exchange
+// allows, all of it if none was requested.
+func exchangeScope(requested, allowed []string) ([]string, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	if !domain.ScopeSubset(requested, allowed) {
+		return nil, oauthError(OAuthInvalidScope, "scope exceeds what can be exchanged")
+	}
+	return requested, nil
+}
@@ -0,0 +1,378 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+const testAudience = "https://orders.internal"
+
+var (
+	// gatewayClient delegates, it can not impersonate.
+	gatewayClient = domain.OAuthClient{
+		ID:         "client_gateway",
+		Scopes:     []string{"orders:read", "orders:write"},
+		Audiences:  []string{testAudience},
+		GrantTypes: []string{domain.GrantTokenExchange},
+	}
+	// supportClient is the support tool staff impersonate users with.
+	supportClient = domain.OAuthClient{
+		ID:         "client_support",
+		Scopes:     []string{domain.ScopeAccount, "orders:read", domain.PermissionImpersonate},
+		Audiences:  []string{testAudience},
+		GrantTypes: []string{domain.GrantTokenExchange},
+	}
+)
+
+type exchangeFixture struct {
+	oauth    *OAuthService
+	tokens   *JWTService
+	sessions *fakeSessions
+	audit    *fakeAudit
+	// staff may impersonate, user may not and is the one impersonated,
+	// privileged may impersonate as well and disabled can not log in.
+	staff, user, privileged, disabled uuid.UUID
+}
+
+func newExchangeFixture(t *testing.T) *exchangeFixture {
+	t.Helper()
+
+	cfg := testConfig()
+	// longer than maxImpersonationTTL to see it applied
+	cfg.AccessTTL = time.Hour
+
+	f := &exchangeFixture{
+		tokens:     NewJwtService(cfg),
+		sessions:   &fakeSessions{},
+		audit:      &fakeAudit{},
+		staff:      uuid.New(),
+		user:       uuid.New(),
+		privileged: uuid.New(),
+		disabled:   uuid.New(),
+	}
+	users := newFakeUsers(
+		domain.User{GUID: f.staff, Username: "staff", Status: domain.UserActive},
+		domain.User{GUID: f.user, Username: "alice", Status: domain.UserActive},
+		domain.User{GUID: f.privileged, Username: "admin", Status: domain.UserActive},
+		domain.User{GUID: f.disabled, Username: "bob", Status: domain.UserDisabled},
+	)
+	roles := fakeRoles{permissions: map[uuid.UUID][]string{
+		f.staff:      {"orders:read", domain.PermissionImpersonate},
+		f.user:       {"orders:read", "orders:write"},
+		f.privileged: {domain.PermissionImpersonate},
+		f.disabled:   {"orders:read"},
+	}}
+	auth := NewAuthService(f.sessions, f.tokens, users, f.audit, nil, nil, nil, nil, roles, nil, nil, cfg, zap.NewNop())
+	f.oauth = NewOAuthService(auth, newFakeClients(), cfg, zap.NewNop())
+	return f
+}
+
+// login starts a session of guid and returns its access token.
+func (f *exchangeFixture) login(t *testing.T, guid uuid.UUID, acr string, scope ...string) string {
+	t.Helper()
+
+	sessionID := uuid.NewString()
+	if err := f.sessions.StoreRefreshToken(context.Background(), domain.RefreshToken{GUID: guid, SessionID: sessionID}); err != nil {
+		t.Fatalf("StoreRefreshToken: %v", err)
+	}
+	token, err := f.tokens.GenerateAccessToken(domain.AccessClaims{GUID: guid, SessionID: sessionID, ACR: acr, Scope: scope})
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	return token
+}
+
+func (f *exchangeFixture) exchange(client domain.OAuthClient, subjectToken string, req TokenExchangeRequest) (OAuthTokens, error) {
+	req.SubjectToken = subjectToken
+	if req.SubjectTokenType == "" {
+		req.SubjectTokenType = domain.TokenTypeAccessToken
+	}
+	return f.oauth.ExchangeToken(context.Background(), client, req, testUserAgent, "192.0.2.1")
+}
+
+// exchangedClaims returns the claims of an exchanged token as they are
+// serialized.
+func exchangedClaims(t *testing.T, token string) jwt.MapClaims {
+	t.Helper()
+
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	return claims
+}
+
+// wantActor checks the act claim, a JSON object naming the actor by its
+// sub (RFC 8693 section 4.1).
+func wantActor(t *testing.T, claims jwt.MapClaims, actor string) {
+	t.Helper()
+
+	act, ok := claims["act"].(map[string]any)
+	if !ok {
+		t.Fatalf("act = %#v, want an object", claims["act"])
+	}
+	if act["sub"] != actor || len(act) != 1 {
+		t.Errorf("act = %v, want {sub: %s}", act, actor)
+	}
+}
+
+func TestExchangeTokenDelegatesWithinTheSubjectScope(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		req       TokenExchangeRequest
+		wantScope []string
+		wantErr   string
+	}{
+		{name: "defaults to what both allow", wantScope: []string{"orders:read"}},
+		{name: "requested scope", req: TokenExchangeRequest{Scope: []string{"orders:read"}}, wantScope: []string{"orders:read"}},
+		{name: "scope of the client beyond the subject token", req: TokenExchangeRequest{Scope: []string{"orders:write"}}, wantErr: OAuthInvalidScope},
+		{name: "scope of the subject token beyond the client", req: TokenExchangeRequest{Scope: []string{domain.ScopeAccount}}, wantErr: OAuthInvalidScope},
+		{name: "audience beyond the client", req: TokenExchangeRequest{Audience: []string{"https://billing.internal"}}, wantErr: OAuthInvalidTarget},
+		{name: "actor token", req: TokenExchangeRequest{ActorToken: "token"}, wantErr: OAuthInvalidRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newExchangeFixture(t)
+			// the user may write orders, the session was narrowed to reading
+			subjectToken := f.login(t, f.user, domain.ACRSingleFactor, domain.ScopeAccount, "orders:read")
+
+			tokens, err := f.exchange(gatewayClient, subjectToken, tc.req)
+			if tc.wantErr != "" {
+				wantOAuthError(t, err, tc.wantErr)
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExchangeToken: %v", err)
+			}
+			if !slices.Equal(tokens.Scope, tc.wantScope) || tokens.IssuedTokenType != domain.TokenTypeAccessToken {
+				t.Errorf("ExchangeToken = scope %v, type %q, want %v", tokens.Scope, tokens.IssuedTokenType, tc.wantScope)
+			}
+
+			claims := exchangedClaims(t, tokens.AccessToken)
+			if claims["sub"] != f.user.String() || claims["client_id"] != gatewayClient.ID || claims["scope"] != domain.FormatScope(tc.wantScope) {
+				t.Errorf("claims = %v, want the user as subject of the gateway", claims)
+			}
+			if aud, _ := claims.GetAudience(); !slices.Equal(aud, []string{testAudience}) {
+				t.Errorf("aud = %v, want %s", aud, testAudience)
+			}
+			wantActor(t, claims, gatewayClient.ID)
+
+			if events := f.audit.events(); !slices.Equal(events, []domain.AuditEventType{domain.AuditEventTokenExchange}) {
+				t.Errorf("audit events = %v, want a token exchange", events)
+			}
+		})
+	}
+}
+
+func TestExchangeTokenImpersonates(t *testing.T) {
+	f := newExchangeFixture(t)
+	subjectToken := f.login(t, f.staff, domain.ACRMultiFactor, domain.ScopeAccount, domain.PermissionImpersonate)
+
+	tokens, err := f.exchange(supportClient, subjectToken, TokenExchangeRequest{RequestedSubject: f.user.String()})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %v", err)
+	}
+	// the account scope and the permission to impersonate are never passed
+	// on, orders:write is not a scope of the client
+	if !slices.Equal(tokens.Scope, []string{"orders:read"}) {
+		t.Errorf("scope = %v, want orders:read", tokens.Scope)
+	}
+	if ttl := time.Until(tokens.ExpiresAt); ttl > maxImpersonationTTL {
+		t.Errorf("token expires in %v, want at most %v", ttl, maxImpersonationTTL)
+	}
+
+	claims := exchangedClaims(t, tokens.AccessToken)
+	if claims["sub"] != f.user.String() || claims["client_id"] != supportClient.ID {
+		t.Errorf("claims = %v, want the user as subject of the support tool", claims)
+	}
+	wantActor(t, claims, f.staff.String())
+
+	f.audit.mu.Lock()
+	defer f.audit.mu.Unlock()
+	if len(f.audit.entries) != 1 {
+		t.Fatalf("audit entries = %+v, want the impersonation", f.audit.entries)
+	}
+	entry := f.audit.entries[0]
+	if entry.EventType != domain.AuditEventImpersonate || entry.GUID != f.user || entry.Actor != f.staff.String() || entry.Details["denied"] != "" {
+		t.Errorf("audit entry = %+v, want the impersonation of the user by the staff member", entry)
+	}
+}
+
+func TestExchangeTokenImpersonationPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		client  domain.OAuthClient
+		login   func(f *exchangeFixture, t *testing.T) string
+		subject func(f *exchangeFixture) string
+		wantErr string
+		// wantDenied is set for refusals audited on the staff member.
+		wantDenied bool
+	}{
+		{
+			name:   "client only allowed to delegate",
+			client: gatewayClient,
+			login: func(f *exchangeFixture, t *testing.T) string {
+				return f.login(t, f.staff, domain.ACRMultiFactor, domain.PermissionImpersonate)
+			},
+			wantErr: OAuthUnauthorizedClient,
+		},
+		{
+			name: "single-factor session",
+			login: func(f *exchangeFixture, t *testing.T) string {
+				return f.login(t, f.staff, domain.ACRSingleFactor, domain.PermissionImpersonate)
+			},
+			wantErr:    OAuthInvalidGrant,
+			wantDenied: true,
+		},
+		{
+			name: "subject token downscoped without the permission",
+			login: func(f *exchangeFixture, t *testing.T) string {
+				return f.login(t, f.staff, domain.ACRMultiFactor, domain.ScopeAccount)
+			},
+			wantErr:    OAuthInvalidGrant,
+			wantDenied: true,
+		},
+		{
+			name: "user without the permission",
+			login: func(f *exchangeFixture, t *testing.T) string {
+				return f.login(t, f.user, domain.ACRMultiFactor, domain.PermissionImpersonate)
+			},
+			subject:    func(f *exchangeFixture) string { return f.staff.String() },
+			wantErr:    OAuthInvalidGrant,
+			wantDenied: true,
+		},
+		{
+			name:       "user allowed to impersonate",
+			subject:    func(f *exchangeFixture) string { return f.privileged.String() },
+			wantErr:    OAuthInvalidGrant,
+			wantDenied: true,
+		},
+		{
+			name:       "disabled user",
+			subject:    func(f *exchangeFixture) string { return f.disabled.String() },
+			wantErr:    OAuthInvalidGrant,
+			wantDenied: true,
+		},
+		{
+			name:    "the staff member",
+			subject: func(f *exchangeFixture) string { return f.staff.String() },
+			wantErr: OAuthInvalidRequest,
+		},
+		{
+			name:    "unknown user",
+			subject: func(f *exchangeFixture) string { return uuid.NewString() },
+			wantErr: OAuthInvalidRequest,
+		},
+		{
+			name:    "not a GUID",
+			subject: func(f *exchangeFixture) string { return "alice" },
+			wantErr: OAuthInvalidRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newExchangeFixture(t)
+			client := supportClient
+			if tc.client.ID != "" {
+				client = tc.client
+			}
+			var subjectToken string
+			if tc.login != nil {
+				subjectToken = tc.login(f, t)
+			} else {
+				subjectToken = f.login(t, f.staff, domain.ACRMultiFactor, domain.PermissionImpersonate)
+			}
+			subject := f.user.String()
+			if tc.subject != nil {
+				subject = tc.subject(f)
+			}
+
+			_, err := f.exchange(client, subjectToken, TokenExchangeRequest{RequestedSubject: subject})
+			wantOAuthError(t, err, tc.wantErr)
+
+			f.audit.mu.Lock()
+			defer f.audit.mu.Unlock()
+			for _, entry := range f.audit.entries {
+				if entry.Details["denied"] == "" {
+					t.Errorf("audit entry %+v for a refused impersonation", entry)
+				}
+			}
+			if tc.wantDenied && len(f.audit.entries) != 1 {
+				t.Errorf("audit entries = %+v, want the refusal", f.audit.entries)
+			}
+		})
+	}
+}
+
+func TestExchangeTokenRejectsSubjectTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		token     func(f *exchangeFixture, t *testing.T) string
+		tokenType string
+	}{
+		{
+			name: "expired",
+			token: func(f *exchangeFixture, t *testing.T) string {
+				sessionID := uuid.NewString()
+				f.sessions.StoreRefreshToken(context.Background(), domain.RefreshToken{GUID: f.user, SessionID: sessionID})
+				token, err := f.tokens.GenerateAccessToken(domain.AccessClaims{GUID: f.user, SessionID: sessionID, ExpiresAt: time.Now().Add(-time.Minute)})
+				if err != nil {
+					t.Fatalf("GenerateAccessToken: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "of another realm",
+			token: func(f *exchangeFixture, t *testing.T) string {
+				sessionID := uuid.NewString()
+				f.sessions.StoreRefreshToken(context.Background(), domain.RefreshToken{GUID: f.user, SessionID: sessionID})
+				token, err := realmJWT("https://other.example.com", "other-realm-secret-with-enough-entropy-0123456789").
+					GenerateAccessToken(domain.AccessClaims{GUID: f.user, SessionID: sessionID})
+				if err != nil {
+					t.Fatalf("GenerateAccessToken: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "of an ended session",
+			token: func(f *exchangeFixture, t *testing.T) string {
+				token, err := f.tokens.GenerateAccessToken(domain.AccessClaims{GUID: f.user, SessionID: uuid.NewString()})
+				if err != nil {
+					t.Fatalf("GenerateAccessToken: %v", err)
+				}
+				return token
+			},
+		},
+		{
+			name: "exchanged before",
+			token: func(f *exchangeFixture, t *testing.T) string {
+				tokens, err := f.exchange(gatewayClient, f.login(t, f.user, domain.ACRSingleFactor, "orders:read"), TokenExchangeRequest{})
+				if err != nil {
+					t.Fatalf("ExchangeToken: %v", err)
+				}
+				return tokens.AccessToken
+			},
+		},
+		{
+			name: "of another type",
+			token: func(f *exchangeFixture, t *testing.T) string {
+				return f.login(t, f.user, domain.ACRSingleFactor, "orders:read")
+			},
+			tokenType: "urn:ietf:params:oauth:token-type:refresh_token",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newExchangeFixture(t)
+
+			_, err := f.exchange(gatewayClient, tc.token(f, t), TokenExchangeRequest{SubjectTokenType: tc.tokenType})
+			wantOAuthError(t, err, OAuthInvalidRequest)
+		})
+	}
+}
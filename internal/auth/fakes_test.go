@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// The fakes embed the interface they stand in for, methods a test does not
+// expect to be called panic on the nil embedded value.
+
+type fakeUsers struct {
+	domain.UserRepository
+
+	mu    sync.Mutex
+	users map[uuid.UUID]domain.User
+}
+
+func newFakeUsers(users ...domain.User) *fakeUsers {
+	f := &fakeUsers{users: make(map[uuid.UUID]domain.User)}
+	for _, user := range users {
+		f.users[user.GUID] = user
+	}
+	return f
+}
+
+func (f *fakeUsers) GetUser(ctx context.Context, guid uuid.UUID) (domain.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[guid]
+	if !ok {
+		return domain.User{}, domain.ErrNotFound
+	}
+	return user, nil
+}
+
+func (f *fakeUsers) GetUserByUsername(ctx context.Context, username string) (domain.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, user := range f.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return domain.User{}, domain.ErrNotFound
+}
+
+type fakeSessions struct {
+	domain.TokenRepository
+
+	mu       sync.Mutex
+	sessions []domain.RefreshToken
+}
+
+// StoreRefreshToken replaces the session of the user without a client, or
+// the session of the same ID, like the repository does.
+func (f *fakeSessions) StoreRefreshToken(ctx context.Context, token domain.RefreshToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, session := range f.sessions {
+		if session.SessionID == token.SessionID || token.ClientID == "" && session.ClientID == "" && session.GUID == token.GUID {
+			f.sessions[i] = token
+			return nil
+		}
+	}
+	f.sessions = append(f.sessions, token)
+	return nil
+}
+
+func (f *fakeSessions) GetSession(ctx context.Context, sessionID string) (domain.RefreshToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, session := range f.sessions {
+		if session.SessionID == sessionID {
+			return session, nil
+		}
+	}
+	return domain.RefreshToken{}, domain.ErrNotFound
+}
+
+func (f *fakeSessions) SessionExists(ctx context.Context, sessionID string) (bool, error) {
+	_, err := f.GetSession(ctx, sessionID)
+	return err == nil, nil
+}
+
+func (f *fakeSessions) ListSessions(ctx context.Context, guid *uuid.UUID) ([]domain.RefreshToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var sessions []domain.RefreshToken
+	for _, session := range f.sessions {
+		if guid == nil || session.GUID == *guid {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (f *fakeSessions) DeleteSession(ctx context.Context, sessionID string) (uuid.UUID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, session := range f.sessions {
+		if session.SessionID == sessionID {
+			f.sessions = append(f.sessions[:i], f.sessions[i+1:]...)
+			return session.GUID, nil
+		}
+	}
+	return uuid.Nil, domain.ErrNotFound
+}
+
+// fakeRoles grants the users in permissions their permissions, no one
+// has a role.
+type fakeRoles struct {
+	domain.RoleRepository
+
+	permissions map[uuid.UUID][]string
+}
+
+func (f fakeRoles) UserRoles(ctx context.Context, guid uuid.UUID) ([]string, []string, error) {
+	return nil, f.permissions[guid], nil
+}
+
+type fakeAudit struct {
+	domain.AuditRepository
+
+	mu      sync.Mutex
+	entries []domain.AuditEntry
+}
+
+func (f *fakeAudit) AppendAuditEntry(ctx context.Context, entry *domain.AuditEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.entries = append(f.entries, *entry)
+	return nil
+}
+
+// events returns the types of the recorded entries in order.
+func (f *fakeAudit) events() []domain.AuditEventType {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	events := make([]domain.AuditEventType, len(f.entries))
+	for i, entry := range f.entries {
+		events[i] = entry.EventType
+	}
+	return events
+}
+
+// fakeMFA holds the TOTP credential and recovery codes of a single user,
+// with the predicates of the repository.
+type fakeMFA struct {
+	domain.MFARepository
+
+	mu            sync.Mutex
+	cred          *domain.TOTPCredential
+	recoveryCodes []string
+}
+
+func (f *fakeMFA) StoreTOTP(ctx context.Context, cred domain.TOTPCredential) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cred != nil && f.cred.Confirmed() {
+		return domain.ErrAlreadyExists
+	}
+	f.cred = &cred
+	return nil
+}
+
+func (f *fakeMFA) GetTOTP(ctx context.Context, guid uuid.UUID) (domain.TOTPCredential, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cred == nil || f.cred.GUID != guid {
+		return domain.TOTPCredential{}, domain.ErrNotFound
+	}
+	return *f.cred, nil
+}
+
+func (f *fakeMFA) ConfirmTOTP(ctx context.Context, guid uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cred == nil || f.cred.GUID != guid || f.cred.Confirmed() || f.cred.LastUsedStep >= step {
+		return domain.ErrNotFound
+	}
+	now := f.cred.CreatedAt
+	f.cred.ConfirmedAt = &now
+	f.cred.LastUsedStep = step
+	f.cred.FailedAttempts = 0
+	f.recoveryCodes = slices.Clone(recoveryCodeHashes)
+	return nil
+}
+
+func (f *fakeMFA) UseTOTPStep(ctx context.Context, guid uuid.UUID, step int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cred == nil || f.cred.GUID != guid || !f.cred.Confirmed() || f.cred.LastUsedStep >= step {
+		return domain.ErrNotFound
+	}
+	f.cred.LastUsedStep = step
+	f.cred.FailedAttempts = 0
+	return nil
+}
+
+func (f *fakeMFA) RecordTOTPFailure(ctx context.Context, guid uuid.UUID) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cred == nil || f.cred.GUID != guid {
+		return 0, domain.ErrNotFound
+	}
+	f.cred.FailedAttempts++
+	return f.cred.FailedAttempts, nil
+}
+
+func (f *fakeMFA) UseRecoveryCode(ctx context.Context, guid uuid.UUID, codeHash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := slices.Index(f.recoveryCodes, codeHash)
+	if f.cred == nil || f.cred.GUID != guid || i < 0 {
+		return domain.ErrNotFound
+	}
+	f.recoveryCodes = slices.Delete(f.recoveryCodes, i, i+1)
+	f.cred.FailedAttempts = 0
+	return nil
+}
+
+func (f *fakeMFA) CountRecoveryCodes(ctx context.Context, guid uuid.UUID) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.recoveryCodes), nil
+}
+
+type fakeWebAuthn struct {
+	mu         sync.Mutex
+	creds      []domain.WebAuthnCredential
+	ceremonies map[string]domain.WebAuthnCeremony
+	// beforeUse runs at the start of UseCredential, to simulate a login
+	// racing the one being finished.
+	beforeUse func()
+}
+
+func newFakeWebAuthn() *fakeWebAuthn {
+	return &fakeWebAuthn{ceremonies: make(map[string]domain.WebAuthnCeremony)}
+}
+
+func (f *fakeWebAuthn) StoreCredential(ctx context.Context, cred domain.WebAuthnCredential) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.creds {
+		if bytes.Equal(c.ID, cred.ID) {
+			return domain.ErrAlreadyExists
+		}
+	}
+	f.creds = append(f.creds, cred)
+	return nil
+}
+
+func (f *fakeWebAuthn) ListCredentials(ctx context.Context, guid uuid.UUID) ([]domain.WebAuthnCredential, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var creds []domain.WebAuthnCredential
+	for _, c := range f.creds {
+		if c.GUID == guid {
+			creds = append(creds, c)
+		}
+	}
+	return creds, nil
+}
+
+func (f *fakeWebAuthn) UseCredential(ctx context.Context, id []byte, signCount uint32, backupState bool) error {
+	if f.beforeUse != nil {
+		f.beforeUse()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, c := range f.creds {
+		if !bytes.Equal(c.ID, id) {
+			continue
+		}
+		// the predicate of the repository
+		if signCount <= c.SignCount && (signCount != 0 || c.SignCount != 0) {
+			return domain.ErrNotFound
+		}
+		now := time.Now()
+		f.creds[i].SignCount = signCount
+		f.creds[i].BackupState = backupState
+		f.creds[i].LastUsedAt = &now
+		return nil
+	}
+	return domain.ErrNotFound
+}
+
+func (f *fakeWebAuthn) DeleteCredential(ctx context.Context, guid uuid.UUID, id []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, c := range f.creds {
+		if c.GUID == guid && bytes.Equal(c.ID, id) {
+			f.creds = append(f.creds[:i], f.creds[i+1:]...)
+			return nil
+		}
+	}
+	return domain.ErrNotFound
+}
+
+func (f *fakeWebAuthn) StoreCeremony(ctx context.Context, ceremony domain.WebAuthnCeremony) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ceremonies[string(ceremony.Kind)+":"+ceremony.Challenge] = ceremony
+	return nil
+}
+
+func (f *fakeWebAuthn) ConsumeCeremony(ctx context.Context, challenge string, kind domain.WebAuthnCeremonyKind) (domain.WebAuthnCeremony, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(kind) + ":" + challenge
+	ceremony, ok := f.ceremonies[key]
+	if !ok || time.Now().After(ceremony.ExpiresAt) {
+		return domain.WebAuthnCeremony{}, domain.ErrNotFound
+	}
+	delete(f.ceremonies, key)
+	return ceremony, nil
+}
+
+type fakeClients struct {
+	domain.OAuthClientRepository
+
+	mu         sync.Mutex
+	clients    map[string]domain.OAuthClient
+	assertions map[string]time.Time
+	// code and device are the single authorization code and device
+	// authorization handed out, as if the user had already decided.
+	code   domain.AuthorizationCode
+	device domain.DeviceAuthorization
+}
+
+func newFakeClients(clients ...domain.OAuthClient) *fakeClients {
+	f := &fakeClients{clients: make(map[string]domain.OAuthClient), assertions: make(map[string]time.Time)}
+	for _, client := range clients {
+		f.clients[client.ID] = client
+	}
+	return f
+}
+
+func (f *fakeClients) GetClient(ctx context.Context, id string) (domain.OAuthClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	client, ok := f.clients[id]
+	if !ok {
+		return domain.OAuthClient{}, domain.ErrNotFound
+	}
+	return client, nil
+}
+
+func (f *fakeClients) UseClientAssertion(ctx context.Context, clientID, jti string, expiresAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := clientID + ":" + jti
+	if _, ok := f.assertions[key]; ok {
+		return domain.ErrAlreadyExists
+	}
+	f.assertions[key] = expiresAt
+	return nil
+}
+
+func (f *fakeClients) UseAuthorizationCode(ctx context.Context, codeHash string) (domain.AuthorizationCode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if codeHash != f.code.CodeHash {
+		return domain.AuthorizationCode{}, domain.ErrNotFound
+	}
+	code := f.code
+	if f.code.UsedAt == nil {
+		now := time.Now()
+		f.code.UsedAt = &now
+	}
+	return code, nil
+}
+
+func (f *fakeClients) PollDeviceAuthorization(ctx context.Context, deviceCodeHash string) (domain.DeviceAuthorization, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if deviceCodeHash != f.device.DeviceCodeHash {
+		return domain.DeviceAuthorization{}, domain.ErrNotFound
+	}
+	return f.device, nil
+}
+
+// testConfig is a valid configuration with cheap password hashing.
+func testConfig() config.Config {
+	return config.Config{
+		JWTSecret:           "test-signing-secret-with-enough-entropy-0123456789",
+		AccessTTL:           15 * time.Minute,
+		RefreshTTL:          24 * time.Hour,
+		PublicHost:          "https://auth.example.com",
+		Argon2Memory:        64,
+		Argon2Iterations:    1,
+		Argon2Parallelism:   1,
+		PasswordMinLength:   8,
+		PasswordMaxLength:   128,
+		WebAuthnRPName:      "Example",
+		WebAuthnAttestation: "none",
+	}
+}
+
+// testAuthService wires an AuthService to the given fakes, nil ones are
+// not expected to be used.
+func testAuthService(t *testing.T, cfg config.Config, users domain.UserRepository, sessions domain.TokenRepository, audit domain.AuditRepository) *AuthService {
+	t.Helper()
+	return NewAuthService(sessions, NewJwtService(cfg), users, audit, nil, nil, nil, nil, fakeRoles{}, nil, nil, cfg, zap.NewNop())
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// ErrNotGuest is returned when upgrading a user that is already registered.
+var ErrNotGuest = errors.New("account is already registered")
+
+// UpgradeGuest attaches a username and password, an email or both to a
+// guest. The GUID and the current sessions stay the same, a new email
+// has to be verified like on registration.
+func (s *AuthService) UpgradeGuest(ctx context.Context, guid uuid.UUID, username, email, displayName, password, userAgent, ip string) (domain.User, error) {
+	if username == "" && email == "" {
+		return domain.User{}, &ValidationError{Field: "username", Message: "or email is required"}
+	}
+	if username == "" && password != "" {
+		return domain.User{}, &ValidationError{Field: "username", Message: "is required to set a password"}
+	}
+	if username != "" {
+		if err := validateUsername(username); err != nil {
+			return domain.User{}, err
+		}
+	}
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			return domain.User{}, err
+		}
+	}
+	if err := validateDisplayName(displayName); err != nil {
+		return domain.User{}, err
+	}
+
+	user, err := s.users.GetUser(ctx, guid)
+	if err != nil {
+		return domain.User{}, err
+	}
+	if !user.Guest {
+		return domain.User{}, ErrNotGuest
+	}
+
+	var hash string
+	if username != "" {
+		if err := s.checkNewPassword(password, username, email); err != nil {
+			return domain.User{}, err
+		}
+		if hash, err = hashPassword(password, s.settings.Load().argon2); err != nil {
+			s.logger.Error("failed to hash password", zap.Error(err))
+			return domain.User{}, err
+		}
+	}
+
+	if err := s.users.UpgradeGuest(ctx, guid, username, email, displayName, hash); err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			// upgraded concurrently
+			return domain.User{}, ErrNotGuest
+		case !errors.Is(err, domain.ErrAlreadyExists):
+			s.logger.Error("failed to upgrade guest", zap.Error(err))
+		}
+		return domain.User{}, err
+	}
+
+	details := map[string]string{}
+	if username != "" {
+		details["username"] = username
+	}
+	if email != "" {
+		details["email_set"] = "true"
+	}
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventGuestUpgrade,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+
+	if email != "" {
+		if err := s.sendEmailVerification(ctx, guid, email); err != nil {
+			s.logger.Error("failed to send email verification", zap.String("guid", guid.String()), zap.Error(err))
+		}
+	}
+
+	return s.users.GetUser(ctx, guid)
+}
+
+// upgradeGuestWithPasskey registers a guest that added a passkey, since
+// it can log in again with it.
+func (s *AuthService) upgradeGuestWithPasskey(ctx context.Context, guid uuid.UUID, userAgent, ip string) {
+	err := s.users.UpgradeGuest(ctx, guid, "", "", "", "")
+	if errors.Is(err, domain.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to upgrade guest", zap.String("guid", guid.String()), zap.Error(err))
+		return
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventGuestUpgrade,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"method": "passkey"},
+	})
+}
+
+// PurgeGuests deletes guests that have been inactive for longer than the
+// guest TTL, together with their sessions. It does nothing if the TTL is 0.
+func (s *AuthService) PurgeGuests(ctx context.Context) (int64, error) {
+	ttl := s.settings.Load().guestTTL
+	if ttl == 0 {
+		return 0, nil
+	}
+
+	n, err := s.users.PurgeGuests(ctx, time.Now().Add(-ttl))
+	if err != nil {
+		s.logger.Error("failed to purge guests", zap.Error(err))
+		return 0, err
+	}
+	if n > 0 {
+		s.logger.Info("purged inactive guests", zap.Int64("count", n), zap.Duration("ttl", ttl))
+	}
+	return n, nil
+}
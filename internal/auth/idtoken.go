@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// temporaryIDKeyBits is the size of the key generated when no ID token
+// signing key is configured.
+const temporaryIDKeyBits = 2048
+
+// idTokenKey is an RSA key signing ID tokens, identified by its RFC 7638
+// thumbprint.
+type idTokenKey struct {
+	id  string
+	key *rsa.PrivateKey
+	// pem is the configured key, empty for a temporary one.
+	pem string
+	// validUntil is set once the key is rotated out, it is published until then.
+	validUntil time.Time
+}
+
+// loadIDTokenKey parses the configured key. It returns current if the key
+// did not change or can not be parsed, and a temporary key if none is
+// configured.
+func loadIDTokenKey(data string, current *idTokenKey) *idTokenKey {
+	if current != nil && current.pem == data {
+		return current
+	}
+
+	var (
+		key *rsa.PrivateKey
+		err error
+	)
+	if data == "" {
+		key, err = rsa.GenerateKey(rand.Reader, temporaryIDKeyBits)
+	} else {
+		key, err = parseRSAPrivateKey(data)
+	}
+	if err != nil {
+		return current
+	}
+	return &idTokenKey{id: rsaThumbprint(&key.PublicKey), key: key, pem: data}
+}
+
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// rsaThumbprint computes the JWK thumbprint of key (RFC 7638).
+func rsaThumbprint(key *rsa.PublicKey) string {
+	e, n := jwkEncode(key)
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func jwkEncode(key *rsa.PublicKey) (e, n string) {
+	return base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+}
+
+type idTokenClaims struct {
+	Nonce           string           `json:"nonce,omitempty"`
+	AuthTime        *jwt.NumericDate `json:"auth_time,omitempty"`
+	AMR             []string         `json:"amr,omitempty"`
+	ACR             string           `json:"acr,omitempty"`
+	AuthorizedParty string           `json:"azp"`
+	AccessTokenHash string           `json:"at_hash,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateIDToken signs an ID token for the client in claims. It expires
+// together with the access token it is issued with.
+func (s *JWTService) GenerateIDToken(claims domain.IDClaims) (string, error) {
+	state := s.state.Load()
+	if state.idKey == nil {
+		return "", errors.New("no ID token signing key")
+	}
+
+	now := time.Now()
+
+	var authTime *jwt.NumericDate
+	if !claims.AuthTime.IsZero() {
+		authTime = jwt.NewNumericDate(claims.AuthTime)
+	}
+
+	var atHash string
+	if claims.AccessToken != "" {
+		// the left half of the hash matching the RS256 algorithm (OpenID
+		// Connect Core section 3.1.3.6)
+		sum := sha256.Sum256([]byte(claims.AccessToken))
+		atHash = base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, idTokenClaims{
+		Nonce:           claims.Nonce,
+		AuthTime:        authTime,
+		AMR:             claims.AMR,
+		ACR:             claims.ACR,
+		AuthorizedParty: claims.ClientID,
+		AccessTokenHash: atHash,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    state.issuer,
+			Subject:   claims.GUID.String(),
+			Audience:  jwt.ClaimStrings{claims.ClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(state.accessTTL)),
+		},
+	})
+	token.Header["kid"] = state.idKey.id
+
+	return token.SignedString(state.idKey.key)
+}
+
+// JWKS returns the public keys ID tokens are verified with, the current
+// key first.
+func (s *JWTService) JWKS() []domain.JSONWebKey {
+	state := s.state.Load()
+	if state.idKey == nil {
+		return []domain.JSONWebKey{}
+	}
+
+	keys := []domain.JSONWebKey{jsonWebKey(*state.idKey)}
+	now := time.Now()
+	for _, key := range state.previousIDKeys {
+		if key.validUntil.After(now) {
+			keys = append(keys, jsonWebKey(key))
+		}
+	}
+	return keys
+}
+
+func jsonWebKey(key idTokenKey) domain.JSONWebKey {
+	e, n := jwkEncode(&key.key.PublicKey)
+	return domain.JSONWebKey{Kty: "RSA", Use: "sig", Alg: "RS256", Kid: key.id, N: n, E: e}
+}
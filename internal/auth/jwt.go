@@ -2,38 +2,233 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
 	"golang.org/x/crypto/bcrypt"
 )
 
-type JWTService struct {
-	secret    string
+// signingKey is an HMAC secret identified by the kid header of the tokens it signs.
+type signingKey struct {
+	id     string
+	secret []byte
+	// validUntil is set once the key is rotated out, tokens signed with it
+	// are still accepted until then.
+	validUntil time.Time
+}
+
+func newSigningKey(secret string) signingKey {
+	return signingKey{id: KeyID(secret), secret: []byte(secret)}
+}
+
+// KeyID derives the kid of a signing secret without revealing it.
+func KeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateSigningSecret returns a new random secret suitable for JWT_SECRET.
+func GenerateSigningSecret() (string, error) {
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Token types set in the typ header of tokens that are not access tokens.
+// They keep the tokens from being accepted in place of each other.
+const (
+	emailVerificationType = "email-verification+jwt"
+	mfaChallengeType      = "mfa-challenge+jwt"
+	// clientAccessTokenType marks access tokens of clients (RFC 9068), the
+	// user endpoints of this API do not accept them.
+	clientAccessTokenType = "at+jwt"
+)
+
+// jwtState is swapped as a whole on config reload.
+type jwtState struct {
+	current   signingKey
+	previous  []signingKey
 	accessTTL time.Duration
+	issuer    string
+	// idKey signs ID tokens. previousIDKeys stay in the JWKS until the ID
+	// tokens they signed have expired.
+	idKey          *idTokenKey
+	previousIDKeys []idTokenKey
 }
 
-func NewJwtService(secret string, expiration time.Duration) *JWTService {
-	return &JWTService{secret: secret, accessTTL: expiration}
+type JWTService struct {
+	state atomic.Pointer[jwtState]
 }
 
-func (s *JWTService) GenerateAccessToken(guid uuid.UUID, sessionID string) (string, error) {
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.RegisteredClaims{
-		Subject:   guid.String(),
-		ID:        sessionID,
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.accessTTL)),
+// NewJwtService signs with the secret of cfg and sets its issuer as the
+// iss claim of the tokens. Tokens of another issuer are rejected.
+func NewJwtService(cfg config.Config) *JWTService {
+	s := &JWTService{}
+	s.state.Store(&jwtState{
+		current:   newSigningKey(cfg.JWTSecret),
+		accessTTL: cfg.AccessTTL,
+		issuer:    cfg.TokenIssuer(),
+		idKey:     loadIDTokenKey(cfg.IDTokenSigningKey, nil),
 	})
+	return s
+}
+
+// ApplyConfig swaps in a new secret, ID token key and access token TTL. A
+// replaced key keeps validating the tokens it has signed until they expire.
+func (s *JWTService) ApplyConfig(cfg config.Config) {
+	old := s.state.Load()
+	next := &jwtState{current: old.current, accessTTL: cfg.AccessTTL, issuer: cfg.TokenIssuer(), idKey: old.idKey}
+
+	now := time.Now()
+	for _, key := range old.previous {
+		if key.validUntil.After(now) {
+			next.previous = append(next.previous, key)
+		}
+	}
+
+	if key := newSigningKey(cfg.JWTSecret); key.id != old.current.id {
+		retired := old.current
+		retired.validUntil = now.Add(old.accessTTL)
+		next.previous = append(next.previous, retired)
+		next.current = key
+	}
 
-	accesTokenString, err := accessToken.SignedString([]byte(s.secret))
+	for _, key := range old.previousIDKeys {
+		if key.validUntil.After(now) {
+			next.previousIDKeys = append(next.previousIDKeys, key)
+		}
+	}
+	if key := loadIDTokenKey(cfg.IDTokenSigningKey, old.idKey); key != old.idKey {
+		if old.idKey != nil {
+			retired := *old.idKey
+			retired.validUntil = now.Add(old.accessTTL)
+			next.previousIDKeys = append(next.previousIDKeys, retired)
+		}
+		next.idKey = key
+	}
+
+	s.state.Store(next)
+}
+
+type accessClaims struct {
+	AMR         []string         `json:"amr,omitempty"`
+	ACR         string           `json:"acr,omitempty"`
+	AuthTime    *jwt.NumericDate `json:"auth_time,omitempty"`
+	Roles       []string         `json:"roles,omitempty"`
+	Permissions []string         `json:"permissions,omitempty"`
+	Scope       string           `json:"scope,omitempty"`
+	OrgID       string           `json:"org_id,omitempty"`
+	ClientID    string           `json:"client_id,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (s *JWTService) GenerateAccessToken(claims domain.AccessClaims) (string, error) {
+	state := s.state.Load()
+
+	expiresAt := claims.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(state.accessTTL)
+	}
+
+	var authTime *jwt.NumericDate
+	if !claims.AuthTime.IsZero() {
+		authTime = jwt.NewNumericDate(claims.AuthTime)
+	}
+
+	var orgID string
+	if claims.OrgID != nil {
+		orgID = claims.OrgID.String()
+	}
+
+	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS512, accessClaims{
+		AMR:         claims.AMR,
+		ACR:         claims.ACR,
+		AuthTime:    authTime,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+		Scope:       domain.FormatScope(claims.Scope),
+		OrgID:       orgID,
+		ClientID:    claims.ClientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    state.issuer,
+			Subject:   claims.GUID.String(),
+			ID:        claims.SessionID,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	accessToken.Header["kid"] = state.current.id
+
+	accesTokenString, err := accessToken.SignedString(state.current.secret)
 	if err != nil {
 		return "", err
 	}
 	return accesTokenString, nil
 }
 
+// actorClaim is the act claim of RFC 8693 section 4.1.
+type actorClaim struct {
+	Subject string `json:"sub"`
+}
+
+type clientAccessClaims struct {
+	ClientID string      `json:"client_id"`
+	Scope    string      `json:"scope,omitempty"`
+	Actor    *actorClaim `json:"act,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (s *JWTService) GenerateClientAccessToken(claims domain.ClientClaims) (string, time.Time, error) {
+	state := s.state.Load()
+
+	ttl := state.accessTTL
+	if claims.TTL > 0 && claims.TTL < ttl {
+		ttl = claims.TTL
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	subject := claims.Subject
+	if subject == "" {
+		subject = claims.ClientID
+	}
+	var actor *actorClaim
+	if claims.Actor != "" {
+		actor = &actorClaim{Subject: claims.Actor}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, clientAccessClaims{
+		ClientID: claims.ClientID,
+		Scope:    domain.FormatScope(claims.Scope),
+		Actor:    actor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    state.issuer,
+			Subject:   subject,
+			Audience:  claims.Audience,
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	token.Header["typ"] = clientAccessTokenType
+	token.Header["kid"] = state.current.id
+
+	signed, err := token.SignedString(state.current.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
 func (s *JWTService) GenerateRefreshToken() (string, error) {
 	refreshTokenBytes := make([]byte, 32)
 	if _, err := rand.Read(refreshTokenBytes); err != nil {
@@ -44,10 +239,7 @@ func (s *JWTService) GenerateRefreshToken() (string, error) {
 
 func (s *JWTService) ValidateAccessToken(token string) (map[string]any, error) {
 	parsed, err := jwt.Parse(token, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
-		}
-		return []byte(s.secret), nil
+		return s.keyFor(t, "JWT")
 	})
 	if err != nil {
 		return nil, err
@@ -63,9 +255,142 @@ func (s *JWTService) ValidateAccessToken(token string) (map[string]any, error) {
 		return nil, fmt.Errorf("invalid claims")
 	}
 
+	iss, _ := claims["iss"].(string)
+	if err := s.checkIssuer(iss); err != nil {
+		return nil, err
+	}
+
 	return claims, nil
 }
 
+// GenerateEmailVerificationToken signs a token proving that its holder
+// received mail sent to email. It is used in verification links.
+func (s *JWTService) GenerateEmailVerificationToken(guid uuid.UUID, email string, ttl time.Duration) (string, error) {
+	state := s.state.Load()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, emailVerificationClaims{
+		Email: email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    state.issuer,
+			Subject:   guid.String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	})
+	token.Header["typ"] = emailVerificationType
+	token.Header["kid"] = state.current.id
+
+	return token.SignedString(state.current.secret)
+}
+
+func (s *JWTService) ValidateEmailVerificationToken(token string) (uuid.UUID, string, error) {
+	var claims emailVerificationClaims
+	parsed, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		return s.keyFor(t, emailVerificationType)
+	})
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if !parsed.Valid || claims.Email == "" {
+		return uuid.Nil, "", fmt.Errorf("invalid token")
+	}
+	if err := s.checkIssuer(claims.Issuer); err != nil {
+		return uuid.Nil, "", err
+	}
+
+	guid, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid subject: %w", err)
+	}
+	return guid, claims.Email, nil
+}
+
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// GenerateMFAChallenge signs the methods that succeeded so far. The
+// challenge is only accepted by the second factor step, not as an access token.
+func (s *JWTService) GenerateMFAChallenge(guid uuid.UUID, amr []string, ttl time.Duration) (string, error) {
+	state := s.state.Load()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, accessClaims{
+		AMR: amr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    state.issuer,
+			Subject:   guid.String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	})
+	token.Header["typ"] = mfaChallengeType
+	token.Header["kid"] = state.current.id
+
+	return token.SignedString(state.current.secret)
+}
+
+func (s *JWTService) ValidateMFAChallenge(token string) (uuid.UUID, []string, error) {
+	var claims accessClaims
+	parsed, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		return s.keyFor(t, mfaChallengeType)
+	})
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	if !parsed.Valid {
+		return uuid.Nil, nil, fmt.Errorf("invalid token")
+	}
+	if err := s.checkIssuer(claims.Issuer); err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	guid, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("invalid subject: %w", err)
+	}
+	return guid, claims.AMR, nil
+}
+
+// keyFor checks the algorithm and token type and returns the key to verify t with.
+func (s *JWTService) keyFor(t *jwt.Token, typ string) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+	}
+	if got, _ := t.Header["typ"].(string); got != typ {
+		return nil, fmt.Errorf("unexpected token type %q", got)
+	}
+	return s.verificationKey(t)
+}
+
+// checkIssuer rejects tokens issued by another realm. Tokens signed before
+// the iss claim was introduced carry none, every realm has its own key so
+// the signature alone ties them to this one.
+func (s *JWTService) checkIssuer(iss string) error {
+	if iss != "" && iss != s.state.Load().issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	return nil
+}
+
+// verificationKey picks the key named by the kid header. Tokens issued
+// before key ids were introduced carry no kid and are checked against the
+// current key.
+func (s *JWTService) verificationKey(t *jwt.Token) ([]byte, error) {
+	state := s.state.Load()
+
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" || kid == state.current.id {
+		return state.current.secret, nil
+	}
+
+	now := time.Now()
+	for _, key := range state.previous {
+		if key.id == kid && key.validUntil.After(now) {
+			return key.secret, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
 func (s *JWTService) HashRefreshToken(token string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
 	if err != nil {
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// realmJWT returns the JWTService of a realm issuing as issuer.
+func realmJWT(issuer, secret string) *JWTService {
+	cfg := testConfig()
+	cfg.Issuer = issuer
+	cfg.JWTSecret = secret
+	return NewJwtService(cfg)
+}
+
+func TestJWTServiceRejectsTokensOfAnotherIssuer(t *testing.T) {
+	// realms must not share a secret, the issuer still tells them apart
+	// if they do
+	const secret = "shared-signing-secret-with-enough-entropy-0123456789"
+	realmA := realmJWT("https://a.example.com", secret)
+	realmB := realmJWT("https://b.example.com", secret)
+	guid := uuid.New()
+
+	access, err := realmA.GenerateAccessToken(domain.AccessClaims{GUID: guid, SessionID: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := realmA.ValidateAccessToken(access); err != nil {
+		t.Fatalf("realm A rejects its own token: %v", err)
+	}
+	if _, err := realmB.ValidateAccessToken(access); err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("realm B ValidateAccessToken = %v, want an issuer error", err)
+	}
+
+	verification, err := realmA.GenerateEmailVerificationToken(guid, "user@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateEmailVerificationToken: %v", err)
+	}
+	if _, _, err := realmB.ValidateEmailVerificationToken(verification); err == nil {
+		t.Error("realm B accepted an email verification token of realm A")
+	}
+
+	challenge, err := realmA.GenerateMFAChallenge(guid, []string{domain.AMRPassword}, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateMFAChallenge: %v", err)
+	}
+	if _, _, err := realmB.ValidateMFAChallenge(challenge); err == nil {
+		t.Error("realm B accepted an MFA challenge of realm A")
+	}
+}
+
+func TestJWTServiceRejectsTokensOfAnotherSecret(t *testing.T) {
+	realmA := realmJWT("https://auth.example.com", "realm-a-signing-secret-with-enough-entropy-0123")
+	realmB := realmJWT("https://auth.example.com", "realm-b-signing-secret-with-enough-entropy-4567")
+
+	access, err := realmA.GenerateAccessToken(domain.AccessClaims{GUID: uuid.New(), SessionID: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := realmB.ValidateAccessToken(access); err == nil {
+		t.Error("realm B accepted an access token signed with the secret of realm A")
+	}
+}
+
+func TestCheckIssuer(t *testing.T) {
+	s := realmJWT("https://a.example.com", "realm-a-signing-secret-with-enough-entropy-0123")
+
+	for _, tc := range []struct {
+		iss     string
+		wantErr bool
+	}{
+		{iss: "https://a.example.com"},
+		// tokens issued before the iss claim was introduced
+		{iss: ""},
+		{iss: "https://b.example.com", wantErr: true},
+		{iss: "https://a.example.com/", wantErr: true},
+	} {
+		if err := s.checkIssuer(tc.iss); (err != nil) != tc.wantErr {
+			t.Errorf("checkIssuer(%q) = %v, want error %v", tc.iss, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// purgeInterval is how often PurgePeriodically looks for expired guests,
+// deleted users and expired authorization codes.
+const purgeInterval = time.Hour
+
+// setUserStatus changes the status of a user on behalf of actor. The
+// repository revokes the sessions together with the change, the
+// revocation is recorded here.
+func (s *AuthService) setUserStatus(ctx context.Context, actor string, guid uuid.UUID, status domain.UserStatus, reason string, lockedUntil *time.Time, action string) error {
+	if err := s.users.SetUserStatus(ctx, guid, status, reason, lockedUntil); err != nil {
+		s.logger.Error("failed to set user status", zap.String("status", string(status)), zap.Error(err))
+		return err
+	}
+
+	details := map[string]string{"status": string(status)}
+	if reason != "" {
+		details["reason"] = reason
+	}
+	if status == domain.UserLocked && lockedUntil != nil {
+		details["locked_until"] = lockedUntil.UTC().Format(time.RFC3339)
+	}
+	s.recordAdminAction(ctx, actor, guid, action, details)
+
+	if status != domain.UserActive {
+		s.recordAudit(ctx, domain.AuditEntry{
+			GUID:      guid,
+			EventType: domain.AuditEventRevoke,
+			Actor:     actor,
+			Details:   map[string]string{"reason": "user " + string(status)},
+		})
+	}
+	return nil
+}
+
+// PurgeDeletedUsers removes users whose deletion is older than the
+// retention window.
+func (s *AuthService) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	retention := s.settings.Load().deletedUserRetention
+
+	n, err := s.users.PurgeDeletedUsers(ctx, time.Now().Add(-retention))
+	if err != nil {
+		s.logger.Error("failed to purge deleted users", zap.Error(err))
+		return 0, err
+	}
+	if n > 0 {
+		s.logger.Info("purged deleted users", zap.Int64("count", n), zap.Duration("retention", retention))
+	}
+	return n, nil
+}
+
+// purgePeriodically runs the purges every purgeInterval until ctx is done,
+// they log their failures themselves.
+func purgePeriodically(ctx context.Context, purges ...func(context.Context) (int64, error)) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, purge := range purges {
+			purge(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap"
+)
+
+const (
+	totpPeriod = 30
+	// totpSkew is the number of time steps before and after the current one
+	// that are accepted, to allow for clock drift.
+	totpSkew = 1
+	// maxTOTPFailures consecutive wrong codes lock TOTP until a recovery
+	// code is used or an admin resets MFA.
+	maxTOTPFailures = 10
+
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+	qrCodeSize        = 256
+)
+
+var (
+	ErrInvalidMFACode = errors.New("invalid mfa code")
+	ErrTOTPLocked     = errors.New("too many wrong codes, use a recovery code")
+)
+
+// MFARequiredError is returned by Login when the password was correct but
+// the user enrolled a second factor. Challenge is exchanged for tokens
+// together with the second factor.
+type MFARequiredError struct {
+	Challenge string
+	ExpiresIn time.Duration
+}
+
+func (e *MFARequiredError) Error() string {
+	return "mfa required"
+}
+
+// TOTPEnrollment is what an authenticator app needs to add the account.
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+	QRCode []byte
+}
+
+// completeLogin issues tokens after a successful first factor, or an MFA
+// challenge if the user has a confirmed second factor.
+func (s *AuthService) completeLogin(ctx context.Context, guid uuid.UUID, amr []string, userAgent, ip string) (domain.TokenPair, error) {
+	if err := s.requireMFA(ctx, guid, amr); err != nil {
+		return domain.TokenPair{}, err
+	}
+	return s.authorize(ctx, &guid, amr, nil, userAgent, ip)
+}
+
+// requireMFA returns an MFARequiredError with a challenge for the methods
+// in amr if the user has a confirmed second factor.
+func (s *AuthService) requireMFA(ctx context.Context, guid uuid.UUID, amr []string) error {
+	cred, err := s.mfa.GetTOTP(ctx, guid)
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		s.logger.Error("failed to get totp credential", zap.Error(err))
+		return err
+	}
+	if err == nil && cred.Confirmed() {
+		challenge, err := s.tokens.GenerateMFAChallenge(guid, amr, mfaChallengeTTL)
+		if err != nil {
+			s.logger.Error("failed to generate mfa challenge", zap.Error(err))
+			return err
+		}
+		return &MFARequiredError{Challenge: challenge, ExpiresIn: mfaChallengeTTL}
+	}
+	return nil
+}
+
+// CompleteMFA exchanges an MFA challenge and either a TOTP code or a
+// recovery code for a token pair.
+func (s *AuthService) CompleteMFA(ctx context.Context, challenge, code, recoveryCode, userAgent, ip string) (domain.TokenPair, error) {
+	guid, amr, err := s.AuthenticateMFA(ctx, challenge, code, recoveryCode, userAgent, ip)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+	return s.authorize(ctx, &guid, amr, nil, userAgent, ip)
+}
+
+// AuthenticateMFA checks the second factor for an MFA challenge without
+// starting a session and returns the user and all methods used.
+func (s *AuthService) AuthenticateMFA(ctx context.Context, challenge, code, recoveryCode, userAgent, ip string) (uuid.UUID, []string, error) {
+	guid, amr, err := s.tokens.ValidateMFAChallenge(challenge)
+	if err != nil {
+		s.logger.Warn("invalid mfa challenge", zap.Error(err))
+		return uuid.Nil, nil, ErrInvalidMFACode
+	}
+
+	if recoveryCode != "" {
+		err = s.useRecoveryCode(ctx, guid, recoveryCode)
+	} else {
+		err = s.useTOTPCode(ctx, guid, code)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrTOTPLocked) {
+			s.recordAudit(ctx, domain.AuditEntry{
+				GUID:      guid,
+				EventType: domain.AuditEventLoginFailed,
+				Actor:     guid.String(),
+				IP:        ip,
+				UserAgent: userAgent,
+				Details:   map[string]string{"reason": err.Error()},
+			})
+		}
+		return uuid.Nil, nil, err
+	}
+
+	return guid, append(amr, domain.AMROTP), nil
+}
+
+// useTOTPCode checks a code of a confirmed credential. Every code is
+// accepted at most once.
+func (s *AuthService) useTOTPCode(ctx context.Context, guid uuid.UUID, code string) error {
+	cred, err := s.mfa.GetTOTP(ctx, guid)
+	if errors.Is(err, domain.ErrNotFound) || (err == nil && !cred.Confirmed()) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		s.logger.Error("failed to get totp credential", zap.Error(err))
+		return err
+	}
+	if cred.FailedAttempts >= maxTOTPFailures {
+		return ErrTOTPLocked
+	}
+
+	step, ok := matchTOTPCode(cred.Secret, code, s.now())
+	if !ok {
+		if _, err := s.mfa.RecordTOTPFailure(ctx, guid); err != nil {
+			s.logger.Error("failed to record totp failure", zap.Error(err))
+		}
+		return ErrInvalidMFACode
+	}
+
+	err = s.mfa.UseTOTPStep(ctx, guid, step)
+	if errors.Is(err, domain.ErrNotFound) {
+		s.logger.Warn("replayed totp code", zap.String("guid", guid.String()))
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		s.logger.Error("failed to use totp code", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s *AuthService) useRecoveryCode(ctx context.Context, guid uuid.UUID, code string) error {
+	err := s.mfa.UseRecoveryCode(ctx, guid, hashUserCode(guid, normalizeRecoveryCode(code)))
+	if errors.Is(err, domain.ErrNotFound) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		s.logger.Error("failed to use recovery code", zap.Error(err))
+		return err
+	}
+
+	if left, err := s.mfa.CountRecoveryCodes(ctx, guid); err == nil && left == 0 {
+		s.logger.Warn("user used the last recovery code", zap.String("guid", guid.String()))
+	}
+	return nil
+}
+
+// EnrollTOTP starts a TOTP enrolment and returns the secret as otpauth URI
+// and QR code. It only takes effect once confirmed with ConfirmTOTP.
+func (s *AuthService) EnrollTOTP(ctx context.Context, guid uuid.UUID) (TOTPEnrollment, error) {
+	user, err := s.users.GetUser(ctx, guid)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+	if account == "" {
+		account = guid.String()
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      s.settings.Load().mfaIssuer,
+		AccountName: account,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		s.logger.Error("failed to generate totp secret", zap.Error(err))
+		return TOTPEnrollment{}, err
+	}
+
+	err = s.mfa.StoreTOTP(ctx, domain.TOTPCredential{
+		GUID:      guid,
+		Secret:    key.Secret(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		if !errors.Is(err, domain.ErrAlreadyExists) {
+			s.logger.Error("failed to store totp credential", zap.Error(err))
+		}
+		return TOTPEnrollment{}, err
+	}
+
+	img, err := key.Image(qrCodeSize, qrCodeSize)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{Secret: key.Secret(), URI: key.URL(), QRCode: qr.Bytes()}, nil
+}
+
+// ConfirmTOTP completes the enrolment with the first code from the
+// authenticator and returns the recovery codes. They are only stored
+// hashed and can not be shown again.
+func (s *AuthService) ConfirmTOTP(ctx context.Context, guid uuid.UUID, code, userAgent, ip string) ([]string, error) {
+	cred, err := s.mfa.GetTOTP(ctx, guid)
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil, domain.ErrMFANotEnrolled
+	}
+	if err != nil {
+		s.logger.Error("failed to get totp credential", zap.Error(err))
+		return nil, err
+	}
+	if cred.Confirmed() {
+		return nil, domain.ErrAlreadyExists
+	}
+
+	step, ok := matchTOTPCode(cred.Secret, code, s.now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes(guid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.mfa.ConfirmTOTP(ctx, guid, step, hashes)
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil, ErrInvalidMFACode
+	}
+	if err != nil {
+		s.logger.Error("failed to confirm totp credential", zap.Error(err))
+		return nil, err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventMFAEnroll,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"method": "totp"},
+	})
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code.
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, guid uuid.UUID, code, userAgent, ip string) ([]string, error) {
+	if err := s.useTOTPCode(ctx, guid, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes(guid)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfa.ReplaceRecoveryCodes(ctx, guid, hashes); err != nil {
+		s.logger.Error("failed to replace recovery codes", zap.Error(err))
+		return nil, err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventMFAEnroll,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"method": "recovery_codes"},
+	})
+	return codes, nil
+}
+
+// matchTOTPCode returns the time step code belongs to, if it matches any
+// step within the allowed skew.
+func matchTOTPCode(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns recovery codes formatted for display and their hashes.
+func newRecoveryCodes(guid uuid.UUID) ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		hashes[i] = hashUserCode(guid, raw)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ToLower(code)
+}
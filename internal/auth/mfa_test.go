@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// testTOTPTime is the start of a time step.
+var testTOTPTime = time.Unix(1_700_000_010, 0)
+
+func totpCode(t *testing.T, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.GenerateCodeCustom(testTOTPSecret, at, totp.ValidateOpts{
+		Period:    totpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatalf("GenerateCodeCustom: %v", err)
+	}
+	return code
+}
+
+func TestMatchTOTPCode(t *testing.T) {
+	step := testTOTPTime.Unix() / totpPeriod
+
+	for _, tc := range []struct {
+		name     string
+		offset   int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", offset: 0, wantStep: step, wantOK: true},
+		{name: "previous step", offset: -1, wantStep: step - 1, wantOK: true},
+		{name: "next step", offset: 1, wantStep: step + 1, wantOK: true},
+		{name: "beyond the skew in the past", offset: -2},
+		{name: "beyond the skew in the future", offset: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code := totpCode(t, testTOTPTime.Add(time.Duration(tc.offset*totpPeriod)*time.Second))
+
+			got, ok := matchTOTPCode(testTOTPSecret, code, testTOTPTime)
+			if ok != tc.wantOK || got != tc.wantStep {
+				t.Errorf("matchTOTPCode = %d, %v, want %d, %v", got, ok, tc.wantStep, tc.wantOK)
+			}
+		})
+	}
+
+	// the last second of a step still matches it
+	if got, ok := matchTOTPCode(testTOTPSecret, " "+totpCode(t, testTOTPTime)+"\n", testTOTPTime.Add(29*time.Second)); !ok || got != step {
+		t.Errorf("code with surrounding space = %d, %v, want %d", got, ok, step)
+	}
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := matchTOTPCode(testTOTPSecret, code, testTOTPTime); ok {
+			t.Errorf("matchTOTPCode(%q) matched", code)
+		}
+	}
+}
+
+type mfaFixture struct {
+	s     *AuthService
+	mfa   *fakeMFA
+	audit *fakeAudit
+	guid  uuid.UUID
+	clock time.Time
+}
+
+// newMFAFixture enrolls a user with testTOTPSecret and confirms it with
+// the code of the step before testTOTPTime.
+func newMFAFixture(t *testing.T) (*mfaFixture, []string) {
+	t.Helper()
+
+	f := &mfaFixture{mfa: &fakeMFA{}, audit: &fakeAudit{}, guid: uuid.New(), clock: testTOTPTime.Add(-totpPeriod * time.Second)}
+	f.s = &AuthService{mfa: f.mfa, audit: f.audit, logger: zap.NewNop(), now: func() time.Time { return f.clock }}
+
+	err := f.mfa.StoreTOTP(context.Background(), domain.TOTPCredential{GUID: f.guid, Secret: testTOTPSecret, CreatedAt: f.clock})
+	if err != nil {
+		t.Fatalf("StoreTOTP: %v", err)
+	}
+	codes, err := f.s.ConfirmTOTP(context.Background(), f.guid, totpCode(t, f.clock), "test-agent", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	f.clock = testTOTPTime
+	return f, codes
+}
+
+func (f *mfaFixture) use(code string) error {
+	return f.s.useTOTPCode(context.Background(), f.guid, code)
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	f, codes := newMFAFixture(t)
+
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("ConfirmTOTP returned %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	if events := f.audit.events(); len(events) != 1 || events[0] != domain.AuditEventMFAEnroll {
+		t.Errorf("audit events = %v, want one %s", events, domain.AuditEventMFAEnroll)
+	}
+	if _, err := f.s.ConfirmTOTP(context.Background(), f.guid, totpCode(t, f.clock), "test-agent", "192.0.2.1"); !errors.Is(err, domain.ErrAlreadyExists) {
+		t.Errorf("second ConfirmTOTP = %v, want ErrAlreadyExists", err)
+	}
+
+	// the code the enrolment was confirmed with is spent
+	f.clock = testTOTPTime.Add(-totpPeriod * time.Second)
+	if err := f.use(totpCode(t, f.clock)); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("code of the confirmation = %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestTOTPCodesWorkOnce(t *testing.T) {
+	f, _ := newMFAFixture(t)
+
+	code := totpCode(t, testTOTPTime)
+	if err := f.use(code); err != nil {
+		t.Fatalf("useTOTPCode: %v", err)
+	}
+	if err := f.use(code); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("replayed code = %v, want ErrInvalidMFACode", err)
+	}
+
+	// a code of the next step is fine, the one before it is not anymore
+	// although it is still within the skew
+	next := totpCode(t, testTOTPTime.Add(totpPeriod*time.Second))
+	if err := f.use(next); err != nil {
+		t.Errorf("code of the next step = %v", err)
+	}
+	f.clock = testTOTPTime.Add(totpPeriod * time.Second)
+	if err := f.use(code); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("code older than the last used one = %v, want ErrInvalidMFACode", err)
+	}
+
+	// once the clock moved on, a new code works
+	f.clock = testTOTPTime.Add(2 * totpPeriod * time.Second)
+	if err := f.use(totpCode(t, f.clock)); err != nil {
+		t.Errorf("code of a later step = %v", err)
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	f, codes := newMFAFixture(t)
+
+	wrong := totpCode(t, testTOTPTime.Add(-10*totpPeriod*time.Second))
+	for i := 0; i < maxTOTPFailures; i++ {
+		if err := f.use(wrong); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("wrong code %d = %v, want ErrInvalidMFACode", i+1, err)
+		}
+	}
+	if err := f.use(totpCode(t, f.clock)); !errors.Is(err, ErrTOTPLocked) {
+		t.Fatalf("correct code after %d failures = %v, want ErrTOTPLocked", maxTOTPFailures, err)
+	}
+
+	// a recovery code unlocks TOTP again
+	if err := f.s.useRecoveryCode(context.Background(), f.guid, codes[0]); err != nil {
+		t.Fatalf("useRecoveryCode: %v", err)
+	}
+	if err := f.use(totpCode(t, f.clock)); err != nil {
+		t.Errorf("correct code after a recovery code = %v", err)
+	}
+}
+
+func TestTOTPSuccessResetsFailures(t *testing.T) {
+	f, _ := newMFAFixture(t)
+
+	wrong := totpCode(t, testTOTPTime.Add(-10*totpPeriod*time.Second))
+	for i := 0; i < maxTOTPFailures-1; i++ {
+		f.use(wrong)
+	}
+	if err := f.use(totpCode(t, f.clock)); err != nil {
+		t.Fatalf("correct code after %d failures = %v", maxTOTPFailures-1, err)
+	}
+	if err := f.use(wrong); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("wrong code after a success = %v, want ErrInvalidMFACode, not locked", err)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	f, codes := newMFAFixture(t)
+	ctx := context.Background()
+
+	// codes are accepted without dashes and in upper case
+	if err := f.s.useRecoveryCode(ctx, f.guid, strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))); err != nil {
+		t.Fatalf("useRecoveryCode: %v", err)
+	}
+	if err := f.s.useRecoveryCode(ctx, f.guid, codes[0]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("used recovery code = %v, want ErrInvalidMFACode", err)
+	}
+	if left, _ := f.mfa.CountRecoveryCodes(ctx, f.guid); left != recoveryCodeCount-1 {
+		t.Errorf("%d recovery codes left, want %d", left, recoveryCodeCount-1)
+	}
+
+	// codes are bound to their user
+	other := *f
+	other.guid = uuid.New()
+	if err := other.s.useRecoveryCode(ctx, other.guid, codes[1]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("recovery code of another user = %v, want ErrInvalidMFACode", err)
+	}
+	if err := f.s.useRecoveryCode(ctx, f.guid, "aaaa-bbbb-cccc-dddd"); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("unknown recovery code = %v, want ErrInvalidMFACode", err)
+	}
+}
@@ -0,0 +1,509 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	// clientIDPrefix keeps client IDs apart from user GUIDs in the sub claim.
+	clientIDPrefix = "client_"
+	// ClientAssertionType is the client_assertion_type of private_key_jwt
+	// (RFC 7523 section 2.2).
+	ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// maxAssertionLifetime bounds how long a client assertion may be valid,
+	// its jti has to be remembered that long.
+	maxAssertionLifetime = 10 * time.Minute
+)
+
+// Error codes of the token endpoint (RFC 6749 section 5.2, RFC 8707).
+const (
+	OAuthInvalidRequest       = "invalid_request"
+	OAuthInvalidClient        = "invalid_client"
+	OAuthInvalidGrant         = "invalid_grant"
+	OAuthUnauthorizedClient   = "unauthorized_client"
+	OAuthUnsupportedGrantType = "unsupported_grant_type"
+	OAuthInvalidScope         = "invalid_scope"
+	OAuthInvalidTarget        = "invalid_target"
+)
+
+// OAuthError is an error the token endpoint reports to the client.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) error {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// errInvalidClient is returned for every failed client authentication,
+// the reason is only logged.
+var errInvalidClient = oauthError(OAuthInvalidClient, "client authentication failed")
+
+// supportedGrantTypes are the grants clients can be registered for.
+var supportedGrantTypes = []string{domain.GrantAuthorizationCode, domain.GrantClientCredentials, domain.GrantDeviceCode, domain.GrantRefreshToken, domain.GrantTokenExchange}
+
+// scopeTokenPattern is the scope-token of RFC 6749 section 3.3.
+var scopeTokenPattern = regexp.MustCompile(`^[\x21\x23-\x5B\x5D-\x7E]{1,128}$`)
+
+type oauthSettings struct {
+	endpoints Endpoints
+	accessTTL time.Duration
+}
+
+// Endpoints are the URLs OpenID Connect discovery publishes.
+type Endpoints struct {
+	Issuer                      string
+	AuthorizationEndpoint       string
+	TokenEndpoint               string
+	UserinfoEndpoint            string
+	JWKSURI                     string
+	DeviceAuthorizationEndpoint string
+	// VerificationURI is where users enter the user codes of devices.
+	VerificationURI string
+}
+
+// OAuthService registers OAuth clients and runs the grants of the token
+// endpoint. Tokens are signed by the JWTService of the AuthService.
+type OAuthService struct {
+	auth    *AuthService
+	clients domain.OAuthClientRepository
+	logger  *zap.Logger
+
+	settings atomic.Pointer[oauthSettings]
+}
+
+func NewOAuthService(auth *AuthService, clients domain.OAuthClientRepository, cfg config.Config, logger *zap.Logger) *OAuthService {
+	o := &OAuthService{
+		auth:    auth,
+		clients: clients,
+		logger:  logger,
+	}
+	o.ApplyConfig(cfg)
+	return o
+}
+
+// ApplyConfig swaps in the issuer and the endpoint URLs, client
+// assertions are addressed to the token endpoint.
+func (o *OAuthService) ApplyConfig(cfg config.Config) {
+	host := strings.TrimRight(cfg.PublicHost, "/")
+	o.settings.Store(&oauthSettings{
+		accessTTL: cfg.AccessTTL,
+		endpoints: Endpoints{
+			Issuer:                      cfg.TokenIssuer(),
+			AuthorizationEndpoint:       host + "/oauth/authorize",
+			TokenEndpoint:               host + "/oauth/token",
+			UserinfoEndpoint:            host + "/oauth/userinfo",
+			JWKSURI:                     host + "/oauth/jwks",
+			DeviceAuthorizationEndpoint: host + "/oauth/device_authorization",
+			VerificationURI:             host + "/oauth/device",
+		},
+	})
+}
+
+// Endpoints returns the URLs of the OAuth and OpenID Connect endpoints.
+func (o *OAuthService) Endpoints() Endpoints {
+	return o.settings.Load().endpoints
+}
+
+// JWKS returns the keys ID tokens are verified with.
+func (o *OAuthService) JWKS() []domain.JSONWebKey {
+	return o.auth.tokens.JWKS()
+}
+
+// OAuthTokens is the result of a grant.
+type OAuthTokens struct {
+	AccessToken string
+	// RefreshToken is only issued for sessions of users.
+	RefreshToken string
+	// IDToken is issued for sessions granted the openid scope.
+	IDToken string
+	// IssuedTokenType is set by token exchange.
+	IssuedTokenType string
+	ExpiresAt       time.Time
+	Scope           []string
+}
+
+// ClientAuthentication carries the credentials a client presented at the
+// token endpoint.
+type ClientAuthentication struct {
+	ClientID     string
+	ClientSecret string
+	// Basic is set when the credentials came in the Authorization header.
+	Basic         bool
+	AssertionType string
+	Assertion     string
+}
+
+// AuthenticateClient checks the credentials against the registered
+// authentication method of the client.
+func (o *OAuthService) AuthenticateClient(ctx context.Context, creds ClientAuthentication) (domain.OAuthClient, error) {
+	if creds.Assertion != "" || creds.AssertionType != "" {
+		if creds.ClientSecret != "" {
+			return domain.OAuthClient{}, oauthError(OAuthInvalidRequest, "more than one client authentication method used")
+		}
+		return o.authenticateAssertion(ctx, creds)
+	}
+	if creds.ClientID == "" {
+		return domain.OAuthClient{}, errInvalidClient
+	}
+
+	client, err := o.getClient(ctx, creds.ClientID)
+	if err != nil {
+		return domain.OAuthClient{}, err
+	}
+
+	method := domain.ClientSecretPost
+	switch {
+	case creds.Basic:
+		method = domain.ClientSecretBasic
+	case creds.ClientSecret == "":
+		method = domain.ClientAuthNone
+	}
+	if client.AuthMethod != method {
+		o.logger.Info("client used another authentication method", zap.String("client_id", client.ID), zap.String("method", method))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+	if client.Public() {
+		return client, nil
+	}
+	if creds.ClientSecret == "" || subtle.ConstantTimeCompare([]byte(hashOpaqueToken(creds.ClientSecret)), []byte(client.SecretHash)) != 1 {
+		o.logger.Info("invalid client secret", zap.String("client_id", client.ID))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+	return client, nil
+}
+
+func (o *OAuthService) getClient(ctx context.Context, id string) (domain.OAuthClient, error) {
+	client, err := o.clients.GetClient(ctx, id)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			o.logger.Info("unknown client", zap.String("client_id", id))
+			return domain.OAuthClient{}, errInvalidClient
+		}
+		o.logger.Error("failed to get client", zap.Error(err))
+		return domain.OAuthClient{}, err
+	}
+	return client, nil
+}
+
+// authenticateAssertion verifies a private_key_jwt assertion (RFC 7523
+// section 3): signed by the key of the client, issued by and about the
+// client, addressed to this server and not seen before.
+func (o *OAuthService) authenticateAssertion(ctx context.Context, creds ClientAuthentication) (domain.OAuthClient, error) {
+	if creds.AssertionType != ClientAssertionType {
+		return domain.OAuthClient{}, oauthError(OAuthInvalidRequest, "unsupported client_assertion_type")
+	}
+
+	var unverified jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(creds.Assertion, &unverified); err != nil || unverified.Subject == "" {
+		return domain.OAuthClient{}, errInvalidClient
+	}
+	if creds.ClientID != "" && creds.ClientID != unverified.Subject {
+		return domain.OAuthClient{}, errInvalidClient
+	}
+
+	client, err := o.getClient(ctx, unverified.Subject)
+	if err != nil {
+		return domain.OAuthClient{}, err
+	}
+	if client.AuthMethod != domain.PrivateKeyJWT {
+		o.logger.Info("client used another authentication method", zap.String("client_id", client.ID), zap.String("method", domain.PrivateKeyJWT))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+
+	key, methods, err := parseClientKey(client.PublicKey)
+	if err != nil {
+		o.logger.Error("invalid client key", zap.String("client_id", client.ID), zap.Error(err))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+
+	var claims jwt.RegisteredClaims
+	_, err = jwt.ParseWithClaims(creds.Assertion, &claims, func(*jwt.Token) (any, error) {
+		return key, nil
+	}, jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithIssuer(client.ID), jwt.WithSubject(client.ID))
+	if err != nil {
+		o.logger.Info("invalid client assertion", zap.String("client_id", client.ID), zap.Error(err))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+
+	settings := o.settings.Load()
+	if !slices.Contains(claims.Audience, settings.endpoints.TokenEndpoint) && !slices.Contains(claims.Audience, settings.endpoints.Issuer) {
+		o.logger.Info("client assertion for another audience", zap.String("client_id", client.ID), zap.Strings("aud", claims.Audience))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+	if claims.ID == "" || time.Until(claims.ExpiresAt.Time) > maxAssertionLifetime {
+		o.logger.Info("client assertion without jti or valid for too long", zap.String("client_id", client.ID))
+		return domain.OAuthClient{}, errInvalidClient
+	}
+
+	if err := o.clients.UseClientAssertion(ctx, client.ID, claims.ID, claims.ExpiresAt.Time); err != nil {
+		if errors.Is(err, domain.ErrAlreadyExists) {
+			o.logger.Warn("client assertion replayed", zap.String("client_id", client.ID), zap.String("jti", claims.ID))
+			return domain.OAuthClient{}, errInvalidClient
+		}
+		o.logger.Error("failed to store client assertion", zap.Error(err))
+		return domain.OAuthClient{}, err
+	}
+	return client, nil
+}
+
+// parseClientKey parses a PEM encoded public key and returns the
+// signature algorithms it verifies.
+func parseClientKey(pem string) (any, []string, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, []string{"ES256", "ES384", "ES512"}, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, []string{"EdDSA"}, nil
+	}
+	return nil, nil, errors.New("not a PEM encoded RSA, EC or Ed25519 public key")
+}
+
+// ClientCredentials runs the client credentials grant. The scope and
+// audience default to everything the client is registered for.
+func (o *OAuthService) ClientCredentials(ctx context.Context, client domain.OAuthClient, scope, audience []string) (OAuthTokens, error) {
+	if !slices.Contains(client.GrantTypes, domain.GrantClientCredentials) {
+		return OAuthTokens{}, oauthError(OAuthUnauthorizedClient, "client is not allowed to use this grant")
+	}
+
+	if len(scope) == 0 {
+		scope = client.Scopes
+	} else if !domain.ScopeSubset(scope, client.Scopes) {
+		return OAuthTokens{}, oauthError(OAuthInvalidScope, "scope exceeds the scopes of the client")
+	}
+	if len(audience) == 0 {
+		audience = client.Audiences
+	} else if !domain.ScopeSubset(audience, client.Audiences) {
+		return OAuthTokens{}, oauthError(OAuthInvalidTarget, "audience is not allowed for the client")
+	}
+
+	token, expiresAt, err := o.auth.tokens.GenerateClientAccessToken(domain.ClientClaims{
+		ClientID: client.ID,
+		Scope:    scope,
+		Audience: audience,
+	})
+	if err != nil {
+		o.logger.Error("failed to sign client access token", zap.Error(err))
+		return OAuthTokens{}, err
+	}
+
+	o.logger.Info("issued client access token", zap.String("client_id", client.ID), zap.Strings("scope", scope), zap.Strings("aud", audience))
+	return OAuthTokens{AccessToken: token, ExpiresAt: expiresAt, Scope: scope}, nil
+}
+
+// Client registration. Like the other admin operations every change is
+// recorded on behalf of actor.
+
+func newClientID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return clientIDPrefix + hex.EncodeToString(b), nil
+}
+
+// validateTokenList checks a list of scope or audience values and returns
+// it sorted without duplicates.
+func validateTokenList(field string, values []string, valid func(string) bool) ([]string, error) {
+	for _, v := range values {
+		if !valid(v) {
+			return nil, &ValidationError{Field: field, Message: fmt.Sprintf("%q is not allowed", v)}
+		}
+	}
+	values = slices.Clone(values)
+	slices.Sort(values)
+	return slices.Compact(values), nil
+}
+
+func validAudience(aud string) bool {
+	return aud != "" && len(aud) <= 200 && strings.IndexFunc(aud, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+func normalizeClient(client domain.OAuthClient) (domain.OAuthClient, error) {
+	if err := validateName(client.Name); err != nil {
+		return domain.OAuthClient{}, err
+	}
+
+	if client.AuthMethod == "" {
+		client.AuthMethod = domain.ClientSecretBasic
+	}
+	switch client.AuthMethod {
+	case domain.ClientSecretBasic, domain.ClientSecretPost, domain.ClientAuthNone:
+		if client.PublicKey != "" {
+			return domain.OAuthClient{}, &ValidationError{Field: "public_key", Message: "is only used with private_key_jwt"}
+		}
+	case domain.PrivateKeyJWT:
+		if _, _, err := parseClientKey(client.PublicKey); err != nil {
+			return domain.OAuthClient{}, &ValidationError{Field: "public_key", Message: "must be a PEM encoded RSA, EC or Ed25519 public key"}
+		}
+	default:
+		return domain.OAuthClient{}, &ValidationError{Field: "token_endpoint_auth_method", Message: "must be client_secret_basic, client_secret_post, private_key_jwt or none"}
+	}
+
+	var err error
+	if client.Scopes, err = validateTokenList("scopes", client.Scopes, scopeTokenPattern.MatchString); err != nil {
+		return domain.OAuthClient{}, err
+	}
+	if client.Audiences, err = validateTokenList("audiences", client.Audiences, validAudience); err != nil {
+		return domain.OAuthClient{}, err
+	}
+
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{domain.GrantClientCredentials}
+	}
+	if client.GrantTypes, err = validateTokenList("grant_types", client.GrantTypes, func(grant string) bool {
+		return slices.Contains(supportedGrantTypes, grant)
+	}); err != nil {
+		return domain.OAuthClient{}, err
+	}
+	if client.Public() && slices.Contains(client.GrantTypes, domain.GrantClientCredentials) {
+		return domain.OAuthClient{}, &ValidationError{Field: "grant_types", Message: "client_credentials needs a client that can authenticate"}
+	}
+
+	if client.RedirectURIs, err = validateTokenList("redirect_uris", client.RedirectURIs, validRedirectURI); err != nil {
+		return domain.OAuthClient{}, err
+	}
+	if slices.Contains(client.GrantTypes, domain.GrantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return domain.OAuthClient{}, &ValidationError{Field: "redirect_uris", Message: "are required for authorization_code"}
+	}
+	return client, nil
+}
+
+// deniedRedirectSchemes run code in or read from the user agent, they are
+// never accepted.
+var deniedRedirectSchemes = []string{"javascript", "data", "file", "vbscript"}
+
+// privateUseSchemePattern is a reverse domain name used as private-use URI
+// scheme, like com.example.app.
+var privateUseSchemePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*(\.[a-z0-9-]+)+$`)
+
+// validRedirectURI accepts absolute URIs without a fragment (RFC 6749
+// section 3.1.2) using https, http on a loopback address or a private-use
+// scheme of a native app (RFC 8252 sections 7.1 and 7.3).
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || u.Fragment != "" || strings.Contains(uri, "#") || len(uri) > 2000 || strings.ContainsAny(uri, " \t\r\n") {
+		return false
+	}
+	if slices.Contains(deniedRedirectSchemes, u.Scheme) {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return privateUseSchemePattern.MatchString(u.Scheme)
+	}
+}
+
+// CreateClient registers a client and returns it together with its
+// secret, which is not stored and can not be shown again. Clients using
+// private_key_jwt get no secret.
+func (o *OAuthService) CreateClient(ctx context.Context, actor string, client domain.OAuthClient) (domain.OAuthClient, string, error) {
+	client, err := normalizeClient(client)
+	if err != nil {
+		return domain.OAuthClient{}, "", err
+	}
+
+	if client.ID, err = newClientID(); err != nil {
+		return domain.OAuthClient{}, "", err
+	}
+	var secret string
+	if client.AuthMethod != domain.PrivateKeyJWT {
+		if secret, client.SecretHash, err = newOpaqueToken(); err != nil {
+			return domain.OAuthClient{}, "", err
+		}
+	}
+	client.CreatedAt = time.Now()
+
+	if err := o.clients.CreateClient(ctx, client); err != nil {
+		o.logger.Error("failed to create client", zap.Error(err))
+		return domain.OAuthClient{}, "", err
+	}
+
+	o.auth.recordAdminAction(ctx, actor, uuid.Nil, "client_create", map[string]string{
+		"client_id":   client.ID,
+		"auth_method": client.AuthMethod,
+		"scopes":      domain.FormatScope(client.Scopes),
+		"audiences":   strings.Join(client.Audiences, " "),
+		"grant_types": strings.Join(client.GrantTypes, " "),
+	})
+	return client, secret, nil
+}
+
+func (o *OAuthService) ListClients(ctx context.Context) ([]domain.OAuthClient, error) {
+	clients, err := o.clients.ListClients(ctx)
+	if err != nil {
+		o.logger.Error("failed to list clients", zap.Error(err))
+	}
+	return clients, err
+}
+
+func (o *OAuthService) GetClient(ctx context.Context, id string) (domain.OAuthClient, error) {
+	return o.clients.GetClient(ctx, id)
+}
+
+// DeleteClient removes a client and ends the sessions of users started
+// through it. Access tokens it holds for itself stay valid until they expire.
+func (o *OAuthService) DeleteClient(ctx context.Context, actor, id string) error {
+	if err := o.clients.DeleteClient(ctx, id); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			o.logger.Error("failed to delete client", zap.Error(err))
+		}
+		return err
+	}
+
+	o.auth.recordAdminAction(ctx, actor, uuid.Nil, "client_delete", map[string]string{"client_id": id})
+	return nil
+}
+
+// RotateClientSecret replaces the secret of a client, the old one stops
+// working immediately. Clients using private_key_jwt have no secret and
+// give ErrNotFound.
+func (o *OAuthService) RotateClientSecret(ctx context.Context, actor, id string) (string, error) {
+	secret, hash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := o.clients.UpdateClientSecret(ctx, id, hash); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			o.logger.Error("failed to update client secret", zap.Error(err))
+		}
+		return "", err
+	}
+
+	o.auth.recordAdminAction(ctx, actor, uuid.Nil, "client_secret_rotate", map[string]string{"client_id": id})
+	return secret, nil
+}
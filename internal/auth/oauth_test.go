@@ -0,0 +1,536 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+const testClientSecret = "test-client-secret"
+
+func testOAuthService(t *testing.T, clients ...domain.OAuthClient) *OAuthService {
+	t.Helper()
+
+	cfg := testConfig()
+	return NewOAuthService(testAuthService(t, cfg, nil, nil, nil), newFakeClients(clients...), cfg, zap.NewNop())
+}
+
+func wantOAuthError(t *testing.T, err error, code string) {
+	t.Helper()
+
+	var oauthErr *OAuthError
+	if !errors.As(err, &oauthErr) || oauthErr.Code != code {
+		t.Fatalf("err = %v, want %s", err, code)
+	}
+}
+
+func TestAuthenticateClientWithSecret(t *testing.T) {
+	basic := domain.OAuthClient{ID: "client_basic", AuthMethod: domain.ClientSecretBasic, SecretHash: hashOpaqueToken(testClientSecret)}
+	post := domain.OAuthClient{ID: "client_post", AuthMethod: domain.ClientSecretPost, SecretHash: hashOpaqueToken(testClientSecret)}
+	o := testOAuthService(t, basic, post)
+
+	for _, tc := range []struct {
+		name   string
+		creds  ClientAuthentication
+		wantID string
+	}{
+		{name: "client_secret_basic", creds: ClientAuthentication{ClientID: basic.ID, ClientSecret: testClientSecret, Basic: true}, wantID: basic.ID},
+		{name: "client_secret_post", creds: ClientAuthentication{ClientID: post.ID, ClientSecret: testClientSecret}, wantID: post.ID},
+		{name: "basic client posting its secret", creds: ClientAuthentication{ClientID: basic.ID, ClientSecret: testClientSecret}},
+		{name: "post client using basic", creds: ClientAuthentication{ClientID: post.ID, ClientSecret: testClientSecret, Basic: true}},
+		{name: "wrong secret", creds: ClientAuthentication{ClientID: basic.ID, ClientSecret: "wrong", Basic: true}},
+		{name: "no secret", creds: ClientAuthentication{ClientID: post.ID}},
+		{name: "no client ID", creds: ClientAuthentication{ClientSecret: testClientSecret}},
+		{name: "unknown client", creds: ClientAuthentication{ClientID: "client_unknown", ClientSecret: testClientSecret, Basic: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := o.AuthenticateClient(context.Background(), tc.creds)
+			if tc.wantID == "" {
+				wantOAuthError(t, err, OAuthInvalidClient)
+				return
+			}
+			if err != nil {
+				t.Fatalf("AuthenticateClient: %v", err)
+			}
+			if client.ID != tc.wantID {
+				t.Errorf("client = %q, want %q", client.ID, tc.wantID)
+			}
+		})
+	}
+}
+
+// testClientKey returns a P-256 key and its public half in PEM.
+func testClientKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func assertionClaims(clientID string) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Issuer:    clientID,
+		Subject:   clientID,
+		Audience:  jwt.ClaimStrings{"https://auth.example.com/oauth/token"},
+		ID:        "assertion-1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+func signAssertion(t *testing.T, method jwt.SigningMethod, key any, claims jwt.RegisteredClaims) string {
+	t.Helper()
+
+	signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func TestAuthenticateClientWithAssertion(t *testing.T) {
+	key, publicKey := testClientKey(t)
+	otherKey, _ := testClientKey(t)
+	client := domain.OAuthClient{ID: "client_jwt", AuthMethod: domain.PrivateKeyJWT, PublicKey: publicKey}
+	secretClient := domain.OAuthClient{ID: "client_basic", AuthMethod: domain.ClientSecretBasic, SecretHash: hashOpaqueToken(testClientSecret)}
+
+	for _, tc := range []struct {
+		name      string
+		assertion func(claims jwt.RegisteredClaims) string
+		wantOK    bool
+	}{
+		{
+			name: "addressed to the token endpoint",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+			wantOK: true,
+		},
+		{
+			name: "addressed to the issuer",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.Audience = jwt.ClaimStrings{testConfig().TokenIssuer()}
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+			wantOK: true,
+		},
+		{
+			name: "another audience",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.Audience = jwt.ClaimStrings{"https://other.example.com/oauth/token"}
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+		},
+		{
+			name: "expired",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+		},
+		{
+			name: "without expiry",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.ExpiresAt = nil
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+		},
+		{
+			name: "valid for too long",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+		},
+		{
+			name: "without jti",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.ID = ""
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+		},
+		{
+			name: "issued by someone else",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				claims.Issuer = "client_other"
+				return signAssertion(t, jwt.SigningMethodES256, key, claims)
+			},
+		},
+		{
+			name: "signed by another key",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				return signAssertion(t, jwt.SigningMethodES256, otherKey, claims)
+			},
+		},
+		{
+			name: "HMAC keyed with the public key",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				return signAssertion(t, jwt.SigningMethodHS256, []byte(publicKey), claims)
+			},
+		},
+		{
+			name: "alg none",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				return signAssertion(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims)
+			},
+		},
+		{
+			name: "client registered for a secret",
+			assertion: func(claims jwt.RegisteredClaims) string {
+				return signAssertion(t, jwt.SigningMethodES256, key, assertionClaims(secretClient.ID))
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := testOAuthService(t, client, secretClient)
+
+			got, err := o.AuthenticateClient(context.Background(), ClientAuthentication{
+				AssertionType: ClientAssertionType,
+				Assertion:     tc.assertion(assertionClaims(client.ID)),
+			})
+			if !tc.wantOK {
+				wantOAuthError(t, err, OAuthInvalidClient)
+				return
+			}
+			if err != nil {
+				t.Fatalf("AuthenticateClient: %v", err)
+			}
+			if got.ID != client.ID {
+				t.Errorf("client = %q, want %q", got.ID, client.ID)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClientRejectsReplayedAssertion(t *testing.T) {
+	key, publicKey := testClientKey(t)
+	client := domain.OAuthClient{ID: "client_jwt", AuthMethod: domain.PrivateKeyJWT, PublicKey: publicKey}
+	o := testOAuthService(t, client)
+
+	creds := ClientAuthentication{
+		ClientID:      client.ID,
+		AssertionType: ClientAssertionType,
+		Assertion:     signAssertion(t, jwt.SigningMethodES256, key, assertionClaims(client.ID)),
+	}
+	if _, err := o.AuthenticateClient(context.Background(), creds); err != nil {
+		t.Fatalf("first AuthenticateClient: %v", err)
+	}
+	_, err := o.AuthenticateClient(context.Background(), creds)
+	wantOAuthError(t, err, OAuthInvalidClient)
+}
+
+func TestAuthenticateClientRejectsMixedMethods(t *testing.T) {
+	key, publicKey := testClientKey(t)
+	client := domain.OAuthClient{ID: "client_jwt", AuthMethod: domain.PrivateKeyJWT, PublicKey: publicKey}
+	o := testOAuthService(t, client)
+
+	for _, tc := range []struct {
+		name  string
+		creds ClientAuthentication
+		want  string
+	}{
+		{
+			name: "assertion and secret",
+			creds: ClientAuthentication{
+				ClientSecret:  testClientSecret,
+				AssertionType: ClientAssertionType,
+				Assertion:     signAssertion(t, jwt.SigningMethodES256, key, assertionClaims(client.ID)),
+			},
+			want: OAuthInvalidRequest,
+		},
+		{
+			name: "unsupported assertion type",
+			creds: ClientAuthentication{
+				AssertionType: "urn:ietf:params:oauth:client-assertion-type:saml2-bearer",
+				Assertion:     signAssertion(t, jwt.SigningMethodES256, key, assertionClaims(client.ID)),
+			},
+			want: OAuthInvalidRequest,
+		},
+		{
+			name: "client_id of another client",
+			creds: ClientAuthentication{
+				ClientID:      "client_other",
+				AssertionType: ClientAssertionType,
+				Assertion:     signAssertion(t, jwt.SigningMethodES256, key, assertionClaims(client.ID)),
+			},
+			want: OAuthInvalidClient,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := o.AuthenticateClient(context.Background(), tc.creds)
+			wantOAuthError(t, err, tc.want)
+		})
+	}
+}
+
+func TestClientCredentialsLimitsScope(t *testing.T) {
+	client := domain.OAuthClient{
+		ID:         "client_basic",
+		AuthMethod: domain.ClientSecretBasic,
+		Scopes:     []string{"orders:read", "orders:write"},
+		Audiences:  []string{"https://api.example.com"},
+		GrantTypes: []string{domain.GrantClientCredentials},
+	}
+	o := testOAuthService(t, client)
+
+	for _, tc := range []struct {
+		name      string
+		client    domain.OAuthClient
+		scope     []string
+		audience  []string
+		wantScope []string
+		wantErr   string
+	}{
+		{name: "defaults to the client scopes", client: client, wantScope: client.Scopes},
+		{name: "narrower scope", client: client, scope: []string{"orders:read"}, wantScope: []string{"orders:read"}},
+		{name: "scope beyond the client", client: client, scope: []string{"orders:read", "users:read"}, wantErr: OAuthInvalidScope},
+		{name: "audience beyond the client", client: client, audience: []string{"https://other.example.com"}, wantErr: OAuthInvalidTarget},
+		{
+			name: "grant not registered",
+			client: func() domain.OAuthClient {
+				c := client
+				c.GrantTypes = nil
+				return c
+			}(),
+			wantErr: OAuthUnauthorizedClient,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := o.ClientCredentials(context.Background(), tc.client, tc.scope, tc.audience)
+			if tc.wantErr != "" {
+				wantOAuthError(t, err, tc.wantErr)
+				return
+			}
+			if err != nil {
+				t.Fatalf("ClientCredentials: %v", err)
+			}
+			if !slices.Equal(tokens.Scope, tc.wantScope) {
+				t.Errorf("scope = %v, want %v", tokens.Scope, tc.wantScope)
+			}
+
+			var claims clientAccessClaims
+			if _, _, err := jwt.NewParser().ParseUnverified(tokens.AccessToken, &claims); err != nil {
+				t.Fatalf("ParseUnverified: %v", err)
+			}
+			if claims.Scope != domain.FormatScope(tc.wantScope) || claims.Subject != client.ID {
+				t.Errorf("token scope = %q, sub = %q", claims.Scope, claims.Subject)
+			}
+		})
+	}
+}
+
+const testUserAgent = "test-agent"
+
+func TestValidRedirectURI(t *testing.T) {
+	for _, tc := range []struct {
+		uri  string
+		want bool
+	}{
+		{uri: "https://app.example.com/callback", want: true},
+		{uri: "https://app.example.com/callback?tenant=1", want: true},
+		{uri: "http://127.0.0.1:8765/callback", want: true},
+		{uri: "http://[::1]:8765/callback", want: true},
+		{uri: "http://localhost/callback", want: true},
+		{uri: "com.example.app:/oauth2redirect", want: true},
+		{uri: "com.example.app:oauth2redirect", want: true},
+		{uri: "http://app.example.com/callback"},
+		{uri: "https:///callback"},
+		{uri: "https://app.example.com/callback#fragment"},
+		{uri: "/callback"},
+		{uri: "myapp://callback"},
+		{uri: "javascript:alert(document.cookie)"},
+		{uri: "JavaScript:alert(document.cookie)"},
+		{uri: "vbscript:msgbox(1)"},
+		{uri: "data:text/html,<script>alert(1)</script>"},
+		{uri: "file:///etc/passwd"},
+		{uri: "com.example.app:/callback with space"},
+	} {
+		if got := validRedirectURI(tc.uri); got != tc.want {
+			t.Errorf("validRedirectURI(%q) = %v, want %v", tc.uri, got, tc.want)
+		}
+	}
+}
+
+type oauthFixture struct {
+	auth     *AuthService
+	oauth    *OAuthService
+	sessions *fakeSessions
+	clients  *fakeClients
+	client   domain.OAuthClient
+	guid     uuid.UUID
+	// own is the session the user started without a client.
+	own issuedTokens
+}
+
+func newOAuthFixture(t *testing.T) *oauthFixture {
+	t.Helper()
+
+	cfg := testConfig()
+	user := domain.User{GUID: uuid.New(), Username: "alice", Status: domain.UserActive}
+	sessions := &fakeSessions{}
+	clients := newFakeClients()
+	auth := testAuthService(t, cfg, newFakeUsers(user), sessions, &fakeAudit{})
+
+	own, err := auth.issueTokens(context.Background(), &user.GUID, domain.RefreshToken{
+		AMR:      []string{domain.AMRPassword},
+		AuthTime: time.Now(),
+	}, testUserAgent, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("issueTokens: %v", err)
+	}
+
+	return &oauthFixture{
+		auth:     auth,
+		oauth:    NewOAuthService(auth, clients, cfg, zap.NewNop()),
+		sessions: sessions,
+		clients:  clients,
+		client: domain.OAuthClient{
+			ID:         "cli",
+			AuthMethod: domain.ClientAuthNone,
+			GrantTypes: []string{domain.GrantAuthorizationCode, domain.GrantDeviceCode, domain.GrantRefreshToken},
+		},
+		guid: user.GUID,
+		own:  own,
+	}
+}
+
+// refreshOwn refreshes the session of the user without a client and keeps
+// the new one.
+func (f *oauthFixture) refreshOwn(t *testing.T) {
+	t.Helper()
+
+	pair, err := f.auth.Refresh(context.Background(), f.guid, f.own.sessionID, f.own.RefreshToken, nil, testUserAgent, "192.0.2.1")
+	if err != nil || pair.RefreshToken == "" {
+		t.Fatalf("Refresh of the own session = %+v, %v", pair, err)
+	}
+	sessions, _ := f.sessions.ListSessions(context.Background(), &f.guid)
+	for _, session := range sessions {
+		if session.ClientID == "" {
+			f.own = issuedTokens{TokenPair: pair, guid: f.guid, sessionID: session.SessionID}
+		}
+	}
+}
+
+func (f *oauthFixture) exchangeCode(t *testing.T) OAuthTokens {
+	t.Helper()
+
+	const code, verifier = "code", "verifier-with-enough-entropy-0123456789-abcdefghij"
+	sum := sha256.Sum256([]byte(verifier))
+	f.clients.code = domain.AuthorizationCode{
+		CodeHash:      hashOpaqueToken(code),
+		ClientID:      f.client.ID,
+		GUID:          f.guid,
+		Scope:         []string{domain.ScopeAccount},
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+		AMR:           []string{domain.AMRPassword},
+		AuthTime:      time.Now(),
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+
+	tokens, err := f.oauth.ExchangeAuthorizationCode(context.Background(), f.client, code, "", verifier, "client-agent", "198.51.100.1")
+	if err != nil {
+		t.Fatalf("ExchangeAuthorizationCode: %v", err)
+	}
+	return tokens
+}
+
+func (f *oauthFixture) exchangeDeviceCode(t *testing.T) OAuthTokens {
+	t.Helper()
+
+	const deviceCode = "device-code"
+	f.clients.device = domain.DeviceAuthorization{
+		DeviceCodeHash: hashOpaqueToken(deviceCode),
+		ClientID:       f.client.ID,
+		Scope:          []string{domain.ScopeAccount},
+		Status:         domain.DeviceApproved,
+		GUID:           f.guid,
+		AMR:            []string{domain.AMRPassword},
+		AuthTime:       time.Now(),
+		ExpiresAt:      time.Now().Add(time.Minute),
+	}
+
+	tokens, err := f.oauth.ExchangeDeviceCode(context.Background(), f.client, deviceCode, "device-agent", "198.51.100.2")
+	if err != nil {
+		t.Fatalf("ExchangeDeviceCode: %v", err)
+	}
+	return tokens
+}
+
+func TestClientGrantsAddASession(t *testing.T) {
+	for _, grant := range []struct {
+		name     string
+		exchange func(*oauthFixture, *testing.T) OAuthTokens
+	}{
+		{name: "authorization code", exchange: (*oauthFixture).exchangeCode},
+		{name: "device code", exchange: (*oauthFixture).exchangeDeviceCode},
+	} {
+		t.Run(grant.name, func(t *testing.T) {
+			f := newOAuthFixture(t)
+			ctx := context.Background()
+
+			tokens := grant.exchange(f, t)
+			if sessions, _ := f.sessions.ListSessions(ctx, &f.guid); len(sessions) != 2 {
+				t.Fatalf("%d sessions after the grant, want the own and the client session", len(sessions))
+			}
+			f.refreshOwn(t)
+
+			// refreshing the client session rotates it, the old refresh token
+			// is spent
+			refreshed, err := f.oauth.RefreshClientSession(ctx, f.client, tokens.RefreshToken, nil, "client-agent", "198.51.100.1")
+			if err != nil {
+				t.Fatalf("RefreshClientSession: %v", err)
+			}
+			if _, err := f.oauth.RefreshClientSession(ctx, f.client, tokens.RefreshToken, nil, "client-agent", "198.51.100.1"); err == nil {
+				t.Error("RefreshClientSession accepted a spent refresh token")
+			}
+			f.refreshOwn(t)
+
+			// ending the client session keeps the own one
+			sessionID, _, _ := strings.Cut(refreshed.RefreshToken, refreshTokenSeparator)
+			if err := f.auth.Deauthorize(ctx, f.guid, sessionID, "client-agent", "198.51.100.1"); err != nil {
+				t.Fatalf("Deauthorize: %v", err)
+			}
+			if sessions, _ := f.sessions.ListSessions(ctx, &f.guid); len(sessions) != 1 || sessions[0].ClientID != "" {
+				t.Errorf("sessions after ending the client session = %+v, want the own one", sessions)
+			}
+			f.refreshOwn(t)
+		})
+	}
+}
+
+func TestReplayedCodeEndsOnlyItsSession(t *testing.T) {
+	f := newOAuthFixture(t)
+	ctx := context.Background()
+
+	f.exchangeCode(t)
+	if _, err := f.oauth.ExchangeAuthorizationCode(ctx, f.client, "code", "", "verifier-with-enough-entropy-0123456789-abcdefghij", "client-agent", "198.51.100.1"); err == nil {
+		t.Fatal("ExchangeAuthorizationCode accepted a used code")
+	}
+
+	sessions, _ := f.sessions.ListSessions(ctx, &f.guid)
+	if len(sessions) != 1 || sessions[0].ClientID != "" {
+		t.Errorf("sessions after the replay = %+v, want the own one", sessions)
+	}
+	f.refreshOwn(t)
+}
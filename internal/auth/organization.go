@@ -0,0 +1,417 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/mailer"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrOrgForbidden is returned when a member's role does not allow a change.
+	ErrOrgForbidden = errors.New("insufficient organization role")
+	// ErrInvalidInvitation is returned for unknown, used and expired invitations alike.
+	ErrInvalidInvitation = errors.New("invalid or expired invitation")
+)
+
+// Organizations are managed by their own members. Users that are not a
+// member get ErrNotFound, so they can not tell which organizations exist.
+
+func validateOrgName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > 100 || strings.TrimSpace(name) != name || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return &ValidationError{Field: "name", Message: "must be 1 to 100 characters without surrounding spaces or control characters"}
+	}
+	return nil
+}
+
+func validateOrgRole(role domain.OrgRole) error {
+	if !role.Valid() {
+		return &ValidationError{Field: "role", Message: "must be owner, admin or member"}
+	}
+	return nil
+}
+
+// orgMember returns the membership of guid, ErrNotFound if there is none
+// and ErrOrgForbidden if manage is set and the role may not manage members.
+func (s *AuthService) orgMember(ctx context.Context, orgID, guid uuid.UUID, manage bool) (domain.Membership, error) {
+	member, err := s.orgs.GetMember(ctx, orgID, guid)
+	if err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to get organization member", zap.Error(err))
+		}
+		return domain.Membership{}, err
+	}
+	if manage && !member.Role.CanManage() {
+		return domain.Membership{}, ErrOrgForbidden
+	}
+	return member, nil
+}
+
+func (s *AuthService) recordOrgAction(ctx context.Context, guid, orgID uuid.UUID, action string, details map[string]string, userAgent, ip string) {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details["action"] = action
+	details["org_id"] = orgID.String()
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventOrganization,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+}
+
+// CreateOrganization creates an organization owned by guid.
+func (s *AuthService) CreateOrganization(ctx context.Context, guid uuid.UUID, name, userAgent, ip string) (domain.Organization, error) {
+	if err := validateOrgName(name); err != nil {
+		return domain.Organization{}, err
+	}
+
+	org := domain.Organization{
+		ID:        uuid.New(),
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	if err := s.orgs.CreateOrganization(ctx, org, guid); err != nil {
+		s.logger.Error("failed to create organization", zap.Error(err))
+		return domain.Organization{}, err
+	}
+
+	s.recordOrgAction(ctx, guid, org.ID, "create", map[string]string{"name": name}, userAgent, ip)
+	return org, nil
+}
+
+func (s *AuthService) ListOrganizations(ctx context.Context, guid uuid.UUID) ([]domain.UserOrganization, error) {
+	return s.orgs.ListUserOrganizations(ctx, guid)
+}
+
+func (s *AuthService) GetOrganization(ctx context.Context, guid, orgID uuid.UUID) (domain.Organization, error) {
+	if _, err := s.orgMember(ctx, orgID, guid, false); err != nil {
+		return domain.Organization{}, err
+	}
+	return s.orgs.GetOrganization(ctx, orgID)
+}
+
+// DeleteOrganization deletes an organization with its memberships and
+// invitations. Only owners may delete it.
+func (s *AuthService) DeleteOrganization(ctx context.Context, guid, orgID uuid.UUID, userAgent, ip string) error {
+	member, err := s.orgMember(ctx, orgID, guid, false)
+	if err != nil {
+		return err
+	}
+	if member.Role != domain.OrgOwner {
+		return ErrOrgForbidden
+	}
+
+	if err := s.orgs.DeleteOrganization(ctx, orgID); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to delete organization", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordOrgAction(ctx, guid, orgID, "delete", nil, userAgent, ip)
+	return nil
+}
+
+func (s *AuthService) ListMembers(ctx context.Context, guid, orgID uuid.UUID) ([]domain.Membership, error) {
+	if _, err := s.orgMember(ctx, orgID, guid, false); err != nil {
+		return nil, err
+	}
+	return s.orgs.ListMembers(ctx, orgID)
+}
+
+// UpdateMemberRole changes the role of a member. Owners and admins manage
+// members, only owners may make or unmake owners.
+func (s *AuthService) UpdateMemberRole(ctx context.Context, guid, orgID, memberGUID uuid.UUID, role domain.OrgRole, userAgent, ip string) error {
+	if err := validateOrgRole(role); err != nil {
+		return err
+	}
+
+	actor, err := s.orgMember(ctx, orgID, guid, true)
+	if err != nil {
+		return err
+	}
+	member, err := s.orgs.GetMember(ctx, orgID, memberGUID)
+	if err != nil {
+		return err
+	}
+	if (role == domain.OrgOwner || member.Role == domain.OrgOwner) && actor.Role != domain.OrgOwner {
+		return ErrOrgForbidden
+	}
+
+	if err := s.orgs.UpdateMemberRole(ctx, orgID, memberGUID, role); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) && !errors.Is(err, domain.ErrLastOwner) {
+			s.logger.Error("failed to update organization member", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordOrgAction(ctx, guid, orgID, "member_update", map[string]string{
+		"member": memberGUID.String(),
+		"role":   string(role),
+	}, userAgent, ip)
+	return nil
+}
+
+// RemoveMember removes a member from the organization. Members may always
+// leave, removing others takes the same role as changing theirs.
+func (s *AuthService) RemoveMember(ctx context.Context, guid, orgID, memberGUID uuid.UUID, userAgent, ip string) error {
+	if memberGUID != guid {
+		actor, err := s.orgMember(ctx, orgID, guid, true)
+		if err != nil {
+			return err
+		}
+		member, err := s.orgs.GetMember(ctx, orgID, memberGUID)
+		if err != nil {
+			return err
+		}
+		if member.Role == domain.OrgOwner && actor.Role != domain.OrgOwner {
+			return ErrOrgForbidden
+		}
+	}
+
+	if err := s.orgs.RemoveMember(ctx, orgID, memberGUID); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) && !errors.Is(err, domain.ErrLastOwner) {
+			s.logger.Error("failed to remove organization member", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordOrgAction(ctx, guid, orgID, "member_remove", map[string]string{"member": memberGUID.String()}, userAgent, ip)
+	return nil
+}
+
+// InviteMember mails an invitation to join the organization with role.
+// Whoever follows it becomes a member, an account is created for the
+// email if there is none yet.
+func (s *AuthService) InviteMember(ctx context.Context, guid, orgID uuid.UUID, email string, role domain.OrgRole, userAgent, ip string) (domain.OrgInvitation, error) {
+	if err := validateEmail(email); err != nil {
+		return domain.OrgInvitation{}, err
+	}
+	if err := validateOrgRole(role); err != nil {
+		return domain.OrgInvitation{}, err
+	}
+
+	actor, err := s.orgMember(ctx, orgID, guid, true)
+	if err != nil {
+		return domain.OrgInvitation{}, err
+	}
+	if role == domain.OrgOwner && actor.Role != domain.OrgOwner {
+		return domain.OrgInvitation{}, ErrOrgForbidden
+	}
+	org, err := s.orgs.GetOrganization(ctx, orgID)
+	if err != nil {
+		return domain.OrgInvitation{}, err
+	}
+
+	settings := s.settings.Load()
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return domain.OrgInvitation{}, err
+	}
+
+	now := time.Now()
+	invitation := domain.OrgInvitation{
+		ID:        uuid.New(),
+		TokenHash: tokenHash,
+		OrgID:     orgID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: &guid,
+		CreatedAt: now,
+		ExpiresAt: now.Add(settings.invitationTTL),
+	}
+	if err := s.orgs.StoreInvitation(ctx, invitation); err != nil {
+		s.logger.Error("failed to store invitation", zap.Error(err))
+		return domain.OrgInvitation{}, err
+	}
+
+	link := settings.publicHost + "/invitations/accept?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "You are invited to join " + org.Name,
+		Body: fmt.Sprintf(
+			"You were invited to join %s as %s.\n\n"+
+				"Open %s or use this token to accept the invitation:\n\n%s\n\n"+
+				"The invitation expires in %s and can only be used once. "+
+				"If you do not want to join, you can ignore this email.\n",
+			org.Name, role, link, token, settings.invitationTTL,
+		),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+
+		if err := settings.mailer.Send(ctx, msg); err != nil {
+			s.logger.Error("failed to send invitation mail", zap.String("org_id", orgID.String()), zap.Error(err))
+		}
+	}()
+
+	s.recordOrgAction(ctx, guid, orgID, "invite", map[string]string{
+		"invitation_id": invitation.ID.String(),
+		"role":          string(role),
+	}, userAgent, ip)
+	return invitation, nil
+}
+
+func (s *AuthService) ListInvitations(ctx context.Context, guid, orgID uuid.UUID) ([]domain.OrgInvitation, error) {
+	if _, err := s.orgMember(ctx, orgID, guid, true); err != nil {
+		return nil, err
+	}
+	return s.orgs.ListInvitations(ctx, orgID)
+}
+
+func (s *AuthService) RevokeInvitation(ctx context.Context, guid, orgID, invitationID uuid.UUID, userAgent, ip string) error {
+	if _, err := s.orgMember(ctx, orgID, guid, true); err != nil {
+		return err
+	}
+
+	if err := s.orgs.DeleteInvitation(ctx, orgID, invitationID); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to delete invitation", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordOrgAction(ctx, guid, orgID, "invitation_revoke", map[string]string{"invitation_id": invitationID.String()}, userAgent, ip)
+	return nil
+}
+
+// AcceptInvitation adds the signed in user to the organization of an
+// invitation, whichever email it was sent to.
+func (s *AuthService) AcceptInvitation(ctx context.Context, guid uuid.UUID, token, userAgent, ip string) (domain.Membership, error) {
+	invitation, err := s.acceptInvitation(ctx, token, guid, false, userAgent, ip)
+	if err != nil {
+		return domain.Membership{}, err
+	}
+	return s.orgs.GetMember(ctx, invitation.OrgID, guid)
+}
+
+// AcceptInvitationAndLogin accepts an invitation without a signed in user
+// and logs in the user owning the invited email, or a new user created
+// for it. Like a mailed login link the invitation proves control of the
+// inbox, so the email counts as verified.
+func (s *AuthService) AcceptInvitationAndLogin(ctx context.Context, token, userAgent, ip string) (domain.TokenPair, error) {
+	pending, err := s.orgs.GetInvitation(ctx, hashOpaqueToken(token))
+	if errors.Is(err, domain.ErrNotFound) {
+		return domain.TokenPair{}, ErrInvalidInvitation
+	}
+	if err != nil {
+		s.logger.Error("failed to get invitation", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	user, err := s.users.GetUserByEmail(ctx, pending.Email)
+	switch {
+	case errors.Is(err, domain.ErrNotFound):
+		guid := uuid.New()
+		if _, err := s.acceptInvitation(ctx, token, guid, true, userAgent, ip); err != nil {
+			return domain.TokenPair{}, err
+		}
+		s.recordAudit(ctx, domain.AuditEntry{
+			GUID:      guid,
+			EventType: domain.AuditEventRegister,
+			Actor:     guid.String(),
+			IP:        ip,
+			UserAgent: userAgent,
+			Details:   map[string]string{"method": "invitation", "org_id": pending.OrgID.String()},
+		})
+		return s.authorize(ctx, &guid, []string{domain.AMREmail}, nil, userAgent, ip)
+
+	case err != nil:
+		s.logger.Error("failed to look up user for invitation", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	if err := user.CheckActive(); err != nil {
+		return domain.TokenPair{}, err
+	}
+	if _, err := s.acceptInvitation(ctx, token, user.GUID, false, userAgent, ip); err != nil {
+		return domain.TokenPair{}, err
+	}
+	if !user.Verified() {
+		if err := s.markEmailVerified(ctx, user.GUID, pending.Email, "invitation", userAgent, ip); err != nil {
+			return domain.TokenPair{}, err
+		}
+	}
+	return s.completeLogin(ctx, user.GUID, []string{domain.AMREmail}, userAgent, ip)
+}
+
+func (s *AuthService) acceptInvitation(ctx context.Context, token string, guid uuid.UUID, create bool, userAgent, ip string) (domain.OrgInvitation, error) {
+	invitation, err := s.orgs.AcceptInvitation(ctx, hashOpaqueToken(token), guid, create)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			return domain.OrgInvitation{}, ErrInvalidInvitation
+		case errors.Is(err, domain.ErrAlreadyExists):
+			// the email was registered since the invitation was looked up
+			return domain.OrgInvitation{}, ErrInvalidInvitation
+		}
+		s.logger.Error("failed to accept invitation", zap.Error(err))
+		return domain.OrgInvitation{}, err
+	}
+
+	s.recordOrgAction(ctx, guid, invitation.OrgID, "invitation_accept", map[string]string{
+		"invitation_id": invitation.ID.String(),
+		"role":          string(invitation.Role),
+	}, userAgent, ip)
+	return invitation, nil
+}
+
+// SwitchOrganization selects the active organization of the current
+// session, nil clears it. The session keeps its ID, authentication, scope
+// and expiry, a new token pair carrying the org_id claim replaces the
+// current one.
+func (s *AuthService) SwitchOrganization(ctx context.Context, guid uuid.UUID, sessionID string, orgID *uuid.UUID, userAgent, ip string) (domain.TokenPair, error) {
+	stored, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil || stored.GUID != guid {
+		s.logger.Warn("organization switch for unknown session", zap.String("guid", guid.String()))
+		return domain.TokenPair{}, fmt.Errorf("unauthorized")
+	}
+	if stored.UserAgent != userAgent {
+		s.logger.Warn("user-agent mismatch", zap.String("guid", guid.String()))
+		s.revokeSession(ctx, guid, sessionID, guid.String(), "user-agent mismatch", userAgent, ip)
+		return domain.TokenPair{}, fmt.Errorf("unauthorized")
+	}
+
+	if orgID != nil {
+		if _, err := s.orgMember(ctx, *orgID, guid, false); err != nil {
+			return domain.TokenPair{}, err
+		}
+	}
+
+	stored.OrgID = orgID
+	pair, err := s.issueTokens(ctx, &guid, stored, userAgent, ip)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	details := map[string]string{"session_id": sessionID}
+	if orgID != nil {
+		details["org_id"] = orgID.String()
+	}
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventOrgSwitch,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+	return pair.TokenPair, nil
+}
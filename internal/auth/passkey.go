@@ -0,0 +1,481 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// passkeyCeremonyTTL is how long a started registration or login can be finished.
+const passkeyCeremonyTTL = 5 * time.Minute
+
+var (
+	// ErrInvalidPasskey is returned for every failed ceremony, the reason is only logged.
+	ErrInvalidPasskey        = errors.New("invalid passkey")
+	errPasskeysNotConfigured = errors.New("passkeys are not configured")
+)
+
+// PasskeyService runs WebAuthn registration and login ceremonies. Logins
+// end in the session machinery of the AuthService.
+type PasskeyService struct {
+	auth   *AuthService
+	users  domain.UserRepository
+	repo   domain.WebAuthnRepository
+	logger *zap.Logger
+
+	webauthn atomic.Pointer[webauthn.WebAuthn]
+}
+
+func NewPasskeyService(auth *AuthService, users domain.UserRepository, repo domain.WebAuthnRepository, cfg config.Config, logger *zap.Logger) *PasskeyService {
+	p := &PasskeyService{
+		auth:   auth,
+		users:  users,
+		repo:   repo,
+		logger: logger,
+	}
+	p.ApplyConfig(cfg)
+	return p
+}
+
+// ApplyConfig swaps in the relying party settings.
+func (p *PasskeyService) ApplyConfig(cfg config.Config) {
+	rpID, origins := cfg.WebAuthnRelyingParty()
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyCeremonyTTL, TimeoutUVD: passkeyCeremonyTTL}
+
+	rp, err := webauthn.New(&webauthn.Config{
+		RPID:                  rpID,
+		RPDisplayName:         cfg.WebAuthnRPName,
+		RPOrigins:             origins,
+		AttestationPreference: protocol.ConveyancePreference(cfg.WebAuthnAttestation),
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		p.logger.Error("invalid webauthn config, keeping the previous one", zap.Error(err))
+		return
+	}
+	p.webauthn.Store(rp)
+}
+
+func (p *PasskeyService) relyingParty() (*webauthn.WebAuthn, error) {
+	rp := p.webauthn.Load()
+	if rp == nil {
+		return nil, errPasskeysNotConfigured
+	}
+	return rp, nil
+}
+
+// passkeyUser adapts a user and its passkeys to the WebAuthn library.
+type passkeyUser struct {
+	user  domain.User
+	creds []webauthn.Credential
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return u.user.GUID[:]
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	switch {
+	case u.user.Username != "":
+		return u.user.Username
+	case u.user.Email != "":
+		return u.user.Email
+	default:
+		return u.user.GUID.String()
+	}
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	if u.user.DisplayName != "" {
+		return u.user.DisplayName
+	}
+	return u.WebAuthnName()
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.creds
+}
+
+func (p *PasskeyService) loadUser(ctx context.Context, guid uuid.UUID) (passkeyUser, error) {
+	user, err := p.users.GetUser(ctx, guid)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+
+	stored, err := p.repo.ListCredentials(ctx, guid)
+	if err != nil {
+		p.logger.Error("failed to list passkeys", zap.Error(err))
+		return passkeyUser{}, err
+	}
+
+	creds := make([]webauthn.Credential, len(stored))
+	for i, c := range stored {
+		transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+		for j, t := range c.Transports {
+			transports[j] = protocol.AuthenticatorTransport(t)
+		}
+		creds[i] = webauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		}
+	}
+	return passkeyUser{user: user, creds: creds}, nil
+}
+
+func (p *PasskeyService) storeCeremony(ctx context.Context, kind domain.WebAuthnCeremonyKind, guid *uuid.UUID, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = p.repo.StoreCeremony(ctx, domain.WebAuthnCeremony{
+		Challenge:   session.Challenge,
+		Kind:        kind,
+		GUID:        guid,
+		SessionData: data,
+		ExpiresAt:   time.Now().Add(passkeyCeremonyTTL),
+	})
+	if err != nil {
+		p.logger.Error("failed to store webauthn ceremony", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// consumeCeremony looks up the ceremony a response answers by the
+// challenge in its client data. It can only be used once.
+func (p *PasskeyService) consumeCeremony(ctx context.Context, kind domain.WebAuthnCeremonyKind, challenge string) (domain.WebAuthnCeremony, webauthn.SessionData, error) {
+	ceremony, err := p.repo.ConsumeCeremony(ctx, challenge, kind)
+	if errors.Is(err, domain.ErrNotFound) {
+		p.logger.Warn("unknown or expired webauthn challenge", zap.String("kind", string(kind)))
+		return domain.WebAuthnCeremony{}, webauthn.SessionData{}, ErrInvalidPasskey
+	}
+	if err != nil {
+		p.logger.Error("failed to get webauthn ceremony", zap.Error(err))
+		return domain.WebAuthnCeremony{}, webauthn.SessionData{}, err
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal(ceremony.SessionData, &session); err != nil {
+		p.logger.Error("failed to decode webauthn ceremony", zap.Error(err))
+		return domain.WebAuthnCeremony{}, webauthn.SessionData{}, err
+	}
+	return ceremony, session, nil
+}
+
+// BeginRegistration starts adding a passkey to the account of a logged in
+// user. Passkeys the user already has are excluded, so an authenticator
+// is not registered twice.
+func (p *PasskeyService) BeginRegistration(ctx context.Context, guid uuid.UUID) (*protocol.CredentialCreation, error) {
+	rp, err := p.relyingParty()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := p.loadUser(ctx, guid)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, len(user.creds))
+	for i, c := range user.creds {
+		exclusions[i] = c.Descriptor()
+	}
+
+	creation, session, err := rp.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		p.logger.Error("failed to begin passkey registration", zap.Error(err))
+		return nil, err
+	}
+
+	if err := p.storeCeremony(ctx, domain.WebAuthnRegistration, &guid, session); err != nil {
+		return nil, err
+	}
+	return creation, nil
+}
+
+// FinishRegistration verifies the attestation response and stores the new
+// passkey under name.
+func (p *PasskeyService) FinishRegistration(ctx context.Context, guid uuid.UUID, name string, response []byte, userAgent, ip string) (domain.WebAuthnCredential, error) {
+	if err := validatePasskeyName(name); err != nil {
+		return domain.WebAuthnCredential{}, err
+	}
+
+	rp, err := p.relyingParty()
+	if err != nil {
+		return domain.WebAuthnCredential{}, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		p.logger.Warn("invalid passkey registration response", zap.Error(err))
+		return domain.WebAuthnCredential{}, ErrInvalidPasskey
+	}
+
+	ceremony, session, err := p.consumeCeremony(ctx, domain.WebAuthnRegistration, parsed.Response.CollectedClientData.Challenge)
+	if err != nil {
+		return domain.WebAuthnCredential{}, err
+	}
+	if ceremony.GUID == nil || *ceremony.GUID != guid {
+		p.logger.Warn("passkey registration finished by another user", zap.String("guid", guid.String()))
+		return domain.WebAuthnCredential{}, ErrInvalidPasskey
+	}
+
+	user, err := p.loadUser(ctx, guid)
+	if err != nil {
+		return domain.WebAuthnCredential{}, err
+	}
+
+	cred, err := rp.CreateCredential(user, session, parsed)
+	if err != nil {
+		p.logger.Warn("passkey registration failed", zap.String("guid", guid.String()), zap.Error(err))
+		return domain.WebAuthnCredential{}, ErrInvalidPasskey
+	}
+
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	stored := domain.WebAuthnCredential{
+		ID:              cred.ID,
+		GUID:            guid,
+		Name:            name,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		Transports:      transports,
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+	if err := p.repo.StoreCredential(ctx, stored); err != nil {
+		if !errors.Is(err, domain.ErrAlreadyExists) {
+			p.logger.Error("failed to store passkey", zap.Error(err))
+		}
+		return domain.WebAuthnCredential{}, err
+	}
+
+	p.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventPasskeyRegister,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"credential_id":    EncodeCredentialID(cred.ID),
+			"attestation_type": cred.AttestationType,
+		},
+	})
+
+	if user.user.Guest {
+		p.auth.upgradeGuestWithPasskey(ctx, guid, userAgent, ip)
+	}
+	return stored, nil
+}
+
+// BeginLogin starts a passkey login. Without a username, or for unknown
+// users and users without passkeys, the authenticator is asked for any
+// discoverable passkey of this relying party.
+func (p *PasskeyService) BeginLogin(ctx context.Context, username string) (*protocol.CredentialAssertion, error) {
+	rp, err := p.relyingParty()
+	if err != nil {
+		return nil, err
+	}
+
+	var user passkeyUser
+	if username != "" {
+		found, err := p.users.GetUserByUsername(ctx, username)
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			p.logger.Error("failed to look up user", zap.Error(err))
+			return nil, err
+		}
+		if err == nil {
+			if user, err = p.loadUser(ctx, found.GUID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var (
+		assertion *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		guid      *uuid.UUID
+	)
+	if len(user.creds) > 0 {
+		guid = &user.user.GUID
+		assertion, session, err = rp.BeginLogin(user)
+	} else {
+		assertion, session, err = rp.BeginDiscoverableLogin()
+	}
+	if err != nil {
+		p.logger.Error("failed to begin passkey login", zap.Error(err))
+		return nil, err
+	}
+
+	if err := p.storeCeremony(ctx, domain.WebAuthnLogin, guid, session); err != nil {
+		return nil, err
+	}
+	return assertion, nil
+}
+
+// FinishLogin verifies the assertion response and the sign counter and
+// issues tokens. A passkey with user verification counts as two factors,
+// without it a confirmed TOTP is still asked for.
+func (p *PasskeyService) FinishLogin(ctx context.Context, response []byte, userAgent, ip string) (domain.TokenPair, error) {
+	rp, err := p.relyingParty()
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		p.logger.Warn("invalid passkey login response", zap.Error(err))
+		return domain.TokenPair{}, ErrInvalidPasskey
+	}
+
+	ceremony, session, err := p.consumeCeremony(ctx, domain.WebAuthnLogin, parsed.Response.CollectedClientData.Challenge)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	var (
+		guid uuid.UUID
+		cred *webauthn.Credential
+	)
+	if ceremony.GUID != nil {
+		guid = *ceremony.GUID
+		user, err := p.loadUser(ctx, guid)
+		if err != nil {
+			return domain.TokenPair{}, err
+		}
+		cred, err = rp.ValidateLogin(user, session, parsed)
+	} else {
+		cred, err = rp.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			id, err := uuid.FromBytes(userHandle)
+			if err != nil {
+				return nil, err
+			}
+			guid = id
+			return p.loadUser(ctx, id)
+		}, session, parsed)
+	}
+	if err != nil {
+		p.logger.Warn("passkey login failed", zap.String("guid", guid.String()), zap.Error(err))
+		p.recordLoginFailure(ctx, guid, "invalid passkey", userAgent, ip)
+		return domain.TokenPair{}, ErrInvalidPasskey
+	}
+
+	if cred.Authenticator.CloneWarning {
+		p.logger.Warn("passkey sign counter did not increase", zap.String("guid", guid.String()))
+		p.recordLoginFailure(ctx, guid, "sign counter did not increase", userAgent, ip)
+		return domain.TokenPair{}, ErrInvalidPasskey
+	}
+	err = p.repo.UseCredential(ctx, cred.ID, cred.Authenticator.SignCount, cred.Flags.BackupState)
+	if errors.Is(err, domain.ErrNotFound) {
+		// a concurrent login with the same or a newer counter won the race
+		p.logger.Warn("passkey sign counter did not increase", zap.String("guid", guid.String()))
+		p.recordLoginFailure(ctx, guid, "sign counter did not increase", userAgent, ip)
+		return domain.TokenPair{}, ErrInvalidPasskey
+	}
+	if err != nil {
+		p.logger.Error("failed to update passkey", zap.Error(err))
+		return domain.TokenPair{}, err
+	}
+
+	amr := []string{domain.AMRHardwareKey}
+	if cred.Flags.UserVerified {
+		return p.auth.authorize(ctx, &guid, append(amr, domain.AMRMultiFactor), nil, userAgent, ip)
+	}
+	return p.auth.completeLogin(ctx, guid, amr, userAgent, ip)
+}
+
+func (p *PasskeyService) recordLoginFailure(ctx context.Context, guid uuid.UUID, reason, userAgent, ip string) {
+	p.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventLoginFailed,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"method": "passkey", "reason": reason},
+	})
+}
+
+// ListCredentials returns the passkeys of a user.
+func (p *PasskeyService) ListCredentials(ctx context.Context, guid uuid.UUID) ([]domain.WebAuthnCredential, error) {
+	creds, err := p.repo.ListCredentials(ctx, guid)
+	if err != nil {
+		p.logger.Error("failed to list passkeys", zap.Error(err))
+		return nil, err
+	}
+	return creds, nil
+}
+
+// DeleteCredential removes a passkey of a user.
+func (p *PasskeyService) DeleteCredential(ctx context.Context, guid uuid.UUID, id []byte, userAgent, ip string) error {
+	if err := p.repo.DeleteCredential(ctx, guid, id); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			p.logger.Error("failed to delete passkey", zap.Error(err))
+		}
+		return err
+	}
+
+	p.auth.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventPasskeyRemove,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"credential_id": EncodeCredentialID(id)},
+	})
+	return nil
+}
+
+// EncodeCredentialID encodes a credential ID the way WebAuthn clients do,
+// as unpadded base64url.
+func EncodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// DecodeCredentialID is the inverse of EncodeCredentialID.
+func DecodeCredentialID(id string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(id)
+}
+
+func validatePasskeyName(name string) error {
+	if utf8.RuneCountInString(name) > 64 {
+		return &ValidationError{Field: "name", Message: "must be at most 64 characters"}
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return &ValidationError{Field: "name", Message: "must not contain control characters"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+const testOrigin = "https://auth.example.com"
+
+// Flags of the authenticator data (WebAuthn section 6.1).
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// softAuthenticator is a software ES256 authenticator answering with
+// attestation "none", like most platform authenticators.
+type softAuthenticator struct {
+	t         *testing.T
+	rpID      string
+	credID    []byte
+	key       *ecdsa.PrivateKey
+	userID    []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rpID string) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{t: t, rpID: rpID, credID: credID, key: key}
+}
+
+func (a *softAuthenticator) clientData(kind, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{"type": kind, "challenge": challenge, "origin": testOrigin})
+	if err != nil {
+		a.t.Fatalf("marshal client data: %v", err)
+	}
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, extra []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, extra...)
+}
+
+// create answers a registration with a new credential.
+func (a *softAuthenticator) create(creation *protocol.CredentialCreation) []byte {
+	a.t.Helper()
+
+	a.userID = creation.Response.User.ID.(protocol.URLEncodedBase64)
+
+	coseKey, err := webauthncbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatalf("marshal cose key: %v", err)
+	}
+	attested := make([]byte, 16) // AAGUID, all zero for attestation none
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(attested, a.credID...)
+	attested = append(attested, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(flagUserPresent|flagUserVerified|flagAttestedData, attested),
+	})
+	if err != nil {
+		a.t.Fatalf("marshal attestation: %v", err)
+	}
+
+	return a.response(map[string]any{
+		"clientDataJSON":    encode(a.clientData("webauthn.create", creation.Response.Challenge.String())),
+		"attestationObject": encode(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get answers a login, counting the signature first.
+func (a *softAuthenticator) get(assertion *protocol.CredentialAssertion) []byte {
+	a.t.Helper()
+
+	a.signCount++
+	return a.sign(assertion.Response.Challenge.String())
+}
+
+// sign answers a login challenge with the current sign counter.
+func (a *softAuthenticator) sign(challenge string) []byte {
+	a.t.Helper()
+
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authData(flagUserPresent|flagUserVerified, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(slices.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("sign: %v", err)
+	}
+
+	return a.response(map[string]any{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(a.userID),
+	})
+}
+
+func (a *softAuthenticator) response(response map[string]any) []byte {
+	a.t.Helper()
+
+	data, err := json.Marshal(map[string]any{
+		"id":       encode(a.credID),
+		"rawId":    encode(a.credID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		a.t.Fatalf("marshal response: %v", err)
+	}
+	return data
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+type passkeyFixture struct {
+	passkeys *PasskeyService
+	repo     *fakeWebAuthn
+	sessions *fakeSessions
+	audit    *fakeAudit
+	user     domain.User
+	device   *softAuthenticator
+}
+
+func newPasskeyFixture(t *testing.T) *passkeyFixture {
+	t.Helper()
+
+	cfg := testConfig()
+	user := domain.User{GUID: uuid.New(), Username: "alice", Status: domain.UserActive}
+	users := newFakeUsers(user)
+	sessions := &fakeSessions{}
+	audit := &fakeAudit{}
+	repo := newFakeWebAuthn()
+
+	service := testAuthService(t, cfg, users, sessions, audit)
+	rpID, _ := cfg.WebAuthnRelyingParty()
+	return &passkeyFixture{
+		passkeys: NewPasskeyService(service, users, repo, cfg, zap.NewNop()),
+		repo:     repo,
+		sessions: sessions,
+		audit:    audit,
+		user:     user,
+		device:   newSoftAuthenticator(t, rpID),
+	}
+}
+
+// register adds the passkey of the fixture device to the user.
+func (f *passkeyFixture) register(t *testing.T) domain.WebAuthnCredential {
+	t.Helper()
+
+	ctx := context.Background()
+	creation, err := f.passkeys.BeginRegistration(ctx, f.user.GUID)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	cred, err := f.passkeys.FinishRegistration(ctx, f.user.GUID, "laptop", f.device.create(creation), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	return cred
+}
+
+func (f *passkeyFixture) beginLogin(t *testing.T) *protocol.CredentialAssertion {
+	t.Helper()
+
+	assertion, err := f.passkeys.BeginLogin(context.Background(), f.user.Username)
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	return assertion
+}
+
+func (f *passkeyFixture) finishLogin(response []byte) (domain.TokenPair, error) {
+	return f.passkeys.FinishLogin(context.Background(), response, "test", "127.0.0.1")
+}
+
+// lastLoginFailure returns the reason of the last audited failed login.
+func (f *passkeyFixture) lastLoginFailure() string {
+	f.audit.mu.Lock()
+	defer f.audit.mu.Unlock()
+
+	for i := len(f.audit.entries) - 1; i >= 0; i-- {
+		if f.audit.entries[i].EventType == domain.AuditEventLoginFailed {
+			return f.audit.entries[i].Details["reason"]
+		}
+	}
+	return ""
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	f := newPasskeyFixture(t)
+
+	cred := f.register(t)
+	if cred.AttestationType != "none" {
+		t.Errorf("attestation type = %q, want none", cred.AttestationType)
+	}
+	if cred.GUID != f.user.GUID || cred.Name != "laptop" || EncodeCredentialID(cred.ID) != encode(f.device.credID) {
+		t.Errorf("stored credential = %+v, want the device credential of the user", cred)
+	}
+
+	pair, err := f.finishLogin(f.device.get(f.beginLogin(t)))
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if pair.AccessToken == "" || pair.RefreshToken == "" {
+		t.Fatalf("FinishLogin returned no tokens: %+v", pair)
+	}
+
+	claims, err := f.passkeys.auth.tokens.ValidateAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateAccessToken: %v", err)
+	}
+	if sub, _ := claims["sub"].(string); sub != f.user.GUID.String() {
+		t.Errorf("sub = %q, want %s", sub, f.user.GUID)
+	}
+	if acr, _ := claims["acr"].(string); acr != domain.ACRMultiFactor {
+		t.Errorf("acr = %q, a user verifying passkey counts as multi-factor", acr)
+	}
+
+	if len(f.sessions.sessions) != 1 {
+		t.Fatalf("stored %d sessions, want 1", len(f.sessions.sessions))
+	}
+	if !slices.Contains(f.sessions.sessions[0].AMR, domain.AMRHardwareKey) {
+		t.Errorf("session amr = %v, want %s", f.sessions.sessions[0].AMR, domain.AMRHardwareKey)
+	}
+	if f.repo.creds[0].SignCount != 1 || f.repo.creds[0].LastUsedAt == nil {
+		t.Errorf("credential after login = %+v, want the sign counter recorded", f.repo.creds[0])
+	}
+	if events := f.audit.events(); !slices.Equal(events, []domain.AuditEventType{domain.AuditEventPasskeyRegister, domain.AuditEventAuthorize}) {
+		t.Errorf("audit events = %v", events)
+	}
+}
+
+func TestPasskeyDiscoverableLogin(t *testing.T) {
+	f := newPasskeyFixture(t)
+	f.register(t)
+
+	assertion, err := f.passkeys.BeginLogin(context.Background(), "")
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	if len(assertion.Response.AllowedCredentials) != 0 {
+		t.Errorf("discoverable login names credentials: %v", assertion.Response.AllowedCredentials)
+	}
+	if _, err := f.finishLogin(f.device.get(assertion)); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+}
+
+func TestPasskeyLoginRejectsNonIncreasingSignCount(t *testing.T) {
+	f := newPasskeyFixture(t)
+	f.register(t)
+
+	if _, err := f.finishLogin(f.device.get(f.beginLogin(t))); err != nil {
+		t.Fatalf("first FinishLogin: %v", err)
+	}
+
+	// a clone of the authenticator signs with the counter already seen
+	assertion := f.beginLogin(t)
+	if _, err := f.finishLogin(f.device.sign(assertion.Response.Challenge.String())); !errors.Is(err, ErrInvalidPasskey) {
+		t.Fatalf("FinishLogin with a replayed counter = %v, want ErrInvalidPasskey", err)
+	}
+	if len(f.sessions.sessions) != 1 {
+		t.Errorf("stored %d sessions, the replay must not log in", len(f.sessions.sessions))
+	}
+	if f.repo.creds[0].SignCount != 1 {
+		t.Errorf("sign count = %d, the replay must not update it", f.repo.creds[0].SignCount)
+	}
+	if reason := f.lastLoginFailure(); reason != "sign counter did not increase" {
+		t.Errorf("login failure reason = %q, want the sign counter", reason)
+	}
+}
+
+func TestPasskeyLoginLosesRaceWithNewerCounter(t *testing.T) {
+	f := newPasskeyFixture(t)
+	f.register(t)
+
+	// another login with a newer counter is stored after the credential
+	// was loaded, so the CloneWarning check passes and the update guards
+	f.repo.beforeUse = func() {
+		f.repo.mu.Lock()
+		defer f.repo.mu.Unlock()
+		f.repo.creds[0].SignCount = 5
+	}
+	if _, err := f.finishLogin(f.device.get(f.beginLogin(t))); !errors.Is(err, ErrInvalidPasskey) {
+		t.Fatalf("FinishLogin losing the race = %v, want ErrInvalidPasskey", err)
+	}
+	if len(f.sessions.sessions) != 0 {
+		t.Errorf("stored %d sessions, the losing login must not log in", len(f.sessions.sessions))
+	}
+	if reason := f.lastLoginFailure(); reason != "sign counter did not increase" {
+		t.Errorf("login failure reason = %q, want the sign counter", reason)
+	}
+}
+
+func TestPasskeyCeremonyCanNotBeReused(t *testing.T) {
+	f := newPasskeyFixture(t)
+	ctx := context.Background()
+
+	creation, err := f.passkeys.BeginRegistration(ctx, f.user.GUID)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	registration := f.device.create(creation)
+	if _, err := f.passkeys.FinishRegistration(ctx, f.user.GUID, "laptop", registration, "test", "127.0.0.1"); err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	if _, err := f.passkeys.FinishRegistration(ctx, f.user.GUID, "laptop", registration, "test", "127.0.0.1"); !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("second FinishRegistration = %v, want ErrInvalidPasskey", err)
+	}
+
+	login := f.device.get(f.beginLogin(t))
+	if _, err := f.finishLogin(login); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if _, err := f.finishLogin(login); !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("replayed FinishLogin = %v, want ErrInvalidPasskey", err)
+	}
+
+	// a registration challenge does not finish a login
+	creation, err = f.passkeys.BeginRegistration(ctx, f.user.GUID)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	f.device.signCount++
+	if _, err := f.finishLogin(f.device.sign(creation.Response.Challenge.String())); !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("FinishLogin with a registration challenge = %v, want ErrInvalidPasskey", err)
+	}
+	if len(f.sessions.sessions) != 1 {
+		t.Errorf("stored %d sessions, want only the first login", len(f.sessions.sessions))
+	}
+}
+
+func TestPasskeyCeremonyExpires(t *testing.T) {
+	f := newPasskeyFixture(t)
+	f.register(t)
+
+	assertion := f.beginLogin(t)
+	f.repo.mu.Lock()
+	for key, ceremony := range f.repo.ceremonies {
+		ceremony.ExpiresAt = time.Now().Add(-time.Second)
+		f.repo.ceremonies[key] = ceremony
+	}
+	f.repo.mu.Unlock()
+
+	if _, err := f.finishLogin(f.device.get(assertion)); !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("FinishLogin after expiry = %v, want ErrInvalidPasskey", err)
+	}
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// cheapArgon2 keeps the tests fast, the cost does not change the format.
+var cheapArgon2 = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestHashPassword(t *testing.T) {
+	encoded, err := hashPassword("correct horse", cheapArgon2)
+	if err != nil {
+		t.Fatalf("hashPassword: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q is not a PHC string of the parameters", encoded)
+	}
+
+	ok, params, err := verifyPassword("correct horse", encoded)
+	if err != nil || !ok {
+		t.Errorf("verifyPassword of the password = %v, %v", ok, err)
+	}
+	if params != cheapArgon2 {
+		t.Errorf("verifyPassword params = %+v, want %+v", params, cheapArgon2)
+	}
+	if ok, _, err := verifyPassword("correct horse!", encoded); err != nil || ok {
+		t.Errorf("verifyPassword of another password = %v, %v, want false", ok, err)
+	}
+
+	// every hash gets its own salt
+	if again, _ := hashPassword("correct horse", cheapArgon2); again == encoded {
+		t.Error("hashPassword returned the same hash twice")
+	}
+}
+
+func TestVerifyPasswordParsesPHC(t *testing.T) {
+	// "password" hashed with m=64,t=1,p=1 and the salt "saltsaltsaltsalt"
+	const known = "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0"
+
+	ok, params, err := verifyPassword("password", known)
+	if err != nil || !ok {
+		t.Fatalf("verifyPassword of a known hash = %v, %v", ok, err)
+	}
+	if params != cheapArgon2 {
+		t.Errorf("params = %+v, want %+v", params, cheapArgon2)
+	}
+
+	for _, encoded := range []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+		"$argon2id$v=19$m=64,t=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$not base64!",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	} {
+		if ok, _, err := verifyPassword("password", encoded); !errors.Is(err, errInvalidPasswordHash) || ok {
+			t.Errorf("verifyPassword(%q) = %v, %v, want errInvalidPasswordHash", encoded, ok, err)
+		}
+	}
+}
+
+// passwordUsers stores the password hash of a single user.
+type passwordUsers struct {
+	domain.UserRepository
+
+	user domain.User
+}
+
+func (r *passwordUsers) GetUserByUsername(ctx context.Context, username string) (domain.User, error) {
+	if username != r.user.Username {
+		return domain.User{}, domain.ErrNotFound
+	}
+	return r.user, nil
+}
+
+func (r *passwordUsers) UpdatePasswordHash(ctx context.Context, guid uuid.UUID, passwordHash string) error {
+	r.user.PasswordHash = passwordHash
+	return nil
+}
+
+func passwordService(t *testing.T, params Argon2Params, users domain.UserRepository) *AuthService {
+	t.Helper()
+
+	s := &AuthService{users: users, logger: zap.NewNop()}
+	s.ApplyConfig(config.Config{
+		Argon2Memory:      int(params.Memory),
+		Argon2Iterations:  int(params.Iterations),
+		Argon2Parallelism: int(params.Parallelism),
+	})
+	return s
+}
+
+func TestVerifyCredentialsRehashesOutdatedParameters(t *testing.T) {
+	old, err := hashPassword("correct horse", cheapArgon2)
+	if err != nil {
+		t.Fatalf("hashPassword: %v", err)
+	}
+	users := &passwordUsers{user: domain.User{GUID: uuid.New(), Username: "alice", PasswordHash: old}}
+
+	// a wrong password does not touch the hash
+	current := Argon2Params{Memory: 128, Iterations: 2, Parallelism: 1}
+	s := passwordService(t, current, users)
+	if _, err := s.verifyCredentials(context.Background(), "alice", "wrong horse"); !errors.Is(err, domain.ErrInvalidCredentials) {
+		t.Fatalf("verifyCredentials with a wrong password = %v, want ErrInvalidCredentials", err)
+	}
+	if users.user.PasswordHash != old {
+		t.Fatal("a failed login rehashed the password")
+	}
+
+	if _, err := s.verifyCredentials(context.Background(), "alice", "correct horse"); err != nil {
+		t.Fatalf("verifyCredentials: %v", err)
+	}
+	ok, params, err := verifyPassword("correct horse", users.user.PasswordHash)
+	if err != nil || !ok || params != current {
+		t.Errorf("rehashed password = %v, %+v, %v, want it verified with %+v", ok, params, err, current)
+	}
+
+	// a hash of the current parameters is kept
+	rehashed := users.user.PasswordHash
+	if _, err := s.verifyCredentials(context.Background(), "alice", "correct horse"); err != nil {
+		t.Fatalf("verifyCredentials: %v", err)
+	}
+	if users.user.PasswordHash != rehashed {
+		t.Error("a current hash was rehashed")
+	}
+}
+
+func TestVerifyCredentialsRejectsUnknownUsers(t *testing.T) {
+	users := &passwordUsers{user: domain.User{GUID: uuid.New(), Username: "alice"}}
+	s := passwordService(t, cheapArgon2, users)
+
+	for _, username := range []string{"bob", "alice"} {
+		if _, err := s.verifyCredentials(context.Background(), username, "correct horse"); !errors.Is(err, domain.ErrInvalidCredentials) {
+			t.Errorf("verifyCredentials(%q) = %v, want ErrInvalidCredentials", username, err)
+		}
+	}
+}
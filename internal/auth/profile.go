@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// UpdateProfile sets the display name and email of a user. A new email
+// is unverified until the user confirms it through the mailed link or code.
+func (s *AuthService) UpdateProfile(ctx context.Context, guid uuid.UUID, displayName, email, userAgent, ip string) (domain.User, error) {
+	if err := validateDisplayName(displayName); err != nil {
+		return domain.User{}, err
+	}
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			return domain.User{}, err
+		}
+	}
+
+	user, err := s.users.GetUser(ctx, guid)
+	if err != nil {
+		return domain.User{}, err
+	}
+	emailChanged := !strings.EqualFold(user.Email, email)
+	if user.Guest && emailChanged {
+		return domain.User{}, &ValidationError{Field: "email", Message: "guests have to upgrade their account to set one"}
+	}
+
+	if err := s.users.UpdateProfile(ctx, guid, displayName, email); err != nil {
+		if !errors.Is(err, domain.ErrAlreadyExists) {
+			s.logger.Error("failed to update profile", zap.Error(err))
+		}
+		return domain.User{}, err
+	}
+
+	details := map[string]string{}
+	if emailChanged {
+		details["email_changed"] = "true"
+		if err := s.verifications.DeleteEmailVerification(ctx, guid); err != nil {
+			s.logger.Warn("failed to delete email verification", zap.Error(err))
+		}
+		if email != "" {
+			if err := s.sendEmailVerification(ctx, guid, email); err != nil {
+				s.logger.Error("failed to send email verification", zap.String("guid", guid.String()), zap.Error(err))
+			}
+		}
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventProfileUpdate,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+
+	return s.users.GetUser(ctx, guid)
+}
+
+// DeleteAccount deletes the user on its own request. Its sessions end
+// at once, the account with its credentials is purged after the
+// retention window.
+func (s *AuthService) DeleteAccount(ctx context.Context, guid uuid.UUID, userAgent, ip string) error {
+	if err := s.users.SetUserStatus(ctx, guid, domain.UserDeleted, "deleted by user", nil); err != nil {
+		s.logger.Error("failed to delete user", zap.Error(err))
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventAccountDelete,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+	})
+	return nil
+}
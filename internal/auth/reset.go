@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/mailer"
+	"go.uber.org/zap"
+)
+
+const mailTimeout = 30 * time.Second
+
+// ErrInvalidResetToken is returned for unknown, used and expired reset tokens alike.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// ForgotPassword mails a reset token to the user owning email. It behaves
+// the same whether or not such a user exists, so it can not be used to
+// find out which emails are registered: past the lookup of the user, the
+// work is done in the background.
+func (s *AuthService) ForgotPassword(ctx context.Context, email, userAgent, ip string) error {
+	user, err := s.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, domain.ErrNotFound) || (err == nil && (!user.HasPassword() || !user.Active())) {
+		return nil
+	}
+	if err != nil {
+		s.logger.Error("failed to look up user for password reset", zap.Error(err))
+		return err
+	}
+
+	go s.sendPasswordReset(user, userAgent, ip)
+	return nil
+}
+
+// sendPasswordReset stores a reset token of user and mails it. It runs
+// detached from the request, so it has its own deadline.
+func (s *AuthService) sendPasswordReset(user domain.User, userAgent, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	settings := s.settings.Load()
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		s.logger.Error("failed to generate reset token", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	err = s.resets.StorePasswordResetToken(ctx, domain.PasswordResetToken{
+		TokenHash: tokenHash,
+		GUID:      user.GUID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(settings.passwordResetTTL),
+	})
+	if err != nil {
+		s.logger.Error("failed to store reset token", zap.Error(err))
+		return
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      user.GUID,
+		EventType: domain.AuditEventPasswordReset,
+		Actor:     user.GUID.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"step": "requested"},
+	})
+
+	link := settings.publicHost + "/reset-password?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"A password reset was requested for your account.\n\n"+
+				"Open %s or use this token to choose a new password:\n\n%s\n\n"+
+				"The token expires in %s and can only be used once. "+
+				"If you did not request a reset, you can ignore this email.\n",
+			link, token, settings.passwordResetTTL,
+		),
+	}
+	if err := settings.mailer.Send(ctx, msg); err != nil {
+		s.logger.Error("failed to send password reset mail", zap.String("guid", user.GUID.String()), zap.Error(err))
+	}
+}
+
+// ResetPassword sets a new password using a reset token. The token is
+// spent only once the new password passed the policy, and every session
+// of the user is revoked afterwards.
+func (s *AuthService) ResetPassword(ctx context.Context, token, newPassword, userAgent, ip string) error {
+	tokenHash := hashOpaqueToken(token)
+
+	stored, err := s.resets.GetPasswordResetToken(ctx, tokenHash)
+	if errors.Is(err, domain.ErrNotFound) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		s.logger.Error("failed to get reset token", zap.Error(err))
+		return err
+	}
+
+	user, err := s.users.GetUser(ctx, stored.GUID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkNewPassword(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(newPassword, s.settings.Load().argon2)
+	if err != nil {
+		s.logger.Error("failed to hash password", zap.Error(err))
+		return err
+	}
+
+	guid, err := s.resets.ConsumePasswordResetToken(ctx, tokenHash)
+	if errors.Is(err, domain.ErrNotFound) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		s.logger.Error("failed to consume reset token", zap.Error(err))
+		return err
+	}
+
+	if err := s.users.UpdatePasswordHash(ctx, guid, hash); err != nil {
+		s.logger.Error("failed to update password", zap.Error(err))
+		return err
+	}
+
+	if err := s.resets.DeletePasswordResetTokens(ctx, guid); err != nil {
+		s.logger.Warn("failed to delete remaining reset tokens", zap.Error(err))
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventPasswordReset,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"step": "completed"},
+	})
+
+	return s.revoke(ctx, guid, guid.String(), "password reset", userAgent, ip)
+}
+
+// newOpaqueToken returns a random url-safe token and the hash it is stored under.
+func newOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOpaqueToken(token), nil
+}
+
+// hashOpaqueToken hashes high entropy tokens for storage. Unlike passwords
+// they can not be guessed, so a fast unsalted hash that allows lookups is enough.
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
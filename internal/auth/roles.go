@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Role and permission management. Like the other admin operations every
+// change is recorded on behalf of actor. Users see changes with their
+// next access token.
+
+// rbacNamePattern is shared by roles and permissions, it allows names
+// like "admin" or "orders:read".
+var rbacNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_.:-]{0,63}$`)
+
+func validateRBACName(field, name string) error {
+	if !rbacNamePattern.MatchString(name) {
+		return &ValidationError{Field: field, Message: "must be 1 to 64 lowercase letters, digits, dots, colons, dashes or underscores, starting with a letter"}
+	}
+	return nil
+}
+
+func validateDescription(description string) error {
+	if utf8.RuneCountInString(description) > 200 || strings.IndexFunc(description, unicode.IsControl) >= 0 {
+		return &ValidationError{Field: "description", Message: "must be at most 200 characters without control characters"}
+	}
+	return nil
+}
+
+func (s *AuthService) CreatePermission(ctx context.Context, actor string, permission domain.Permission) error {
+	if err := validateRBACName("name", permission.Name); err != nil {
+		return err
+	}
+	if err := validateDescription(permission.Description); err != nil {
+		return err
+	}
+
+	if err := s.roles.CreatePermission(ctx, permission); err != nil {
+		if !errors.Is(err, domain.ErrAlreadyExists) {
+			s.logger.Error("failed to create permission", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, uuid.Nil, "permission_create", map[string]string{"permission": permission.Name})
+	return nil
+}
+
+func (s *AuthService) ListPermissions(ctx context.Context) ([]domain.Permission, error) {
+	return s.roles.ListPermissions(ctx)
+}
+
+func (s *AuthService) DeletePermission(ctx context.Context, actor, name string) error {
+	if err := s.roles.DeletePermission(ctx, name); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to delete permission", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, uuid.Nil, "permission_delete", map[string]string{"permission": name})
+	return nil
+}
+
+// CreateRole creates a role with existing permissions.
+func (s *AuthService) CreateRole(ctx context.Context, actor string, role domain.Role) (domain.Role, error) {
+	role, err := normalizeRole(role)
+	if err != nil {
+		return domain.Role{}, err
+	}
+
+	if err := s.roles.CreateRole(ctx, role); err != nil {
+		if !errors.Is(err, domain.ErrAlreadyExists) && !errors.Is(err, domain.ErrUnknownPermission) {
+			s.logger.Error("failed to create role", zap.Error(err))
+		}
+		return domain.Role{}, err
+	}
+
+	s.recordAdminAction(ctx, actor, uuid.Nil, "role_create", map[string]string{
+		"role":        role.Name,
+		"permissions": strings.Join(role.Permissions, " "),
+	})
+	return s.roles.GetRole(ctx, role.Name)
+}
+
+// UpdateRole replaces the description and permissions of a role.
+func (s *AuthService) UpdateRole(ctx context.Context, actor string, role domain.Role) (domain.Role, error) {
+	role, err := normalizeRole(role)
+	if err != nil {
+		return domain.Role{}, err
+	}
+
+	if err := s.roles.UpdateRole(ctx, role); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) && !errors.Is(err, domain.ErrUnknownPermission) {
+			s.logger.Error("failed to update role", zap.Error(err))
+		}
+		return domain.Role{}, err
+	}
+
+	s.recordAdminAction(ctx, actor, uuid.Nil, "role_update", map[string]string{
+		"role":        role.Name,
+		"permissions": strings.Join(role.Permissions, " "),
+	})
+	return s.roles.GetRole(ctx, role.Name)
+}
+
+func normalizeRole(role domain.Role) (domain.Role, error) {
+	if err := validateRBACName("name", role.Name); err != nil {
+		return domain.Role{}, err
+	}
+	if err := validateDescription(role.Description); err != nil {
+		return domain.Role{}, err
+	}
+	for _, p := range role.Permissions {
+		if err := validateRBACName("permissions", p); err != nil {
+			return domain.Role{}, err
+		}
+	}
+
+	role.Permissions = slices.Compact(slices.Sorted(slices.Values(role.Permissions)))
+	return role, nil
+}
+
+func (s *AuthService) GetRole(ctx context.Context, name string) (domain.Role, error) {
+	return s.roles.GetRole(ctx, name)
+}
+
+func (s *AuthService) ListRoles(ctx context.Context) ([]domain.Role, error) {
+	return s.roles.ListRoles(ctx)
+}
+
+// DeleteRole deletes a role and takes it away from every user.
+func (s *AuthService) DeleteRole(ctx context.Context, actor, name string) error {
+	if err := s.roles.DeleteRole(ctx, name); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to delete role", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, uuid.Nil, "role_delete", map[string]string{"role": name})
+	return nil
+}
+
+func (s *AuthService) AssignRole(ctx context.Context, actor string, guid uuid.UUID, role string) error {
+	if err := s.roles.AssignRole(ctx, guid, role); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to assign role", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, guid, "role_assign", map[string]string{"role": role})
+	return nil
+}
+
+func (s *AuthService) UnassignRole(ctx context.Context, actor string, guid uuid.UUID, role string) error {
+	if err := s.roles.UnassignRole(ctx, guid, role); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to unassign role", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAdminAction(ctx, actor, guid, "role_unassign", map[string]string{"role": role})
+	return nil
+}
+
+// UserRoles returns the roles of a user and the permissions they grant.
+func (s *AuthService) UserRoles(ctx context.Context, guid uuid.UUID) ([]string, []string, error) {
+	if _, err := s.users.GetUser(ctx, guid); err != nil {
+		return nil, nil, err
+	}
+	return s.roles.UserRoles(ctx, guid)
+}
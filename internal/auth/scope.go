@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidScope is returned when a scope is requested that the user or
+// the session is not allowed.
+var ErrInvalidScope = errors.New("invalid scope")
+
+// downscopeMaxTTL caps the lifetime of downscoped access tokens, they are
+// handed to less trusted components and cannot be revoked on their own.
+const downscopeMaxTTL = 5 * time.Minute
+
+// scopesFor returns the scopes a user with permissions may request.
+func scopesFor(permissions []string) []string {
+	return slices.Compact(slices.Sorted(slices.Values(append(domain.BaseScopes(), permissions...))))
+}
+
+// allowedScopes returns the scopes the user may currently request.
+func (s *AuthService) allowedScopes(ctx context.Context, guid uuid.UUID) ([]string, error) {
+	_, permissions, err := s.roles.UserRoles(ctx, guid)
+	if err != nil {
+		s.logger.Error("failed to get user roles", zap.Error(err))
+		return nil, err
+	}
+	return scopesFor(permissions), nil
+}
+
+// checkNarrowedScope checks that scope is within the scope of the session,
+// or within what the user is allowed if the session was not narrowed.
+func (s *AuthService) checkNarrowedScope(ctx context.Context, guid uuid.UUID, scope, session []string) error {
+	allowed := session
+	if allowed == nil {
+		var err error
+		if allowed, err = s.allowedScopes(ctx, guid); err != nil {
+			return err
+		}
+	}
+	if !domain.ScopeSubset(scope, allowed) {
+		return ErrInvalidScope
+	}
+	return nil
+}
+
+// Downscope issues a short lived access token for the current session
+// with part of the scope of the current access token and the same active
+// organization. It carries no authentication methods, so it never passes
+// a step-up check, and it expires at the latest with the current token.
+// expiresIn 0 picks the longest lifetime allowed.
+func (s *AuthService) Downscope(ctx context.Context, guid uuid.UUID, sessionID string, current, scope []string, currentExpiresAt time.Time, expiresIn time.Duration, userAgent, ip string) (string, time.Time, error) {
+	if len(scope) == 0 || !domain.ScopeSubset(scope, current) {
+		return "", time.Time{}, ErrInvalidScope
+	}
+	if expiresIn < 0 || expiresIn > downscopeMaxTTL {
+		return "", time.Time{}, &ValidationError{Field: "expires_in", Message: "must be between 0 and 300 seconds"}
+	}
+	if expiresIn == 0 {
+		expiresIn = downscopeMaxTTL
+	}
+
+	expiresAt := time.Now().Add(expiresIn)
+	if !currentExpiresAt.IsZero() && currentExpiresAt.Before(expiresAt) {
+		expiresAt = currentExpiresAt
+	}
+
+	stored, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil || stored.GUID != guid {
+		s.logger.Warn("downscope for unknown session", zap.String("guid", guid.String()))
+		return "", time.Time{}, domain.ErrNotFound
+	}
+
+	// permissions are checked again so a removed one is not passed on
+	_, permissions, err := s.roles.UserRoles(ctx, guid)
+	if err != nil {
+		s.logger.Error("failed to get user roles", zap.Error(err))
+		return "", time.Time{}, err
+	}
+
+	accessToken, err := s.tokens.GenerateAccessToken(domain.AccessClaims{
+		GUID:        guid,
+		SessionID:   sessionID,
+		Permissions: domain.IntersectScope(permissions, scope),
+		Scope:       scope,
+		OrgID:       stored.OrgID,
+		ClientID:    stored.ClientID,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		s.logger.Error("failed to generate access token", zap.String("reason", err.Error()))
+		return "", time.Time{}, err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventDownscope,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"session_id": sessionID,
+			"scope":      domain.FormatScope(scope),
+			"expires_at": expiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+	return accessToken, expiresAt, nil
+}
@@ -4,116 +4,356 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
 	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/mailer"
+	"github.com/nerfthisdev/go-backend-test-task/internal/password"
 	"go.uber.org/zap"
 )
 
+// serviceSettings holds the reloadable part of the AuthService configuration.
+type serviceSettings struct {
+	refreshTTL    time.Duration
+	guestTTL      time.Duration
+	webhookURL    string
+	webhookClient *http.Client
+	argon2        Argon2Params
+	// deletedUserRetention is how long soft-deleted users are kept.
+	deletedUserRetention time.Duration
+	// dummyPasswordHash is verified against when a login names an unknown
+	// user, so that the response time does not reveal whether it exists.
+	dummyPasswordHash string
+
+	passwordPolicy password.Policy
+	breachedPath   string
+	breached       password.BreachChecker
+
+	publicHost       string
+	passwordResetTTL time.Duration
+	mailer           mailer.Mailer
+
+	emailVerificationTTL time.Duration
+	requireVerifiedEmail bool
+	emailLoginTTL        time.Duration
+	invitationTTL        time.Duration
+	apiKeyMaxTTL         time.Duration
+
+	mfaIssuer string
+}
+
 type AuthService struct {
-	repo   domain.TokenRepository
-	tokens domain.TokenService
-	users  domain.UserRepository
-	logger *zap.Logger
+	repo          domain.TokenRepository
+	tokens        domain.TokenService
+	users         domain.UserRepository
+	audit         domain.AuditRepository
+	resets        domain.PasswordResetRepository
+	verifications domain.EmailVerificationRepository
+	emailLogins   domain.EmailLoginRepository
+	mfa           domain.MFARepository
+	roles         domain.RoleRepository
+	orgs          domain.OrganizationRepository
+	apiKeys       domain.APIKeyRepository
+	logger        *zap.Logger
+	settings      atomic.Pointer[serviceSettings]
+	// now is the clock TOTP codes are checked against.
+	now func() time.Time
+}
+
+func NewAuthService(repo domain.TokenRepository, tokens domain.TokenService, users domain.UserRepository, audit domain.AuditRepository, resets domain.PasswordResetRepository, verifications domain.EmailVerificationRepository, emailLogins domain.EmailLoginRepository, mfa domain.MFARepository, roles domain.RoleRepository, orgs domain.OrganizationRepository, apiKeys domain.APIKeyRepository, cfg config.Config, logger *zap.Logger) *AuthService {
+	s := &AuthService{
+		repo:          repo,
+		tokens:        tokens,
+		users:         users,
+		audit:         audit,
+		resets:        resets,
+		verifications: verifications,
+		emailLogins:   emailLogins,
+		mfa:           mfa,
+		roles:         roles,
+		orgs:          orgs,
+		apiKeys:       apiKeys,
+		logger:        logger,
+		now:           time.Now,
+	}
+	s.ApplyConfig(cfg)
+	return s
+}
+
+// ApplyConfig swaps in the TTLs and retention, webhook, password and mail settings.
+func (s *AuthService) ApplyConfig(cfg config.Config) {
+	previous := s.settings.Load()
+
+	settings := &serviceSettings{
+		refreshTTL:    cfg.RefreshTTL,
+		guestTTL:      cfg.GuestTTL,
+		webhookURL:    cfg.WebhookURL,
+		webhookClient: &http.Client{Timeout: cfg.WebhookTimeout},
+		argon2: Argon2Params{
+			Memory:      uint32(cfg.Argon2Memory),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		},
+		passwordPolicy: password.Policy{
+			MinLength:  cfg.PasswordMinLength,
+			MaxLength:  cfg.PasswordMaxLength,
+			MinClasses: cfg.PasswordMinClasses,
+		},
+		breachedPath:     cfg.BreachedPasswordsPath,
+		publicHost:       cfg.PublicHost,
+		passwordResetTTL: cfg.PasswordResetTTL,
+
+		emailVerificationTTL: cfg.EmailVerificationTTL,
+		requireVerifiedEmail: cfg.RequireVerifiedEmail,
+		emailLoginTTL:        cfg.EmailLoginTTL,
+		invitationTTL:        cfg.InvitationTTL,
+		apiKeyMaxTTL:         cfg.APIKeyMaxTTL,
+
+		mfaIssuer: cfg.MFAIssuer,
+
+		deletedUserRetention: cfg.DeletedUserRetention,
+	}
+
+	if cfg.SMTPHost != "" {
+		settings.mailer = mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+		})
+	} else {
+		settings.mailer = mailer.NewLogMailer(s.logger)
+	}
+
+	// the corpus can be large, it is only reloaded when its path changes
+	if previous != nil && previous.breachedPath == cfg.BreachedPasswordsPath {
+		settings.breached = previous.breached
+	} else if checker, err := password.OpenBreachChecker(cfg.BreachedPasswordsPath); err != nil {
+		s.logger.Error("failed to load breached password corpus, check disabled", zap.Error(err))
+		settings.breached = password.NoBreachCheck{}
+	} else {
+		settings.breached = checker
+	}
+
+	dummy, err := hashPassword(uuid.NewString(), settings.argon2)
+	if err != nil {
+		s.logger.Error("failed to generate dummy password hash", zap.Error(err))
+	}
+	settings.dummyPasswordHash = dummy
+
+	s.settings.Store(settings)
+}
+
+// Authorize issues tokens without any authentication method, for new
+// anonymous users or on behalf of an admin. A nil scope grants everything
+// the user is allowed.
+func (s *AuthService) Authorize(ctx context.Context, guid *uuid.UUID, scope []string, useragent, ip string) (domain.TokenPair, error) {
+	if scope != nil {
+		allowed := domain.BaseScopes()
+		if guid != nil {
+			var err error
+			if allowed, err = s.allowedScopes(ctx, *guid); err != nil {
+				return domain.TokenPair{}, err
+			}
+		}
+		if !domain.ScopeSubset(scope, allowed) {
+			return domain.TokenPair{}, ErrInvalidScope
+		}
+	}
+	return s.authorize(ctx, guid, nil, scope, useragent, ip)
 }
 
-func NewAuthService(repo domain.TokenRepository, tokens domain.TokenService, users domain.UserRepository, logger *zap.Logger) *AuthService {
-	return &AuthService{
-		repo:   repo,
-		tokens: tokens,
-		users:  users,
-		logger: logger,
+// authorize issues tokens for a session started with the methods in amr.
+func (s *AuthService) authorize(ctx context.Context, guid *uuid.UUID, amr, scope []string, useragent, ip string) (domain.TokenPair, error) {
+	pair, err := s.issueTokens(ctx, guid, domain.RefreshToken{AMR: amr, AuthTime: time.Now(), Scope: scope}, useragent, ip)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	details := map[string]string{"session_id": pair.sessionID}
+	if len(amr) > 0 {
+		details["amr"] = strings.Join(amr, " ")
+	}
+	if scope != nil {
+		details["scope"] = domain.FormatScope(scope)
 	}
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      pair.guid,
+		EventType: domain.AuditEventAuthorize,
+		Actor:     pair.guid.String(),
+		IP:        ip,
+		UserAgent: useragent,
+		Details:   details,
+	})
+
+	return pair.TokenPair, nil
 }
 
-func (s *AuthService) Authorize(ctx context.Context, guid *uuid.UUID, useragent, ip string) (domain.TokenPair, error) {
-	sessionID := uuid.NewString()
+// issuedTokens is a token pair together with the session it was issued for.
+type issuedTokens struct {
+	domain.TokenPair
+	guid      uuid.UUID
+	sessionID string
+}
+
+// issueTokens stores a session with a new refresh token. session holds
+// what it carries over: the authentication methods and auth_time, the
+// scope it was narrowed to and the active organization. A session ID or
+// expiry set in it is kept, otherwise a new session is started.
+func (s *AuthService) issueTokens(ctx context.Context, guid *uuid.UUID, session domain.RefreshToken, useragent, ip string) (issuedTokens, error) {
+	settings := s.settings.Load()
+	if session.SessionID == "" {
+		session.SessionID = uuid.NewString()
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = time.Now().Add(settings.refreshTTL)
+	}
 
 	if guid == nil {
+		// a new anonymous user can never have a verified email
+		if settings.requireVerifiedEmail {
+			return issuedTokens{}, domain.ErrEmailNotVerified
+		}
+
 		newGuid := uuid.New()
-		err := s.users.CreateUser(ctx, newGuid)
+		err := s.users.CreateUser(ctx, newGuid, true)
 		if err != nil {
-			return domain.TokenPair{}, err
+			return issuedTokens{}, err
 		}
 		guid = &newGuid
 	}
 
-	exists, err := s.users.UserExists(ctx, *guid)
+	user, err := s.users.GetUser(ctx, *guid)
+	if errors.Is(err, domain.ErrNotFound) {
+		s.logger.Warn("unauthorized attempt with unknown guid", zap.String("guid", guid.String()))
+		return issuedTokens{}, fmt.Errorf("user does not exist")
+	}
 	if err != nil {
 		s.logger.Error("failed to check user existance", zap.String("reason", err.Error()))
-		return domain.TokenPair{}, err
+		return issuedTokens{}, err
 	}
 
-	if !exists {
-		s.logger.Warn("unauthorized attempt with unknown guid", zap.String("guid", guid.String()))
-		return domain.TokenPair{}, fmt.Errorf("user does not exist")
+	if err := user.CheckActive(); err != nil {
+		s.logger.Warn("unauthorized attempt for inactive user", zap.String("guid", guid.String()), zap.String("status", string(user.Status)))
+		return issuedTokens{}, err
+	}
+	if settings.requireVerifiedEmail && !user.Verified() {
+		return issuedTokens{}, domain.ErrEmailNotVerified
 	}
 
-	accessToken, err := s.tokens.GenerateAccessToken(*guid, sessionID)
+	session.GUID = *guid
+	accessToken, granted, err := s.generateAccessToken(ctx, session)
 	if err != nil {
-		s.logger.Error("failed to generate access token", zap.String("reason", err.Error()))
-		return domain.TokenPair{}, err
+		return issuedTokens{}, err
 	}
 
 	refreshPlain, err := s.tokens.GenerateRefreshToken()
 	if err != nil {
 		s.logger.Error("failed to generate refresh token", zap.String("reason", err.Error()))
-		return domain.TokenPair{}, err
+		return issuedTokens{}, err
 	}
 
 	hashed, err := s.tokens.HashRefreshToken(refreshPlain)
 	if err != nil {
 		s.logger.Error("failed to hash refresh token", zap.Error(err))
-		return domain.TokenPair{}, err
+		return issuedTokens{}, err
 	}
 
-	refreshToken := domain.RefreshToken{
-		GUID:      *guid,
-		TokenHash: hashed,
-		SessionID: sessionID,
-		UserAgent: useragent,
-		IP:        ip,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-	}
+	session.TokenHash = hashed
+	session.UserAgent = useragent
+	session.IP = ip
+	session.CreatedAt = time.Now()
 
-	if err := s.repo.StoreRefreshToken(ctx, refreshToken); err != nil {
+	if err := s.repo.StoreRefreshToken(ctx, session); err != nil {
 		s.logger.Error("failed to store refresh token", zap.Error(err))
-		return domain.TokenPair{}, err
+		return issuedTokens{}, err
 	}
-	return domain.TokenPair{
-		AccessToken:  accessToken,
-		RefreshToken: s.tokens.EncodeBase64(refreshPlain),
+	return issuedTokens{
+		TokenPair: domain.TokenPair{
+			AccessToken:  accessToken,
+			RefreshToken: s.tokens.EncodeBase64(refreshPlain),
+			Scope:        domain.FormatScope(granted),
+		},
+		guid:      *guid,
+		sessionID: session.SessionID,
 	}, nil
 }
 
-func (s *AuthService) Refresh(ctx context.Context, guid uuid.UUID, sessionID, refreshToken, userAgent, ip string) (domain.TokenPair, error) {
-	stored, err := s.repo.GetRefreshToken(ctx, guid)
+// generateAccessToken issues an access token for a session, carrying the
+// current roles and permissions of the user. The token is granted the
+// part of the session scope the user is still allowed, or everything if
+// the session is not narrowed, and only the permissions within it.
+func (s *AuthService) generateAccessToken(ctx context.Context, session domain.RefreshToken) (string, []string, error) {
+	roles, permissions, err := s.roles.UserRoles(ctx, session.GUID)
+	if err != nil {
+		s.logger.Error("failed to get user roles", zap.Error(err))
+		return "", nil, err
+	}
+
+	granted := scopesFor(permissions)
+	if session.Scope != nil {
+		granted = domain.IntersectScope(session.Scope, granted)
+	}
+
+	accessToken, err := s.tokens.GenerateAccessToken(domain.AccessClaims{
+		GUID:        session.GUID,
+		SessionID:   session.SessionID,
+		AMR:         session.AMR,
+		ACR:         domain.ACRForAMR(session.AMR),
+		AuthTime:    session.AuthTime,
+		Roles:       roles,
+		Permissions: domain.IntersectScope(permissions, granted),
+		Scope:       granted,
+		OrgID:       session.OrgID,
+		ClientID:    session.ClientID,
+	})
+	if err != nil {
+		s.logger.Error("failed to generate access token", zap.String("reason", err.Error()))
+		return "", nil, err
+	}
+	return accessToken, granted, nil
+}
+
+// Refresh rotates the session. A non nil scope narrows the session, it
+// has to be within what the session was granted before.
+func (s *AuthService) Refresh(ctx context.Context, guid uuid.UUID, sessionID, refreshToken string, scope []string, userAgent, ip string) (domain.TokenPair, error) {
+	stored, err := s.repo.GetSession(ctx, sessionID)
+	if errors.Is(err, domain.ErrNotFound) {
+		s.logger.Warn("refresh failed: no stored token", zap.String("guid", guid.String()))
+		return domain.TokenPair{}, fmt.Errorf("unauthorized")
+	}
 	if err != nil {
-		s.logger.Error("refresh failed: no stored token", zap.Error(err))
-		return domain.TokenPair{}, nil
+		s.logger.Error("refresh failed: failed to get stored token", zap.Error(err))
+		return domain.TokenPair{}, fmt.Errorf("failed to get refresh token: %w", err)
 	}
 
-	if stored.SessionID != sessionID {
+	// sessions of a client are refreshed through the token endpoint
+	if stored.GUID != guid || stored.ClientID != "" {
 		s.logger.Warn("session id doesnt match", zap.String("guid", guid.String()))
-		s.repo.DeleteRefreshToken(ctx, guid)
+		if session, err := s.firstPartySession(ctx, guid); err == nil {
+			s.revokeSession(ctx, guid, session.SessionID, guid.String(), "session id mismatch", userAgent, ip)
+		}
 		return domain.TokenPair{}, fmt.Errorf("unauthorized")
 	}
 
 	decoded, err := s.tokens.DecodeBase64(refreshToken)
 	if err != nil || !s.tokens.CompareRefreshToken(decoded, stored.TokenHash) {
 		s.logger.Warn("refresh token mismatch or tampered", zap.String("guid", guid.String()))
-		s.repo.DeleteRefreshToken(ctx, guid)
+		s.revokeSession(ctx, guid, sessionID, guid.String(), "refresh token mismatch", userAgent, ip)
 		return domain.TokenPair{}, fmt.Errorf("unauthorized")
 	}
 
 	if stored.UserAgent != userAgent {
 		s.logger.Warn("user-agent mismatch", zap.String("guid", guid.String()))
-		s.Deauthorize(ctx, guid)
+		s.revokeSession(ctx, guid, sessionID, guid.String(), "user-agent mismatch", userAgent, ip)
 		return domain.TokenPair{}, fmt.Errorf("unauthorized")
 	}
 
@@ -121,19 +361,138 @@ func (s *AuthService) Refresh(ctx context.Context, guid uuid.UUID, sessionID, re
 		go s.sendIPChangeWebhook(guid, stored.IP, ip, userAgent)
 	}
 
-	return s.Authorize(ctx, &guid, userAgent, ip)
+	if scope == nil {
+		scope = stored.Scope
+	} else if err := s.checkNarrowedScope(ctx, guid, scope, stored.Scope); err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	// the new session keeps the authentication of the one it replaces
+	pair, err := s.issueTokens(ctx, &guid, domain.RefreshToken{
+		AMR:      stored.AMR,
+		AuthTime: stored.AuthTime,
+		Scope:    scope,
+		OrgID:    stored.OrgID,
+		ClientID: stored.ClientID,
+	}, userAgent, ip)
+	if err != nil {
+		return domain.TokenPair{}, err
+	}
+
+	details := map[string]string{
+		"previous_session_id": sessionID,
+		"session_id":          pair.sessionID,
+		"previous_ip":         stored.IP,
+	}
+	if scope != nil {
+		details["scope"] = domain.FormatScope(scope)
+	}
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventRefresh,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   details,
+	})
+
+	return pair.TokenPair, nil
+}
+
+// Deauthorize ends the current session. Without one, as with an API key,
+// it ends the session the user started without a client.
+func (s *AuthService) Deauthorize(ctx context.Context, guid uuid.UUID, sessionID, userAgent, ip string) error {
+	if sessionID == "" {
+		session, err := s.firstPartySession(ctx, guid)
+		if errors.Is(err, domain.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sessionID = session.SessionID
+	}
+	err := s.revokeSession(ctx, guid, sessionID, guid.String(), "deauthorized by user", userAgent, ip)
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil
+	}
+	return err
 }
 
-func (s *AuthService) Deauthorize(ctx context.Context, guid uuid.UUID) error {
-	err := s.repo.DeleteRefreshToken(ctx, guid)
+// revoke deletes every session of the user and records the revocation.
+func (s *AuthService) revoke(ctx context.Context, guid uuid.UUID, actor, reason, userAgent, ip string) error {
+	err := s.repo.DeleteUserSessions(ctx, guid)
 	if err != nil {
 		s.logger.Error("failed to deauth user", zap.Error(err))
 		return err
 	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventRevoke,
+		Actor:     actor,
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"reason": reason},
+	})
 	return nil
 }
 
+// revokeSession deletes a single session of the user and records the
+// revocation, the other sessions are kept.
+func (s *AuthService) revokeSession(ctx context.Context, guid uuid.UUID, sessionID, actor, reason, userAgent, ip string) error {
+	if _, err := s.repo.DeleteSession(ctx, sessionID); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to revoke session", zap.Error(err))
+		}
+		return err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventRevoke,
+		Actor:     actor,
+		IP:        ip,
+		UserAgent: userAgent,
+		Details: map[string]string{
+			"reason":     reason,
+			"session_id": sessionID,
+		},
+	})
+	return nil
+}
+
+// firstPartySession returns the session the user started without an
+// OAuth client, or ErrNotFound.
+func (s *AuthService) firstPartySession(ctx context.Context, guid uuid.UUID) (domain.RefreshToken, error) {
+	sessions, err := s.repo.ListSessions(ctx, &guid)
+	if err != nil {
+		return domain.RefreshToken{}, err
+	}
+	for _, session := range sessions {
+		if session.ClientID == "" {
+			return session, nil
+		}
+	}
+	return domain.RefreshToken{}, domain.ErrNotFound
+}
+
+func (s *AuthService) recordAudit(ctx context.Context, entry domain.AuditEntry) {
+	if err := s.audit.AppendAuditEntry(ctx, &entry); err != nil {
+		s.logger.Error("failed to write audit entry",
+			zap.String("event_type", string(entry.EventType)),
+			zap.String("guid", entry.GUID.String()),
+			zap.Error(err),
+		)
+	}
+}
+
 func (s *AuthService) sendIPChangeWebhook(guid uuid.UUID, oldIP, newIP, ua string) {
+	settings := s.settings.Load()
+	if settings.webhookURL == "" {
+		return
+	}
+
 	type WebhookPayload struct {
 		GUID      string `json:"guid"`
 		OldIP     string `json:"old_ip"`
@@ -151,8 +510,10 @@ func (s *AuthService) sendIPChangeWebhook(guid uuid.UUID, oldIP, newIP, ua strin
 	}
 
 	body, _ := json.Marshal(payload)
-	_, err := http.Post(os.Getenv("WEBHOOK_URL"), "application/json", bytes.NewReader(body))
+	resp, err := settings.webhookClient.Post(settings.webhookURL, "application/json", bytes.NewReader(body))
 	if err != nil {
 		s.logger.Error("failed to send IP change webhook", zap.Error(err))
+		return
 	}
+	resp.Body.Close()
 }
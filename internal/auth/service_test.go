@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// sessionLookup answers every session lookup with err.
+type sessionLookup struct {
+	domain.TokenRepository
+	err error
+}
+
+func (f sessionLookup) GetSession(ctx context.Context, sessionID string) (domain.RefreshToken, error) {
+	return domain.RefreshToken{}, f.err
+}
+
+func TestRefreshFailsWithoutStoredSession(t *testing.T) {
+	failure := errors.New("connection refused")
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{name: "no session", err: domain.ErrNotFound},
+		{name: "repository failure", err: failure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testAuthService(t, testConfig(), newFakeUsers(), sessionLookup{err: tc.err}, &fakeAudit{})
+
+			pair, err := s.Refresh(context.Background(), uuid.New(), uuid.NewString(), "refresh-token", nil, "test-agent", "192.0.2.1")
+			if err == nil {
+				t.Fatalf("Refresh = %+v, nil, want an error", pair)
+			}
+			if pair != (domain.TokenPair{}) {
+				t.Errorf("Refresh returned tokens %+v", pair)
+			}
+			if tc.err == failure && !errors.Is(err, failure) {
+				t.Errorf("Refresh = %v, want the repository failure wrapped", err)
+			}
+		})
+	}
+}
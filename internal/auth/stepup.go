@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Reauthenticate checks the password or a TOTP code again and records it
+// in the current session instead of starting a new one. A method the
+// session did not use yet raises its acr. The returned access token
+// carries the new auth_time, the refresh token stays valid.
+func (s *AuthService) Reauthenticate(ctx context.Context, guid uuid.UUID, sessionID, password, code, userAgent, ip string) (string, error) {
+	stored, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil || stored.GUID != guid {
+		s.logger.Warn("reauthentication for unknown session", zap.String("guid", guid.String()))
+		return "", domain.ErrNotFound
+	}
+
+	user, err := s.users.GetUser(ctx, guid)
+	if err != nil {
+		return "", err
+	}
+	if err := user.CheckActive(); err != nil {
+		return "", err
+	}
+
+	var method string
+	if password != "" {
+		method = domain.AMRPassword
+		if !user.HasPassword() {
+			err = domain.ErrInvalidCredentials
+		} else {
+			_, err = s.verifyCredentials(ctx, user.Username, password)
+		}
+	} else {
+		method = domain.AMROTP
+		err = s.useTOTPCode(ctx, guid, code)
+	}
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidCredentials) || errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrTOTPLocked) {
+			s.recordAudit(ctx, domain.AuditEntry{
+				GUID:      guid,
+				EventType: domain.AuditEventLoginFailed,
+				Actor:     guid.String(),
+				IP:        ip,
+				UserAgent: userAgent,
+				Details:   map[string]string{"method": method, "reason": "reauthenticate"},
+			})
+		}
+		return "", err
+	}
+
+	amr := stored.AMR
+	if !slices.Contains(amr, method) {
+		amr = append(slices.Clone(amr), method)
+	}
+	now := time.Now()
+
+	if err := s.repo.UpdateSessionAuthentication(ctx, sessionID, amr, now); err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			s.logger.Error("failed to update session", zap.Error(err))
+		}
+		return "", err
+	}
+
+	stored.AMR, stored.AuthTime = amr, now
+	accessToken, _, err := s.generateAccessToken(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventReauth,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"session_id": sessionID, "amr": strings.Join(amr, " ")},
+	})
+	return accessToken, nil
+}
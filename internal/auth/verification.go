@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/mailer"
+	"go.uber.org/zap"
+)
+
+// maxVerificationAttempts is how often a code may be entered before a new
+// one has to be requested.
+const maxVerificationAttempts = 5
+
+// ErrInvalidVerification is returned for wrong, used and expired verification links and codes alike.
+var ErrInvalidVerification = errors.New("invalid or expired verification")
+
+// SendEmailVerification mails a new verification link and code to the
+// user owning email. Like ForgotPassword it does not reveal whether such a
+// user exists, and verified emails are skipped silently.
+func (s *AuthService) SendEmailVerification(ctx context.Context, email string) error {
+	user, err := s.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, domain.ErrNotFound) || (err == nil && (user.Verified() || !user.Active())) {
+		return nil
+	}
+	if err != nil {
+		s.logger.Error("failed to look up user for email verification", zap.Error(err))
+		return err
+	}
+
+	return s.sendEmailVerification(ctx, user.GUID, user.Email)
+}
+
+// sendEmailVerification replaces the pending verification of the user and
+// mails a signed link and a 6-digit code for email. Either can be used.
+func (s *AuthService) sendEmailVerification(ctx context.Context, guid uuid.UUID, email string) error {
+	settings := s.settings.Load()
+
+	code, err := newVerificationCode()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = s.verifications.StoreEmailVerification(ctx, domain.EmailVerification{
+		GUID:      guid,
+		Email:     email,
+		CodeHash:  hashUserCode(guid, code),
+		CreatedAt: now,
+		ExpiresAt: now.Add(settings.emailVerificationTTL),
+	})
+	if err != nil {
+		s.logger.Error("failed to store email verification", zap.Error(err))
+		return err
+	}
+
+	token, err := s.tokens.GenerateEmailVerificationToken(guid, email, settings.emailVerificationTTL)
+	if err != nil {
+		s.logger.Error("failed to generate email verification token", zap.Error(err))
+		return err
+	}
+
+	link := settings.publicHost + "/verify-email?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Open %s to confirm this email address, or enter this code:\n\n%s\n\n"+
+				"The link and the code expire in %s. "+
+				"If you did not sign up, you can ignore this email.\n",
+			link, code, settings.emailVerificationTTL,
+		),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+
+		if err := settings.mailer.Send(ctx, msg); err != nil {
+			s.logger.Error("failed to send email verification", zap.String("guid", guid.String()), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// VerifyEmailToken verifies an email through a signed verification link.
+// The link only counts while the user still has the email it was sent to.
+func (s *AuthService) VerifyEmailToken(ctx context.Context, token, userAgent, ip string) error {
+	guid, email, err := s.tokens.ValidateEmailVerificationToken(token)
+	if err != nil {
+		s.logger.Warn("invalid email verification token", zap.Error(err))
+		return ErrInvalidVerification
+	}
+
+	return s.markEmailVerified(ctx, guid, email, "link", userAgent, ip)
+}
+
+// VerifyEmailCode verifies an email through the code mailed to it. Every
+// attempt counts, after maxVerificationAttempts the code is spent.
+func (s *AuthService) VerifyEmailCode(ctx context.Context, email, code, userAgent, ip string) error {
+	user, err := s.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, domain.ErrNotFound) {
+		return ErrInvalidVerification
+	}
+	if err != nil {
+		s.logger.Error("failed to look up user for email verification", zap.Error(err))
+		return err
+	}
+
+	pending, err := s.verifications.AttemptEmailVerification(ctx, user.GUID, maxVerificationAttempts)
+	if errors.Is(err, domain.ErrNotFound) {
+		return ErrInvalidVerification
+	}
+	if err != nil {
+		s.logger.Error("failed to get email verification", zap.Error(err))
+		return err
+	}
+
+	expected := hashUserCode(user.GUID, strings.TrimSpace(code))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(pending.CodeHash)) != 1 {
+		s.logger.Warn("wrong email verification code",
+			zap.String("guid", user.GUID.String()),
+			zap.Int("attempts", pending.Attempts),
+		)
+		return ErrInvalidVerification
+	}
+
+	return s.markEmailVerified(ctx, user.GUID, pending.Email, "code", userAgent, ip)
+}
+
+func (s *AuthService) markEmailVerified(ctx context.Context, guid uuid.UUID, email, method, userAgent, ip string) error {
+	err := s.users.MarkEmailVerified(ctx, guid, email)
+	if errors.Is(err, domain.ErrNotFound) {
+		return ErrInvalidVerification
+	}
+	if err != nil {
+		s.logger.Error("failed to mark email verified", zap.Error(err))
+		return err
+	}
+
+	if err := s.verifications.DeleteEmailVerification(ctx, guid); err != nil {
+		s.logger.Warn("failed to delete email verification", zap.Error(err))
+	}
+
+	s.recordAudit(ctx, domain.AuditEntry{
+		GUID:      guid,
+		EventType: domain.AuditEventEmailVerified,
+		Actor:     guid.String(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Details:   map[string]string{"method": method},
+	})
+	return nil
+}
+
+func newVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashUserCode hashes a code that belongs to one user. Binding it to the
+// user keeps equal codes of different users from sharing a hash.
+func hashUserCode(guid uuid.UUID, code string) string {
+	return hashOpaqueToken(guid.String() + ":" + code)
+}
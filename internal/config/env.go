@@ -1,7 +1,13 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func getEnv(key, fallback string) string {
@@ -11,28 +17,295 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int, errs *[]error) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvBool(key string, fallback bool, errs *[]error) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvDuration(key string, fallback time.Duration, errs *[]error) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+		return fallback
+	}
+	return parsed
+}
+
+// getSecret reads a secret either from the file named by KEY_FILE
+// (docker and kubernetes secrets) or from KEY itself. Setting both is an error.
+func getSecret(key, fallback string, errs *[]error) string {
+	path, fromFile := os.LookupEnv(key + "_FILE")
+	if !fromFile {
+		return getEnv(key, fallback)
+	}
+
+	if _, ok := os.LookupEnv(key); ok {
+		*errs = append(*errs, fmt.Errorf("%s and %s_FILE are mutually exclusive", key, key))
+		return fallback
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s_FILE: %w", key, err))
+		return fallback
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// Config is the service configuration. Fields tagged reload:"restart"
+// are only read at startup, all others are applied on reload, the realms
+// in part.
+// Fields tagged secret:"true" are never printed.
 type Config struct {
-	PublicHost string
-	Port       string
-	DBUser     string
-	DBPassword string
-	DBAddress  string
-	DBPort     string
-	DBName     string
-	JWTSecret  string
-	AccessTTL  string
-}
-
-func InitConfig() Config {
+	PublicHost string `yaml:"public_host" reload:"restart"`
+	// Issuer is the iss claim of the tokens, it defaults to PublicHost.
+	Issuer     string `yaml:"issuer" reload:"restart"`
+	Port       string `yaml:"http_port" reload:"restart"`
+	DBUser     string `yaml:"db_user" reload:"restart"`
+	DBPassword string `yaml:"db_password" reload:"restart" secret:"true"`
+	DBAddress  string `yaml:"db_host" reload:"restart"`
+	DBPort     string `yaml:"db_port" reload:"restart"`
+	DBName     string `yaml:"db_name" reload:"restart"`
+	// AutoMigrate applies pending migrations when the server starts, set it
+	// to false to migrate in a separate deploy step.
+	AutoMigrate bool `yaml:"auto_migrate" reload:"restart"`
+
+	JWTSecret      string        `yaml:"jwt_secret" secret:"true"`
+	AccessTTL      time.Duration `yaml:"access_token_ttl"`
+	RefreshTTL     time.Duration `yaml:"refresh_token_ttl"`
+	AdminToken     string        `yaml:"admin_token" secret:"true"`
+	WebhookURL     string        `yaml:"webhook_url"`
+	WebhookTimeout time.Duration `yaml:"webhook_timeout"`
+	// StepUpMaxAge is how recent the authentication must be for sensitive
+	// operations like changing the email or deleting the account.
+	StepUpMaxAge time.Duration `yaml:"step_up_max_age" reload:"restart"`
+	// GuestTTL is how long a guest may stay inactive before it is deleted
+	// together with its sessions, 0 keeps guests forever.
+	GuestTTL time.Duration `yaml:"guest_ttl"`
+	// DeletedUserRetention is how long deleted users are kept, and can be
+	// restored, before they are purged for good.
+	DeletedUserRetention time.Duration `yaml:"deleted_user_retention"`
+	// RateLimit is the number of requests per minute a client IP may send
+	// to the token endpoints, 0 disables rate limiting.
+	RateLimit int `yaml:"rate_limit_per_minute"`
+
+	// Argon2id password hashing cost, memory is in KiB. Existing hashes are
+	// upgraded to new parameters on the next successful login.
+	Argon2Memory      int `yaml:"argon2_memory_kib"`
+	Argon2Iterations  int `yaml:"argon2_iterations"`
+	Argon2Parallelism int `yaml:"argon2_parallelism"`
+
+	// Password policy applied to new passwords. PasswordMinClasses is the
+	// number of character classes a password must mix, 0 disables the rule.
+	PasswordMinLength  int `yaml:"password_min_length"`
+	PasswordMaxLength  int `yaml:"password_max_length"`
+	PasswordMinClasses int `yaml:"password_min_classes"`
+	// BreachedPasswordsPath is a directory of HIBP range files or a bloom
+	// filter file built with "auth-service breach build", empty disables the check.
+	BreachedPasswordsPath string `yaml:"breached_passwords_path"`
+
+	PasswordResetTTL time.Duration `yaml:"password_reset_ttl"`
+	// EmailVerificationTTL is how long verification links and codes stay
+	// valid. Links are signed with JWT_SECRET and stop working shortly
+	// after it is rotated.
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl"`
+	// RequireVerifiedEmail refuses tokens to users without a verified email,
+	// including anonymous users.
+	RequireVerifiedEmail bool `yaml:"require_verified_email"`
+	// EmailLoginTTL is how long passwordless login links and codes stay valid.
+	EmailLoginTTL time.Duration `yaml:"email_login_ttl"`
+	// InvitationTTL is how long invitations to an organization stay valid.
+	InvitationTTL time.Duration `yaml:"invitation_ttl"`
+	// APIKeyMaxTTL caps the lifetime of API keys, 0 allows keys that never expire.
+	APIKeyMaxTTL time.Duration `yaml:"api_key_max_ttl"`
+
+	// IDTokenSigningKey is the PEM encoded RSA private key OpenID Connect
+	// ID tokens are signed with, clients verify them with the public part
+	// published as JWKS. Without it a temporary key is generated at startup.
+	IDTokenSigningKey string `yaml:"id_token_signing_key" secret:"true"`
+
+	// MFAIssuer names the service in authenticator apps.
+	MFAIssuer string `yaml:"mfa_issuer"`
+
+	// WebAuthn relying party. WebAuthnRPID defaults to the host of
+	// PublicHost and WebAuthnOrigins, a comma separated list, to PublicHost.
+	// Passkeys are bound to the RP ID, changing it invalidates all of them.
+	WebAuthnRPID    string `yaml:"webauthn_rp_id"`
+	WebAuthnRPName  string `yaml:"webauthn_rp_name"`
+	WebAuthnOrigins string `yaml:"webauthn_origins"`
+	// WebAuthnAttestation is the attestation conveyance preference: none, indirect or direct.
+	WebAuthnAttestation string `yaml:"webauthn_attestation"`
+
+	// Outgoing mail. Without SMTPHost mails are written to the log instead.
+	SMTPHost     string `yaml:"smtp_host"`
+	SMTPPort     string `yaml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password" secret:"true"`
+	SMTPFrom     string `yaml:"smtp_from"`
+
+	// Realms are tenants isolated from the default realm and from each
+	// other. They are only set in the config file. Adding or removing a
+	// realm or changing its hosts or issuer needs a restart, the other
+	// settings of a realm are applied on reload.
+	Realms []RealmConfig `yaml:"realms" reload:"realms" secret:"true"`
+}
+
+// WebAuthnRelyingParty returns the RP ID and allowed origins with the
+// defaults derived from PublicHost filled in.
+func (c Config) WebAuthnRelyingParty() (string, []string) {
+	rpID := c.WebAuthnRPID
+	if rpID == "" {
+		if u, err := url.Parse(c.PublicHost); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(c.WebAuthnOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{strings.TrimRight(c.PublicHost, "/")}
+		// realms served below a path prefix share the origin of PublicHost
+		if u, err := url.Parse(c.PublicHost); err == nil && u.Host != "" {
+			origins = []string{u.Scheme + "://" + u.Host}
+		}
+	}
+	return rpID, origins
+}
+
+func defaultConfig() Config {
 	return Config{
-		PublicHost: getEnv("PUBLIC_HOST", "http://localhost"),
-		Port:       getEnv("PORT", "8080"),
-		DBUser:     getEnv("DB_USER", "postgres"),
-		DBPassword: getEnv("DB_PASSWORD", "postgres"),
-		DBAddress:  getEnv("DB_HOST", "db"),
-		DBPort:     getEnv("DB_PORT", "5432"),
-		DBName:     getEnv("DB_NAME", "authdb"),
-		JWTSecret:  getEnv("JWT_SECRET", ""),
-		AccessTTL:  getEnv("ACCESS_TOKEN_TTL", "15m"),
+		PublicHost:     "http://localhost",
+		Port:           "8080",
+		DBUser:         "postgres",
+		DBPassword:     "postgres",
+		DBAddress:      "db",
+		DBPort:         "5432",
+		DBName:         "authdb",
+		AutoMigrate:    true,
+		AccessTTL:      15 * time.Minute,
+		RefreshTTL:     24 * time.Hour,
+		StepUpMaxAge:   10 * time.Minute,
+		GuestTTL:       30 * 24 * time.Hour,
+		WebhookTimeout: 5 * time.Second,
+		RateLimit:      60,
+
+		DeletedUserRetention: 30 * 24 * time.Hour,
+
+		Argon2Memory:      64 * 1024,
+		Argon2Iterations:  3,
+		Argon2Parallelism: 2,
+
+		PasswordMinLength: 8,
+		PasswordMaxLength: 128,
+		PasswordResetTTL:  30 * time.Minute,
+
+		EmailVerificationTTL: 24 * time.Hour,
+		EmailLoginTTL:        15 * time.Minute,
+		InvitationTTL:        7 * 24 * time.Hour,
+		APIKeyMaxTTL:         365 * 24 * time.Hour,
+		MFAIssuer:            "auth-service",
+
+		WebAuthnRPName:      "auth-service",
+		WebAuthnAttestation: "none",
+
+		SMTPPort: "587",
+		SMTPFrom: "no-reply@localhost",
+	}
+}
+
+// InitConfig builds the configuration from three layers: built-in defaults,
+// the YAML file named by CONFIG_FILE and environment variables, each layer
+// overriding the previous one. The result is validated and all problems
+// are reported together.
+func InitConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	var errs []error
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	cfg.PublicHost = getEnv("PUBLIC_HOST", cfg.PublicHost)
+	cfg.Port = getEnv("HTTP_PORT", getEnv("PORT", cfg.Port))
+	cfg.DBUser = getEnv("DB_USER", cfg.DBUser)
+	cfg.DBPassword = getSecret("DB_PASSWORD", cfg.DBPassword, &errs)
+	cfg.DBAddress = getEnv("DB_HOST", cfg.DBAddress)
+	cfg.DBPort = getEnv("DB_PORT", cfg.DBPort)
+	cfg.DBName = getEnv("DB_NAME", cfg.DBName)
+	cfg.AutoMigrate = getEnvBool("AUTO_MIGRATE", cfg.AutoMigrate, &errs)
+	cfg.JWTSecret = getSecret("JWT_SECRET", cfg.JWTSecret, &errs)
+	cfg.IDTokenSigningKey = getSecret("ID_TOKEN_SIGNING_KEY", cfg.IDTokenSigningKey, &errs)
+	cfg.Issuer = getEnv("ISSUER", cfg.Issuer)
+	cfg.AccessTTL = getEnvDuration("ACCESS_TOKEN_TTL", cfg.AccessTTL, &errs)
+	cfg.RefreshTTL = getEnvDuration("REFRESH_TOKEN_TTL", cfg.RefreshTTL, &errs)
+	cfg.StepUpMaxAge = getEnvDuration("STEP_UP_MAX_AGE", cfg.StepUpMaxAge, &errs)
+	cfg.GuestTTL = getEnvDuration("GUEST_TTL", cfg.GuestTTL, &errs)
+	cfg.DeletedUserRetention = getEnvDuration("DELETED_USER_RETENTION", cfg.DeletedUserRetention, &errs)
+	cfg.AdminToken = getSecret("ADMIN_TOKEN", cfg.AdminToken, &errs)
+	cfg.WebhookURL = getEnv("WEBHOOK_URL", cfg.WebhookURL)
+	cfg.WebhookTimeout = getEnvDuration("WEBHOOK_TIMEOUT", cfg.WebhookTimeout, &errs)
+	cfg.RateLimit = getEnvInt("RATE_LIMIT_PER_MINUTE", cfg.RateLimit, &errs)
+	cfg.Argon2Memory = getEnvInt("ARGON2_MEMORY_KIB", cfg.Argon2Memory, &errs)
+	cfg.Argon2Iterations = getEnvInt("ARGON2_ITERATIONS", cfg.Argon2Iterations, &errs)
+	cfg.Argon2Parallelism = getEnvInt("ARGON2_PARALLELISM", cfg.Argon2Parallelism, &errs)
+	cfg.PasswordMinLength = getEnvInt("PASSWORD_MIN_LENGTH", cfg.PasswordMinLength, &errs)
+	cfg.PasswordMaxLength = getEnvInt("PASSWORD_MAX_LENGTH", cfg.PasswordMaxLength, &errs)
+	cfg.PasswordMinClasses = getEnvInt("PASSWORD_MIN_CLASSES", cfg.PasswordMinClasses, &errs)
+	cfg.BreachedPasswordsPath = getEnv("BREACHED_PASSWORDS_PATH", cfg.BreachedPasswordsPath)
+	cfg.PasswordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", cfg.PasswordResetTTL, &errs)
+	cfg.EmailVerificationTTL = getEnvDuration("EMAIL_VERIFICATION_TTL", cfg.EmailVerificationTTL, &errs)
+	cfg.RequireVerifiedEmail = getEnvBool("REQUIRE_VERIFIED_EMAIL", cfg.RequireVerifiedEmail, &errs)
+	cfg.EmailLoginTTL = getEnvDuration("EMAIL_LOGIN_TTL", cfg.EmailLoginTTL, &errs)
+	cfg.InvitationTTL = getEnvDuration("INVITATION_TTL", cfg.InvitationTTL, &errs)
+	cfg.APIKeyMaxTTL = getEnvDuration("API_KEY_MAX_TTL", cfg.APIKeyMaxTTL, &errs)
+	cfg.MFAIssuer = getEnv("MFA_ISSUER", cfg.MFAIssuer)
+	cfg.WebAuthnRPID = getEnv("WEBAUTHN_RP_ID", cfg.WebAuthnRPID)
+	cfg.WebAuthnRPName = getEnv("WEBAUTHN_RP_NAME", cfg.WebAuthnRPName)
+	cfg.WebAuthnOrigins = getEnv("WEBAUTHN_ORIGINS", cfg.WebAuthnOrigins)
+	cfg.WebAuthnAttestation = getEnv("WEBAUTHN_ATTESTATION", cfg.WebAuthnAttestation)
+	cfg.SMTPHost = getEnv("SMTP_HOST", cfg.SMTPHost)
+	cfg.SMTPPort = getEnv("SMTP_PORT", cfg.SMTPPort)
+	cfg.SMTPUsername = getEnv("SMTP_USERNAME", cfg.SMTPUsername)
+	cfg.SMTPPassword = getSecret("SMTP_PASSWORD", cfg.SMTPPassword, &errs)
+	cfg.SMTPFrom = getEnv("SMTP_FROM", cfg.SMTPFrom)
+	errs = append(errs, cfg.loadRealmSecrets())
+
+	errs = append(errs, cfg.Validate())
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, fmt.Errorf("invalid config:\n%w", err)
 	}
+
+	return cfg, nil
 }
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultRealm is the realm configured by the top level settings. It
+// serves every request that no other realm claims.
+const DefaultRealm = "default"
+
+var realmNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+
+// RealmConfig describes a tenant with its own users, sessions, roles, audit
+// log, signing key and admin token. A realm is selected by one of its hosts
+// or by the /realms/<name> path prefix. Empty settings are taken from the
+// top level config.
+type RealmConfig struct {
+	Name  string   `yaml:"name"`
+	Hosts []string `yaml:"hosts"`
+	// Issuer is the iss claim of the tokens, it defaults to the URL the
+	// realm is served at.
+	Issuer    string `yaml:"issuer"`
+	JWTSecret string `yaml:"jwt_secret"`
+	// JWTSecretFile holds the secret instead of JWTSecret. The file is
+	// watched and rewritten by "auth-service keys rotate -realm".
+	JWTSecretFile string `yaml:"jwt_secret_file"`
+	// AdminToken guards the admin API of the realm, which is disabled
+	// without one. The admin token of the default realm is not accepted.
+	AdminToken string        `yaml:"admin_token"`
+	AccessTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTTL time.Duration `yaml:"refresh_token_ttl"`
+	WebhookURL string        `yaml:"webhook_url"`
+	// IDTokenSigningKey defaults to the key of the default realm.
+	IDTokenSigningKey string `yaml:"id_token_signing_key"`
+}
+
+// RealmNames returns the default realm followed by the configured ones.
+func (c Config) RealmNames() []string {
+	names := []string{DefaultRealm}
+	for _, realm := range c.Realms {
+		names = append(names, realm.Name)
+	}
+	return names
+}
+
+// TokenIssuer returns the iss claim of tokens, Issuer or else PublicHost.
+func (c Config) TokenIssuer() string {
+	if c.Issuer != "" {
+		return c.Issuer
+	}
+	return strings.TrimRight(c.PublicHost, "/")
+}
+
+// ForRealm returns the config of the named realm: the top level config
+// with the overrides of the realm applied. Unknown names get the default realm.
+func (c Config) ForRealm(name string) Config {
+	for _, realm := range c.Realms {
+		if realm.Name != name {
+			continue
+		}
+
+		cfg := c
+		cfg.Realms = nil
+		cfg.PublicHost = c.realmURL(realm)
+		cfg.Issuer = realm.Issuer
+		cfg.JWTSecret = realm.JWTSecret
+		cfg.AdminToken = realm.AdminToken
+		if realm.AccessTTL != 0 {
+			cfg.AccessTTL = realm.AccessTTL
+		}
+		if realm.RefreshTTL != 0 {
+			cfg.RefreshTTL = realm.RefreshTTL
+		}
+		if realm.WebhookURL != "" {
+			cfg.WebhookURL = realm.WebhookURL
+		}
+		if realm.IDTokenSigningKey != "" {
+			cfg.IDTokenSigningKey = realm.IDTokenSigningKey
+		}
+		return cfg
+	}
+	return c
+}
+
+// loadRealmSecrets reads the secret files of the realms.
+func (c *Config) loadRealmSecrets() error {
+	var errs []error
+	for i := range c.Realms {
+		realm := &c.Realms[i]
+		if realm.JWTSecretFile == "" {
+			continue
+		}
+		if realm.JWTSecret != "" {
+			errs = append(errs, fmt.Errorf("realms.%s: jwt_secret and jwt_secret_file are mutually exclusive", realm.Name))
+			continue
+		}
+		data, err := os.ReadFile(realm.JWTSecretFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("realms.%s.jwt_secret_file: %w", realm.Name, err))
+			continue
+		}
+		realm.JWTSecret = strings.TrimRight(string(data), "\r\n")
+	}
+	return errors.Join(errs...)
+}
+
+// sameRealms reports whether a and b configure the same realms at the
+// same hosts and issuers. Other settings of a realm, its secrets
+// included, are applied on reload.
+func sameRealms(a, b []RealmConfig) bool {
+	return slices.EqualFunc(a, b, func(a, b RealmConfig) bool {
+		return a.Name == b.Name && a.Issuer == b.Issuer && slices.Equal(a.Hosts, b.Hosts)
+	})
+}
+
+// realmURL is where the realm is served: its first host or else its path
+// prefix below PublicHost. Links in mails of the realm point there.
+func (c Config) realmURL(realm RealmConfig) string {
+	u, err := url.Parse(c.PublicHost)
+	if err != nil {
+		return c.PublicHost
+	}
+	if len(realm.Hosts) > 0 {
+		return u.Scheme + "://" + strings.ToLower(realm.Hosts[0])
+	}
+	return strings.TrimRight(c.PublicHost, "/") + "/realms/" + realm.Name
+}
+
+// validateRealms checks the realms on their own and against each other.
+// Every realm needs its own secret, a shared one would let a token of one
+// realm pass the signature check of another.
+func (c Config) validateRealms() error {
+	var errs []error
+
+	names := map[string]bool{DefaultRealm: true}
+	hosts := map[string]string{}
+	secrets := map[string]string{c.JWTSecret: DefaultRealm}
+	adminTokens := map[string]string{c.AdminToken: DefaultRealm}
+	issuers := map[string]string{c.TokenIssuer(): DefaultRealm}
+
+	for i, realm := range c.Realms {
+		key := fmt.Sprintf("realms[%d]", i)
+		if !realmNamePattern.MatchString(realm.Name) {
+			errs = append(errs, fmt.Errorf("%s.name: %q must be lowercase letters, digits and dashes", key, realm.Name))
+			continue
+		}
+		key = "realms." + realm.Name
+		if names[realm.Name] {
+			errs = append(errs, fmt.Errorf("%s: name is already in use", key))
+			continue
+		}
+		names[realm.Name] = true
+
+		for _, host := range realm.Hosts {
+			host = strings.ToLower(host)
+			if host == "" || strings.ContainsAny(host, "/ ") {
+				errs = append(errs, fmt.Errorf("%s.hosts: %q is not a host", key, host))
+			} else if other, ok := hosts[host]; ok {
+				errs = append(errs, fmt.Errorf("%s.hosts: %q is already used by realm %s", key, host, other))
+			}
+			hosts[host] = realm.Name
+		}
+
+		if err := validateSigningSecret(realm.JWTSecret); err != nil {
+			errs = append(errs, fmt.Errorf("%s.jwt_secret: %w", key, err))
+		} else if other, ok := secrets[realm.JWTSecret]; ok {
+			errs = append(errs, fmt.Errorf("%s.jwt_secret: must differ from the secret of realm %s", key, other))
+		}
+		secrets[realm.JWTSecret] = realm.Name
+
+		if realm.AdminToken != "" {
+			if len(realm.AdminToken) < minSecretLength {
+				errs = append(errs, fmt.Errorf("%s.admin_token: must be at least %d characters", key, minSecretLength))
+			} else if other, ok := adminTokens[realm.AdminToken]; ok {
+				errs = append(errs, fmt.Errorf("%s.admin_token: must differ from the admin token of realm %s", key, other))
+			}
+			adminTokens[realm.AdminToken] = realm.Name
+		}
+
+		cfg := c.ForRealm(realm.Name)
+		if u, err := url.Parse(cfg.TokenIssuer()); err != nil || u.Scheme == "" {
+			errs = append(errs, fmt.Errorf("%s.issuer: %q is not an absolute url", key, cfg.TokenIssuer()))
+		} else if other, ok := issuers[cfg.TokenIssuer()]; ok {
+			errs = append(errs, fmt.Errorf("%s.issuer: %q is already used by realm %s", key, cfg.TokenIssuer(), other))
+		}
+		issuers[cfg.TokenIssuer()] = realm.Name
+
+		if realm.AccessTTL < 0 || realm.AccessTTL > 24*time.Hour {
+			errs = append(errs, fmt.Errorf("%s.access_token_ttl: must be positive and at most 24h, got %s", key, realm.AccessTTL))
+		}
+		if realm.RefreshTTL < 0 || (realm.RefreshTTL != 0 && realm.RefreshTTL < c.StepUpMaxAge) {
+			errs = append(errs, fmt.Errorf("%s.refresh_token_ttl: must be at least STEP_UP_MAX_AGE, got %s", key, realm.RefreshTTL))
+		} else if c.GuestTTL != 0 && cfg.RefreshTTL > c.GuestTTL {
+			errs = append(errs, fmt.Errorf("%s.refresh_token_ttl: must not exceed GUEST_TTL, got %s", key, realm.RefreshTTL))
+		}
+		if realm.WebhookURL != "" {
+			if u, err := url.Parse(realm.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s.webhook_url: %q is not an absolute http(s) url", key, realm.WebhookURL))
+			}
+		}
+		if realm.IDTokenSigningKey != "" {
+			if err := validateIDTokenSigningKey(realm.IDTokenSigningKey); err != nil {
+				errs = append(errs, fmt.Errorf("%s.id_token_signing_key: %w", key, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const watchInterval = 5 * time.Second
+
+// Reloadable is implemented by components that pick up config changes
+// without a restart. ApplyConfig must swap the new values in atomically.
+type Reloadable interface {
+	ApplyConfig(cfg Config)
+}
+
+// Reloader re-reads the configuration on SIGHUP or when one of the config
+// or secret files changes and hands it to the registered components.
+// A config that fails validation is rejected and the last good one is kept.
+type Reloader struct {
+	logger  *zap.Logger
+	targets []Reloadable
+
+	mu      sync.Mutex
+	current Config
+}
+
+func NewReloader(logger *zap.Logger, cfg Config, targets ...Reloadable) *Reloader {
+	return &Reloader{
+		logger:  logger,
+		targets: targets,
+		current: cfg,
+	}
+}
+
+// Current returns the config that is currently applied.
+func (r *Reloader) Current() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads, validates and applies the configuration.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := InitConfig()
+	if err != nil {
+		r.logger.Error("config reload rejected, keeping last good config", zap.Error(err))
+		return err
+	}
+
+	changes, restartOnly := Diff(r.current, next)
+	if len(restartOnly) > 0 {
+		r.logger.Warn("config changes require a restart and were not applied", zap.Strings("changes", restartOnly))
+		keepRestartFields(&next, r.current)
+	}
+	if len(changes) == 0 {
+		r.logger.Info("config reloaded, nothing changed")
+		return nil
+	}
+
+	for _, target := range r.targets {
+		target.ApplyConfig(next)
+	}
+	r.current = next
+
+	r.logger.Info("config reloaded", zap.Strings("changes", changes))
+	return nil
+}
+
+// Watch reloads the config on SIGHUP and whenever a watched file changes,
+// until ctx is done.
+func (r *Reloader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	stamps := fileStamps(WatchedFiles(r.Current()))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logger.Info("received SIGHUP, reloading config")
+			r.Reload()
+		case <-ticker.C:
+			current := fileStamps(WatchedFiles(r.Current()))
+			if !reflect.DeepEqual(current, stamps) {
+				stamps = current
+				r.logger.Info("config file changed, reloading config")
+				r.Reload()
+			}
+		}
+	}
+}
+
+// WatchedFiles returns the config file and all secret files in use,
+// those of the realms of cfg included.
+func WatchedFiles(cfg Config) []string {
+	var files []string
+	for _, key := range []string{"CONFIG_FILE", "JWT_SECRET_FILE", "DB_PASSWORD_FILE", "ADMIN_TOKEN_FILE", "SMTP_PASSWORD_FILE", "ID_TOKEN_SIGNING_KEY_FILE"} {
+		if path := os.Getenv(key); path != "" {
+			files = append(files, path)
+		}
+	}
+	for _, realm := range cfg.Realms {
+		if realm.JWTSecretFile != "" {
+			files = append(files, realm.JWTSecretFile)
+		}
+	}
+	return files
+}
+
+func fileStamps(files []string) map[string]string {
+	stamps := make(map[string]string, len(files))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			stamps[path] = "missing"
+			continue
+		}
+		stamps[path] = fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamps
+}
+
+// Diff lists the fields that differ between old and next. Changes to fields
+// that need a restart are returned separately. Secret values are masked.
+// A change to the realms needs a restart unless they keep their names,
+// hosts and issuers.
+func Diff(old, next Config) (changes, restartOnly []string) {
+	oldValue := reflect.ValueOf(old)
+	nextValue := reflect.ValueOf(next)
+	t := oldValue.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		a, b := oldValue.Field(i).Interface(), nextValue.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+
+		change := fmt.Sprintf("%s: %v -> %v", field.Tag.Get("yaml"), a, b)
+		if field.Tag.Get("secret") == "true" {
+			change = field.Tag.Get("yaml") + ": changed"
+		}
+
+		if needsRestart(field, oldValue.Field(i), nextValue.Field(i)) {
+			restartOnly = append(restartOnly, change)
+		} else {
+			changes = append(changes, change)
+		}
+	}
+	return changes, restartOnly
+}
+
+func keepRestartFields(next *Config, running Config) {
+	nextValue := reflect.ValueOf(next).Elem()
+	runningValue := reflect.ValueOf(running)
+	t := nextValue.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if needsRestart(t.Field(i), runningValue.Field(i), nextValue.Field(i)) {
+			nextValue.Field(i).Set(runningValue.Field(i))
+		}
+	}
+}
+
+func needsRestart(field reflect.StructField, old, next reflect.Value) bool {
+	switch field.Tag.Get("reload") {
+	case "restart":
+		return true
+	case "realms":
+		return !sameRealms(old.Interface().([]RealmConfig), next.Interface().([]RealmConfig))
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minSecretLength      = 32
+	minSecretEntropyBits = 128
+	// maxPasswordLength bounds the configurable maximum, longer passwords
+	// are never accepted
+	maxPasswordLength = 1024
+)
+
+// Validate checks every field and returns all problems joined into one error.
+func (c Config) Validate() error {
+	var errs []error
+
+	if u, err := url.Parse(c.PublicHost); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("PUBLIC_HOST: %q is not an absolute http(s) url", c.PublicHost))
+	}
+
+	if err := validatePort(c.Port); err != nil {
+		errs = append(errs, fmt.Errorf("HTTP_PORT: %w", err))
+	}
+	if err := validatePort(c.DBPort); err != nil {
+		errs = append(errs, fmt.Errorf("DB_PORT: %w", err))
+	}
+
+	for _, field := range []struct{ key, value string }{
+		{"DB_USER", c.DBUser},
+		{"DB_HOST", c.DBAddress},
+		{"DB_NAME", c.DBName},
+	} {
+		if field.value == "" {
+			errs = append(errs, fmt.Errorf("%s: must not be empty", field.key))
+		}
+	}
+
+	if err := validateSigningSecret(c.JWTSecret); err != nil {
+		errs = append(errs, fmt.Errorf("JWT_SECRET: %w", err))
+	}
+	if c.IDTokenSigningKey != "" {
+		if err := validateIDTokenSigningKey(c.IDTokenSigningKey); err != nil {
+			errs = append(errs, fmt.Errorf("ID_TOKEN_SIGNING_KEY: %w", err))
+		}
+	}
+
+	if c.AccessTTL <= 0 {
+		errs = append(errs, fmt.Errorf("ACCESS_TOKEN_TTL: must be positive, got %s", c.AccessTTL))
+	} else if c.AccessTTL > 24*time.Hour {
+		errs = append(errs, fmt.Errorf("ACCESS_TOKEN_TTL: must not exceed 24h, got %s", c.AccessTTL))
+	}
+
+	if c.RefreshTTL <= 0 {
+		errs = append(errs, fmt.Errorf("REFRESH_TOKEN_TTL: must be positive, got %s", c.RefreshTTL))
+	}
+
+	if c.StepUpMaxAge <= 0 || c.StepUpMaxAge > c.RefreshTTL {
+		errs = append(errs, fmt.Errorf("STEP_UP_MAX_AGE: must be positive and at most REFRESH_TOKEN_TTL, got %s", c.StepUpMaxAge))
+	}
+
+	// a shorter ttl would delete guests whose refresh token is still valid
+	if c.GuestTTL != 0 && c.GuestTTL < c.RefreshTTL {
+		errs = append(errs, fmt.Errorf("GUEST_TTL: must be 0 or at least REFRESH_TOKEN_TTL, got %s", c.GuestTTL))
+	}
+
+	if c.DeletedUserRetention < 0 {
+		errs = append(errs, fmt.Errorf("DELETED_USER_RETENTION: must not be negative, got %s", c.DeletedUserRetention))
+	}
+
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("WEBHOOK_URL: %q is not an absolute http(s) url", c.WebhookURL))
+		}
+	}
+	if c.WebhookTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("WEBHOOK_TIMEOUT: must be positive, got %s", c.WebhookTimeout))
+	}
+
+	if c.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_PER_MINUTE: must not be negative, got %d", c.RateLimit))
+	}
+
+	if c.Argon2Parallelism < 1 || c.Argon2Parallelism > 255 {
+		errs = append(errs, fmt.Errorf("ARGON2_PARALLELISM: must be between 1 and 255, got %d", c.Argon2Parallelism))
+	}
+	if c.Argon2Iterations < 1 {
+		errs = append(errs, fmt.Errorf("ARGON2_ITERATIONS: must be positive, got %d", c.Argon2Iterations))
+	}
+	if c.Argon2Memory < 8*c.Argon2Parallelism || c.Argon2Memory > 4*1024*1024 {
+		errs = append(errs, fmt.Errorf("ARGON2_MEMORY_KIB: must be between 8*ARGON2_PARALLELISM and 4GiB, got %d", c.Argon2Memory))
+	}
+
+	if c.PasswordMinLength < 1 {
+		errs = append(errs, fmt.Errorf("PASSWORD_MIN_LENGTH: must be positive, got %d", c.PasswordMinLength))
+	}
+	if c.PasswordMaxLength < c.PasswordMinLength || c.PasswordMaxLength > maxPasswordLength {
+		errs = append(errs, fmt.Errorf("PASSWORD_MAX_LENGTH: must be between PASSWORD_MIN_LENGTH and %d, got %d", maxPasswordLength, c.PasswordMaxLength))
+	}
+	if c.PasswordMinClasses < 0 || c.PasswordMinClasses > 4 {
+		errs = append(errs, fmt.Errorf("PASSWORD_MIN_CLASSES: must be between 0 and 4, got %d", c.PasswordMinClasses))
+	}
+	if c.BreachedPasswordsPath != "" {
+		if _, err := os.Stat(c.BreachedPasswordsPath); err != nil {
+			errs = append(errs, fmt.Errorf("BREACHED_PASSWORDS_PATH: %w", err))
+		}
+	}
+
+	if c.PasswordResetTTL <= 0 || c.PasswordResetTTL > 24*time.Hour {
+		errs = append(errs, fmt.Errorf("PASSWORD_RESET_TTL: must be positive and at most 24h, got %s", c.PasswordResetTTL))
+	}
+
+	if c.EmailVerificationTTL <= 0 || c.EmailVerificationTTL > 7*24*time.Hour {
+		errs = append(errs, fmt.Errorf("EMAIL_VERIFICATION_TTL: must be positive and at most 168h, got %s", c.EmailVerificationTTL))
+	}
+
+	if c.EmailLoginTTL <= 0 || c.EmailLoginTTL > time.Hour {
+		errs = append(errs, fmt.Errorf("EMAIL_LOGIN_TTL: must be positive and at most 1h, got %s", c.EmailLoginTTL))
+	}
+
+	if c.InvitationTTL <= 0 || c.InvitationTTL > 30*24*time.Hour {
+		errs = append(errs, fmt.Errorf("INVITATION_TTL: must be positive and at most 720h, got %s", c.InvitationTTL))
+	}
+
+	if c.APIKeyMaxTTL < 0 {
+		errs = append(errs, fmt.Errorf("API_KEY_MAX_TTL: must not be negative, got %s", c.APIKeyMaxTTL))
+	}
+
+	if c.MFAIssuer == "" || strings.Contains(c.MFAIssuer, ":") {
+		errs = append(errs, fmt.Errorf("MFA_ISSUER: must be set and must not contain a colon"))
+	}
+
+	if err := c.validateWebAuthn(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.SMTPHost != "" {
+		if err := validatePort(c.SMTPPort); err != nil {
+			errs = append(errs, fmt.Errorf("SMTP_PORT: %w", err))
+		}
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			errs = append(errs, fmt.Errorf("SMTP_FROM: %w", err))
+		}
+	}
+
+	if c.Issuer != "" {
+		if u, err := url.Parse(c.Issuer); err != nil || u.Scheme == "" {
+			errs = append(errs, fmt.Errorf("ISSUER: %q is not an absolute url", c.Issuer))
+		}
+	}
+
+	if err := c.validateRealms(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.AdminToken != "" && len(c.AdminToken) < minSecretLength {
+		errs = append(errs, fmt.Errorf("ADMIN_TOKEN: must be at least %d characters", minSecretLength))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateWebAuthn checks that every origin lies within the RP ID, as
+// browsers refuse passkey ceremonies otherwise.
+func (c Config) validateWebAuthn() error {
+	var errs []error
+
+	rpID, origins := c.WebAuthnRelyingParty()
+	if rpID == "" || strings.ContainsAny(rpID, ":/") {
+		errs = append(errs, fmt.Errorf("WEBAUTHN_RP_ID: %q is not a domain", rpID))
+	}
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("WEBAUTHN_ORIGINS: %q is not an http(s) origin", origin))
+			continue
+		}
+		if host := u.Hostname(); host != rpID && !strings.HasSuffix(host, "."+rpID) {
+			errs = append(errs, fmt.Errorf("WEBAUTHN_ORIGINS: %q is not within WEBAUTHN_RP_ID %q", origin, rpID))
+		}
+	}
+
+	if c.WebAuthnRPName == "" {
+		errs = append(errs, fmt.Errorf("WEBAUTHN_RP_NAME: must not be empty"))
+	}
+	switch c.WebAuthnAttestation {
+	case "none", "indirect", "direct":
+	default:
+		errs = append(errs, fmt.Errorf("WEBAUTHN_ATTESTATION: must be none, indirect or direct, got %q", c.WebAuthnAttestation))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q is not a valid port", port)
+	}
+	return nil
+}
+
+func validateSigningSecret(secret string) error {
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("must be at least %d characters, got %d", minSecretLength, len(secret))
+	}
+	if bits := entropyBits(secret); bits < minSecretEntropyBits {
+		return fmt.Errorf("estimated entropy is %.0f bits, at least %d required", bits, minSecretEntropyBits)
+	}
+	return nil
+}
+
+// minIDTokenKeyBits is the smallest RSA key accepted for ID tokens.
+const minIDTokenKeyBits = 2048
+
+// validateIDTokenSigningKey checks for a PEM encoded PKCS #1 or PKCS #8
+// RSA private key of at least minIDTokenKeyBits.
+func validateIDTokenSigningKey(data string) error {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return errors.New("must be a PEM encoded RSA private key")
+	}
+
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, _ = parsed.(*rsa.PrivateKey)
+	}
+	if key == nil {
+		return errors.New("must be a PEM encoded RSA private key")
+	}
+	if bits := key.N.BitLen(); bits < minIDTokenKeyBits {
+		return fmt.Errorf("must have at least %d bits, got %d", minIDTokenKeyBits, bits)
+	}
+	return nil
+}
+
+// entropyBits estimates the entropy of s as its length times the Shannon
+// entropy of its byte distribution. It catches repeated or low-variety
+// secrets, not ones that are merely predictable.
+func entropyBits(s string) float64 {
+	counts := make(map[byte]int)
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+
+	n := float64(len(s))
+	var perSymbol float64
+	for _, c := range counts {
+		p := float64(c) / n
+		perSymbol -= p * math.Log2(p)
+	}
+	return perSymbol * n
+}
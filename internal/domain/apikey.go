@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyPrefix starts every API key, so that leaked keys are easy to
+// recognize and to scan for.
+const APIKeyPrefix = "gbt_"
+
+// APIKey is a long lived credential for scripts and machine clients. It
+// is presented as a bearer token in place of an access token. Only the
+// hash of the key is stored, the lookup prefix identifies it.
+type APIKey struct {
+	ID   uuid.UUID `json:"id"`
+	GUID uuid.UUID `json:"guid"`
+	Name string    `json:"name"`
+	// Prefix is the start of the key after APIKeyPrefix, it is not secret.
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scope      []string   `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+// Expired reports whether the key has expired at now.
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+type APIKeyRepository interface {
+	StoreAPIKey(ctx context.Context, key APIKey) error
+	// GetAPIKeyByPrefix returns ErrNotFound unless the key exists and its
+	// user is active.
+	GetAPIKeyByPrefix(ctx context.Context, prefix string) (APIKey, error)
+	ListAPIKeys(ctx context.Context, guid uuid.UUID) ([]APIKey, error)
+	DeleteAPIKey(ctx context.Context, guid, id uuid.UUID) error
+	// TouchAPIKey records that the key was used from ip.
+	TouchAPIKey(ctx context.Context, id uuid.UUID, ip string) error
+}
+
+// APIKeyAuthenticator checks API keys presented in place of access tokens.
+type APIKeyAuthenticator interface {
+	// AuthenticateAPIKey returns the key with the scope it currently
+	// grants, or ErrNotFound if the key is unknown, expired or revoked.
+	AuthenticateAPIKey(ctx context.Context, key, ip string) (APIKey, error)
+}
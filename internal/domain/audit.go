@@ -0,0 +1,116 @@
+package domain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditEventType string
+
+const (
+	AuditEventAuthorize    AuditEventType = "authorize"
+	AuditEventRefresh      AuditEventType = "refresh"
+	AuditEventRevoke       AuditEventType = "revoke"
+	AuditEventAdminAction  AuditEventType = "admin_action"
+	AuditEventRegister     AuditEventType = "register"
+	AuditEventGuestUpgrade AuditEventType = "guest_upgrade"
+	AuditEventLoginFailed  AuditEventType = "login_failed"
+	AuditEventReauth       AuditEventType = "reauthenticate"
+	AuditEventDownscope    AuditEventType = "downscope"
+
+	AuditEventPasswordChange AuditEventType = "password_change"
+	AuditEventPasswordReset  AuditEventType = "password_reset"
+
+	AuditEventProfileUpdate AuditEventType = "profile_update"
+	AuditEventAccountDelete AuditEventType = "account_delete"
+	AuditEventEmailVerified AuditEventType = "email_verified"
+
+	AuditEventMFAEnroll  AuditEventType = "mfa_enroll"
+	AuditEventEmailLogin AuditEventType = "email_login"
+
+	AuditEventPasskeyRegister AuditEventType = "passkey_register"
+	AuditEventPasskeyRemove   AuditEventType = "passkey_remove"
+
+	// AuditEventOrganization records changes to organizations, their
+	// members and invitations, the action is in the details.
+	AuditEventOrganization AuditEventType = "organization"
+	AuditEventOrgSwitch    AuditEventType = "org_switch"
+
+	// AuditEventAPIKey records the creation and revocation of API keys.
+	AuditEventAPIKey AuditEventType = "api_key"
+
+	// AuditEventTokenExchange records tokens issued to clients for a user,
+	// AuditEventImpersonate those issued to another user acting as them.
+	AuditEventTokenExchange AuditEventType = "token_exchange"
+	AuditEventImpersonate   AuditEventType = "impersonate"
+)
+
+// AuditEntry is a single record of the tamper-evident audit log.
+// Every entry carries the hash of its predecessor, so editing or removing
+// an entry breaks the chain for everything written after it.
+type AuditEntry struct {
+	ID        int64             `json:"id"`
+	GUID      uuid.UUID         `json:"guid"`
+	EventType AuditEventType    `json:"event_type"`
+	Actor     string            `json:"actor"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+// ComputeHash returns the chain hash of the entry. It covers every field
+// except Hash itself, including the hash of the previous entry.
+func (e AuditEntry) ComputeHash() string {
+	payload, _ := json.Marshal(struct {
+		ID        int64             `json:"id"`
+		GUID      string            `json:"guid"`
+		EventType AuditEventType    `json:"event_type"`
+		Actor     string            `json:"actor"`
+		IP        string            `json:"ip"`
+		UserAgent string            `json:"user_agent"`
+		Details   map[string]string `json:"details"`
+		CreatedAt string            `json:"created_at"`
+		PrevHash  string            `json:"prev_hash"`
+	}{
+		ID:        e.ID,
+		GUID:      e.GUID.String(),
+		EventType: e.EventType,
+		Actor:     e.Actor,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Details:   e.Details,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		PrevHash:  e.PrevHash,
+	})
+
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+type AuditFilter struct {
+	GUID      *uuid.UUID
+	EventType AuditEventType
+	From      time.Time
+	To        time.Time
+	// BeforeID is the pagination cursor: only entries with a smaller id are returned.
+	BeforeID int64
+	Limit    int
+}
+
+type AuditRepository interface {
+	// AppendAuditEntry links the entry to the current chain head, fills in
+	// ID, CreatedAt, PrevHash and Hash, and stores it.
+	AppendAuditEntry(ctx context.Context, entry *AuditEntry) error
+	// ListAuditEntries returns entries matching the filter, newest first.
+	ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	// AuditChain returns up to limit entries with id greater than afterID, oldest first.
+	AuditChain(ctx context.Context, afterID int64, limit int) ([]AuditEntry, error)
+}
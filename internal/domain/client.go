@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Token endpoint authentication methods of clients, named as in RFC 7591.
+const (
+	ClientSecretBasic = "client_secret_basic"
+	ClientSecretPost  = "client_secret_post"
+	PrivateKeyJWT     = "private_key_jwt"
+	// ClientAuthNone is used by public clients, like SPAs and native apps,
+	// that can not keep a secret. They rely on PKCE instead.
+	ClientAuthNone = "none"
+)
+
+// Grant types of the token endpoint.
+const (
+	// GrantClientCredentials gets a token for the client itself (RFC 6749
+	// section 4.4).
+	GrantClientCredentials = "client_credentials"
+	// GrantAuthorizationCode exchanges the code a user authorized the
+	// client with for a session of the user (RFC 6749 section 4.1).
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	// GrantDeviceCode lets devices without a browser poll for a session
+	// the user approves on another device (RFC 8628).
+	GrantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+	// GrantTokenExchange swaps a token of a user for one restricted to an
+	// audience, or lets support staff impersonate a user (RFC 8693).
+	GrantTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// TokenTypeAccessToken is the only token type token exchange takes and
+// issues (RFC 8693 section 3).
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// OAuthClient is a registered OAuth client, for example a backend
+// service. Clients authenticate with a secret, of which only the hash is
+// stored, or with JWTs signed by the key registered as PublicKey.
+type OAuthClient struct {
+	ID         string `json:"client_id"`
+	Name       string `json:"name"`
+	AuthMethod string `json:"token_endpoint_auth_method" enums:"client_secret_basic,client_secret_post,private_key_jwt,none"`
+	SecretHash string `json:"-"`
+	// PublicKey is the PEM encoded key private_key_jwt assertions are
+	// verified with.
+	PublicKey string `json:"public_key,omitempty"`
+	// Scopes and Audiences bound what the client may request.
+	Scopes     []string `json:"scopes"`
+	Audiences  []string `json:"audiences"`
+	GrantTypes []string `json:"grant_types"`
+	// RedirectURIs are matched exactly against the redirect_uri of
+	// authorization requests.
+	RedirectURIs []string  `json:"redirect_uris,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Public reports whether the client has no credentials of its own.
+func (c OAuthClient) Public() bool {
+	return c.AuthMethod == ClientAuthNone
+}
+
+// AuthorizationCode is issued to a client once a user authorized it. It
+// is bound to the PKCE challenge of the authorization request and can be
+// exchanged for tokens once.
+type AuthorizationCode struct {
+	CodeHash string
+	ClientID string
+	GUID     uuid.UUID
+	// RedirectURI is the redirect_uri of the authorization request, empty
+	// if it relied on the only registered one. The token request has to
+	// repeat it.
+	RedirectURI string
+	Scope       []string
+	// CodeChallenge is the S256 PKCE challenge, Nonce the OpenID Connect
+	// nonce of the request.
+	CodeChallenge string
+	Nonce         string
+	AMR           []string
+	AuthTime      time.Time
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	// UsedAt is set once the code was exchanged.
+	UsedAt *time.Time
+}
+
+// ClientClaims are the claims of an access token issued to a client, for
+// itself or, through token exchange, for a user.
+type ClientClaims struct {
+	ClientID string
+	Scope    []string
+	Audience []string
+	// Subject is the user the token is for, the client ID if it is empty.
+	Subject string
+	// Actor is the party acting for the subject, the act claim of RFC 8693
+	// section 4.1.
+	Actor string
+	// TTL shortens the access token TTL if it is set.
+	TTL time.Duration
+}
+
+// DeviceStatus is the decision of the user on a device authorization.
+type DeviceStatus string
+
+const (
+	DevicePending  DeviceStatus = "pending"
+	DeviceApproved DeviceStatus = "approved"
+	DeviceDenied   DeviceStatus = "denied"
+)
+
+// DeviceAuthorization is started by a device and decided by the user, who
+// enters the user code on another device. The device polls with the device
+// code, of which only the hash is stored.
+type DeviceAuthorization struct {
+	DeviceCodeHash string
+	// UserCode is stored normalized, without separators.
+	UserCode string
+	ClientID string
+	Scope    []string
+	Status   DeviceStatus
+	// GUID, AMR and AuthTime are set once the user approved.
+	GUID     uuid.UUID
+	AMR      []string
+	AuthTime time.Time
+	// Interval is how long the device has to wait between polls.
+	Interval     time.Duration
+	LastPolledAt *time.Time
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+type OAuthClientRepository interface {
+	// CreateClient returns ErrAlreadyExists if the client ID is taken.
+	CreateClient(ctx context.Context, client OAuthClient) error
+	GetClient(ctx context.Context, id string) (OAuthClient, error)
+	ListClients(ctx context.Context) ([]OAuthClient, error)
+	DeleteClient(ctx context.Context, id string) error
+	UpdateClientSecret(ctx context.Context, id, secretHash string) error
+	// UseClientAssertion remembers the jti of a client assertion until it
+	// expires and returns ErrAlreadyExists if it was used before.
+	UseClientAssertion(ctx context.Context, clientID, jti string, expiresAt time.Time) error
+
+	StoreAuthorizationCode(ctx context.Context, code AuthorizationCode) error
+	// UseAuthorizationCode marks a code as used and returns it as it was
+	// before, a set UsedAt means it was used already.
+	UseAuthorizationCode(ctx context.Context, codeHash string) (AuthorizationCode, error)
+	// PurgeAuthorizationCodes deletes the codes that expired before
+	// expiredBefore, used or not.
+	PurgeAuthorizationCodes(ctx context.Context, expiredBefore time.Time) (int64, error)
+
+	// StoreDeviceAuthorization returns ErrAlreadyExists if the user code
+	// is taken.
+	StoreDeviceAuthorization(ctx context.Context, device DeviceAuthorization) error
+	// GetDeviceAuthorization finds an authorization by its user code.
+	GetDeviceAuthorization(ctx context.Context, userCode string) (DeviceAuthorization, error)
+	// DecideDeviceAuthorization records the decision of the user. It
+	// returns ErrNotFound unless the authorization is pending and unexpired.
+	DecideDeviceAuthorization(ctx context.Context, userCode string, status DeviceStatus, guid *uuid.UUID, amr []string, authTime time.Time) error
+	// PollDeviceAuthorization records a poll and returns the authorization
+	// as it was before. A decided authorization is removed, the device code
+	// only works once.
+	PollDeviceAuthorization(ctx context.Context, deviceCodeHash string) (DeviceAuthorization, error)
+	SetDevicePollInterval(ctx context.Context, deviceCodeHash string, interval time.Duration) error
+}
@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmailLogin is a pending passwordless login. The mailed link token and
+// code are stored hashed and only work from the requesting user agent.
+type EmailLogin struct {
+	GUID      uuid.UUID
+	Email     string
+	TokenHash string
+	CodeHash  string
+	UserAgent string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type EmailLoginRepository interface {
+	// StoreEmailLogin replaces the pending login of the user, unless that
+	// was created after notBefore. It returns ErrAlreadyExists in that case.
+	StoreEmailLogin(ctx context.Context, login EmailLogin, notBefore time.Time) error
+	// AttemptEmailLogin counts an attempt to enter the code and returns the
+	// pending login. It returns ErrNotFound if there is none, it expired or
+	// maxAttempts were already made.
+	AttemptEmailLogin(ctx context.Context, guid uuid.UUID, maxAttempts int) (EmailLogin, error)
+	// ConsumeEmailLoginToken deletes and returns the unexpired login with
+	// the token, if it was requested by userAgent.
+	ConsumeEmailLoginToken(ctx context.Context, tokenHash, userAgent string) (EmailLogin, error)
+	// ConsumeEmailLoginCode deletes the unexpired login of the user with the
+	// code. Like ConsumeEmailLoginToken it succeeds only once.
+	ConsumeEmailLoginCode(ctx context.Context, guid uuid.UUID, codeHash string) error
+}
@@ -0,0 +1,29 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmailVerification is the pending verification of a user's email. It
+// holds the hash of the code that was mailed, a user has at most one.
+type EmailVerification struct {
+	GUID      uuid.UUID
+	Email     string
+	CodeHash  string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type EmailVerificationRepository interface {
+	// StoreEmailVerification replaces any pending verification of the user.
+	StoreEmailVerification(ctx context.Context, verification EmailVerification) error
+	// AttemptEmailVerification counts an attempt to enter the code and returns
+	// the pending verification. It returns ErrNotFound if there is none, it
+	// expired or maxAttempts were already made.
+	AttemptEmailVerification(ctx context.Context, guid uuid.UUID, maxAttempts int) (EmailVerification, error)
+	DeleteEmailVerification(ctx context.Context, guid uuid.UUID) error
+}
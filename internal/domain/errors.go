@@ -0,0 +1,14 @@
+package domain
+
+import "errors"
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUserDisabled = errors.New("user is disabled")
+
+	ErrEmailNotVerified = errors.New("email is not verified")
+	ErrMFANotEnrolled   = errors.New("mfa is not enrolled")
+
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
@@ -0,0 +1,91 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Authentication method references (RFC 8176) recorded in the amr claim.
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRHardwareKey = "hwk"
+	AMRMultiFactor = "mfa"
+	// AMREmail is not registered by RFC 8176, it marks a login through a
+	// link or code mailed to the user.
+	AMREmail = "email"
+)
+
+// Authentication context class references, from weakest to strongest.
+const (
+	// ACRNone is the class of anonymous sessions.
+	ACRNone         = "0"
+	ACRSingleFactor = "1"
+	ACRMultiFactor  = "2"
+)
+
+// ACRForAMR returns the class reached by the authentication methods.
+func ACRForAMR(amr []string) string {
+	methods := make(map[string]bool)
+	for _, m := range amr {
+		if m == AMRMultiFactor {
+			return ACRMultiFactor
+		}
+		methods[m] = true
+	}
+	switch {
+	case len(methods) >= 2:
+		return ACRMultiFactor
+	case len(methods) == 1:
+		return ACRSingleFactor
+	default:
+		return ACRNone
+	}
+}
+
+// ACRSatisfies reports whether acr is at least as strong as min.
+func ACRSatisfies(acr, min string) bool {
+	rank := map[string]int{ACRNone: 0, ACRSingleFactor: 1, ACRMultiFactor: 2}
+	got, ok := rank[acr]
+	return ok && got >= rank[min]
+}
+
+// TOTPCredential is the TOTP secret of a user. It only counts as a second
+// factor once the user confirmed it with a first code.
+type TOTPCredential struct {
+	GUID   uuid.UUID
+	Secret string
+	// LastUsedStep is the time step of the last accepted code.
+	LastUsedStep   int64
+	FailedAttempts int
+	CreatedAt      time.Time
+	ConfirmedAt    *time.Time
+}
+
+func (c TOTPCredential) Confirmed() bool {
+	return c.ConfirmedAt != nil
+}
+
+type MFARepository interface {
+	// StoreTOTP starts an enrolment, replacing an unconfirmed one. It returns
+	// ErrAlreadyExists if the user has a confirmed credential.
+	StoreTOTP(ctx context.Context, cred TOTPCredential) error
+	GetTOTP(ctx context.Context, guid uuid.UUID) (TOTPCredential, error)
+	// ConfirmTOTP confirms the enrolment and stores the recovery codes in one transaction.
+	ConfirmTOTP(ctx context.Context, guid uuid.UUID, step int64, recoveryCodeHashes []string) error
+	// UseTOTPStep records a successful code. It returns ErrNotFound if step
+	// is not newer than the last used one, so every code works only once.
+	UseTOTPStep(ctx context.Context, guid uuid.UUID, step int64) error
+	// RecordTOTPFailure counts a wrong code and returns the consecutive failures.
+	RecordTOTPFailure(ctx context.Context, guid uuid.UUID) (int, error)
+
+	// UseRecoveryCode spends a recovery code, ErrNotFound is returned for unknown and used codes.
+	UseRecoveryCode(ctx context.Context, guid uuid.UUID, codeHash string) error
+	ReplaceRecoveryCodes(ctx context.Context, guid uuid.UUID, codeHashes []string) error
+	CountRecoveryCodes(ctx context.Context, guid uuid.UUID) (int, error)
+
+	// DeleteMFA removes the TOTP credential and recovery codes of the user.
+	DeleteMFA(ctx context.Context, guid uuid.UUID) error
+}
@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrLastOwner is returned when a change would leave an organization
+// without an owner.
+var ErrLastOwner = errors.New("organization needs an owner")
+
+// OrgRole is the role of a member within an organization.
+type OrgRole string
+
+const (
+	// OrgOwner can do everything, including deleting the organization
+	// and managing other owners.
+	OrgOwner OrgRole = "owner"
+	// OrgAdmin manages members and invitations.
+	OrgAdmin  OrgRole = "admin"
+	OrgMember OrgRole = "member"
+)
+
+func (r OrgRole) Valid() bool {
+	switch r {
+	case OrgOwner, OrgAdmin, OrgMember:
+		return true
+	}
+	return false
+}
+
+// CanManage reports whether the role may manage members and invitations.
+func (r OrgRole) CanManage() bool {
+	return r == OrgOwner || r == OrgAdmin
+}
+
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership is the membership of a user in an organization.
+type Membership struct {
+	OrgID    uuid.UUID `json:"org_id"`
+	GUID     uuid.UUID `json:"guid"`
+	Role     OrgRole   `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// UserOrganization is an organization together with the role the user
+// has in it.
+type UserOrganization struct {
+	Organization
+	Role OrgRole `json:"role"`
+}
+
+// OrgInvitation is a single-use invitation mailed to join an
+// organization. Only the hash of its token is stored.
+type OrgInvitation struct {
+	ID        uuid.UUID  `json:"id"`
+	TokenHash string     `json:"-"`
+	OrgID     uuid.UUID  `json:"org_id"`
+	Email     string     `json:"email"`
+	Role      OrgRole    `json:"role"`
+	InvitedBy *uuid.UUID `json:"invited_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+type OrganizationRepository interface {
+	// CreateOrganization creates the organization with owner as its
+	// first member.
+	CreateOrganization(ctx context.Context, org Organization, owner uuid.UUID) error
+	GetOrganization(ctx context.Context, id uuid.UUID) (Organization, error)
+	// ListUserOrganizations returns the organizations guid is a member of.
+	ListUserOrganizations(ctx context.Context, guid uuid.UUID) ([]UserOrganization, error)
+	DeleteOrganization(ctx context.Context, id uuid.UUID) error
+
+	// GetMember returns ErrNotFound if guid is not a member of the organization.
+	GetMember(ctx context.Context, orgID, guid uuid.UUID) (Membership, error)
+	ListMembers(ctx context.Context, orgID uuid.UUID) ([]Membership, error)
+	// UpdateMemberRole and RemoveMember return ErrLastOwner instead of
+	// taking away the last owner. RemoveMember also clears the organization
+	// from the session of the member.
+	UpdateMemberRole(ctx context.Context, orgID, guid uuid.UUID, role OrgRole) error
+	RemoveMember(ctx context.Context, orgID, guid uuid.UUID) error
+
+	StoreInvitation(ctx context.Context, invitation OrgInvitation) error
+	// GetInvitation returns ErrNotFound unless the invitation is unused and unexpired.
+	GetInvitation(ctx context.Context, tokenHash string) (OrgInvitation, error)
+	// ListInvitations returns the pending invitations of an organization.
+	ListInvitations(ctx context.Context, orgID uuid.UUID) ([]OrgInvitation, error)
+	DeleteInvitation(ctx context.Context, orgID, id uuid.UUID) error
+	// AcceptInvitation spends the invitation and adds guid to the
+	// organization, a member keeps the role it has. With create the user is
+	// created first with the invited email, verified by the invitation. It
+	// returns ErrNotFound for used or expired invitations and
+	// ErrAlreadyExists if the user to create clashes with another.
+	AcceptInvitation(ctx context.Context, tokenHash string, guid uuid.UUID, create bool) (OrgInvitation, error)
+}
@@ -0,0 +1,27 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PasswordResetToken is a single-use token mailed to a user who forgot
+// the password. Only its hash is stored.
+type PasswordResetToken struct {
+	TokenHash string
+	GUID      uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type PasswordResetRepository interface {
+	StorePasswordResetToken(ctx context.Context, token PasswordResetToken) error
+	// GetPasswordResetToken returns ErrNotFound unless the token is unused and unexpired.
+	GetPasswordResetToken(ctx context.Context, tokenHash string) (PasswordResetToken, error)
+	// ConsumePasswordResetToken marks the token used. It succeeds only once
+	// per token and returns ErrNotFound for used or expired tokens.
+	ConsumePasswordResetToken(ctx context.Context, tokenHash string) (uuid.UUID, error)
+	DeletePasswordResetTokens(ctx context.Context, guid uuid.UUID) error
+}
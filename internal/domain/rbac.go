@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUnknownPermission is returned when a role names a permission that
+// has not been created.
+var ErrUnknownPermission = errors.New("unknown permission")
+
+// PermissionImpersonate lets support staff exchange their token for one
+// of another user. It has to be created and granted like any other
+// permission, clients need it among their scopes to ask for it.
+const PermissionImpersonate = "users:impersonate"
+
+// Permission is a named right checked by the services that accept the
+// access tokens, like "orders:read".
+type Permission struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Role groups permissions. Users get the union of the permissions of
+// their roles.
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type RoleRepository interface {
+	// CreatePermission returns ErrAlreadyExists if the name is taken.
+	CreatePermission(ctx context.Context, permission Permission) error
+	ListPermissions(ctx context.Context) ([]Permission, error)
+	// DeletePermission also removes it from every role.
+	DeletePermission(ctx context.Context, name string) error
+
+	// CreateRole returns ErrAlreadyExists if the name is taken and
+	// ErrUnknownPermission if a permission does not exist.
+	CreateRole(ctx context.Context, role Role) error
+	// UpdateRole replaces the description and permissions of a role.
+	UpdateRole(ctx context.Context, role Role) error
+	GetRole(ctx context.Context, name string) (Role, error)
+	ListRoles(ctx context.Context) ([]Role, error)
+	// DeleteRole also takes it away from every user.
+	DeleteRole(ctx context.Context, name string) error
+
+	// AssignRole grants a role to a user, granting it twice is no error.
+	// It returns ErrNotFound if the user or the role does not exist.
+	AssignRole(ctx context.Context, guid uuid.UUID, role string) error
+	UnassignRole(ctx context.Context, guid uuid.UUID, role string) error
+	// UserRoles returns the sorted roles of a user and the union of their
+	// permissions.
+	UserRoles(ctx context.Context, guid uuid.UUID) (roles, permissions []string, err error)
+}
@@ -2,18 +2,62 @@ package domain
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type TokenRepository interface {
+	// StoreRefreshToken stores a session. A user has one session without a
+	// client, storing another replaces it. Sessions of a client are added
+	// next to it and only replaced by one keeping their ID.
 	StoreRefreshToken(ctx context.Context, token RefreshToken) error
-	GetRefreshToken(ctx context.Context, guid uuid.UUID) (RefreshToken, error)
-	DeleteRefreshToken(ctx context.Context, guid uuid.UUID) error
+	// GetSession returns ErrNotFound if the session is gone.
+	GetSession(ctx context.Context, sessionID string) (RefreshToken, error)
+	// DeleteUserSessions removes every session of the user.
+	DeleteUserSessions(ctx context.Context, guid uuid.UUID) error
+	// SessionExists reports whether the session exists and its user is active.
 	SessionExists(ctx context.Context, sessionID string) (bool, error)
+	// ListSessions returns all sessions, or only those of guid if it is not nil.
+	ListSessions(ctx context.Context, guid *uuid.UUID) ([]RefreshToken, error)
+	// UpdateSessionAuthentication records a new authentication in a session
+	// without replacing it. It returns ErrNotFound if the session is gone.
+	UpdateSessionAuthentication(ctx context.Context, sessionID string, amr []string, authTime time.Time) error
+	// DeleteSession removes a single session and returns the GUID it belonged to.
+	DeleteSession(ctx context.Context, sessionID string) (uuid.UUID, error)
 }
 
 type UserRepository interface {
 	UserExists(ctx context.Context, guid uuid.UUID) (bool, error)
-	CreateUser(ctx context.Context, guid uuid.UUID) error
+	// CreateUser creates a user without credentials, guest marks it for
+	// the guest expiry.
+	CreateUser(ctx context.Context, guid uuid.UUID, guest bool) error
+	GetUser(ctx context.Context, guid uuid.UUID) (User, error)
+	// CreateUserWithPassword returns ErrAlreadyExists if the username or email is taken.
+	// An empty email or display name is stored as none.
+	CreateUserWithPassword(ctx context.Context, guid uuid.UUID, username, email, displayName, passwordHash string) error
+	GetUserByUsername(ctx context.Context, username string) (User, error)
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	UpdatePasswordHash(ctx context.Context, guid uuid.UUID, passwordHash string) error
+	// UpdateProfile sets the display name and email. Changing the email
+	// clears the verification, ErrAlreadyExists is returned if it is taken.
+	UpdateProfile(ctx context.Context, guid uuid.UUID, displayName, email string) error
+	// MarkEmailVerified verifies the user's email if it still equals email.
+	// It returns ErrNotFound if the user or the email do not match.
+	MarkEmailVerified(ctx context.Context, guid uuid.UUID, email string) error
+	// UpgradeGuest turns a guest into a registered user and sets the
+	// non-empty fields. It returns ErrNotFound if the user is not a guest
+	// and ErrAlreadyExists if the username or email is taken.
+	UpgradeGuest(ctx context.Context, guid uuid.UUID, username, email, displayName, passwordHash string) error
+	// PurgeGuests deletes guests whose last session started before
+	// inactiveSince, or who were created before it and have none, and
+	// returns how many were deleted.
+	PurgeGuests(ctx context.Context, inactiveSince time.Time) (int64, error)
+	// SetUserStatus changes the status of the user. Any status but active
+	// deletes the sessions of the user in the same transaction, so none
+	// outlives the change. lockedUntil is only stored for UserLocked.
+	SetUserStatus(ctx context.Context, guid uuid.UUID, status UserStatus, reason string, lockedUntil *time.Time) error
+	// PurgeDeletedUsers removes users deleted before deletedBefore for good
+	// and returns how many were removed.
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error)
 }
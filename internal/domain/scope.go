@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"slices"
+	"strings"
+)
+
+// Scopes every user may request. The permissions of the roles of a user
+// can be requested as scopes as well.
+const (
+	// ScopeProfile allows reading the profile.
+	ScopeProfile = "profile"
+	// ScopeAccount allows managing the account: credentials, sessions and
+	// the profile itself.
+	ScopeAccount = "account"
+	// ScopeOpenID asks for an OpenID Connect ID token and allows the
+	// userinfo endpoint.
+	ScopeOpenID = "openid"
+	// ScopeEmail adds the email address to the userinfo response.
+	ScopeEmail = "email"
+)
+
+// BaseScopes returns the scopes every user is allowed.
+func BaseScopes() []string {
+	return []string{ScopeAccount, ScopeEmail, ScopeOpenID, ScopeProfile}
+}
+
+// ParseScope splits a space separated scope parameter (RFC 6749 section
+// 3.3) into a sorted set without duplicates. An empty parameter gives nil.
+func ParseScope(scope string) []string {
+	fields := strings.Fields(scope)
+	if len(fields) == 0 {
+		return nil
+	}
+	slices.Sort(fields)
+	return slices.Compact(fields)
+}
+
+// FormatScope joins a scope set for the scope claim and parameter.
+func FormatScope(scope []string) string {
+	return strings.Join(scope, " ")
+}
+
+// ScopeSubset reports whether every element of scope is in allowed.
+func ScopeSubset(scope, allowed []string) bool {
+	for _, s := range scope {
+		if !slices.Contains(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectScope returns the elements of scope that are in allowed.
+func IntersectScope(scope, allowed []string) []string {
+	result := []string{}
+	for _, s := range scope {
+		if slices.Contains(allowed, s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
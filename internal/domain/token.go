@@ -9,6 +9,8 @@ import (
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	// Scope is the space separated scope granted to the access token.
+	Scope string `json:"scope,omitempty"`
 }
 
 type RefreshToken struct {
@@ -17,14 +19,86 @@ type RefreshToken struct {
 	SessionID string
 	IP        string
 	UserAgent string
+	// AMR lists the authentication methods the session was started with.
+	AMR []string
+	// AuthTime is when the user last authenticated in this session.
+	AuthTime time.Time
+	// Scope is what the session was narrowed to, nil if it was not.
+	// Refreshing can narrow it further but never widen it.
+	Scope []string
+	// OrgID is the active organization of the session, if any.
+	OrgID *uuid.UUID
+	// ClientID is the OAuth client the session was started through, empty
+	// for sessions of this API itself.
+	ClientID  string
 	CreatedAt time.Time
 	ExpiresAt time.Time
 }
 
+// AccessClaims are the session specific claims of an access token.
+type AccessClaims struct {
+	GUID      uuid.UUID
+	SessionID string
+	AMR       []string
+	ACR       string
+	AuthTime  time.Time
+	// Roles and Permissions are read when the token is issued, changes
+	// reach the user with the next access token.
+	Roles       []string
+	Permissions []string
+	Scope       []string
+	OrgID       *uuid.UUID
+	ClientID    string
+	// ExpiresAt overrides the access token TTL if it is set.
+	ExpiresAt time.Time
+}
+
+// IDClaims are the claims of an OpenID Connect ID token issued to a client
+// for a user.
+type IDClaims struct {
+	GUID     uuid.UUID
+	ClientID string
+	// Nonce is echoed from the authorization request, it is empty in ID
+	// tokens issued on refresh.
+	Nonce    string
+	AuthTime time.Time
+	AMR      []string
+	ACR      string
+	// AccessToken is the access token issued alongside, its hash is the
+	// at_hash claim.
+	AccessToken string
+}
+
+// JSONWebKey is a public key in the JWK format (RFC 7517).
+type JSONWebKey struct {
+	Kty string `json:"kty" example:"RSA"`
+	Use string `json:"use" example:"sig"`
+	Alg string `json:"alg" example:"RS256"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e" example:"AQAB"`
+}
+
 type TokenService interface {
-	GenerateAccessToken(guid uuid.UUID, sessionID string) (string, error)
+	GenerateAccessToken(claims AccessClaims) (string, error)
 	GenerateRefreshToken() (string, error)
 	ValidateAccessToken(token string) (map[string]any, error)
+	// GenerateClientAccessToken signs an access token for a client acting
+	// on its own behalf and returns it with its expiry.
+	GenerateClientAccessToken(claims ClientClaims) (string, time.Time, error)
+	// GenerateIDToken signs an OpenID Connect ID token with the RSA key of
+	// the realm, clients verify it with the keys returned by JWKS.
+	GenerateIDToken(claims IDClaims) (string, error)
+	JWKS() []JSONWebKey
+
+	GenerateEmailVerificationToken(guid uuid.UUID, email string, ttl time.Duration) (string, error)
+	// ValidateEmailVerificationToken returns the GUID and email the token was issued for.
+	ValidateEmailVerificationToken(token string) (uuid.UUID, string, error)
+
+	// GenerateMFAChallenge signs the proof that the first factor succeeded,
+	// it is exchanged for tokens together with a second factor.
+	GenerateMFAChallenge(guid uuid.UUID, amr []string, ttl time.Duration) (string, error)
+	ValidateMFAChallenge(token string) (uuid.UUID, []string, error)
 
 	HashRefreshToken(token string) (string, error)
 	CompareRefreshToken(token string, hash string) bool
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserStatus is the lifecycle state of a user. Only active users, and
+// locked users whose lock has expired, can obtain and use tokens.
+type UserStatus string
+
+const (
+	UserActive   UserStatus = "active"
+	UserDisabled UserStatus = "disabled"
+	UserLocked   UserStatus = "locked"
+	// UserDeleted users are kept for the retention window and then purged.
+	UserDeleted UserStatus = "deleted"
+)
+
+func (s UserStatus) Valid() bool {
+	switch s {
+	case UserActive, UserDisabled, UserLocked, UserDeleted:
+		return true
+	}
+	return false
+}
+
+// UserStatusError is returned for users that are not active. It matches
+// ErrUserDisabled with errors.Is.
+type UserStatusError struct {
+	Status UserStatus
+}
+
+func (e *UserStatusError) Error() string {
+	return "user is " + string(e.Status)
+}
+
+func (e *UserStatusError) Is(target error) bool {
+	return target == ErrUserDisabled
+}
+
+// User is an account. Guest is set for users created anonymously that
+// have not attached a username, email or passkey yet, inactive guests
+// are purged.
+type User struct {
+	GUID         uuid.UUID  `json:"guid"`
+	Username     string     `json:"username,omitempty"`
+	Email        string     `json:"email,omitempty"`
+	DisplayName  string     `json:"display_name,omitempty"`
+	PasswordHash string     `json:"-"`
+	Guest        bool       `json:"guest"`
+	Status       UserStatus `json:"status"`
+	StatusReason string     `json:"status_reason,omitempty"`
+	// StatusChangedAt is unset for users that were always active.
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+	// LockedUntil is when a lock expires, unset for indefinite locks.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
+}
+
+// Active reports whether the user may obtain and use tokens.
+func (u User) Active() bool {
+	return u.CheckActive() == nil
+}
+
+// CheckActive returns a *UserStatusError if the user is not active.
+func (u User) CheckActive() error {
+	switch {
+	case u.Status == UserActive:
+		return nil
+	case u.Status == UserLocked && u.LockedUntil != nil && !time.Now().Before(*u.LockedUntil):
+		return nil
+	}
+	return &UserStatusError{Status: u.Status}
+}
+
+// HasPassword reports whether the user can log in with a password.
+func (u User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
+// Verified reports whether the user has confirmed the current email.
+func (u User) Verified() bool {
+	return u.VerifiedAt != nil
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebAuthnCeremonyKind tells registration and login ceremonies apart, so
+// the challenge of one can not be used to finish the other.
+type WebAuthnCeremonyKind string
+
+const (
+	WebAuthnRegistration WebAuthnCeremonyKind = "registration"
+	WebAuthnLogin        WebAuthnCeremonyKind = "login"
+)
+
+// WebAuthnCredential is a passkey registered by a user.
+type WebAuthnCredential struct {
+	ID              []byte
+	GUID            uuid.UUID
+	Name            string
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32
+	Transports      []string
+	BackupEligible  bool
+	BackupState     bool
+	CreatedAt       time.Time
+	LastUsedAt      *time.Time
+}
+
+// WebAuthnCeremony is a started registration or login. SessionData is the
+// serialised state the WebAuthn library needs to finish it.
+type WebAuthnCeremony struct {
+	Challenge string
+	Kind      WebAuthnCeremonyKind
+	// GUID is nil for logins that do not name a user.
+	GUID        *uuid.UUID
+	SessionData []byte
+	ExpiresAt   time.Time
+}
+
+type WebAuthnRepository interface {
+	// StoreCredential returns ErrAlreadyExists if the credential ID is registered already.
+	StoreCredential(ctx context.Context, cred WebAuthnCredential) error
+	ListCredentials(ctx context.Context, guid uuid.UUID) ([]WebAuthnCredential, error)
+	// UseCredential records a login with the credential. It returns
+	// ErrNotFound if signCount did not grow, unless the authenticator does
+	// not count at all and both are 0.
+	UseCredential(ctx context.Context, id []byte, signCount uint32, backupState bool) error
+	// DeleteCredential returns ErrNotFound if the user has no such credential.
+	DeleteCredential(ctx context.Context, guid uuid.UUID, id []byte) error
+
+	StoreCeremony(ctx context.Context, ceremony WebAuthnCeremony) error
+	// ConsumeCeremony returns and deletes an unexpired ceremony, so every
+	// challenge can be answered once.
+	ConsumeCeremony(ctx context.Context, challenge string, kind WebAuthnCeremonyKind) (WebAuthnCeremony, error)
+}
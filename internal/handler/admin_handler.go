@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+const adminActor = "admin"
+
+// AuditLogResponse is a page of audit log entries.
+type AuditLogResponse struct {
+	Entries []domain.AuditEntry `json:"entries"`
+	// NextCursor is passed as cursor to fetch the next page, 0 if the page is empty.
+	NextCursor int64 `json:"next_cursor"`
+}
+
+type AdminHandler struct {
+	auth *auth.AuthService
+}
+
+func NewAdminHandler(service *auth.AuthService) *AdminHandler {
+	return &AdminHandler{
+		auth: service,
+	}
+}
+
+// AuditLog godoc
+// @Summary      Query audit log
+// @Description  Returns audit log entries newest first, filtered by guid, event type and time range
+// @Tags         admin
+// @Produce      json
+// @Param        guid        query  string  false  "User GUID"
+// @Param        event_type  query  string  false  "Event type"  Enums(authorize, refresh, revoke, admin_action)
+// @Param        from        query  string  false  "Start of time range (RFC3339, inclusive)"
+// @Param        to          query  string  false  "End of time range (RFC3339, exclusive)"
+// @Param        limit       query  int     false  "Page size"
+// @Param        cursor      query  int     false  "next_cursor of the previous page"
+// @Success      200 {object} AuditLogResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Security     AdminToken
+// @Router       /admin/audit [get]
+func (h *AdminHandler) AuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var (
+		filter domain.AuditFilter
+		err    error
+	)
+
+	if guidStr := query.Get("guid"); guidStr != "" {
+		parsed, err := uuid.Parse(guidStr)
+		if err != nil {
+			http.Error(w, "invalid guid", http.StatusBadRequest)
+			return
+		}
+		filter.GUID = &parsed
+	}
+
+	filter.EventType = domain.AuditEventType(query.Get("event_type"))
+
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.BeforeID, err = strconv.ParseInt(cursor, 10, 64); err != nil || filter.BeforeID < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := h.auth.AuditLog(r.Context(), adminActor, r.RemoteAddr, filter)
+	if err != nil {
+		http.Error(w, "failed to query audit log", http.StatusInternalServerError)
+		return
+	}
+
+	response := AuditLogResponse{
+		Entries: entries,
+	}
+	if response.Entries == nil {
+		response.Entries = []domain.AuditEntry{}
+	}
+	if len(entries) > 0 {
+		response.NextCursor = entries[len(entries)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// UserStatusRequest changes the status of a user.
+type UserStatusRequest struct {
+	Status domain.UserStatus `json:"status" enums:"active,disabled,locked,deleted"`
+	Reason string            `json:"reason,omitempty"`
+	// LockedUntil ends a lock, without it the user stays locked until activated.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// UserStatusResponse is the status of a user after a change.
+type UserStatusResponse struct {
+	GUID            uuid.UUID         `json:"guid"`
+	Status          domain.UserStatus `json:"status"`
+	StatusReason    string            `json:"status_reason,omitempty"`
+	StatusChangedAt *time.Time        `json:"status_changed_at,omitempty"`
+	LockedUntil     *time.Time        `json:"locked_until,omitempty"`
+}
+
+// SetUserStatus godoc
+// @Summary      Set user status
+// @Description  Disables, locks, deletes or activates a user. Every status but active revokes the sessions of the user at once. Deleted users can be activated again until they are purged after the retention window.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        guid     path  string             true  "User GUID"
+// @Param        request  body  UserStatusRequest  true  "New status"
+// @Success      200 {object} UserStatusResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "user not found"
+// @Security     AdminToken
+// @Router       /admin/users/{guid}/status [put]
+func (h *AdminHandler) SetUserStatus(w http.ResponseWriter, r *http.Request) {
+	guid, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid guid", http.StatusBadRequest)
+		return
+	}
+
+	var req UserStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Status.Valid() {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.LockedUntil != nil && (req.Status != domain.UserLocked || !req.LockedUntil.After(time.Now())) {
+		http.Error(w, "locked_until must be in the future and requires status locked", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Status {
+	case domain.UserActive:
+		err = h.auth.ActivateUser(r.Context(), adminActor, guid, req.Reason)
+	case domain.UserDisabled:
+		err = h.auth.DisableUser(r.Context(), adminActor, guid, req.Reason)
+	case domain.UserLocked:
+		err = h.auth.LockUser(r.Context(), adminActor, guid, req.Reason, req.LockedUntil)
+	case domain.UserDeleted:
+		err = h.auth.DeleteUser(r.Context(), adminActor, guid, req.Reason)
+	}
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to set user status", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.auth.GetUser(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserStatusResponse{
+		GUID:            user.GUID,
+		Status:          user.Status,
+		StatusReason:    user.StatusReason,
+		StatusChangedAt: user.StatusChangedAt,
+		LockedUntil:     user.LockedUntil,
+	})
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+)
+
+// APIKeyRequest creates an API key.
+type APIKeyRequest struct {
+	Name string `json:"name" example:"ci"`
+	// Scope is a space separated subset of the scope of the current
+	// token, all of it if empty.
+	Scope string `json:"scope,omitempty"`
+	// ExpiresIn is the lifetime in seconds, 0 picks the longest allowed.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// APIKeyResponse carries a new API key. The key is only ever shown here.
+type APIKeyResponse struct {
+	domain.APIKey
+	Key string `json:"key" example:"gbt_0123456789ab_..."`
+}
+
+// CreateAPIKey godoc
+// @Summary      Create API key
+// @Description  Creates a long lived API key for scripts and machine clients. It is sent as a bearer token in place of an access token and grants the requested scope. The key is only returned once. API keys can not create other keys.
+// @Tags         api-keys
+// @Accept       json
+// @Produce      json
+// @Param        request body APIKeyRequest true "API key"
+// @Success      201 {object} APIKeyResponse
+// @Failure      400 {string} string "invalid request or scope"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "api keys can not manage api keys"
+// @Failure      409 {string} string "too many api keys"
+// @Security     BearerAuth
+// @Router       /me/api-keys [post]
+func (h *AuthHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Context().Value(middleware.ContextAPIKeyIDKey).(uuid.UUID); ok {
+		http.Error(w, "api keys can not manage api keys", http.StatusForbidden)
+		return
+	}
+
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+	current, _ := r.Context().Value(middleware.ContextScopeKey).([]string)
+
+	key, plain, err := h.auth.CreateAPIKey(r.Context(), guid, req.Name, domain.ParseScope(req.Scope), current, time.Duration(req.ExpiresIn)*time.Second, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.Is(err, auth.ErrInvalidScope), errors.As(err, &validationErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, auth.ErrTooManyAPIKeys):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "failed to create api key", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIKeyResponse{APIKey: key, Key: plain})
+}
+
+// ListAPIKeys godoc
+// @Summary      List API keys
+// @Description  Lists the API keys of the current user with when and from where they were last used
+// @Tags         api-keys
+// @Produce      json
+// @Success      200 {array} domain.APIKey
+// @Failure      401 {string} string "unauthorized"
+// @Security     BearerAuth
+// @Router       /me/api-keys [get]
+func (h *AuthHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	keys, err := h.auth.ListAPIKeys(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to list api keys", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []domain.APIKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKey godoc
+// @Summary      Revoke API key
+// @Description  Deletes an API key of the current user, it stops working immediately
+// @Tags         api-keys
+// @Param        id path string true "API key ID"
+// @Success      204
+// @Failure      400 {string} string "invalid api key id"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "api keys can not manage api keys"
+// @Failure      404 {string} string "api key not found"
+// @Security     BearerAuth
+// @Router       /me/api-keys/{id} [delete]
+func (h *AuthHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Context().Value(middleware.ContextAPIKeyIDKey).(uuid.UUID); ok {
+		http.Error(w, "api keys can not manage api keys", http.StatusForbidden)
+		return
+	}
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid api key id", http.StatusBadRequest)
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.auth.RevokeAPIKey(r.Context(), guid, id, r.UserAgent(), r.RemoteAddr); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to revoke api key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
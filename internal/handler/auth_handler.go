@@ -2,65 +2,130 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
 	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
 )
 
+// AuthorizeRequest is the optional payload of the authorize endpoint.
+type AuthorizeRequest struct {
+	// Scope is a space separated subset of the allowed scopes, all of
+	// them if it is omitted.
+	Scope string `json:"scope,omitempty"`
+}
+
 // RefreshRequest represents a request payload for token refresh.
 type RefreshRequest struct {
 	GUID         uuid.UUID `json:"guid"`
 	RefreshToken string    `json:"refresh_token"`
+	// Scope narrows the session, it can not add scopes the session was
+	// not granted. The session keeps its scope if it is omitted.
+	Scope string `json:"scope,omitempty"`
+}
+
+// RegisterRequest is the payload of the register endpoint.
+type RegisterRequest struct {
+	Username string `json:"username"`
+	// Email is optional unless verified emails are required, without it
+	// the password can not be reset.
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Password    string `json:"password"`
+}
+
+// CredentialsRequest is the payload of the login endpoint.
+type CredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // TokenResponse contains generated JWT tokens.
 type TokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	// Scope is the space separated scope granted to the access token.
+	Scope string `json:"scope,omitempty"`
 }
 
 // MeResponse represents the /me endpoint response.
 type MeResponse struct {
-	GUID uuid.UUID `json:"guid"`
+	GUID          uuid.UUID  `json:"guid"`
+	Username      string     `json:"username,omitempty"`
+	Email         string     `json:"email,omitempty"`
+	EmailVerified bool       `json:"email_verified"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"`
+	DisplayName   string     `json:"display_name,omitempty"`
+	Guest         bool       `json:"guest"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func newMeResponse(user domain.User) MeResponse {
+	return MeResponse{
+		GUID:          user.GUID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.Verified(),
+		VerifiedAt:    user.VerifiedAt,
+		DisplayName:   user.DisplayName,
+		Guest:         user.Guest,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+	}
 }
 
 type AuthHandler struct {
 	auth *auth.AuthService
+	// stepUpMaxAge is how recent the authentication must be to change an email.
+	stepUpMaxAge time.Duration
 }
 
-func NewAuthHandler(service *auth.AuthService) *AuthHandler {
+func NewAuthHandler(service *auth.AuthService, stepUpMaxAge time.Duration) *AuthHandler {
 	return &AuthHandler{
-		auth: service,
+		auth:         service,
+		stepUpMaxAge: stepUpMaxAge,
 	}
 }
 
 // Authorize godoc
-// @Summary      Authorize user
-// @Description  Returns new access and refresh tokens. If guid is empty a new user is created.
+// @Summary      Authorize anonymous user
+// @Description  Creates a new anonymous user and returns its access and refresh tokens. Existing users log in through /login. The session can be limited to some of the base scopes.
 // @Tags         auth
-// @Param        guid  query     string  false  "User GUID"
+// @Accept       json
 // @Produce      json
+// @Param        request body AuthorizeRequest false "Requested scope"
 // @Success      200  {object}  TokenResponse
+// @Failure      400  {string}  string  "invalid scope"
 // @Failure      401  {string}  string  "unauthorized"
+// @Failure      403  {string}  string  "email is not verified"
+// @Failure      429  {string}  string  "too many requests"
 // @Router       /auth [post]
 func (h *AuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
-	guidStr := r.URL.Query().Get("guid")
-	var guidPtr *uuid.UUID
-	if guidStr != "" {
-		parsed, err := uuid.Parse(guidStr)
-		if err != nil {
-			http.Error(w, "invalid guid", http.StatusBadRequest)
-			return
-		}
-		guidPtr = &parsed
+	var req AuthorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
 	}
 
 	userAgent := r.UserAgent()
 	ip := r.RemoteAddr
 
-	tokens, err := h.auth.Authorize(r.Context(), guidPtr, userAgent, ip)
+	tokens, err := h.auth.Authorize(r.Context(), nil, domain.ParseScope(req.Scope), userAgent, ip)
+	if errors.Is(err, auth.ErrInvalidScope) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, domain.ErrEmailNotVerified) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
@@ -69,19 +134,114 @@ func (h *AuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(TokenResponse{
 		AccessToken:  tokens.AccessToken,
 		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
+
+// Register godoc
+// @Summary      Register user
+// @Description  Creates a user with a username and password and returns its tokens. A verification is mailed to the email if one is given. If verified emails are required, no tokens are returned until the email is verified, and a taken username or email gets the same 202 so accounts can not be enumerated. Otherwise a taken username or email gets 409.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body RegisterRequest true "Credentials"
+// @Success      200 {object} TokenResponse
+// @Success      202 "email verification required, also for a taken username or email"
+// @Failure      400 {string} string "invalid request"
+// @Failure      409 {string} string "username or email already taken, only if verified emails are not required"
+// @Failure      429 {string} string "too many requests"
+// @Router       /register [post]
+func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.auth.Register(r.Context(), req.Username, req.Email, req.DisplayName, req.Password, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.Is(err, domain.ErrEmailNotVerified):
+			w.WriteHeader(http.StatusAccepted)
+		case errors.As(err, &validationErr):
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "username or email already taken", http.StatusConflict)
+		default:
+			http.Error(w, "failed to register", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
+
+// Login godoc
+// @Summary      Log in
+// @Description  Verifies username and password and returns new access and refresh tokens
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body CredentialsRequest true "Credentials"
+// @Success      200 {object} TokenResponse
+// @Success      202 {object} MFAChallengeResponse "second factor required, continue at /login/mfa"
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid credentials"
+// @Failure      403 {string} string "user is disabled or email is not verified"
+// @Failure      429 {string} string "too many requests"
+// @Router       /login [post]
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var req CredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.auth.Login(r.Context(), req.Username, req.Password, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		switch {
+		case errors.As(err, &mfaErr):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(MFAChallengeResponse{
+				ChallengeToken: mfaErr.Challenge,
+				ExpiresIn:      int(mfaErr.ExpiresIn.Seconds()),
+			})
+		case errors.Is(err, domain.ErrInvalidCredentials):
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		case errors.Is(err, domain.ErrUserDisabled), errors.Is(err, domain.ErrEmailNotVerified):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to log in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
 	})
 }
 
 // Refresh godoc
 // @Summary      Refresh tokens
-// @Description  Generates new token pair using refresh token
+// @Description  Generates new token pair using refresh token. A scope narrows the session, it can never be widened again.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        request body RefreshRequest true "Refresh request"
 // @Success      200 {object} TokenResponse
-// @Failure      400 {string} string "invalid request"
+// @Failure      400 {string} string "invalid request or scope"
 // @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "api keys can not use this endpoint"
+// @Failure      429 {string} string "too many requests"
 // @Security     BearerAuth
 // @Router       /refresh [post]
 func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
@@ -104,9 +264,14 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 		req.GUID,
 		sessionID,
 		req.RefreshToken,
+		domain.ParseScope(req.Scope),
 		userAgent,
 		ip,
 	)
+	if errors.Is(err, auth.ErrInvalidScope) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -115,12 +280,13 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(TokenResponse{
 		AccessToken:  tokens.AccessToken,
 		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
 	})
 }
 
 // Me godoc
 // @Summary      Get user info
-// @Description  Returns current user GUID
+// @Description  Returns the profile of the current user
 // @Tags         auth
 // @Produce      json
 // @Success      200 {object} MeResponse
@@ -132,19 +298,280 @@ func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 
 	guid := guidVal.(uuid.UUID)
 
-	response := MeResponse{
-		GUID: guid,
+	user, err := h.auth.GetUser(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newMeResponse(user)); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// UpdateProfileRequest is the payload of the profile update. Omitted
+// fields are left unchanged, empty strings clear them.
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"display_name,omitempty"`
+	Email       *string `json:"email,omitempty"`
+}
+
+// UpdateMe godoc
+// @Summary      Update profile
+// @Description  Updates display name and email of the current user. A changed email has to be verified again. Replacing an email requires a recent authentication, see /reauthenticate.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body UpdateProfileRequest true "Profile fields"
+// @Success      200 {object} MeResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {object} middleware.InsufficientAuthenticationResponse "unauthorized or reauthentication required"
+// @Failure      409 {string} string "email already taken"
+// @Security     BearerAuth
+// @Router       /me [patch]
+func (h *AuthHandler) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	user, err := h.auth.GetUser(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	displayName, email := user.DisplayName, user.Email
+	if req.DisplayName != nil {
+		displayName = *req.DisplayName
+	}
+	if req.Email != nil {
+		email = *req.Email
+	}
+
+	// whoever holds a session must not be able to take the account over
+	// by replacing its email
+	if user.Email != "" && !strings.EqualFold(user.Email, email) && !middleware.AuthLevelSatisfied(r, h.stepUpMaxAge, domain.ACRSingleFactor) {
+		middleware.InsufficientAuthentication(w, h.stepUpMaxAge, domain.ACRSingleFactor)
+		return
+	}
+
+	user, err = h.auth.UpdateProfile(r.Context(), guid, displayName, email, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "email already taken", http.StatusConflict)
+		default:
+			http.Error(w, "failed to update profile", http.StatusInternalServerError)
+		}
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeResponse(user)); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 	}
 }
 
+// DeleteMe godoc
+// @Summary      Delete account
+// @Description  Deletes the current user with all sessions and credentials. Requires a recent authentication, see /reauthenticate.
+// @Tags         auth
+// @Success      204
+// @Failure      401 {object} middleware.InsufficientAuthenticationResponse "unauthorized or reauthentication required"
+// @Security     BearerAuth
+// @Router       /me [delete]
+func (h *AuthHandler) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.auth.DeleteAccount(r.Context(), guid, r.UserAgent(), r.RemoteAddr); err != nil {
+		http.Error(w, "failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpgradeRequest turns a guest into a registered user. A password
+// requires a username, at least one of username and email is required.
+type UpgradeRequest struct {
+	Username    string `json:"username,omitempty"`
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Password    string `json:"password,omitempty"`
+}
+
+// Upgrade godoc
+// @Summary      Upgrade guest
+// @Description  Attaches a username and password, an email or both to the current guest. The GUID and the sessions are kept, a verification is mailed to the email. Registering a passkey upgrades a guest as well.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body UpgradeRequest true "Credentials"
+// @Success      200 {object} MeResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      409 {string} string "already registered, or username or email already taken"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /me/upgrade [post]
+func (h *AuthHandler) Upgrade(w http.ResponseWriter, r *http.Request) {
+	var req UpgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	user, err := h.auth.UpgradeGuest(r.Context(), guid, req.Username, req.Email, req.DisplayName, req.Password, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		case errors.Is(err, auth.ErrNotGuest):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "username or email already taken", http.StatusConflict)
+		default:
+			http.Error(w, "failed to upgrade account", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newMeResponse(user)); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// ReauthenticateRequest carries either the password or a TOTP code.
+type ReauthenticateRequest struct {
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// AccessTokenResponse carries a new access token for the current session.
+type AccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// Reauthenticate godoc
+// @Summary      Reauthenticate
+// @Description  Checks the password or a TOTP code again and updates auth_time, amr and acr of the current session. The refresh token stays valid, only a new access token is returned.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body ReauthenticateRequest true "Password or code"
+// @Success      200 {object} AccessTokenResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid credentials"
+// @Failure      403 {string} string "user is disabled, totp is locked or the request used an api key"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /reauthenticate [post]
+func (h *AuthHandler) Reauthenticate(w http.ResponseWriter, r *http.Request) {
+	var req ReauthenticateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Password == "") == (req.Code == "") {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+	sessionID := r.Context().Value(middleware.ContextSessionIDKey).(string)
+
+	accessToken, err := h.auth.Reauthenticate(r.Context(), guid, sessionID, req.Password, req.Code, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidCredentials), errors.Is(err, auth.ErrInvalidMFACode), errors.Is(err, domain.ErrNotFound):
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrTOTPLocked), errors.Is(err, domain.ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to reauthenticate", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(AccessTokenResponse{AccessToken: accessToken})
+}
+
+// DownscopeRequest is the payload of the downscope endpoint.
+type DownscopeRequest struct {
+	// Scope is a space separated subset of the scope of the current token.
+	Scope string `json:"scope"`
+	// ExpiresIn is the lifetime in seconds, at most 300. The token never
+	// outlives the current one.
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// DownscopeResponse carries a downscoped access token.
+type DownscopeResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// Downscope godoc
+// @Summary      Downscope access token
+// @Description  Issues a short lived access token for the current session with part of the scope of the current one, to hand to less trusted components. It carries no authentication methods and is revoked with the session.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body DownscopeRequest true "Requested scope"
+// @Success      200 {object} DownscopeResponse
+// @Failure      400 {string} string "invalid request or scope"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /token/downscope [post]
+func (h *AuthHandler) Downscope(w http.ResponseWriter, r *http.Request) {
+	var req DownscopeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+	sessionID := r.Context().Value(middleware.ContextSessionIDKey).(string)
+	current, _ := r.Context().Value(middleware.ContextScopeKey).([]string)
+	currentExpiresAt, _ := r.Context().Value(middleware.ContextExpiresAtKey).(time.Time)
+	scope := domain.ParseScope(req.Scope)
+
+	accessToken, expiresAt, err := h.auth.Downscope(r.Context(), guid, sessionID, current, scope, currentExpiresAt, time.Duration(req.ExpiresIn)*time.Second, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.Is(err, auth.ErrInvalidScope), errors.As(err, &validationErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrNotFound):
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			http.Error(w, "failed to downscope token", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(DownscopeResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(time.Until(expiresAt).Seconds()),
+		Scope:       domain.FormatScope(scope),
+	})
+}
+
 // Deauthorize godoc
 // @Summary      Deauthorize user
-// @Description  Deauthorizing current token and forbid user from requesting protected endpoints
+// @Description  Deauthorizing current session and forbid it from requesting protected endpoints, other sessions of the user are kept
 // @Tags         auth
 // @Success      204
 // @Failure      401 {string} string "unauthorized"
@@ -154,8 +581,9 @@ func (h *AuthHandler) Deauthorize(w http.ResponseWriter, r *http.Request) {
 	guidVal := r.Context().Value(middleware.ContextUserGUIDKey)
 
 	guid := guidVal.(uuid.UUID)
+	sessionID := r.Context().Value(middleware.ContextSessionIDKey).(string)
 
-	err := h.auth.Deauthorize(r.Context(), guid)
+	err := h.auth.Deauthorize(r.Context(), guid, sessionID, r.UserAgent(), r.RemoteAddr)
 	if err != nil {
 		http.Error(w, "failed to deauthorize", http.StatusInternalServerError)
 		return
@@ -163,3 +591,296 @@ func (h *AuthHandler) Deauthorize(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// ChangePasswordRequest is the payload of the password change endpoint.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword godoc
+// @Summary      Change password
+// @Description  Replaces the password of the current user. The new password must satisfy the password policy and must not appear in the breached password corpus.
+// @Tags         auth
+// @Accept       json
+// @Param        request body ChangePasswordRequest true "Current and new password"
+// @Success      204
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Security     BearerAuth
+// @Router       /password/change [post]
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := h.auth.ChangePassword(r.Context(), guid, req.CurrentPassword, req.NewPassword, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrInvalidCredentials):
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			http.Error(w, "failed to change password", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ForgotPasswordRequest is the payload of the forgot password endpoint.
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest is the payload of the password reset endpoint.
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ForgotPassword godoc
+// @Summary      Request password reset
+// @Description  Mails a single-use reset token if a user with this email exists. The response is the same either way.
+// @Tags         auth
+// @Accept       json
+// @Param        request body ForgotPasswordRequest true "Email"
+// @Success      202
+// @Failure      400 {string} string "invalid request"
+// @Failure      429 {string} string "too many requests"
+// @Router       /password/forgot [post]
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.auth.ForgotPassword(r.Context(), req.Email, r.UserAgent(), r.RemoteAddr); err != nil {
+		http.Error(w, "failed to request password reset", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword godoc
+// @Summary      Reset password
+// @Description  Sets a new password using a reset token and revokes every session of the user
+// @Tags         auth
+// @Accept       json
+// @Param        request body ResetPasswordRequest true "Reset token and new password"
+// @Success      204
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid or expired reset token"
+// @Failure      429 {string} string "too many requests"
+// @Router       /password/reset [post]
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := h.auth.ResetPassword(r.Context(), req.Token, req.NewPassword, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		case errors.Is(err, auth.ErrInvalidResetToken):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, "failed to reset password", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendVerificationRequest is the payload of the resend verification endpoint.
+type SendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// VerifyEmailRequest carries either the token of a verification link or
+// the email together with the mailed code.
+type VerifyEmailRequest struct {
+	Token string `json:"token,omitempty"`
+	Email string `json:"email,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// SendEmailVerification godoc
+// @Summary      Resend email verification
+// @Description  Mails a new verification link and code if an unverified user with this email exists. The response is the same either way.
+// @Tags         auth
+// @Accept       json
+// @Param        request body SendVerificationRequest true "Email"
+// @Success      202
+// @Failure      400 {string} string "invalid request"
+// @Failure      429 {string} string "too many requests"
+// @Router       /email/verify/send [post]
+func (h *AuthHandler) SendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	var req SendVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.auth.SendEmailVerification(r.Context(), req.Email); err != nil {
+		http.Error(w, "failed to send verification", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail godoc
+// @Summary      Verify email
+// @Description  Verifies an email with the token of a verification link, or with the email and the 6-digit code
+// @Tags         auth
+// @Accept       json
+// @Param        request body VerifyEmailRequest true "Link token, or email and code"
+// @Success      204
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid or expired verification"
+// @Failure      429 {string} string "too many requests"
+// @Router       /email/verify [post]
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case req.Token != "":
+		err = h.auth.VerifyEmailToken(r.Context(), req.Token, r.UserAgent(), r.RemoteAddr)
+	case req.Email != "" && req.Code != "":
+		err = h.auth.VerifyEmailCode(r.Context(), req.Email, req.Code, r.UserAgent(), r.RemoteAddr)
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidVerification) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EmailLoginRequest asks for a login link and code to be mailed.
+type EmailLoginRequest struct {
+	Email string `json:"email"`
+}
+
+// EmailLoginVerifyRequest carries either the token of a login link or the
+// email together with the mailed code.
+type EmailLoginVerifyRequest struct {
+	Token string `json:"token,omitempty"`
+	Email string `json:"email,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// RequestEmailLogin godoc
+// @Summary      Request a passwordless login
+// @Description  Mails a login link and a 6-digit code if a user with this email exists. The response is the same either way. Both only work from the same user agent.
+// @Tags         auth
+// @Accept       json
+// @Param        request body EmailLoginRequest true "Email"
+// @Success      202
+// @Failure      400 {string} string "invalid request"
+// @Failure      429 {string} string "too many requests"
+// @Router       /login/email [post]
+func (h *AuthHandler) RequestEmailLogin(w http.ResponseWriter, r *http.Request) {
+	var req EmailLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.auth.RequestEmailLogin(r.Context(), req.Email, r.UserAgent(), r.RemoteAddr); err != nil {
+		http.Error(w, "failed to request login", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmailLogin godoc
+// @Summary      Complete a passwordless login
+// @Description  Exchanges the token of a login link, or the email and the 6-digit code, for tokens
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body EmailLoginVerifyRequest true "Link token, or email and code"
+// @Success      200 {object} TokenResponse
+// @Success      202 {object} MFAChallengeResponse "second factor required, continue at /login/mfa"
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid or expired login"
+// @Failure      403 {string} string "user is disabled or email is not verified"
+// @Failure      429 {string} string "too many requests"
+// @Router       /login/email/verify [post]
+func (h *AuthHandler) VerifyEmailLogin(w http.ResponseWriter, r *http.Request) {
+	var req EmailLoginVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		tokens domain.TokenPair
+		err    error
+	)
+	switch {
+	case req.Token != "":
+		tokens, err = h.auth.LoginWithEmailToken(r.Context(), req.Token, r.UserAgent(), r.RemoteAddr)
+	case req.Email != "" && req.Code != "":
+		tokens, err = h.auth.LoginWithEmailCode(r.Context(), req.Email, req.Code, r.UserAgent(), r.RemoteAddr)
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		switch {
+		case errors.As(err, &mfaErr):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(MFAChallengeResponse{
+				ChallengeToken: mfaErr.Challenge,
+				ExpiresIn:      int(mfaErr.ExpiresIn.Seconds()),
+			})
+		case errors.Is(err, auth.ErrInvalidEmailLogin):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, domain.ErrUserDisabled), errors.Is(err, domain.ErrEmailNotVerified):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to log in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var authorizeTemplate = template.Must(template.ParseFS(templateFS, "templates/authorize.html"))
+
+// authorizationParams are carried from the authorization request through
+// the login form.
+var authorizationParams = []string{
+	"client_id", "redirect_uri", "response_type", "scope", "state", "code_challenge", "code_challenge_method", "nonce",
+}
+
+// authorizePage is rendered by templates/authorize.html.
+type authorizePage struct {
+	Client       *domain.OAuthClient
+	Scope        []string
+	Params       map[string]string
+	Username     string
+	MFAChallenge string
+	Error        string
+	// Fatal replaces the form, the request can not continue.
+	Fatal string
+}
+
+func authorizationRequest(form url.Values) auth.AuthorizationRequest {
+	return auth.AuthorizationRequest{
+		ClientID:            form.Get("client_id"),
+		RedirectURI:         form.Get("redirect_uri"),
+		ResponseType:        form.Get("response_type"),
+		Scope:               domain.ParseScope(form.Get("scope")),
+		State:               form.Get("state"),
+		CodeChallenge:       form.Get("code_challenge"),
+		CodeChallengeMethod: form.Get("code_challenge_method"),
+		Nonce:               form.Get("nonce"),
+		Prompt:              form.Get("prompt"),
+	}
+}
+
+// Authorize is the OAuth 2.0 authorization endpoint. It shows a login and
+// consent page for the client named in the query.
+func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	prompt, ok := h.checkAuthorizationRequest(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+	h.renderAuthorize(w, http.StatusOK, prompt, r.URL.Query(), authorizePage{})
+}
+
+// AuthorizeSubmit takes the login and consent form. A wrong password or
+// a second factor shows the page again, otherwise the user agent is sent
+// back to the client with a code or an error.
+func (h *OAuthHandler) AuthorizeSubmit(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderAuthorize(w, http.StatusBadRequest, auth.AuthorizationPrompt{}, nil, authorizePage{Fatal: "invalid form"})
+		return
+	}
+
+	prompt, ok := h.checkAuthorizationRequest(w, r, r.PostForm)
+	if !ok {
+		return
+	}
+	if r.PostForm.Get("consent") != "allow" {
+		redirectAuthorization(w, r, prompt, url.Values{"error": {auth.OAuthAccessDenied}})
+		return
+	}
+
+	login, err := h.formLogin(r)
+	if err != nil {
+		redirectAuthorization(w, r, prompt, url.Values{"error": {"server_error"}})
+		return
+	}
+	page := authorizePage{Username: r.PostForm.Get("username"), MFAChallenge: login.MFAChallenge, Error: login.Error}
+	if login.Status != http.StatusOK || page.MFAChallenge != "" {
+		h.renderAuthorize(w, login.Status, prompt, r.PostForm, page)
+		return
+	}
+
+	code, err := h.oauth.IssueAuthorizationCode(r.Context(), prompt, login.GUID, login.AMR)
+	if err != nil {
+		var statusErr *domain.UserStatusError
+		if errors.As(err, &statusErr) {
+			page.MFAChallenge = ""
+			page.Error = "This account can not sign in."
+			h.renderAuthorize(w, http.StatusForbidden, prompt, r.PostForm, page)
+			return
+		}
+		redirectAuthorization(w, r, prompt, url.Values{"error": {"server_error"}})
+		return
+	}
+
+	redirectAuthorization(w, r, prompt, url.Values{"code": {code}})
+}
+
+// loginResult is the outcome of the login part of a form.
+type loginResult struct {
+	GUID uuid.UUID
+	AMR  []string
+	// MFAChallenge is set when a second factor has to be asked for.
+	MFAChallenge string
+	// Error is shown to the user with Status if the login failed.
+	Error  string
+	Status int
+}
+
+// formLogin authenticates the user with the password, or with the second
+// factor once the form carries an mfa_token. Failed logins are reported
+// in the result, the error is only set if the login could not be checked.
+func (h *OAuthHandler) formLogin(r *http.Request) (loginResult, error) {
+	ip := r.Header.Get("X-Real-IP")
+	if ip == "" {
+		ip = r.RemoteAddr
+	}
+
+	var (
+		result = loginResult{Status: http.StatusOK}
+		err    error
+	)
+	if challenge := r.PostForm.Get("mfa_token"); challenge != "" {
+		result.MFAChallenge = challenge
+		result.GUID, result.AMR, err = h.auth.AuthenticateMFA(r.Context(), challenge, r.PostForm.Get("code"), r.PostForm.Get("recovery_code"), r.UserAgent(), ip)
+	} else {
+		result.GUID, result.AMR, err = h.auth.AuthenticatePassword(r.Context(), r.PostForm.Get("username"), r.PostForm.Get("password"), r.UserAgent(), ip)
+	}
+	if err == nil {
+		result.MFAChallenge = ""
+		return result, nil
+	}
+
+	var mfaErr *auth.MFARequiredError
+	switch {
+	case errors.As(err, &mfaErr):
+		result.MFAChallenge = mfaErr.Challenge
+	case errors.Is(err, domain.ErrInvalidCredentials):
+		result.Error, result.Status = "Invalid username or password.", http.StatusUnauthorized
+	case errors.Is(err, auth.ErrTOTPLocked):
+		result.Error, result.Status = "Too many wrong codes, use a recovery code.", http.StatusUnauthorized
+	case errors.Is(err, auth.ErrInvalidMFACode):
+		result.Error, result.Status = "Invalid code.", http.StatusUnauthorized
+	default:
+		return loginResult{}, err
+	}
+	return result, nil
+}
+
+// checkAuthorizationRequest validates the request in form. Errors that
+// can go back to the client are redirected there, others are shown to the
+// user. It reports whether the request can continue.
+func (h *OAuthHandler) checkAuthorizationRequest(w http.ResponseWriter, r *http.Request, form url.Values) (auth.AuthorizationPrompt, bool) {
+	prompt, err := h.oauth.ValidateAuthorizationRequest(r.Context(), authorizationRequest(form))
+	if err == nil {
+		return prompt, true
+	}
+
+	var oauthErr *auth.OAuthError
+	switch {
+	case errors.As(err, &oauthErr):
+		redirectAuthorization(w, r, prompt, url.Values{"error": {oauthErr.Code}, "error_description": {oauthErr.Description}})
+	case errors.Is(err, auth.ErrUnknownClient), errors.Is(err, auth.ErrInvalidRedirectURI):
+		h.renderAuthorize(w, http.StatusBadRequest, prompt, nil, authorizePage{Fatal: "The application sent an invalid request: " + err.Error() + "."})
+	default:
+		h.renderAuthorize(w, http.StatusInternalServerError, prompt, nil, authorizePage{Fatal: "The request could not be processed, try again later."})
+	}
+	return prompt, false
+}
+
+// redirectAuthorization sends the user agent back to the client with the
+// response parameters and the state of the request.
+func redirectAuthorization(w http.ResponseWriter, r *http.Request, prompt auth.AuthorizationPrompt, params url.Values) {
+	target, err := url.Parse(prompt.RedirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if prompt.Request.State != "" {
+		query.Set("state", prompt.Request.State)
+	}
+	target.RawQuery = query.Encode()
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+// renderAuthorize shows the login and consent page. The page must not be
+// framed, a hidden frame could trick users into approving a client.
+func (h *OAuthHandler) renderAuthorize(w http.ResponseWriter, status int, prompt auth.AuthorizationPrompt, form url.Values, page authorizePage) {
+	if page.Fatal == "" {
+		page.Client = &prompt.Client
+		page.Scope = prompt.Scope
+		page.Params = make(map[string]string)
+		for _, name := range authorizationParams {
+			if value := form.Get(name); value != "" {
+				page.Params[name] = value
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	authorizeTemplate.Execute(w, page)
+}
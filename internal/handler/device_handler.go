@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+var deviceTemplate = template.Must(template.ParseFS(templateFS, "templates/device.html"))
+
+// DeviceAuthorizationResponse is the device authorization response (RFC
+// 8628 section 3.2).
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code" example:"BDWP-HQLZ"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// devicePage is rendered by templates/device.html. Without a client it
+// asks for the user code.
+type devicePage struct {
+	UserCode     string
+	Client       *domain.OAuthClient
+	Scope        []string
+	Username     string
+	MFAChallenge string
+	Error        string
+	// Done replaces the form once the user decided.
+	Done string
+}
+
+// DeviceAuthorization is the device authorization endpoint. Clients
+// authenticate as at the token endpoint and get the codes to poll with
+// and to show the user.
+func (h *OAuthHandler) DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	client, basic, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.oauth.AuthorizeDevice(r.Context(), client, domain.ParseScope(r.PostForm.Get("scope")))
+	if err != nil {
+		writeOAuthError(w, err, basic)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(DeviceAuthorizationResponse{
+		DeviceCode:              codes.DeviceCode,
+		UserCode:                codes.UserCode,
+		VerificationURI:         codes.VerificationURI,
+		VerificationURIComplete: codes.VerificationURIComplete,
+		ExpiresIn:               int64(time.Until(codes.ExpiresAt).Seconds()),
+		Interval:                int64(codes.Interval.Seconds()),
+	})
+}
+
+// Device is the verification page. It asks for the user code unless the
+// query carries one, then for a login and the approval.
+func (h *OAuthHandler) Device(w http.ResponseWriter, r *http.Request) {
+	userCode := r.URL.Query().Get("user_code")
+	if userCode == "" {
+		renderDevice(w, http.StatusOK, auth.DevicePrompt{}, devicePage{})
+		return
+	}
+
+	prompt, ok := h.lookupDevice(w, r, userCode)
+	if !ok {
+		return
+	}
+	renderDevice(w, http.StatusOK, prompt, devicePage{})
+}
+
+// DeviceSubmit takes the login and approval form of the verification page.
+func (h *OAuthHandler) DeviceSubmit(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		renderDevice(w, http.StatusBadRequest, auth.DevicePrompt{}, devicePage{Error: "Invalid form."})
+		return
+	}
+
+	prompt, ok := h.lookupDevice(w, r, r.PostForm.Get("user_code"))
+	if !ok {
+		return
+	}
+
+	if r.PostForm.Get("consent") != "allow" {
+		if err := h.oauth.DenyDevice(r.Context(), prompt); err != nil {
+			deviceError(w, err)
+			return
+		}
+		renderDevice(w, http.StatusOK, prompt, devicePage{Done: "Access denied"})
+		return
+	}
+
+	login, err := h.formLogin(r)
+	if err != nil {
+		deviceError(w, err)
+		return
+	}
+	page := devicePage{Username: r.PostForm.Get("username"), MFAChallenge: login.MFAChallenge, Error: login.Error}
+	if login.Status != http.StatusOK || page.MFAChallenge != "" {
+		renderDevice(w, login.Status, prompt, page)
+		return
+	}
+
+	if err := h.oauth.ApproveDevice(r.Context(), prompt, login.GUID, login.AMR); err != nil {
+		var statusErr *domain.UserStatusError
+		if errors.As(err, &statusErr) {
+			page.Error = "This account can not sign in."
+			renderDevice(w, http.StatusForbidden, prompt, page)
+			return
+		}
+		deviceError(w, err)
+		return
+	}
+	renderDevice(w, http.StatusOK, prompt, devicePage{Done: "Device connected"})
+}
+
+// lookupDevice finds the authorization of a user code. An unknown code
+// asks for the code again. It reports whether the request can continue.
+func (h *OAuthHandler) lookupDevice(w http.ResponseWriter, r *http.Request, userCode string) (auth.DevicePrompt, bool) {
+	prompt, err := h.oauth.LookupDevice(r.Context(), userCode)
+	if err != nil {
+		if errors.Is(err, auth.ErrUnknownUserCode) {
+			renderDevice(w, http.StatusNotFound, auth.DevicePrompt{}, devicePage{UserCode: userCode, Error: "Unknown or expired code, check the code on your device."})
+			return prompt, false
+		}
+		deviceError(w, err)
+		return prompt, false
+	}
+	return prompt, true
+}
+
+// deviceError shows the code entry again, a code decided or expired in the
+// meantime can not be approved anymore.
+func deviceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrUnknownUserCode) {
+		renderDevice(w, http.StatusNotFound, auth.DevicePrompt{}, devicePage{Error: "Unknown or expired code, check the code on your device."})
+		return
+	}
+	renderDevice(w, http.StatusInternalServerError, auth.DevicePrompt{}, devicePage{Error: "The request could not be processed, try again later."})
+}
+
+// renderDevice shows the verification page. Like the authorization page it
+// must not be framed.
+func renderDevice(w http.ResponseWriter, status int, prompt auth.DevicePrompt, page devicePage) {
+	if prompt.UserCode != "" {
+		page.UserCode = auth.FormatUserCode(prompt.UserCode)
+		if page.Done == "" {
+			page.Client = &prompt.Client
+			page.Scope = prompt.Scope
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	deviceTemplate.Execute(w, page)
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+)
+
+// MFAChallengeResponse is returned by login when a second factor is required.
+type MFAChallengeResponse struct {
+	ChallengeToken string `json:"challenge_token"`
+	// ExpiresIn is in seconds.
+	ExpiresIn int `json:"expires_in"`
+}
+
+// MFALoginRequest completes a login with either a TOTP code or a recovery code.
+type MFALoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+// TOTPEnrollmentResponse carries the new secret for the authenticator app.
+type TOTPEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+	// QRCode is a base64 encoded PNG of the otpauth URI.
+	QRCode []byte `json:"qr_code_png"`
+}
+
+// TOTPCodeRequest carries a code from the authenticator app.
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse lists recovery codes. They are shown only once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// LoginMFA godoc
+// @Summary      Complete login with a second factor
+// @Description  Exchanges the challenge from /login and a TOTP code or a recovery code for tokens
+// @Tags         mfa
+// @Accept       json
+// @Produce      json
+// @Param        request body MFALoginRequest true "Challenge and code"
+// @Success      200 {object} TokenResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid mfa code"
+// @Failure      403 {string} string "user is disabled, email is not verified or totp is locked"
+// @Failure      429 {string} string "too many requests"
+// @Router       /login/mfa [post]
+func (h *AuthHandler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.auth.CompleteMFA(r.Context(), req.ChallengeToken, req.Code, req.RecoveryCode, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidMFACode):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrTOTPLocked), errors.Is(err, domain.ErrUserDisabled), errors.Is(err, domain.ErrEmailNotVerified):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to log in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
+
+// EnrollTOTP godoc
+// @Summary      Start TOTP enrolment
+// @Description  Generates a TOTP secret for the current user. It takes effect once confirmed with a first code.
+// @Tags         mfa
+// @Produce      json
+// @Success      200 {object} TOTPEnrollmentResponse
+// @Failure      401 {string} string "unauthorized"
+// @Failure      409 {string} string "totp already enrolled"
+// @Security     BearerAuth
+// @Router       /mfa/totp [post]
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	enrollment, err := h.auth.EnrollTOTP(r.Context(), guid)
+	if err != nil {
+		if errors.Is(err, domain.ErrAlreadyExists) {
+			http.Error(w, "totp already enrolled", http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to enroll totp", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPEnrollmentResponse{
+		Secret:     enrollment.Secret,
+		OTPAuthURI: enrollment.URI,
+		QRCode:     enrollment.QRCode,
+	})
+}
+
+// ConfirmTOTP godoc
+// @Summary      Confirm TOTP enrolment
+// @Description  Confirms the enrolment with the first code from the authenticator app and returns ten single-use recovery codes
+// @Tags         mfa
+// @Accept       json
+// @Produce      json
+// @Param        request body TOTPCodeRequest true "Code"
+// @Success      200 {object} RecoveryCodesResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid mfa code"
+// @Failure      404 {string} string "mfa is not enrolled"
+// @Failure      409 {string} string "totp already confirmed"
+// @Security     BearerAuth
+// @Router       /mfa/totp/confirm [post]
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	codes, err := h.auth.ConfirmTOTP(r.Context(), guid, req.Code, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidMFACode):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, domain.ErrMFANotEnrolled):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "totp already confirmed", http.StatusConflict)
+		default:
+			http.Error(w, "failed to confirm totp", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary      Regenerate recovery codes
+// @Description  Replaces all recovery codes after checking a current TOTP code
+// @Tags         mfa
+// @Accept       json
+// @Produce      json
+// @Param        request body TOTPCodeRequest true "Code"
+// @Success      200 {object} RecoveryCodesResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid mfa code"
+// @Failure      403 {string} string "totp is locked"
+// @Security     BearerAuth
+// @Router       /mfa/recovery-codes [post]
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	codes, err := h.auth.RegenerateRecoveryCodes(r.Context(), guid, req.Code, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidMFACode):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrTOTPLocked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to regenerate recovery codes", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
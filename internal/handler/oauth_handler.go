@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// ClientRequest registers an OAuth client.
+type ClientRequest struct {
+	Name string `json:"name" example:"billing"`
+	// TokenEndpointAuthMethod defaults to client_secret_basic.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty" enums:"client_secret_basic,client_secret_post,private_key_jwt,none"`
+	// PublicKey is the PEM encoded key the assertions of a private_key_jwt
+	// client are verified with.
+	PublicKey string   `json:"public_key,omitempty"`
+	Scopes    []string `json:"scopes,omitempty" example:"orders:read"`
+	Audiences []string `json:"audiences,omitempty" example:"https://orders.example.com"`
+	// GrantTypes defaults to client_credentials. The device grant is
+	// urn:ietf:params:oauth:grant-type:device_code, token exchange
+	// urn:ietf:params:oauth:grant-type:token-exchange.
+	GrantTypes []string `json:"grant_types,omitempty"`
+	// RedirectURIs are required for authorization_code.
+	RedirectURIs []string `json:"redirect_uris,omitempty" example:"https://app.example.com/callback"`
+}
+
+// ClientResponse carries a client and, when it was just created or its
+// secret rotated, the secret. The secret is only ever shown here.
+type ClientResponse struct {
+	domain.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// OAuthTokenResponse is a successful token endpoint response (RFC 6749 section 5.1).
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type" example:"Bearer"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	// IssuedTokenType is set for token exchange (RFC 8693 section 2.2.1).
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// OAuthErrorResponse is an error of the token endpoint (RFC 6749 section 5.2).
+type OAuthErrorResponse struct {
+	Error            string `json:"error" example:"invalid_client"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type OAuthHandler struct {
+	auth  *auth.AuthService
+	oauth *auth.OAuthService
+}
+
+func NewOAuthHandler(authService *auth.AuthService, oauthService *auth.OAuthService) *OAuthHandler {
+	return &OAuthHandler{
+		auth:  authService,
+		oauth: oauthService,
+	}
+}
+
+// Token is the OAuth 2.0 token endpoint. It takes form encoded requests
+// and answers in the format of RFC 6749 rather than with plain text errors.
+// Clients authenticate with HTTP Basic, client_id and client_secret in the
+// form, or a private_key_jwt client assertion. Public clients only send
+// their client_id.
+func (h *OAuthHandler) Token(w http.ResponseWriter, r *http.Request) {
+	client, basic, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	ip := r.Header.Get("X-Real-IP")
+	if ip == "" {
+		ip = r.RemoteAddr
+	}
+
+	var (
+		tokens auth.OAuthTokens
+		err    error
+	)
+	switch grant := r.PostForm.Get("grant_type"); grant {
+	case domain.GrantClientCredentials:
+		tokens, err = h.oauth.ClientCredentials(r.Context(), client, domain.ParseScope(r.PostForm.Get("scope")), domain.ParseScope(r.PostForm.Get("audience")))
+	case domain.GrantAuthorizationCode:
+		tokens, err = h.oauth.ExchangeAuthorizationCode(r.Context(), client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"), r.UserAgent(), ip)
+	case domain.GrantRefreshToken:
+		tokens, err = h.oauth.RefreshClientSession(r.Context(), client, r.PostForm.Get("refresh_token"), domain.ParseScope(r.PostForm.Get("scope")), r.UserAgent(), ip)
+	case domain.GrantDeviceCode:
+		tokens, err = h.oauth.ExchangeDeviceCode(r.Context(), client, r.PostForm.Get("device_code"), r.UserAgent(), ip)
+	case domain.GrantTokenExchange:
+		tokens, err = h.oauth.ExchangeToken(r.Context(), client, auth.TokenExchangeRequest{
+			SubjectToken:       r.PostForm.Get("subject_token"),
+			SubjectTokenType:   r.PostForm.Get("subject_token_type"),
+			ActorToken:         r.PostForm.Get("actor_token"),
+			RequestedTokenType: r.PostForm.Get("requested_token_type"),
+			RequestedSubject:   r.PostForm.Get("requested_subject"),
+			Audience:           domain.ParseScope(strings.Join(r.PostForm["audience"], " ")),
+			Scope:              domain.ParseScope(r.PostForm.Get("scope")),
+		}, r.UserAgent(), ip)
+	case "":
+		err = &auth.OAuthError{Code: auth.OAuthInvalidRequest, Description: "grant_type is required"}
+	default:
+		err = &auth.OAuthError{Code: auth.OAuthUnsupportedGrantType, Description: "unsupported grant_type " + grant}
+	}
+	if err != nil {
+		writeOAuthError(w, err, basic)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(OAuthTokenResponse{
+		AccessToken:     tokens.AccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(time.Until(tokens.ExpiresAt).Seconds()),
+		RefreshToken:    tokens.RefreshToken,
+		Scope:           domain.FormatScope(tokens.Scope),
+		IDToken:         tokens.IDToken,
+		IssuedTokenType: tokens.IssuedTokenType,
+	})
+}
+
+// authenticateClient parses the form of a token endpoint style request
+// and authenticates the client. It reports whether the client used Basic
+// and whether the request can continue, the error is already written.
+func (h *OAuthHandler) authenticateClient(w http.ResponseWriter, r *http.Request) (domain.OAuthClient, bool, bool) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &auth.OAuthError{Code: auth.OAuthInvalidRequest, Description: "invalid form body"}, false)
+		return domain.OAuthClient{}, false, false
+	}
+
+	creds := auth.ClientAuthentication{
+		ClientID:      r.PostForm.Get("client_id"),
+		ClientSecret:  r.PostForm.Get("client_secret"),
+		AssertionType: r.PostForm.Get("client_assertion_type"),
+		Assertion:     r.PostForm.Get("client_assertion"),
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		if creds.ClientSecret != "" || creds.Assertion != "" {
+			writeOAuthError(w, &auth.OAuthError{Code: auth.OAuthInvalidRequest, Description: "more than one client authentication method used"}, false)
+			return domain.OAuthClient{}, false, false
+		}
+		creds.ClientID, creds.ClientSecret, creds.Basic = id, secret, true
+	}
+
+	client, err := h.oauth.AuthenticateClient(r.Context(), creds)
+	if err != nil {
+		writeOAuthError(w, err, creds.Basic)
+		return domain.OAuthClient{}, creds.Basic, false
+	}
+	return client, creds.Basic, true
+}
+
+// writeOAuthError answers with an RFC 6749 error. Failed client
+// authentication is a 401, with a Basic challenge when the client used it.
+func writeOAuthError(w http.ResponseWriter, err error, basic bool) {
+	var oauthErr *auth.OAuthError
+	if !errors.As(err, &oauthErr) {
+		oauthErr = &auth.OAuthError{Code: "server_error", Description: "the request could not be processed"}
+	}
+
+	status := http.StatusBadRequest
+	switch {
+	case oauthErr.Code == auth.OAuthInvalidClient:
+		status = http.StatusUnauthorized
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+	case oauthErr.Code == "server_error":
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorResponse{Error: oauthErr.Code, ErrorDescription: oauthErr.Description})
+}
+
+// CreateClient godoc
+// @Summary      Register OAuth client
+// @Description  Registers a client, for example a backend service, that gets tokens from POST /oauth/token. The client secret is only returned once, private_key_jwt and public clients get none.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        request body ClientRequest true "Client"
+// @Success      201 {object} ClientResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Security     AdminToken
+// @Router       /admin/clients [post]
+func (h *OAuthHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
+	var req ClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	client, secret, err := h.oauth.CreateClient(r.Context(), adminActor, domain.OAuthClient{
+		Name:         req.Name,
+		AuthMethod:   req.TokenEndpointAuthMethod,
+		PublicKey:    req.PublicKey,
+		Scopes:       req.Scopes,
+		Audiences:    req.Audiences,
+		GrantTypes:   req.GrantTypes,
+		RedirectURIs: req.RedirectURIs,
+	})
+	if err != nil {
+		var validationErr *auth.ValidationError
+		if errors.As(err, &validationErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to create client", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ClientResponse{OAuthClient: client, ClientSecret: secret})
+}
+
+// ListClients godoc
+// @Summary      List OAuth clients
+// @Tags         admin
+// @Produce      json
+// @Success      200 {array} domain.OAuthClient
+// @Failure      401 {string} string "unauthorized"
+// @Security     AdminToken
+// @Router       /admin/clients [get]
+func (h *OAuthHandler) ListClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := h.oauth.ListClients(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list clients", http.StatusInternalServerError)
+		return
+	}
+	if clients == nil {
+		clients = []domain.OAuthClient{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clients)
+}
+
+// GetClient godoc
+// @Summary      Get OAuth client
+// @Tags         admin
+// @Produce      json
+// @Param        id path string true "Client ID"
+// @Success      200 {object} domain.OAuthClient
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "client not found"
+// @Security     AdminToken
+// @Router       /admin/clients/{id} [get]
+func (h *OAuthHandler) GetClient(w http.ResponseWriter, r *http.Request) {
+	client, err := h.oauth.GetClient(r.Context(), r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to get client", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// DeleteClient godoc
+// @Summary      Delete OAuth client
+// @Description  Deletes a client and ends the sessions users started through it. Access tokens the client holds for itself stay valid until they expire.
+// @Tags         admin
+// @Param        id path string true "Client ID"
+// @Success      204
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "client not found"
+// @Security     AdminToken
+// @Router       /admin/clients/{id} [delete]
+func (h *OAuthHandler) DeleteClient(w http.ResponseWriter, r *http.Request) {
+	if err := h.oauth.DeleteClient(r.Context(), adminActor, r.PathValue("id")); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to delete client", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateClientSecret godoc
+// @Summary      Rotate OAuth client secret
+// @Description  Replaces the secret of a client, the old one stops working immediately. The new secret is only returned once.
+// @Tags         admin
+// @Produce      json
+// @Param        id path string true "Client ID"
+// @Success      200 {object} ClientResponse
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "client not found or without secret"
+// @Security     AdminToken
+// @Router       /admin/clients/{id}/secret [post]
+func (h *OAuthHandler) RotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	secret, err := h.oauth.RotateClientSecret(r.Context(), adminActor, id)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "client not found or without secret", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to rotate client secret", http.StatusInternalServerError)
+		return
+	}
+
+	client, err := h.oauth.GetClient(r.Context(), id)
+	if err != nil {
+		http.Error(w, "failed to get client", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClientResponse{OAuthClient: client, ClientSecret: secret})
+}
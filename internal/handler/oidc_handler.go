@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+)
+
+// DiscoveryResponse is the OpenID Provider metadata (OpenID Connect
+// Discovery 1.0 section 3).
+type DiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// JWKSResponse is a JWK Set (RFC 7517 section 5).
+type JWKSResponse struct {
+	Keys []domain.JSONWebKey `json:"keys"`
+}
+
+// UserInfoResponse carries the standard claims of the user (OpenID Connect
+// Core section 5.1). The profile scope adds the profile claims, only the
+// email scope adds the email claims.
+type UserInfoResponse struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	// UpdatedAt is in seconds since the epoch.
+	UpdatedAt     int64  `json:"updated_at,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// Discovery serves the OpenID Provider metadata, off the shelf OpenID
+// Connect clients configure themselves from it.
+func (h *OAuthHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	endpoints := h.oauth.Endpoints()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(DiscoveryResponse{
+		Issuer:                            endpoints.Issuer,
+		AuthorizationEndpoint:             endpoints.AuthorizationEndpoint,
+		TokenEndpoint:                     endpoints.TokenEndpoint,
+		UserinfoEndpoint:                  endpoints.UserinfoEndpoint,
+		JWKSURI:                           endpoints.JWKSURI,
+		DeviceAuthorizationEndpoint:       endpoints.DeviceAuthorizationEndpoint,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{domain.GrantAuthorizationCode, domain.GrantClientCredentials, domain.GrantDeviceCode, domain.GrantRefreshToken, domain.GrantTokenExchange},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		ScopesSupported:                   domain.BaseScopes(),
+		TokenEndpointAuthMethodsSupported: []string{domain.ClientSecretBasic, domain.ClientSecretPost, domain.PrivateKeyJWT, domain.ClientAuthNone},
+		CodeChallengeMethodsSupported:     []string{auth.PKCEMethodS256},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr", "acr", "azp", "at_hash",
+			"name", "preferred_username", "updated_at", "email", "email_verified",
+		},
+	})
+}
+
+// JWKS serves the keys ID tokens are verified with. A rotated key stays
+// listed until the ID tokens it signed have expired.
+func (h *OAuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(JWKSResponse{Keys: h.oauth.JWKS()})
+}
+
+// UserInfo is the OpenID Connect userinfo endpoint. It takes access tokens
+// granted the openid scope and answers with the claims the other scopes
+// of the token allow.
+func (h *OAuthHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	user, err := h.auth.GetUser(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	info := UserInfoResponse{Subject: user.GUID.String()}
+	if middleware.HasScope(r, domain.ScopeProfile) {
+		info.PreferredUsername = user.Username
+		info.Name = user.DisplayName
+		info.UpdatedAt = user.UpdatedAt.Unix()
+	}
+	if middleware.HasScope(r, domain.ScopeEmail) && user.Email != "" {
+		verified := user.Verified()
+		info.Email = user.Email
+		info.EmailVerified = &verified
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,514 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+)
+
+// OrganizationRequest creates an organization.
+type OrganizationRequest struct {
+	Name string `json:"name" example:"Acme"`
+}
+
+// MemberRoleRequest changes the role of a member.
+type MemberRoleRequest struct {
+	Role domain.OrgRole `json:"role" enums:"owner,admin,member"`
+}
+
+// InvitationRequest invites an email to an organization.
+type InvitationRequest struct {
+	Email string         `json:"email"`
+	Role  domain.OrgRole `json:"role" enums:"owner,admin,member"`
+}
+
+// AcceptInvitationRequest carries the token of a mailed invitation.
+type AcceptInvitationRequest struct {
+	Token string `json:"token"`
+}
+
+// SwitchOrganizationRequest selects the active organization, an empty
+// org_id clears it.
+type SwitchOrganizationRequest struct {
+	OrgID *uuid.UUID `json:"org_id"`
+}
+
+// writeOrgError answers the errors shared by the organization endpoints.
+func writeOrgError(w http.ResponseWriter, err error, notFound, failure string) {
+	var validationErr *auth.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, domain.ErrNotFound):
+		http.Error(w, notFound, http.StatusNotFound)
+	case errors.Is(err, auth.ErrOrgForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, domain.ErrLastOwner):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, failure, http.StatusInternalServerError)
+	}
+}
+
+// orgPathValues parses the organization ID, and the named GUID if there
+// is one, from the path.
+func orgPathValues(w http.ResponseWriter, r *http.Request, name string) (uuid.UUID, uuid.UUID, bool) {
+	orgID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid organization id", http.StatusBadRequest)
+		return uuid.Nil, uuid.Nil, false
+	}
+	if name == "" {
+		return orgID, uuid.Nil, true
+	}
+	id, err := uuid.Parse(r.PathValue(name))
+	if err != nil {
+		http.Error(w, "invalid "+name, http.StatusBadRequest)
+		return uuid.Nil, uuid.Nil, false
+	}
+	return orgID, id, true
+}
+
+// CreateOrganization godoc
+// @Summary      Create organization
+// @Description  Creates an organization with the current user as its owner
+// @Tags         organizations
+// @Accept       json
+// @Produce      json
+// @Param        request body OrganizationRequest true "Organization"
+// @Success      201 {object} domain.Organization
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Security     BearerAuth
+// @Router       /orgs [post]
+func (h *AuthHandler) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	var req OrganizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	org, err := h.auth.CreateOrganization(r.Context(), guid, req.Name, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		writeOrgError(w, err, "user not found", "failed to create organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// ListOrganizations godoc
+// @Summary      List organizations
+// @Description  Lists the organizations of the current user with its role in each
+// @Tags         organizations
+// @Produce      json
+// @Success      200 {array} domain.UserOrganization
+// @Failure      401 {string} string "unauthorized"
+// @Security     BearerAuth
+// @Router       /orgs [get]
+func (h *AuthHandler) ListOrganizations(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	orgs, err := h.auth.ListOrganizations(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to list organizations", http.StatusInternalServerError)
+		return
+	}
+	if orgs == nil {
+		orgs = []domain.UserOrganization{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// GetOrganization godoc
+// @Summary      Get organization
+// @Tags         organizations
+// @Produce      json
+// @Param        id path string true "Organization ID"
+// @Success      200 {object} domain.Organization
+// @Failure      400 {string} string "invalid organization id"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "organization not found"
+// @Security     BearerAuth
+// @Router       /orgs/{id} [get]
+func (h *AuthHandler) GetOrganization(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := orgPathValues(w, r, "")
+	if !ok {
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	org, err := h.auth.GetOrganization(r.Context(), guid, orgID)
+	if err != nil {
+		writeOrgError(w, err, "organization not found", "failed to get organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// DeleteOrganization godoc
+// @Summary      Delete organization
+// @Description  Deletes the organization with its memberships and invitations. Only owners may delete it.
+// @Tags         organizations
+// @Param        id path string true "Organization ID"
+// @Success      204
+// @Failure      400 {string} string "invalid organization id"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "insufficient organization role"
+// @Failure      404 {string} string "organization not found"
+// @Security     BearerAuth
+// @Router       /orgs/{id} [delete]
+func (h *AuthHandler) DeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := orgPathValues(w, r, "")
+	if !ok {
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.auth.DeleteOrganization(r.Context(), guid, orgID, r.UserAgent(), r.RemoteAddr); err != nil {
+		writeOrgError(w, err, "organization not found", "failed to delete organization")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListMembers godoc
+// @Summary      List members
+// @Tags         organizations
+// @Produce      json
+// @Param        id path string true "Organization ID"
+// @Success      200 {array} domain.Membership
+// @Failure      400 {string} string "invalid organization id"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "organization not found"
+// @Security     BearerAuth
+// @Router       /orgs/{id}/members [get]
+func (h *AuthHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := orgPathValues(w, r, "")
+	if !ok {
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	members, err := h.auth.ListMembers(r.Context(), guid, orgID)
+	if err != nil {
+		writeOrgError(w, err, "organization not found", "failed to list members")
+		return
+	}
+	if members == nil {
+		members = []domain.Membership{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// UpdateMember godoc
+// @Summary      Change member role
+// @Description  Owners and admins manage members, only owners may make or unmake owners. The last owner can not be demoted.
+// @Tags         organizations
+// @Accept       json
+// @Param        id path string true "Organization ID"
+// @Param        guid path string true "Member GUID"
+// @Param        request body MemberRoleRequest true "Role"
+// @Success      204
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "insufficient organization role"
+// @Failure      404 {string} string "member not found"
+// @Failure      409 {string} string "organization needs an owner"
+// @Security     BearerAuth
+// @Router       /orgs/{id}/members/{guid} [put]
+func (h *AuthHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	orgID, memberGUID, ok := orgPathValues(w, r, "guid")
+	if !ok {
+		return
+	}
+
+	var req MemberRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.auth.UpdateMemberRole(r.Context(), guid, orgID, memberGUID, req.Role, r.UserAgent(), r.RemoteAddr); err != nil {
+		writeOrgError(w, err, "member not found", "failed to update member")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveMember godoc
+// @Summary      Remove member
+// @Description  Removes a member from the organization, members may remove themselves to leave it. The last owner can not leave.
+// @Tags         organizations
+// @Param        id path string true "Organization ID"
+// @Param        guid path string true "Member GUID"
+// @Success      204
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "insufficient organization role"
+// @Failure      404 {string} string "member not found"
+// @Failure      409 {string} string "organization needs an owner"
+// @Security     BearerAuth
+// @Router       /orgs/{id}/members/{guid} [delete]
+func (h *AuthHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	orgID, memberGUID, ok := orgPathValues(w, r, "guid")
+	if !ok {
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.auth.RemoveMember(r.Context(), guid, orgID, memberGUID, r.UserAgent(), r.RemoteAddr); err != nil {
+		writeOrgError(w, err, "member not found", "failed to remove member")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InviteMember godoc
+// @Summary      Invite member
+// @Description  Mails a single-use invitation to join the organization. Owners and admins invite, only owners may invite owners.
+// @Tags         organizations
+// @Accept       json
+// @Produce      json
+// @Param        id path string true "Organization ID"
+// @Param        request body InvitationRequest true "Invitation"
+// @Success      201 {object} domain.OrgInvitation
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "insufficient organization role"
+// @Failure      404 {string} string "organization not found"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /orgs/{id}/invitations [post]
+func (h *AuthHandler) InviteMember(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := orgPathValues(w, r, "")
+	if !ok {
+		return
+	}
+
+	var req InvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	invitation, err := h.auth.InviteMember(r.Context(), guid, orgID, req.Email, req.Role, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		writeOrgError(w, err, "organization not found", "failed to invite member")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// ListInvitations godoc
+// @Summary      List invitations
+// @Description  Lists the pending invitations of the organization
+// @Tags         organizations
+// @Produce      json
+// @Param        id path string true "Organization ID"
+// @Success      200 {array} domain.OrgInvitation
+// @Failure      400 {string} string "invalid organization id"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "insufficient organization role"
+// @Failure      404 {string} string "organization not found"
+// @Security     BearerAuth
+// @Router       /orgs/{id}/invitations [get]
+func (h *AuthHandler) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := orgPathValues(w, r, "")
+	if !ok {
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	invitations, err := h.auth.ListInvitations(r.Context(), guid, orgID)
+	if err != nil {
+		writeOrgError(w, err, "organization not found", "failed to list invitations")
+		return
+	}
+	if invitations == nil {
+		invitations = []domain.OrgInvitation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// RevokeInvitation godoc
+// @Summary      Revoke invitation
+// @Tags         organizations
+// @Param        id path string true "Organization ID"
+// @Param        invitation path string true "Invitation ID"
+// @Success      204
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      403 {string} string "insufficient organization role"
+// @Failure      404 {string} string "invitation not found"
+// @Security     BearerAuth
+// @Router       /orgs/{id}/invitations/{invitation} [delete]
+func (h *AuthHandler) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	orgID, invitationID, ok := orgPathValues(w, r, "invitation")
+	if !ok {
+		return
+	}
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.auth.RevokeInvitation(r.Context(), guid, orgID, invitationID, r.UserAgent(), r.RemoteAddr); err != nil {
+		writeOrgError(w, err, "invitation not found", "failed to revoke invitation")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvitation godoc
+// @Summary      Accept invitation
+// @Description  Accepts an invitation for the current user, whichever email it was sent to
+// @Tags         organizations
+// @Accept       json
+// @Produce      json
+// @Param        request body AcceptInvitationRequest true "Invitation token"
+// @Success      200 {object} domain.Membership
+// @Failure      400 {string} string "invalid request or invitation"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /me/invitations/accept [post]
+func (h *AuthHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req AcceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	member, err := h.auth.AcceptInvitation(r.Context(), guid, req.Token, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidInvitation) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+// AcceptInvitationAndLogin godoc
+// @Summary      Accept invitation and log in
+// @Description  Accepts an invitation without being signed in. The user with the invited email is logged in, one is created if there is none. The invitation verifies the email like a login link.
+// @Tags         organizations
+// @Accept       json
+// @Produce      json
+// @Param        request body AcceptInvitationRequest true "Invitation token"
+// @Success      200 {object} TokenResponse
+// @Success      202 {object} MFAChallengeResponse "second factor required, continue at /login/mfa"
+// @Failure      400 {string} string "invalid request or invitation"
+// @Failure      403 {string} string "user is disabled"
+// @Failure      429 {string} string "too many requests"
+// @Router       /invitations/accept [post]
+func (h *AuthHandler) AcceptInvitationAndLogin(w http.ResponseWriter, r *http.Request) {
+	var req AcceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.auth.AcceptInvitationAndLogin(r.Context(), req.Token, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		switch {
+		case errors.As(err, &mfaErr):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(MFAChallengeResponse{
+				ChallengeToken: mfaErr.Challenge,
+				ExpiresIn:      int(mfaErr.ExpiresIn.Seconds()),
+			})
+		case errors.Is(err, auth.ErrInvalidInvitation):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to accept invitation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
+
+// SwitchOrganization godoc
+// @Summary      Switch organization
+// @Description  Selects the active organization of the current session, carried in the org_id claim. Returns a new token pair for the same session, the previous refresh token stops working.
+// @Tags         organizations
+// @Accept       json
+// @Produce      json
+// @Param        request body SwitchOrganizationRequest true "Organization, empty to clear"
+// @Success      200 {object} TokenResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "organization not found"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /orgs/switch [post]
+func (h *AuthHandler) SwitchOrganization(w http.ResponseWriter, r *http.Request) {
+	var req SwitchOrganizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+	sessionID := r.Context().Value(middleware.ContextSessionIDKey).(string)
+
+	tokens, err := h.auth.SwitchOrganization(r.Context(), guid, sessionID, req.OrgID, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			http.Error(w, "organization not found", http.StatusNotFound)
+		case errors.Is(err, domain.ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
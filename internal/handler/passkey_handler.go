@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"github.com/nerfthisdev/go-backend-test-task/internal/middleware"
+)
+
+// PasskeyRegistrationRequest finishes a passkey registration.
+type PasskeyRegistrationRequest struct {
+	// Name is a label chosen by the user, like "work laptop".
+	Name string `json:"name,omitempty"`
+	// Credential is the PublicKeyCredential returned by navigator.credentials.create.
+	Credential json.RawMessage `json:"credential" swaggertype:"object"`
+}
+
+// PasskeyLoginBeginRequest optionally names the user logging in.
+type PasskeyLoginBeginRequest struct {
+	Username string `json:"username,omitempty"`
+}
+
+// PasskeyLoginRequest finishes a passkey login.
+type PasskeyLoginRequest struct {
+	// Credential is the PublicKeyCredential returned by navigator.credentials.get.
+	Credential json.RawMessage `json:"credential" swaggertype:"object"`
+}
+
+// PasskeyResponse describes a registered passkey.
+type PasskeyResponse struct {
+	// ID is the base64url encoded credential ID.
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Synced     bool       `json:"synced"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func newPasskeyResponse(cred domain.WebAuthnCredential) PasskeyResponse {
+	return PasskeyResponse{
+		ID:         auth.EncodeCredentialID(cred.ID),
+		Name:       cred.Name,
+		Synced:     cred.BackupState,
+		CreatedAt:  cred.CreatedAt,
+		LastUsedAt: cred.LastUsedAt,
+	}
+}
+
+type PasskeyHandler struct {
+	passkeys *auth.PasskeyService
+}
+
+func NewPasskeyHandler(service *auth.PasskeyService) *PasskeyHandler {
+	return &PasskeyHandler{
+		passkeys: service,
+	}
+}
+
+// BeginRegistration godoc
+// @Summary      Begin passkey registration
+// @Description  Returns the options for navigator.credentials.create. The ceremony has to be finished within 5 minutes.
+// @Tags         passkeys
+// @Produce      json
+// @Success      200 {object} object "PublicKeyCredentialCreationOptions"
+// @Failure      401 {string} string "unauthorized"
+// @Security     BearerAuth
+// @Router       /webauthn/register/begin [post]
+func (h *PasskeyHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	creation, err := h.passkeys.BeginRegistration(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to begin passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creation)
+}
+
+// FinishRegistration godoc
+// @Summary      Finish passkey registration
+// @Description  Verifies the new credential and stores it for the current user
+// @Tags         passkeys
+// @Accept       json
+// @Produce      json
+// @Param        request body PasskeyRegistrationRequest true "Credential"
+// @Success      201 {object} PasskeyResponse
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid passkey"
+// @Failure      409 {string} string "passkey already registered"
+// @Failure      429 {string} string "too many requests"
+// @Security     BearerAuth
+// @Router       /webauthn/register/finish [post]
+func (h *PasskeyHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	var req PasskeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Credential) == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	cred, err := h.passkeys.FinishRegistration(r.Context(), guid, req.Name, req.Credential, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, auth.ErrInvalidPasskey):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "passkey already registered", http.StatusConflict)
+		default:
+			http.Error(w, "failed to register passkey", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newPasskeyResponse(cred))
+}
+
+// BeginLogin godoc
+// @Summary      Begin passkey login
+// @Description  Returns the options for navigator.credentials.get. Without a username any discoverable passkey is accepted.
+// @Tags         passkeys
+// @Accept       json
+// @Produce      json
+// @Param        request body PasskeyLoginBeginRequest false "Username"
+// @Success      200 {object} object "PublicKeyCredentialRequestOptions"
+// @Failure      400 {string} string "invalid request"
+// @Failure      429 {string} string "too many requests"
+// @Router       /webauthn/login/begin [post]
+func (h *PasskeyHandler) BeginLogin(w http.ResponseWriter, r *http.Request) {
+	var req PasskeyLoginBeginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := h.passkeys.BeginLogin(r.Context(), req.Username)
+	if err != nil {
+		http.Error(w, "failed to begin passkey login", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assertion)
+}
+
+// FinishLogin godoc
+// @Summary      Finish passkey login
+// @Description  Verifies the assertion and returns tokens. Passkeys without user verification still require a TOTP code if one is enrolled.
+// @Tags         passkeys
+// @Accept       json
+// @Produce      json
+// @Param        request body PasskeyLoginRequest true "Credential"
+// @Success      200 {object} TokenResponse
+// @Success      202 {object} MFAChallengeResponse "second factor required, continue at /login/mfa"
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "invalid passkey"
+// @Failure      403 {string} string "user is disabled or email is not verified"
+// @Failure      429 {string} string "too many requests"
+// @Router       /webauthn/login/finish [post]
+func (h *PasskeyHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	var req PasskeyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Credential) == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.passkeys.FinishLogin(r.Context(), req.Credential, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		switch {
+		case errors.As(err, &mfaErr):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(MFAChallengeResponse{
+				ChallengeToken: mfaErr.Challenge,
+				ExpiresIn:      int(mfaErr.ExpiresIn.Seconds()),
+			})
+		case errors.Is(err, auth.ErrInvalidPasskey):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, domain.ErrUserDisabled), errors.Is(err, domain.ErrEmailNotVerified):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to log in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
+}
+
+// ListCredentials godoc
+// @Summary      List passkeys
+// @Description  Lists the passkeys of the current user
+// @Tags         passkeys
+// @Produce      json
+// @Success      200 {array} PasskeyResponse
+// @Failure      401 {string} string "unauthorized"
+// @Security     BearerAuth
+// @Router       /webauthn/credentials [get]
+func (h *PasskeyHandler) ListCredentials(w http.ResponseWriter, r *http.Request) {
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	creds, err := h.passkeys.ListCredentials(r.Context(), guid)
+	if err != nil {
+		http.Error(w, "failed to list passkeys", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]PasskeyResponse, len(creds))
+	for i, cred := range creds {
+		resp[i] = newPasskeyResponse(cred)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DeleteCredential godoc
+// @Summary      Delete a passkey
+// @Description  Removes a passkey of the current user
+// @Tags         passkeys
+// @Param        id path string true "Base64url encoded credential ID"
+// @Success      204
+// @Failure      400 {string} string "invalid credential id"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "passkey not found"
+// @Security     BearerAuth
+// @Router       /webauthn/credentials/{id} [delete]
+func (h *PasskeyHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	id, err := auth.DecodeCredentialID(r.PathValue("id"))
+	if err != nil || len(id) == 0 {
+		http.Error(w, "invalid credential id", http.StatusBadRequest)
+		return
+	}
+
+	guid := r.Context().Value(middleware.ContextUserGUIDKey).(uuid.UUID)
+
+	if err := h.passkeys.DeleteCredential(r.Context(), guid, id, r.UserAgent(), r.RemoteAddr); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "passkey not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to delete passkey", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// PermissionRequest creates a permission.
+type PermissionRequest struct {
+	Name        string `json:"name" example:"orders:read"`
+	Description string `json:"description,omitempty"`
+}
+
+// RoleRequest creates a role. Permissions have to exist already.
+type RoleRequest struct {
+	Name        string   `json:"name" example:"support"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleUpdateRequest replaces the description and permissions of a role.
+type RoleUpdateRequest struct {
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserRolesResponse lists the roles of a user and the permissions they grant.
+type UserRolesResponse struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// ListPermissions godoc
+// @Summary      List permissions
+// @Tags         admin
+// @Produce      json
+// @Success      200 {array} domain.Permission
+// @Failure      401 {string} string "unauthorized"
+// @Security     AdminToken
+// @Router       /admin/permissions [get]
+func (h *AdminHandler) ListPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions, err := h.auth.ListPermissions(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list permissions", http.StatusInternalServerError)
+		return
+	}
+	if permissions == nil {
+		permissions = []domain.Permission{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissions)
+}
+
+// CreatePermission godoc
+// @Summary      Create permission
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        request body PermissionRequest true "Permission"
+// @Success      201
+// @Failure      400 {string} string "invalid request"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      409 {string} string "permission already exists"
+// @Security     AdminToken
+// @Router       /admin/permissions [post]
+func (h *AdminHandler) CreatePermission(w http.ResponseWriter, r *http.Request) {
+	var req PermissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := h.auth.CreatePermission(r.Context(), adminActor, domain.Permission{Name: req.Name, Description: req.Description})
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "permission already exists", http.StatusConflict)
+		default:
+			http.Error(w, "failed to create permission", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DeletePermission godoc
+// @Summary      Delete permission
+// @Description  Deletes a permission and removes it from every role
+// @Tags         admin
+// @Param        name path string true "Permission name"
+// @Success      204
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "permission not found"
+// @Security     AdminToken
+// @Router       /admin/permissions/{name} [delete]
+func (h *AdminHandler) DeletePermission(w http.ResponseWriter, r *http.Request) {
+	if err := h.auth.DeletePermission(r.Context(), adminActor, r.PathValue("name")); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "permission not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to delete permission", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListRoles godoc
+// @Summary      List roles
+// @Tags         admin
+// @Produce      json
+// @Success      200 {array} domain.Role
+// @Failure      401 {string} string "unauthorized"
+// @Security     AdminToken
+// @Router       /admin/roles [get]
+func (h *AdminHandler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.auth.ListRoles(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list roles", http.StatusInternalServerError)
+		return
+	}
+	if roles == nil {
+		roles = []domain.Role{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+// CreateRole godoc
+// @Summary      Create role
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        request body RoleRequest true "Role"
+// @Success      201 {object} domain.Role
+// @Failure      400 {string} string "invalid request or unknown permission"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      409 {string} string "role already exists"
+// @Security     AdminToken
+// @Router       /admin/roles [post]
+func (h *AdminHandler) CreateRole(w http.ResponseWriter, r *http.Request) {
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	role, err := h.auth.CreateRole(r.Context(), adminActor, domain.Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+	})
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr), errors.Is(err, domain.ErrUnknownPermission):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrAlreadyExists):
+			http.Error(w, "role already exists", http.StatusConflict)
+		default:
+			http.Error(w, "failed to create role", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+// GetRole godoc
+// @Summary      Get role
+// @Tags         admin
+// @Produce      json
+// @Param        name path string true "Role name"
+// @Success      200 {object} domain.Role
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "role not found"
+// @Security     AdminToken
+// @Router       /admin/roles/{name} [get]
+func (h *AdminHandler) GetRole(w http.ResponseWriter, r *http.Request) {
+	role, err := h.auth.GetRole(r.Context(), r.PathValue("name"))
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "role not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to get role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+// UpdateRole godoc
+// @Summary      Update role
+// @Description  Replaces the description and permissions of a role. Users get the new permissions with their next access token.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        name path string true "Role name"
+// @Param        request body RoleUpdateRequest true "Role"
+// @Success      200 {object} domain.Role
+// @Failure      400 {string} string "invalid request or unknown permission"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "role not found"
+// @Security     AdminToken
+// @Router       /admin/roles/{name} [put]
+func (h *AdminHandler) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	var req RoleUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	role, err := h.auth.UpdateRole(r.Context(), adminActor, domain.Role{
+		Name:        r.PathValue("name"),
+		Description: req.Description,
+		Permissions: req.Permissions,
+	})
+	if err != nil {
+		var validationErr *auth.ValidationError
+		switch {
+		case errors.As(err, &validationErr), errors.Is(err, domain.ErrUnknownPermission):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrNotFound):
+			http.Error(w, "role not found", http.StatusNotFound)
+		default:
+			http.Error(w, "failed to update role", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+// DeleteRole godoc
+// @Summary      Delete role
+// @Description  Deletes a role and takes it away from every user
+// @Tags         admin
+// @Param        name path string true "Role name"
+// @Success      204
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "role not found"
+// @Security     AdminToken
+// @Router       /admin/roles/{name} [delete]
+func (h *AdminHandler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	if err := h.auth.DeleteRole(r.Context(), adminActor, r.PathValue("name")); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "role not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to delete role", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UserRoles godoc
+// @Summary      List user roles
+// @Description  Lists the roles of a user and the permissions they grant
+// @Tags         admin
+// @Produce      json
+// @Param        guid path string true "User GUID"
+// @Success      200 {object} UserRolesResponse
+// @Failure      400 {string} string "invalid guid"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "user not found"
+// @Security     AdminToken
+// @Router       /admin/users/{guid}/roles [get]
+func (h *AdminHandler) UserRoles(w http.ResponseWriter, r *http.Request) {
+	guid, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid guid", http.StatusBadRequest)
+		return
+	}
+
+	roles, permissions, err := h.auth.UserRoles(r.Context(), guid)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to get user roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserRolesResponse{Roles: roles, Permissions: permissions})
+}
+
+// AssignRole godoc
+// @Summary      Assign role
+// @Description  Grants a role to a user. It is part of the access tokens issued from now on.
+// @Tags         admin
+// @Param        guid path string true "User GUID"
+// @Param        role path string true "Role name"
+// @Success      204
+// @Failure      400 {string} string "invalid guid"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "user or role not found"
+// @Security     AdminToken
+// @Router       /admin/users/{guid}/roles/{role} [put]
+func (h *AdminHandler) AssignRole(w http.ResponseWriter, r *http.Request) {
+	guid, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid guid", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.auth.AssignRole(r.Context(), adminActor, guid, r.PathValue("role")); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "user or role not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to assign role", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnassignRole godoc
+// @Summary      Unassign role
+// @Description  Takes a role away from a user. Access tokens already issued keep it until they expire.
+// @Tags         admin
+// @Param        guid path string true "User GUID"
+// @Param        role path string true "Role name"
+// @Success      204
+// @Failure      400 {string} string "invalid guid"
+// @Failure      401 {string} string "unauthorized"
+// @Failure      404 {string} string "role not assigned"
+// @Security     AdminToken
+// @Router       /admin/users/{guid}/roles/{role} [delete]
+func (h *AdminHandler) UnassignRole(w http.ResponseWriter, r *http.Request) {
+	guid, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid guid", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.auth.UnassignRole(r.Context(), adminActor, guid, r.PathValue("role")); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.Error(w, "role not assigned", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to unassign role", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
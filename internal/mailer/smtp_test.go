@@ -0,0 +1,261 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what the fake server received.
+type smtpSession struct {
+	commands []string
+	auth     string
+	data     string
+	// tlsErr is the result of the STARTTLS handshake.
+	tlsErr error
+}
+
+// fakeSMTP serves a single SMTP session on localhost and reports it on the
+// returned channel. With tlsConfig set it offers STARTTLS.
+func fakeSMTP(t *testing.T, tlsConfig *tls.Config) (string, <-chan smtpSession) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		var session smtpSession
+		defer func() { sessions <- session }()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			session.commands = append(session.commands, line)
+			verb, arg, _ := strings.Cut(line, " ")
+
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				extensions := []string{"250-localhost"}
+				if tlsConfig != nil {
+					extensions = append(extensions, "250-STARTTLS")
+				}
+				for _, ext := range append(extensions, "250 AUTH PLAIN") {
+					text.PrintfLine("%s", ext)
+				}
+			case "STARTTLS":
+				text.PrintfLine("220 ready to start tls")
+				tlsConn := tls.Server(conn, tlsConfig)
+				session.tlsErr = tlsConn.Handshake()
+				if session.tlsErr != nil {
+					return
+				}
+				conn = tlsConn
+				text = textproto.NewConn(conn)
+			case "AUTH":
+				session.auth = arg
+				text.PrintfLine("235 authenticated")
+			case "MAIL", "RCPT":
+				text.PrintfLine("250 ok")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				// read the raw lines, the dot reader would turn CRLF into LF
+				var data strings.Builder
+				for {
+					line, err := text.R.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				session.data = data.String()
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port, sessions
+}
+
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func send(t *testing.T, cfg SMTPConfig, msg Message) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return NewSMTPMailer(cfg).Send(ctx, msg)
+}
+
+func TestSMTPMailerSendsMessage(t *testing.T) {
+	port, sessions := fakeSMTP(t, nil)
+
+	err := send(t, SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "mailer",
+		Password: "secret",
+		From:     "auth@example.com",
+	}, Message{
+		To:      "user@example.com",
+		Subject: "Reset your password",
+		Body:    "first line\nsecond line",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	session := <-sessions
+
+	auth, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(session.auth, "PLAIN "))
+	if err != nil || string(auth) != "\x00mailer\x00secret" {
+		t.Errorf("AUTH = %q, want PLAIN credentials of mailer", session.auth)
+	}
+	for _, want := range []string{"MAIL FROM:<auth@example.com>", "RCPT TO:<user@example.com>"} {
+		if !containsPrefix(session.commands, want) {
+			t.Errorf("commands %q lack %q", session.commands, want)
+		}
+	}
+
+	headers, body, ok := strings.Cut(session.data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("message has no header section: %q", session.data)
+	}
+	for _, want := range []string{"From: auth@example.com", "To: user@example.com", "Subject: Reset your password", "Content-Type: text/plain; charset=utf-8"} {
+		if !strings.Contains(headers, want+"\r\n") {
+			t.Errorf("headers lack %q:\n%s", want, headers)
+		}
+	}
+	if !strings.Contains(headers, "@example.com>\r\n") {
+		t.Errorf("Message-ID is not in the domain of the sender:\n%s", headers)
+	}
+	if body != "first line\r\nsecond line\r\n" {
+		t.Errorf("body = %q, want lines ending in CRLF", body)
+	}
+}
+
+func TestSMTPMailerStripsLineBreaksFromHeaders(t *testing.T) {
+	port, sessions := fakeSMTP(t, nil)
+
+	err := send(t, SMTPConfig{Host: "127.0.0.1", Port: port, From: "auth@example.com"}, Message{
+		To:      "user@example.com",
+		Subject: "Hello\r\nBcc: victim@example.com\nX-Injected: yes",
+		Body:    "body",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	session := <-sessions
+
+	headers, _, _ := strings.Cut(session.data, "\r\n\r\n")
+	scanner := bufio.NewScanner(strings.NewReader(headers))
+	for scanner.Scan() {
+		name, _, _ := strings.Cut(scanner.Text(), ":")
+		if name == "Bcc" || name == "X-Injected" {
+			t.Errorf("injected header %q in:\n%s", scanner.Text(), headers)
+		}
+	}
+	if !strings.Contains(headers, "Subject: HelloBcc: victim@example.comX-Injected: yes\r\n") {
+		t.Errorf("subject not kept on one line:\n%s", headers)
+	}
+}
+
+func TestSMTPMailerSkipsAuthWithoutCredentials(t *testing.T) {
+	port, sessions := fakeSMTP(t, nil)
+
+	if err := send(t, SMTPConfig{Host: "127.0.0.1", Port: port, From: "auth@example.com"}, Message{To: "user@example.com", Body: "body"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	session := <-sessions
+
+	if containsPrefix(session.commands, "AUTH") {
+		t.Errorf("AUTH sent without credentials: %q", session.commands)
+	}
+}
+
+func TestSMTPMailerRequiresValidStartTLS(t *testing.T) {
+	port, sessions := fakeSMTP(t, selfSignedTLS(t))
+
+	err := send(t, SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "mailer",
+		Password: "secret",
+		From:     "auth@example.com",
+	}, Message{To: "user@example.com", Body: "body"})
+	if err == nil || !strings.Contains(err.Error(), "failed to start tls") {
+		t.Fatalf("Send = %v, want the untrusted certificate to fail STARTTLS", err)
+	}
+	session := <-sessions
+
+	if !containsPrefix(session.commands, "STARTTLS") {
+		t.Errorf("STARTTLS offered but not used: %q", session.commands)
+	}
+	if session.tlsErr == nil {
+		t.Errorf("handshake with an untrusted certificate succeeded")
+	}
+	if session.auth != "" || containsPrefix(session.commands, "MAIL") {
+		t.Errorf("session continued after the failed handshake: %q", session.commands)
+	}
+}
+
+func containsPrefix(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
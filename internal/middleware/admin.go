@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"go.uber.org/zap"
+)
+
+const AdminTokenHeader = "X-Admin-Token"
+
+// AdminAuth protects admin endpoints with a static token passed in the
+// X-Admin-Token header. An empty token disables the admin API entirely.
+type AdminAuth struct {
+	logger *zap.Logger
+	token  atomic.Pointer[string]
+}
+
+func NewAdminAuth(logger *zap.Logger, adminToken string) *AdminAuth {
+	a := &AdminAuth{logger: logger}
+	a.token.Store(&adminToken)
+	return a
+}
+
+// ApplyConfig swaps in a new admin token.
+func (a *AdminAuth) ApplyConfig(cfg config.Config) {
+	token := cfg.AdminToken
+	a.token.Store(&token)
+}
+
+func (a *AdminAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := *a.token.Load()
+		if adminToken == "" {
+			http.Error(w, "admin api disabled", http.StatusForbidden)
+			return
+		}
+
+		provided := r.Header.Get(AdminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(adminToken)) != 1 {
+			a.logger.Warn("invalid admin token", zap.String("remote_addr", r.RemoteAddr))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
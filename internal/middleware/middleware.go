@@ -2,8 +2,10 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
@@ -16,9 +18,27 @@ const (
 	ContextUserGUIDKey    contextKey = "user_guid"
 	ContextSessionIDKey   contextKey = "session_id"
 	ContextAccessTokenKey contextKey = "access_token"
+	// ContextAuthTimeKey holds the time.Time the user last authenticated,
+	// zero for tokens issued without auth_time.
+	ContextAuthTimeKey contextKey = "auth_time"
+	ContextACRKey      contextKey = "acr"
+	// ContextRolesKey and ContextPermissionsKey hold the []string claims
+	// of the access token, nil if it has none.
+	ContextRolesKey       contextKey = "roles"
+	ContextPermissionsKey contextKey = "permissions"
+	// ContextScopeKey holds the parsed []string scope claim.
+	ContextScopeKey contextKey = "scope"
+	// ContextExpiresAtKey holds the time.Time the access token expires.
+	ContextExpiresAtKey contextKey = "expires_at"
+	// ContextAPIKeyIDKey holds the uuid.UUID of the API key the request
+	// was authenticated with, it is unset for access tokens.
+	ContextAPIKeyIDKey contextKey = "api_key_id"
 )
 
-func Auth(logger *zap.Logger, tokens domain.TokenService, repo domain.TokenRepository, next http.Handler) http.Handler {
+// Auth authenticates the request by its bearer access token or, for
+// tokens with domain.APIKeyPrefix, by API key. Requests with an API key
+// have no session ID, auth_time or roles.
+func Auth(logger *zap.Logger, tokens domain.TokenService, repo domain.TokenRepository, keys domain.APIKeyAuthenticator, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 
@@ -30,6 +50,34 @@ func Auth(logger *zap.Logger, tokens domain.TokenService, repo domain.TokenRepos
 
 		accessToken := strings.TrimPrefix(authHeader, "Bearer ")
 
+		if strings.HasPrefix(accessToken, domain.APIKeyPrefix) {
+			key, err := keys.AuthenticateAPIKey(r.Context(), accessToken, r.RemoteAddr)
+			if err != nil {
+				if errors.Is(err, domain.ErrNotFound) {
+					logger.Warn("invalid api key")
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+				} else {
+					http.Error(w, "internal server error", http.StatusInternalServerError)
+				}
+				return
+			}
+
+			var expiresAt time.Time
+			if key.ExpiresAt != nil {
+				expiresAt = *key.ExpiresAt
+			}
+			ctx := context.WithValue(r.Context(), ContextUserGUIDKey, key.GUID)
+			ctx = context.WithValue(ctx, ContextSessionIDKey, "")
+			ctx = context.WithValue(ctx, ContextAPIKeyIDKey, key.ID)
+			ctx = context.WithValue(ctx, ContextAuthTimeKey, time.Time{})
+			ctx = context.WithValue(ctx, ContextACRKey, "")
+			ctx = context.WithValue(ctx, ContextScopeKey, key.Scope)
+			ctx = context.WithValue(ctx, ContextExpiresAtKey, expiresAt)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		claims, err := tokens.ValidateAccessToken(accessToken)
 		if err != nil {
 			logger.Warn("invalid token", zap.Error(err))
@@ -72,6 +120,49 @@ func Auth(logger *zap.Logger, tokens domain.TokenService, repo domain.TokenRepos
 		ctx = context.WithValue(ctx, ContextSessionIDKey, sessionID)
 		ctx = context.WithValue(ctx, ContextAccessTokenKey, accessToken)
 
+		var authTime time.Time
+		if ts, ok := claims["auth_time"].(float64); ok {
+			authTime = time.Unix(int64(ts), 0)
+		}
+		acr, _ := claims["acr"].(string)
+		ctx = context.WithValue(ctx, ContextAuthTimeKey, authTime)
+		ctx = context.WithValue(ctx, ContextACRKey, acr)
+		ctx = context.WithValue(ctx, ContextRolesKey, stringsClaim(claims, "roles"))
+		ctx = context.WithValue(ctx, ContextPermissionsKey, stringsClaim(claims, "permissions"))
+
+		scope, _ := claims["scope"].(string)
+		var expiresAt time.Time
+		if ts, ok := claims["exp"].(float64); ok {
+			expiresAt = time.Unix(int64(ts), 0)
+		}
+		ctx = context.WithValue(ctx, ContextScopeKey, domain.ParseScope(scope))
+		ctx = context.WithValue(ctx, ContextExpiresAtKey, expiresAt)
+
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RequireSession refuses requests authenticated with an API key, for
+// endpoints that act on the session of an access token. It must run
+// behind Auth.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessionID, _ := r.Context().Value(ContextSessionIDKey).(string); sessionID == "" {
+			http.Error(w, "api keys can not use this endpoint", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stringsClaim returns the strings of a JSON array claim.
+func stringsClaim(claims map[string]any, name string) []string {
+	values, _ := claims[name].([]any)
+	var result []string
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/auth"
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+	"go.uber.org/zap"
+)
+
+// realmSessions is the TokenRepository of one realm, it only knows the
+// sessions started there.
+type realmSessions struct {
+	domain.TokenRepository
+	sessions map[string]bool
+}
+
+func (r realmSessions) SessionExists(ctx context.Context, sessionID string) (bool, error) {
+	return r.sessions[sessionID], nil
+}
+
+type testRealm struct {
+	tokens   *auth.JWTService
+	sessions realmSessions
+}
+
+func newTestRealm(issuer, secret string) testRealm {
+	return testRealm{
+		tokens: auth.NewJwtService(config.Config{
+			Issuer:     issuer,
+			JWTSecret:  secret,
+			AccessTTL:  15 * time.Minute,
+			PublicHost: issuer,
+		}),
+		sessions: realmSessions{sessions: make(map[string]bool)},
+	}
+}
+
+// login starts a session in the realm and returns its access token.
+func (r testRealm) login(t *testing.T) string {
+	t.Helper()
+
+	sessionID := uuid.NewString()
+	r.sessions.sessions[sessionID] = true
+	token, err := r.tokens.GenerateAccessToken(domain.AccessClaims{GUID: uuid.New(), SessionID: sessionID})
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	return token
+}
+
+func (r testRealm) serve(token string) int {
+	handler := Auth(zap.NewNop(), r.tokens, r.sessions, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAuthRejectsTokensOfAnotherRealm(t *testing.T) {
+	realmA := newTestRealm("https://a.example.com", "realm-a-signing-secret-with-enough-entropy-0123")
+	realmB := newTestRealm("https://b.example.com", "realm-b-signing-secret-with-enough-entropy-4567")
+
+	if code := realmB.serve(realmB.login(t)); code != http.StatusNoContent {
+		t.Fatalf("realm B answered its own token with %d", code)
+	}
+	if code := realmB.serve(realmA.login(t)); code != http.StatusUnauthorized {
+		t.Errorf("realm B answered a token of realm A with %d, want 401", code)
+	}
+}
+
+func TestAuthRejectsTokensOfAnotherRealmSharingTheSecret(t *testing.T) {
+	const secret = "shared-signing-secret-with-enough-entropy-0123456789"
+	realmA := newTestRealm("https://a.example.com", secret)
+	realmB := newTestRealm("https://b.example.com", secret)
+
+	token := realmA.login(t)
+	// even a session of the same ID in realm B does not let it through
+	for id := range realmA.sessions.sessions {
+		realmB.sessions.sessions[id] = true
+	}
+	if code := realmB.serve(token); code != http.StatusUnauthorized {
+		t.Errorf("realm B answered a token of realm A with %d, want 401", code)
+	}
+}
+
+func TestAuthRejectsSessionsOfAnotherRealm(t *testing.T) {
+	// same key and issuer, only the session store of the realm decides
+	realmA := newTestRealm("https://auth.example.com", "shared-signing-secret-with-enough-entropy-0123456789")
+	realmB := realmA
+	realmB.sessions = realmSessions{sessions: make(map[string]bool)}
+
+	if code := realmB.serve(realmA.login(t)); code != http.StatusUnauthorized {
+		t.Errorf("realm B answered a session of realm A with %d, want 401", code)
+	}
+}
+
+func TestRequireSessionRejectsAPIKeys(t *testing.T) {
+	handler := RequireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		name      string
+		sessionID any
+		want      int
+	}{
+		{name: "access token", sessionID: uuid.NewString(), want: http.StatusNoContent},
+		// Auth leaves the session ID of API keys empty
+		{name: "api key", sessionID: "", want: http.StatusForbidden},
+		{name: "not authenticated", want: http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/refresh", nil)
+		if tc.sessionID != nil {
+			req = req.WithContext(context.WithValue(req.Context(), ContextSessionIDKey, tc.sessionID))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/config"
+)
+
+const (
+	rateLimitWindow = time.Minute
+	// windows of idle clients are dropped once the table grows past this size
+	rateLimitPruneSize = 10000
+)
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimiter allows each client IP a fixed number of requests per minute.
+type RateLimiter struct {
+	perMinute atomic.Int64
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+func NewRateLimiter(perMinute int) *RateLimiter {
+	l := &RateLimiter{windows: make(map[string]*rateWindow)}
+	l.perMinute.Store(int64(perMinute))
+	return l
+}
+
+// ApplyConfig swaps in a new limit, 0 disables rate limiting.
+func (l *RateLimiter) ApplyConfig(cfg config.Config) {
+	l.perMinute.Store(int64(cfg.RateLimit))
+}
+
+// Allow reports whether one more request from key fits in the current
+// window, and if not, how long the caller has to wait.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	limit := int(l.perMinute.Load())
+	if limit == 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.windows) > rateLimitPruneSize {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= rateLimitWindow {
+				delete(l.windows, k)
+			}
+		}
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= rateLimitWindow {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	if w.count >= limit {
+		return false, rateLimitWindow - now.Sub(w.start)
+	}
+	w.count++
+	return true, 0
+}
+
+func (l *RateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		if ok, retryAfter := l.Allow(host); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
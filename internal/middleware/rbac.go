@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+)
+
+// HasPermission reports whether the access token of the request grants
+// permission. It must run behind Auth.
+func HasPermission(r *http.Request, permission string) bool {
+	permissions, _ := r.Context().Value(ContextPermissionsKey).([]string)
+	return slices.Contains(permissions, permission)
+}
+
+// HasRole reports whether the access token of the request carries role.
+// It must run behind Auth.
+func HasRole(r *http.Request, role string) bool {
+	roles, _ := r.Context().Value(ContextRolesKey).([]string)
+	return slices.Contains(roles, role)
+}
+
+// RequirePermission lets a request through only if HasPermission,
+// otherwise it answers 403.
+func RequirePermission(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasPermission(r, permission) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
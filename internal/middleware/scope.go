@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+)
+
+// HasScope reports whether the access token of the request was granted
+// scope. Tokens without a scope claim have none. It must run behind Auth.
+func HasScope(r *http.Request, scope string) bool {
+	granted, _ := r.Context().Value(ContextScopeKey).([]string)
+	return slices.Contains(granted, scope)
+}
+
+// RequireScope lets a request through only if HasScope, otherwise it
+// answers 403 with the missing scope in WWW-Authenticate (RFC 6750
+// section 3.1).
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r, scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, "insufficient scope", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
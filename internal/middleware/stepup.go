@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// InsufficientAuthenticationResponse is the step-up challenge of RFC 9470.
+// The client has to authenticate again, meeting MaxAge and ACRValues.
+type InsufficientAuthenticationResponse struct {
+	Error            string `json:"error" example:"insufficient_user_authentication"`
+	ErrorDescription string `json:"error_description"`
+	// MaxAge is the allowed age of the authentication in seconds.
+	MaxAge    int    `json:"max_age,omitempty"`
+	ACRValues string `json:"acr_values,omitempty"`
+}
+
+// AuthLevelSatisfied reports whether the authentication of the request is
+// at most maxAge old and reaches minACR. Zero values skip the check.
+// It must run behind Auth.
+func AuthLevelSatisfied(r *http.Request, maxAge time.Duration, minACR string) bool {
+	authTime, _ := r.Context().Value(ContextAuthTimeKey).(time.Time)
+	acr, _ := r.Context().Value(ContextACRKey).(string)
+
+	if maxAge > 0 && (authTime.IsZero() || time.Since(authTime) > maxAge) {
+		return false
+	}
+	return minACR == "" || domain.ACRSatisfies(acr, minACR)
+}
+
+// RequireAuthLevel lets a request through only if AuthLevelSatisfied,
+// otherwise it answers with a step-up challenge.
+func RequireAuthLevel(maxAge time.Duration, minACR string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !AuthLevelSatisfied(r, maxAge, minACR) {
+			InsufficientAuthentication(w, maxAge, minACR)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// InsufficientAuthentication writes a 401 step-up challenge, both in the
+// WWW-Authenticate header and as JSON body.
+func InsufficientAuthentication(w http.ResponseWriter, maxAge time.Duration, minACR string) {
+	resp := InsufficientAuthenticationResponse{
+		Error:            "insufficient_user_authentication",
+		ErrorDescription: "a more recent or stronger authentication is required",
+		MaxAge:           int(maxAge.Seconds()),
+		ACRValues:        minACR,
+	}
+
+	challenge := fmt.Sprintf(`Bearer error=%q, error_description=%q`, resp.Error, resp.ErrorDescription)
+	if resp.MaxAge > 0 {
+		challenge += fmt.Sprintf(`, max_age=%d`, resp.MaxAge)
+	}
+	if resp.ACRValues != "" {
+		challenge += fmt.Sprintf(`, acr_values=%q`, resp.ACRValues)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(resp)
+}
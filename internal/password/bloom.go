@@ -0,0 +1,186 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var bloomMagic = [8]byte{'G', 'B', 'T', 'B', 'L', 'M', '0', '1'}
+
+// BloomFilter is a compact, in-memory breach corpus. It never misses a
+// breached password, but may reject an unbreached one with the false
+// positive rate chosen when it was built.
+type BloomFilter struct {
+	bits []byte
+	m    uint64
+	k    uint32
+}
+
+func (f *BloomFilter) Breached(password string) (bool, error) {
+	return f.contains(sha1.Sum([]byte(password))), nil
+}
+
+func (f *BloomFilter) contains(hash [sha1.Size]byte) bool {
+	h1, h2 := bloomHashes(hash)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) add(hash [sha1.Size]byte) {
+	h1, h2 := bloomHashes(hash)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// bloomHashes derives the two base hashes for double hashing. SHA-1 output
+// is uniformly distributed, so its halves can be used directly.
+func bloomHashes(hash [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(hash[0:8]), binary.BigEndian.Uint64(hash[8:16]) | 1
+}
+
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bloom filter: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	var header struct {
+		Magic [8]byte
+		M     uint64
+		K     uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter header: %w", err)
+	}
+	if header.Magic != bloomMagic || header.M == 0 || header.K == 0 {
+		return nil, errors.New("not a bloom filter file")
+	}
+
+	f := &BloomFilter{m: header.M, k: header.K, bits: make([]byte, (header.M+7)/8)}
+	if _, err := io.ReadFull(r, f.bits); err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter: %w", err)
+	}
+	return f, nil
+}
+
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := struct {
+		Magic [8]byte
+		M     uint64
+		K     uint32
+	}{bloomMagic, f.m, f.k}
+
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(f.bits)
+	return int64(n) + int64(binary.Size(header)), err
+}
+
+// BuildBloomFilter builds a filter from an HIBP corpus, either a single
+// file of full SHA1:COUNT lines or a directory of range files. Hashes seen
+// fewer than minCount times are skipped to keep the filter small.
+func BuildBloomFilter(corpus string, falsePositiveRate float64, minCount int) (*BloomFilter, int, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, 0, errors.New("false positive rate must be between 0 and 1")
+	}
+
+	var n int
+	err := walkCorpus(corpus, minCount, func([sha1.Size]byte) { n++ })
+	if err != nil {
+		return nil, 0, err
+	}
+	if n == 0 {
+		return nil, 0, errors.New("corpus has no matching hashes")
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	f := &BloomFilter{m: m, k: k, bits: make([]byte, (m+7)/8)}
+
+	if err := walkCorpus(corpus, minCount, f.add); err != nil {
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+func walkCorpus(corpus string, minCount int, fn func([sha1.Size]byte)) error {
+	info, err := os.Stat(corpus)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return walkCorpusFile(corpus, "", minCount, fn)
+	}
+
+	entries, err := os.ReadDir(corpus)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		prefix := strings.TrimSuffix(entry.Name(), ".txt")
+		if entry.IsDir() || len(prefix) != 5 {
+			continue
+		}
+		if err := walkCorpusFile(filepath.Join(corpus, entry.Name()), prefix, minCount, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkCorpusFile(path, prefix string, minCount int, fn func([sha1.Size]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		hashHex, countStr, hasCount := strings.Cut(text, ":")
+		if hasCount {
+			count, err := strconv.Atoi(countStr)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid count", path, line)
+			}
+			if count < minCount {
+				continue
+			}
+		}
+
+		var hash [sha1.Size]byte
+		decoded, err := hex.DecodeString(prefix + hashHex)
+		if err != nil || len(decoded) != sha1.Size {
+			return fmt.Errorf("%s:%d: invalid sha1 hash", path, line)
+		}
+		copy(hash[:], decoded)
+		fn(hash)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,79 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBreached is returned for passwords found in the breached password corpus.
+var ErrBreached = errors.New("password has appeared in a data breach")
+
+// BreachChecker tells whether a password is part of a known breach corpus.
+// Implementations work offline, the password never leaves the process.
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// NoBreachCheck accepts every password.
+type NoBreachCheck struct{}
+
+func (NoBreachCheck) Breached(string) (bool, error) {
+	return false, nil
+}
+
+// OpenBreachChecker picks the checker matching path: a directory is read
+// as HIBP range files, a regular file as a bloom filter built by
+// BuildBloomFilter. An empty path disables the check.
+func OpenBreachChecker(path string) (BreachChecker, error) {
+	if path == "" {
+		return NoBreachCheck{}, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password corpus: %w", err)
+	}
+	if info.IsDir() {
+		return RangeDirectory(path), nil
+	}
+	return LoadBloomFilter(path)
+}
+
+// RangeDirectory is a directory of HIBP range files as written by the
+// official downloader: one file per 5 character SHA-1 prefix, named after
+// the prefix with an optional .txt extension, holding SUFFIX:COUNT lines.
+// Only the range file of the checked prefix is read.
+type RangeDirectory string
+
+func (d RangeDirectory) Breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(string(d), prefix))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open range file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
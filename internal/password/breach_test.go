@@ -0,0 +1,145 @@
+package password
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixture corpus lists "password", "123456", "qwerty" and, seen only
+// once, "letmein". testdata/ranges holds the range files of the first two,
+// one of them without the .txt extension, next to an unrelated hash.
+const (
+	testRanges = "testdata/ranges"
+	testCorpus = "testdata/corpus.txt"
+)
+
+func checkBreached(t *testing.T, checker BreachChecker, want map[string]bool) {
+	t.Helper()
+
+	for pw, breached := range want {
+		got, err := checker.Breached(pw)
+		if err != nil {
+			t.Errorf("Breached(%q): %v", pw, err)
+			continue
+		}
+		if got != breached {
+			t.Errorf("Breached(%q) = %v, want %v", pw, got, breached)
+		}
+	}
+}
+
+func TestRangeDirectory(t *testing.T) {
+	checkBreached(t, RangeDirectory(testRanges), map[string]bool{
+		"password": true,
+		"123456":   true,
+		// no range file for their prefix
+		"letmein":                      false,
+		"correct horse battery staple": false,
+	})
+}
+
+func TestBloomFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		corpus   string
+		minCount int
+		wantN    int
+		want     map[string]bool
+	}{
+		{
+			name:     "hash file",
+			corpus:   testCorpus,
+			minCount: 1,
+			wantN:    4,
+			want:     map[string]bool{"password": true, "123456": true, "qwerty": true, "letmein": true},
+		},
+		{
+			name:     "hash file above a count",
+			corpus:   testCorpus,
+			minCount: 2,
+			wantN:    3,
+			want:     map[string]bool{"password": true, "123456": true, "qwerty": true, "letmein": false},
+		},
+		{
+			name:     "range files",
+			corpus:   testRanges,
+			minCount: 1,
+			wantN:    3,
+			want:     map[string]bool{"password": true, "123456": true, "qwerty": false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, n, err := BuildBloomFilter(tc.corpus, 0.001, tc.minCount)
+			if err != nil {
+				t.Fatalf("BuildBloomFilter: %v", err)
+			}
+			if n != tc.wantN {
+				t.Errorf("BuildBloomFilter added %d hashes, want %d", n, tc.wantN)
+			}
+			checkBreached(t, filter, tc.want)
+
+			// the filter survives a round trip through its file
+			path := filepath.Join(t.TempDir(), "breached.bloom")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := filter.WriteTo(f); err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			f.Close()
+
+			checker, err := OpenBreachChecker(path)
+			if err != nil {
+				t.Fatalf("OpenBreachChecker: %v", err)
+			}
+			if _, ok := checker.(*BloomFilter); !ok {
+				t.Fatalf("OpenBreachChecker of a filter file = %T", checker)
+			}
+			checkBreached(t, checker, tc.want)
+		})
+	}
+}
+
+func TestOpenBreachChecker(t *testing.T) {
+	checker, err := OpenBreachChecker("")
+	if err != nil {
+		t.Fatalf("OpenBreachChecker of no path: %v", err)
+	}
+	checkBreached(t, checker, map[string]bool{"password": false})
+
+	checker, err = OpenBreachChecker(testRanges)
+	if err != nil {
+		t.Fatalf("OpenBreachChecker of a directory: %v", err)
+	}
+	if _, ok := checker.(RangeDirectory); !ok {
+		t.Errorf("OpenBreachChecker of a directory = %T, want RangeDirectory", checker)
+	}
+
+	if _, err := OpenBreachChecker(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("OpenBreachChecker of a missing path succeeded")
+	}
+	// a corpus file is not a filter
+	if _, err := OpenBreachChecker(testCorpus); err == nil {
+		t.Error("OpenBreachChecker of a hash file succeeded")
+	}
+}
+
+func TestBuildBloomFilterRejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(bad, []byte("not-a-hash:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := BuildBloomFilter(bad, 0.001, 1); err == nil {
+		t.Error("BuildBloomFilter of an invalid hash succeeded")
+	}
+	if _, _, err := BuildBloomFilter(testCorpus, 0, 1); err == nil {
+		t.Error("BuildBloomFilter with a false positive rate of 0 succeeded")
+	}
+	if _, _, err := BuildBloomFilter(testCorpus, 0.001, 1<<30); err == nil {
+		t.Error("BuildBloomFilter of an empty selection succeeded")
+	}
+}
@@ -0,0 +1,106 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// minIdentifierLength is the shortest username or email part that is
+// checked for, shorter ones would reject too many unrelated passwords.
+const minIdentifierLength = 3
+
+// Policy describes what a new password has to look like.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// MinClasses is the number of character classes (lowercase, uppercase,
+	// digits, other) the password must mix, 0 disables the rule.
+	MinClasses int
+}
+
+// PolicyError lists every rule a password violates.
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return strings.Join(e.Violations, "; ")
+}
+
+// Check validates password against the policy. identifiers are values
+// tied to the account, such as the username or email, that the password
+// must not contain.
+func (p Policy) Check(password string, identifiers ...string) error {
+	var violations []string
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters", p.MaxLength))
+	}
+
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, fmt.Sprintf(
+			"must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses,
+		))
+	}
+
+	lower := strings.ToLower(password)
+	for _, identifier := range expandIdentifiers(identifiers) {
+		if strings.Contains(lower, identifier) {
+			violations = append(violations, "must not contain the username or email")
+			break
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// IsPolicyError reports whether err was returned for a policy violation.
+func IsPolicyError(err error) bool {
+	var policyErr *PolicyError
+	return errors.As(err, &policyErr)
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// expandIdentifiers lowercases the identifiers and adds the local part of
+// emails, dropping values too short to be meaningful.
+func expandIdentifiers(identifiers []string) []string {
+	var expanded []string
+	for _, identifier := range identifiers {
+		identifier = strings.ToLower(strings.TrimSpace(identifier))
+		candidates := []string{identifier}
+		if local, _, ok := strings.Cut(identifier, "@"); ok {
+			candidates = append(candidates, local)
+		}
+		for _, c := range candidates {
+			if len(c) >= minIdentifierLength {
+				expanded = append(expanded, c)
+			}
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,87 @@
+package password
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := Policy{MinLength: 8, MaxLength: 16, MinClasses: 3}
+
+	for _, tc := range []struct {
+		name        string
+		password    string
+		identifiers []string
+		want        []string
+	}{
+		{name: "valid", password: "Tr0mbone-ok"},
+		{name: "too short", password: "Ab1!", want: []string{"must be at least 8 characters"}},
+		{name: "too long", password: "Abcdefgh12345678x", want: []string{"must be at most 16 characters"}},
+		// the length is counted in characters, not bytes
+		{name: "multibyte characters", password: "Äöü1äöüß"},
+		{
+			name:     "too few classes",
+			password: "abcdefgh12",
+			want:     []string{"must mix at least 3 of lowercase letters, uppercase letters, digits and symbols"},
+		},
+		{
+			name:        "contains the username",
+			password:    "xAlice-2024",
+			identifiers: []string{"alice"},
+			want:        []string{"must not contain the username or email"},
+		},
+		{
+			name:        "contains the local part of the email",
+			password:    "Bob.Smith-99",
+			identifiers: []string{"someone", "bob.smith@example.com"},
+			want:        []string{"must not contain the username or email"},
+		},
+		{
+			name:        "short identifiers are ignored",
+			password:    "Jo-Tr0mbone",
+			identifiers: []string{"jo", " ", "jo@example.com"},
+		},
+		{
+			name:        "every violation is listed",
+			password:    "alice",
+			identifiers: []string{"Alice"},
+			want: []string{
+				"must be at least 8 characters",
+				"must mix at least 3 of lowercase letters, uppercase letters, digits and symbols",
+				"must not contain the username or email",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := policy.Check(tc.password, tc.identifiers...)
+			if tc.want == nil {
+				if err != nil {
+					t.Errorf("Check = %v, want nil", err)
+				}
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Check = %v, want a PolicyError", err)
+			}
+			if !slices.Equal(policyErr.Violations, tc.want) {
+				t.Errorf("violations = %q, want %q", policyErr.Violations, tc.want)
+			}
+			if !IsPolicyError(err) {
+				t.Error("IsPolicyError = false")
+			}
+		})
+	}
+}
+
+func TestPolicyWithoutLimits(t *testing.T) {
+	// a zero MaxLength and MinClasses disable the rules
+	if err := (Policy{MinLength: 1}).Check("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"); err != nil {
+		t.Errorf("Check = %v, want nil", err)
+	}
+	if IsPolicyError(errors.New("other")) {
+		t.Error("IsPolicyError of another error = true")
+	}
+}
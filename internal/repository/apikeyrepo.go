@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+const apiKeyColumns = `
+	k.id, k.guid, k.name, k.prefix, k.key_hash, k.scope,
+	k.created_at, k.expires_at, k.last_used_at, COALESCE(k.last_used_ip, '')
+`
+
+// APIKeyRepository only sees the API keys of users in its realm.
+type APIKeyRepository struct {
+	db    *pgxpool.Pool
+	realm string
+}
+
+func NewAPIKeyRepository(db *pgxpool.Pool, realm string) *APIKeyRepository {
+	return &APIKeyRepository{db: db, realm: realm}
+}
+
+func scanAPIKey(row pgx.Row) (domain.APIKey, error) {
+	var k domain.APIKey
+	err := row.Scan(&k.ID, &k.GUID, &k.Name, &k.Prefix, &k.KeyHash, &k.Scope, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.APIKey{}, domain.ErrNotFound
+		}
+		return domain.APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+	return k, nil
+}
+
+func (r *APIKeyRepository) StoreAPIKey(ctx context.Context, key domain.APIKey) error {
+	query := `
+		INSERT INTO api_keys (id, guid, realm, name, prefix, key_hash, scope, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	scope := key.Scope
+	if scope == nil {
+		scope = []string{}
+	}
+	_, err := r.db.Exec(ctx, query, key.ID, key.GUID, r.realm, key.Name, key.Prefix, key.KeyHash, scope, key.CreatedAt, key.ExpiresAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		if isForeignKeyViolation(err) {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to store api key: %w", err)
+	}
+	return nil
+}
+
+func (r *APIKeyRepository) GetAPIKeyByPrefix(ctx context.Context, prefix string) (domain.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys k
+		JOIN users u ON u.guid = k.guid
+		WHERE k.prefix = $1
+			AND k.realm = $2
+			AND (u.status = 'active' OR (u.status = 'locked' AND u.locked_until <= NOW()))
+	`
+	return scanAPIKey(r.db.QueryRow(ctx, query, prefix, r.realm))
+}
+
+func (r *APIKeyRepository) ListAPIKeys(ctx context.Context, guid uuid.UUID) ([]domain.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys k
+		WHERE k.guid = $1 AND k.realm = $2
+		ORDER BY k.created_at DESC
+	`
+	rows, err := r.db.Query(ctx, query, guid, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []domain.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (r *APIKeyRepository) DeleteAPIKey(ctx context.Context, guid, id uuid.UUID) error {
+	query := `DELETE FROM api_keys WHERE id = $1 AND guid = $2 AND realm = $3`
+	tag, err := r.db.Exec(ctx, query, id, guid, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to delete api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *APIKeyRepository) TouchAPIKey(ctx context.Context, id uuid.UUID, ip string) error {
+	query := `UPDATE api_keys SET last_used_at = NOW(), last_used_ip = $2 WHERE id = $1 AND realm = $3`
+	if _, err := r.db.Exec(ctx, query, id, ip, r.realm); err != nil {
+		return fmt.Errorf("failed to record api key use: %w", err)
+	}
+	return nil
+}
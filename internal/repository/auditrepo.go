@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+// AuditRepository keeps the audit log of a realm. Every realm has a chain
+// of its own, the realm is not part of the hash but moving an entry to
+// another realm breaks the chains of both.
+type AuditRepository struct {
+	db    *pgxpool.Pool
+	realm string
+}
+
+func NewAuditRepository(db *pgxpool.Pool, realm string) *AuditRepository {
+	return &AuditRepository{db: db, realm: realm}
+}
+
+func (r *AuditRepository) AppendAuditEntry(ctx context.Context, entry *domain.AuditEntry) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin audit tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// appends are serialized so that every entry links to the real chain head
+	if _, err := tx.Exec(ctx, `LOCK TABLE audit_log IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	var prevHash string
+	err = tx.QueryRow(ctx, `SELECT hash FROM audit_log WHERE realm = $1 ORDER BY id DESC LIMIT 1`, r.realm).Scan(&prevHash)
+	if err != nil && err != pgx.ErrNoRows {
+		return fmt.Errorf("failed to read audit chain head: %w", err)
+	}
+
+	var id int64
+	if err := tx.QueryRow(ctx, `SELECT nextval(pg_get_serial_sequence('audit_log', 'id'))`).Scan(&id); err != nil {
+		return fmt.Errorf("failed to allocate audit id: %w", err)
+	}
+
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit details: %w", err)
+	}
+
+	entry.ID = id
+	// postgres keeps microseconds, the hash must survive the round trip
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.PrevHash = prevHash
+	entry.Hash = entry.ComputeHash()
+
+	query := `
+		INSERT INTO audit_log
+		(id, realm, guid, event_type, actor, ip_address, user_agent, details, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+	_, err = tx.Exec(ctx, query,
+		entry.ID, r.realm, nullableUUID(entry.GUID), string(entry.EventType), entry.Actor, entry.IP, entry.UserAgent,
+		string(details), entry.CreatedAt, entry.PrevHash, entry.Hash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store audit entry: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit audit entry: %w", err)
+	}
+	return nil
+}
+
+func (r *AuditRepository) ListAuditEntries(ctx context.Context, filter domain.AuditFilter) ([]domain.AuditEntry, error) {
+	var (
+		conds []string
+		args  []any
+	)
+	addCond := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	addCond("realm = $%d", r.realm)
+	if filter.GUID != nil {
+		addCond("guid = $%d", *filter.GUID)
+	}
+	if filter.EventType != "" {
+		addCond("event_type = $%d", string(filter.EventType))
+	}
+	if !filter.From.IsZero() {
+		addCond("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCond("created_at < $%d", filter.To)
+	}
+	if filter.BeforeID > 0 {
+		addCond("id < $%d", filter.BeforeID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditPageSize
+	}
+	if limit > maxAuditPageSize {
+		limit = maxAuditPageSize
+	}
+
+	query := `
+		SELECT id, guid, event_type, actor, ip_address, user_agent, details, created_at, prev_hash, hash
+		FROM audit_log
+		WHERE ` + strings.Join(conds, " AND ")
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	return scanAuditEntries(rows)
+}
+
+func (r *AuditRepository) AuditChain(ctx context.Context, afterID int64, limit int) ([]domain.AuditEntry, error) {
+	query := `
+		SELECT id, guid, event_type, actor, ip_address, user_agent, details, created_at, prev_hash, hash
+		FROM audit_log
+		WHERE realm = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+	rows, err := r.db.Query(ctx, query, r.realm, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit chain: %w", err)
+	}
+	return scanAuditEntries(rows)
+}
+
+func scanAuditEntries(rows pgx.Rows) ([]domain.AuditEntry, error) {
+	defer rows.Close()
+
+	var entries []domain.AuditEntry
+	for rows.Next() {
+		var (
+			entry     domain.AuditEntry
+			guid      uuid.NullUUID
+			eventType string
+			details   string
+		)
+		err := rows.Scan(
+			&entry.ID, &guid, &eventType, &entry.Actor, &entry.IP, &entry.UserAgent,
+			&details, &entry.CreatedAt, &entry.PrevHash, &entry.Hash,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		if guid.Valid {
+			entry.GUID = guid.UUID
+		}
+		entry.EventType = domain.AuditEventType(eventType)
+		if err := json.Unmarshal([]byte(details), &entry.Details); err != nil {
+			return nil, fmt.Errorf("failed to decode audit details: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func nullableUUID(guid uuid.UUID) uuid.NullUUID {
+	return uuid.NullUUID{UUID: guid, Valid: guid != uuid.Nil}
+}
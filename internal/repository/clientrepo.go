@@ -0,0 +1,318 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+const clientColumns = `
+	id, name, auth_method, COALESCE(secret_hash, ''), COALESCE(public_key, ''),
+	scopes, audiences, grant_types, redirect_uris, created_at
+`
+
+// OAuthClientRepository only sees the clients registered in its realm.
+type OAuthClientRepository struct {
+	db    *pgxpool.Pool
+	realm string
+}
+
+func NewOAuthClientRepository(db *pgxpool.Pool, realm string) *OAuthClientRepository {
+	return &OAuthClientRepository{db: db, realm: realm}
+}
+
+func scanClient(row pgx.Row) (domain.OAuthClient, error) {
+	var c domain.OAuthClient
+	err := row.Scan(&c.ID, &c.Name, &c.AuthMethod, &c.SecretHash, &c.PublicKey, &c.Scopes, &c.Audiences, &c.GrantTypes, &c.RedirectURIs, &c.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.OAuthClient{}, domain.ErrNotFound
+		}
+		return domain.OAuthClient{}, fmt.Errorf("failed to get client: %w", err)
+	}
+	return c, nil
+}
+
+// nonNil keeps nil slices from being stored as NULL in NOT NULL array columns.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func (r *OAuthClientRepository) CreateClient(ctx context.Context, c domain.OAuthClient) error {
+	query := `
+		INSERT INTO oauth_clients (id, realm, name, auth_method, secret_hash, public_key, scopes, audiences, grant_types, redirect_uris, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9, $10, $11)
+	`
+	_, err := r.db.Exec(ctx, query,
+		c.ID, r.realm, c.Name, c.AuthMethod, c.SecretHash, c.PublicKey,
+		nonNil(c.Scopes), nonNil(c.Audiences), nonNil(c.GrantTypes), nonNil(c.RedirectURIs), c.CreatedAt,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) GetClient(ctx context.Context, id string) (domain.OAuthClient, error) {
+	query := `SELECT ` + clientColumns + ` FROM oauth_clients WHERE id = $1 AND realm = $2`
+	return scanClient(r.db.QueryRow(ctx, query, id, r.realm))
+}
+
+func (r *OAuthClientRepository) ListClients(ctx context.Context) ([]domain.OAuthClient, error) {
+	query := `SELECT ` + clientColumns + ` FROM oauth_clients WHERE realm = $1 ORDER BY created_at, id`
+	rows, err := r.db.Query(ctx, query, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+	defer rows.Close()
+
+	var clients []domain.OAuthClient
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+	return clients, nil
+}
+
+func (r *OAuthClientRepository) DeleteClient(ctx context.Context, id string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM oauth_clients WHERE id = $1 AND realm = $2`, id, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to delete client: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) UpdateClientSecret(ctx context.Context, id, secretHash string) error {
+	query := `UPDATE oauth_clients SET secret_hash = $2 WHERE id = $1 AND realm = $3 AND auth_method IN ('client_secret_basic', 'client_secret_post')`
+	tag, err := r.db.Exec(ctx, query, id, secretHash, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to update client secret: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) UseClientAssertion(ctx context.Context, clientID, jti string, expiresAt time.Time) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM oauth_client_assertions WHERE client_id = $1 AND expires_at <= NOW()`, clientID); err != nil {
+		return fmt.Errorf("failed to expire client assertions: %w", err)
+	}
+
+	query := `INSERT INTO oauth_client_assertions (client_id, jti, expires_at) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(ctx, query, clientID, jti, expiresAt); err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to store client assertion: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit client assertion: %w", err)
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) StoreAuthorizationCode(ctx context.Context, code domain.AuthorizationCode) error {
+	query := `
+		INSERT INTO oauth_authorization_codes
+		(code_hash, client_id, guid, realm, redirect_uri, scope, code_challenge, nonce, amr, auth_time, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+	_, err := r.db.Exec(ctx, query,
+		code.CodeHash, code.ClientID, code.GUID, r.realm, code.RedirectURI, nonNil(code.Scope),
+		code.CodeChallenge, code.Nonce, nonNil(code.AMR), code.AuthTime, code.CreatedAt, code.ExpiresAt,
+	)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to store authorization code: %w", err)
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) UseAuthorizationCode(ctx context.Context, codeHash string) (domain.AuthorizationCode, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return domain.AuthorizationCode{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT code_hash, client_id, guid, redirect_uri, scope, code_challenge, nonce, amr, auth_time, created_at, expires_at, used_at
+		FROM oauth_authorization_codes
+		WHERE code_hash = $1 AND realm = $2
+		FOR UPDATE
+	`
+	var code domain.AuthorizationCode
+	err = tx.QueryRow(ctx, query, codeHash, r.realm).Scan(
+		&code.CodeHash, &code.ClientID, &code.GUID, &code.RedirectURI, &code.Scope, &code.CodeChallenge,
+		&code.Nonce, &code.AMR, &code.AuthTime, &code.CreatedAt, &code.ExpiresAt, &code.UsedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.AuthorizationCode{}, domain.ErrNotFound
+		}
+		return domain.AuthorizationCode{}, fmt.Errorf("failed to get authorization code: %w", err)
+	}
+
+	if code.UsedAt == nil {
+		if _, err := tx.Exec(ctx, `UPDATE oauth_authorization_codes SET used_at = NOW() WHERE code_hash = $1`, codeHash); err != nil {
+			return domain.AuthorizationCode{}, fmt.Errorf("failed to use authorization code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return domain.AuthorizationCode{}, fmt.Errorf("failed to commit authorization code: %w", err)
+	}
+	return code, nil
+}
+
+func (r *OAuthClientRepository) PurgeAuthorizationCodes(ctx context.Context, expiredBefore time.Time) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM oauth_authorization_codes WHERE realm = $1 AND expires_at <= $2`, r.realm, expiredBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge authorization codes: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+const deviceColumns = `
+	device_code_hash, user_code, client_id, scope, status, guid, COALESCE(amr, '{}'),
+	auth_time, interval_seconds, last_polled_at, created_at, expires_at
+`
+
+func scanDeviceAuthorization(row pgx.Row) (domain.DeviceAuthorization, error) {
+	var (
+		d        domain.DeviceAuthorization
+		guid     *uuid.UUID
+		authTime *time.Time
+		interval int
+	)
+	err := row.Scan(&d.DeviceCodeHash, &d.UserCode, &d.ClientID, &d.Scope, &d.Status, &guid, &d.AMR,
+		&authTime, &interval, &d.LastPolledAt, &d.CreatedAt, &d.ExpiresAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.DeviceAuthorization{}, domain.ErrNotFound
+		}
+		return domain.DeviceAuthorization{}, fmt.Errorf("failed to get device authorization: %w", err)
+	}
+	if guid != nil {
+		d.GUID = *guid
+	}
+	if authTime != nil {
+		d.AuthTime = *authTime
+	}
+	d.Interval = time.Duration(interval) * time.Second
+	return d, nil
+}
+
+func (r *OAuthClientRepository) StoreDeviceAuthorization(ctx context.Context, d domain.DeviceAuthorization) error {
+	// expired authorizations would keep their user codes taken
+	if _, err := r.db.Exec(ctx, `DELETE FROM oauth_device_authorizations WHERE expires_at <= NOW()`); err != nil {
+		return fmt.Errorf("failed to expire device authorizations: %w", err)
+	}
+
+	query := `
+		INSERT INTO oauth_device_authorizations
+		(device_code_hash, user_code, client_id, realm, scope, interval_seconds, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := r.db.Exec(ctx, query,
+		d.DeviceCodeHash, d.UserCode, d.ClientID, r.realm, nonNil(d.Scope),
+		int(d.Interval/time.Second), d.CreatedAt, d.ExpiresAt,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to store device authorization: %w", err)
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) GetDeviceAuthorization(ctx context.Context, userCode string) (domain.DeviceAuthorization, error) {
+	query := `SELECT ` + deviceColumns + ` FROM oauth_device_authorizations WHERE user_code = $1 AND realm = $2`
+	return scanDeviceAuthorization(r.db.QueryRow(ctx, query, userCode, r.realm))
+}
+
+func (r *OAuthClientRepository) DecideDeviceAuthorization(ctx context.Context, userCode string, status domain.DeviceStatus, guid *uuid.UUID, amr []string, authTime time.Time) error {
+	query := `
+		UPDATE oauth_device_authorizations
+		SET status = $3, guid = $4, amr = $5, auth_time = $6
+		WHERE user_code = $1 AND realm = $2 AND status = 'pending' AND expires_at > NOW()
+	`
+	tag, err := r.db.Exec(ctx, query, userCode, r.realm, status, guid, nonNil(amr), authTime)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to decide device authorization: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *OAuthClientRepository) PollDeviceAuthorization(ctx context.Context, deviceCodeHash string) (domain.DeviceAuthorization, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return domain.DeviceAuthorization{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT ` + deviceColumns + ` FROM oauth_device_authorizations WHERE device_code_hash = $1 AND realm = $2 FOR UPDATE`
+	d, err := scanDeviceAuthorization(tx.QueryRow(ctx, query, deviceCodeHash, r.realm))
+	if err != nil {
+		return domain.DeviceAuthorization{}, err
+	}
+
+	if d.Status == domain.DevicePending {
+		_, err = tx.Exec(ctx, `UPDATE oauth_device_authorizations SET last_polled_at = NOW() WHERE device_code_hash = $1`, deviceCodeHash)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM oauth_device_authorizations WHERE device_code_hash = $1`, deviceCodeHash)
+	}
+	if err != nil {
+		return domain.DeviceAuthorization{}, fmt.Errorf("failed to poll device authorization: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return domain.DeviceAuthorization{}, fmt.Errorf("failed to commit device authorization: %w", err)
+	}
+	return d, nil
+}
+
+func (r *OAuthClientRepository) SetDevicePollInterval(ctx context.Context, deviceCodeHash string, interval time.Duration) error {
+	query := `UPDATE oauth_device_authorizations SET interval_seconds = $2 WHERE device_code_hash = $1 AND realm = $3`
+	if _, err := r.db.Exec(ctx, query, deviceCodeHash, int(interval/time.Second), r.realm); err != nil {
+		return fmt.Errorf("failed to set device poll interval: %w", err)
+	}
+	return nil
+}
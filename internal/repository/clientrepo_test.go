@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+func TestOAuthClientRepositoryPurgesExpiredAuthorizationCodes(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realm, other := testRealms(t, db)
+
+	client := domain.OAuthClient{
+		ID:         "test-" + uuid.NewString(),
+		Name:       "test",
+		AuthMethod: domain.ClientAuthNone,
+		GrantTypes: []string{domain.GrantAuthorizationCode},
+		CreatedAt:  time.Now(),
+	}
+	clients := NewOAuthClientRepository(db, realm)
+	if err := clients.CreateClient(ctx, client); err != nil {
+		t.Fatalf("CreateClient: %v", err)
+	}
+	t.Cleanup(func() { clients.DeleteClient(context.Background(), client.ID) })
+
+	guid := createTestUser(t, NewUserRepository(db, realm), "alice")
+	code := func(hash string, expiresAt time.Time) domain.AuthorizationCode {
+		return domain.AuthorizationCode{
+			CodeHash:      hash + "-" + uuid.NewString(),
+			ClientID:      client.ID,
+			GUID:          guid,
+			CodeChallenge: "challenge",
+			AuthTime:      time.Now(),
+			CreatedAt:     time.Now(),
+			ExpiresAt:     expiresAt,
+		}
+	}
+	live := code("live", time.Now().Add(time.Minute))
+	expired := code("expired", time.Now().Add(-time.Minute))
+	used := code("used", time.Now().Add(-time.Minute))
+	for _, c := range []domain.AuthorizationCode{live, expired, used} {
+		if err := clients.StoreAuthorizationCode(ctx, c); err != nil {
+			t.Fatalf("StoreAuthorizationCode: %v", err)
+		}
+	}
+	if _, err := clients.UseAuthorizationCode(ctx, used.CodeHash); err != nil {
+		t.Fatalf("UseAuthorizationCode: %v", err)
+	}
+
+	// the purge of another realm leaves the codes alone
+	if n, err := NewOAuthClientRepository(db, other).PurgeAuthorizationCodes(ctx, time.Now()); err != nil || n != 0 {
+		t.Errorf("PurgeAuthorizationCodes of another realm = %d, %v, want 0", n, err)
+	}
+
+	if n, err := clients.PurgeAuthorizationCodes(ctx, time.Now()); err != nil || n != 2 {
+		t.Fatalf("PurgeAuthorizationCodes = %d, %v, want 2", n, err)
+	}
+	for _, c := range []domain.AuthorizationCode{expired, used} {
+		if _, err := clients.UseAuthorizationCode(ctx, c.CodeHash); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("UseAuthorizationCode of a purged code = %v, want ErrNotFound", err)
+		}
+	}
+	if _, err := clients.UseAuthorizationCode(ctx, live.CodeHash); err != nil {
+		t.Errorf("UseAuthorizationCode of the live code = %v, want it kept", err)
+	}
+}
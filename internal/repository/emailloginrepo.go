@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+const emailLoginColumns = `guid, email, token_hash, code_hash, user_agent, attempts, created_at, expires_at`
+
+type EmailLoginRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewEmailLoginRepository(db *pgxpool.Pool) *EmailLoginRepository {
+	return &EmailLoginRepository{db: db}
+}
+
+func scanEmailLogin(row pgx.Row) (domain.EmailLogin, error) {
+	var l domain.EmailLogin
+	err := row.Scan(&l.GUID, &l.Email, &l.TokenHash, &l.CodeHash, &l.UserAgent, &l.Attempts, &l.CreatedAt, &l.ExpiresAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.EmailLogin{}, domain.ErrNotFound
+		}
+		return domain.EmailLogin{}, fmt.Errorf("failed to get email login: %w", err)
+	}
+	return l, nil
+}
+
+func (r *EmailLoginRepository) StoreEmailLogin(ctx context.Context, l domain.EmailLogin, notBefore time.Time) error {
+	query := `
+		INSERT INTO email_logins (guid, email, token_hash, code_hash, user_agent, attempts, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, 0, $6, $7)
+		ON CONFLICT (guid) DO UPDATE
+		SET email = EXCLUDED.email,
+			token_hash = EXCLUDED.token_hash,
+			code_hash = EXCLUDED.code_hash,
+			user_agent = EXCLUDED.user_agent,
+			attempts = 0,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE email_logins.created_at <= $8 OR email_logins.expires_at <= NOW()
+	`
+	tag, err := r.db.Exec(ctx, query, l.GUID, l.Email, l.TokenHash, l.CodeHash, l.UserAgent, l.CreatedAt, l.ExpiresAt, notBefore)
+	if err != nil {
+		return fmt.Errorf("failed to store email login: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrAlreadyExists
+	}
+	return nil
+}
+
+func (r *EmailLoginRepository) AttemptEmailLogin(ctx context.Context, guid uuid.UUID, maxAttempts int) (domain.EmailLogin, error) {
+	query := `
+		UPDATE email_logins
+		SET attempts = attempts + 1
+		WHERE guid = $1 AND attempts < $2 AND expires_at > NOW()
+		RETURNING ` + emailLoginColumns
+	return scanEmailLogin(r.db.QueryRow(ctx, query, guid, maxAttempts))
+}
+
+func (r *EmailLoginRepository) ConsumeEmailLoginToken(ctx context.Context, tokenHash, userAgent string) (domain.EmailLogin, error) {
+	query := `
+		DELETE FROM email_logins
+		WHERE token_hash = $1 AND user_agent = $2 AND expires_at > NOW()
+		RETURNING ` + emailLoginColumns
+	return scanEmailLogin(r.db.QueryRow(ctx, query, tokenHash, userAgent))
+}
+
+func (r *EmailLoginRepository) ConsumeEmailLoginCode(ctx context.Context, guid uuid.UUID, codeHash string) error {
+	query := `
+		DELETE FROM email_logins
+		WHERE guid = $1 AND code_hash = $2 AND expires_at > NOW()
+	`
+	tag, err := r.db.Exec(ctx, query, guid, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to consume email login: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
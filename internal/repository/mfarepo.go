@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+type MFARepository struct {
+	db *pgxpool.Pool
+}
+
+func NewMFARepository(db *pgxpool.Pool) *MFARepository {
+	return &MFARepository{db: db}
+}
+
+func (r *MFARepository) StoreTOTP(ctx context.Context, cred domain.TOTPCredential) error {
+	// a confirmed credential is never overwritten, the update matches no row
+	query := `
+		INSERT INTO totp_credentials (guid, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (guid) DO UPDATE
+		SET secret = EXCLUDED.secret,
+			last_used_step = 0,
+			failed_attempts = 0,
+			created_at = EXCLUDED.created_at
+		WHERE totp_credentials.confirmed_at IS NULL
+	`
+	tag, err := r.db.Exec(ctx, query, cred.GUID, cred.Secret, cred.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store totp credential: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrAlreadyExists
+	}
+	return nil
+}
+
+func (r *MFARepository) GetTOTP(ctx context.Context, guid uuid.UUID) (domain.TOTPCredential, error) {
+	query := `
+		SELECT guid, secret, last_used_step, failed_attempts, created_at, confirmed_at
+		FROM totp_credentials
+		WHERE guid = $1
+	`
+	var cred domain.TOTPCredential
+	err := r.db.QueryRow(ctx, query, guid).Scan(
+		&cred.GUID, &cred.Secret, &cred.LastUsedStep, &cred.FailedAttempts, &cred.CreatedAt, &cred.ConfirmedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.TOTPCredential{}, domain.ErrNotFound
+		}
+		return domain.TOTPCredential{}, fmt.Errorf("failed to get totp credential: %w", err)
+	}
+	return cred, nil
+}
+
+func (r *MFARepository) ConfirmTOTP(ctx context.Context, guid uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE totp_credentials
+		SET confirmed_at = NOW(), last_used_step = $2, failed_attempts = 0
+		WHERE guid = $1 AND confirmed_at IS NULL AND last_used_step < $2
+	`
+	tag, err := tx.Exec(ctx, query, guid, step)
+	if err != nil {
+		return fmt.Errorf("failed to confirm totp credential: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, guid, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit totp confirmation: %w", err)
+	}
+	return nil
+}
+
+func (r *MFARepository) UseTOTPStep(ctx context.Context, guid uuid.UUID, step int64) error {
+	query := `
+		UPDATE totp_credentials
+		SET last_used_step = $2, failed_attempts = 0
+		WHERE guid = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2
+	`
+	tag, err := r.db.Exec(ctx, query, guid, step)
+	if err != nil {
+		return fmt.Errorf("failed to use totp code: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *MFARepository) RecordTOTPFailure(ctx context.Context, guid uuid.UUID) (int, error) {
+	query := `
+		UPDATE totp_credentials
+		SET failed_attempts = failed_attempts + 1
+		WHERE guid = $1
+		RETURNING failed_attempts
+	`
+	var failures int
+	if err := r.db.QueryRow(ctx, query, guid).Scan(&failures); err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, domain.ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to record totp failure: %w", err)
+	}
+	return failures, nil
+}
+
+func (r *MFARepository) UseRecoveryCode(ctx context.Context, guid uuid.UUID, codeHash string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE guid = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	tag, err := tx.Exec(ctx, query, guid, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+
+	// a recovery code proves the second factor, it also lifts the lock on codes
+	if _, err := tx.Exec(ctx, `UPDATE totp_credentials SET failed_attempts = 0 WHERE guid = $1`, guid); err != nil {
+		return fmt.Errorf("failed to reset totp failures: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit recovery code use: %w", err)
+	}
+	return nil
+}
+
+func (r *MFARepository) ReplaceRecoveryCodes(ctx context.Context, guid uuid.UUID, codeHashes []string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, guid, codeHashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit recovery codes: %w", err)
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, guid uuid.UUID, codeHashes []string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE guid = $1`, guid); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	query := `
+		INSERT INTO recovery_codes (guid, code_hash)
+		SELECT $1, unnest($2::text[])
+	`
+	if _, err := tx.Exec(ctx, query, guid, codeHashes); err != nil {
+		return fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return nil
+}
+
+func (r *MFARepository) CountRecoveryCodes(ctx context.Context, guid uuid.UUID) (int, error) {
+	query := `SELECT COUNT(*) FROM recovery_codes WHERE guid = $1 AND used_at IS NULL`
+	var n int
+	if err := r.db.QueryRow(ctx, query, guid).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return n, nil
+}
+
+func (r *MFARepository) DeleteMFA(ctx context.Context, guid uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE guid = $1`, guid); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM totp_credentials WHERE guid = $1`, guid); err != nil {
+		return fmt.Errorf("failed to delete totp credential: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit mfa deletion: %w", err)
+	}
+	return nil
+}
@@ -1,16 +1,89 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/pgx"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/nerfthisdev/go-backend-test-task/migrations"
 )
 
-func RunMigrations(pool *pgxpool.Pool, migrationsPath string) error {
+// migrationLockID is the key of the advisory lock held while migrating,
+// so that replicas booting at the same time run migrations one by one.
+const migrationLockID = 7264917301
+
+func RunMigrations(ctx context.Context, pool *pgxpool.Pool) error {
+	return withMigrate(ctx, pool, func(m *migrate.Migrate) error {
+		if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
+		return nil
+	})
+}
+
+// RollbackMigrations reverts the given number of applied migrations.
+func RollbackMigrations(ctx context.Context, pool *pgxpool.Pool, steps int) error {
+	return withMigrate(ctx, pool, func(m *migrate.Migrate) error {
+		if err := m.Steps(-steps); err != nil && err != migrate.ErrNoChange {
+			return fmt.Errorf("failed to roll back migrations: %w", err)
+		}
+		return nil
+	})
+}
+
+// MigrationVersion returns the current schema version and whether the last
+// migration failed half way. The version is 0 if no migration was applied.
+func MigrationVersion(ctx context.Context, pool *pgxpool.Pool) (uint, bool, error) {
+	var (
+		version uint
+		dirty   bool
+	)
+	err := withMigrate(ctx, pool, func(m *migrate.Migrate) error {
+		var err error
+		version, dirty, err = m.Version()
+		if errors.Is(err, migrate.ErrNilVersion) {
+			return nil
+		}
+		return err
+	})
+	return version, dirty, err
+}
+
+// ForceMigrationVersion sets the schema version without running anything
+// and clears the dirty flag, to recover from a failed migration by hand.
+func ForceMigrationVersion(ctx context.Context, pool *pgxpool.Pool, version int) error {
+	return withMigrate(ctx, pool, func(m *migrate.Migrate) error {
+		if err := m.Force(version); err != nil {
+			return fmt.Errorf("failed to force migration version: %w", err)
+		}
+		return nil
+	})
+}
+
+// withMigrate runs fn while holding the migration advisory lock. The lock is
+// bound to a dedicated connection and released when fn returns.
+func withMigrate(ctx context.Context, pool *pgxpool.Pool, fn func(m *migrate.Migrate) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection for migration lock: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		return fmt.Errorf("failed to open embedded migrations: %w", err)
+	}
+
 	sqlDB := stdlib.OpenDBFromPool(pool)
 	defer sqlDB.Close()
 
@@ -19,13 +92,9 @@ func RunMigrations(pool *pgxpool.Pool, migrationsPath string) error {
 		return fmt.Errorf("failed to create migration driver: %w", err)
 	}
 
-	m, err := migrate.NewWithDatabaseInstance("file://"+migrationsPath, "postgres", driver)
+	m, err := migrate.NewWithInstance("iofs", source, "postgres", driver)
 	if err != nil {
 		return fmt.Errorf("failed to init migrate: %w", err)
 	}
-
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		return fmt.Errorf("failed to run migrations: %w", err)
-	}
-	return nil
+	return fn(m)
 }
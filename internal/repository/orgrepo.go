@@ -0,0 +1,388 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// OrganizationRepository only sees the organizations of its realm, and
+// only users of the realm can become members.
+type OrganizationRepository struct {
+	db    *pgxpool.Pool
+	realm string
+}
+
+func NewOrganizationRepository(db *pgxpool.Pool, realm string) *OrganizationRepository {
+	return &OrganizationRepository{db: db, realm: realm}
+}
+
+func (r *OrganizationRepository) CreateOrganization(ctx context.Context, org domain.Organization, owner uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO organizations (id, name, created_at, realm) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(ctx, query, org.ID, org.Name, org.CreatedAt, r.realm); err != nil {
+		return fmt.Errorf("failed to create organization: %w", err)
+	}
+	query = `
+		INSERT INTO organization_members (org_id, guid, role)
+		SELECT $1, guid, $3 FROM users WHERE guid = $2 AND realm = $4
+	`
+	tag, err := tx.Exec(ctx, query, org.ID, owner, domain.OrgOwner, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to add organization owner: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit organization: %w", err)
+	}
+	return nil
+}
+
+func (r *OrganizationRepository) GetOrganization(ctx context.Context, id uuid.UUID) (domain.Organization, error) {
+	query := `SELECT id, name, created_at FROM organizations WHERE id = $1 AND realm = $2`
+	var org domain.Organization
+	if err := r.db.QueryRow(ctx, query, id, r.realm).Scan(&org.ID, &org.Name, &org.CreatedAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.Organization{}, domain.ErrNotFound
+		}
+		return domain.Organization{}, fmt.Errorf("failed to get organization: %w", err)
+	}
+	return org, nil
+}
+
+func (r *OrganizationRepository) ListUserOrganizations(ctx context.Context, guid uuid.UUID) ([]domain.UserOrganization, error) {
+	query := `
+		SELECT o.id, o.name, o.created_at, m.role
+		FROM organization_members m
+		JOIN organizations o ON o.id = m.org_id
+		WHERE m.guid = $1 AND o.realm = $2
+		ORDER BY o.name, o.id
+	`
+	rows, err := r.db.Query(ctx, query, guid, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	defer rows.Close()
+
+	var orgs []domain.UserOrganization
+	for rows.Next() {
+		var org domain.UserOrganization
+		if err := rows.Scan(&org.ID, &org.Name, &org.CreatedAt, &org.Role); err != nil {
+			return nil, fmt.Errorf("failed to scan organization: %w", err)
+		}
+		orgs = append(orgs, org)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	return orgs, nil
+}
+
+func (r *OrganizationRepository) DeleteOrganization(ctx context.Context, id uuid.UUID) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM organizations WHERE id = $1 AND realm = $2`, id, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to delete organization: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *OrganizationRepository) GetMember(ctx context.Context, orgID, guid uuid.UUID) (domain.Membership, error) {
+	query := `
+		SELECT m.org_id, m.guid, m.role, m.joined_at
+		FROM organization_members m
+		JOIN organizations o ON o.id = m.org_id
+		WHERE m.org_id = $1 AND m.guid = $2 AND o.realm = $3
+	`
+	var m domain.Membership
+	if err := r.db.QueryRow(ctx, query, orgID, guid, r.realm).Scan(&m.OrgID, &m.GUID, &m.Role, &m.JoinedAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.Membership{}, domain.ErrNotFound
+		}
+		return domain.Membership{}, fmt.Errorf("failed to get member: %w", err)
+	}
+	return m, nil
+}
+
+func (r *OrganizationRepository) ListMembers(ctx context.Context, orgID uuid.UUID) ([]domain.Membership, error) {
+	query := `
+		SELECT m.org_id, m.guid, m.role, m.joined_at
+		FROM organization_members m
+		JOIN organizations o ON o.id = m.org_id
+		WHERE m.org_id = $1 AND o.realm = $2
+		ORDER BY m.joined_at, m.guid
+	`
+	rows, err := r.db.Query(ctx, query, orgID, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []domain.Membership
+	for rows.Next() {
+		var m domain.Membership
+		if err := rows.Scan(&m.OrgID, &m.GUID, &m.Role, &m.JoinedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan member: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	return members, nil
+}
+
+// lockMember locks the organization, so owners can not be changed
+// concurrently, and returns the current role of guid in it.
+func lockMember(ctx context.Context, tx pgx.Tx, realm string, orgID, guid uuid.UUID) (domain.OrgRole, error) {
+	var dummy int
+	query := `SELECT 1 FROM organizations WHERE id = $1 AND realm = $2 FOR UPDATE`
+	if err := tx.QueryRow(ctx, query, orgID, realm).Scan(&dummy); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", domain.ErrNotFound
+		}
+		return "", fmt.Errorf("failed to lock organization: %w", err)
+	}
+
+	query = `SELECT role FROM organization_members WHERE org_id = $1 AND guid = $2`
+	var role domain.OrgRole
+	if err := tx.QueryRow(ctx, query, orgID, guid).Scan(&role); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", domain.ErrNotFound
+		}
+		return "", fmt.Errorf("failed to get member: %w", err)
+	}
+	return role, nil
+}
+
+// checkOtherOwner returns ErrLastOwner if the organization has no owner
+// but guid.
+func checkOtherOwner(ctx context.Context, tx pgx.Tx, orgID, guid uuid.UUID) error {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM organization_members
+			WHERE org_id = $1 AND guid <> $2 AND role = 'owner'
+		)
+	`
+	var exists bool
+	if err := tx.QueryRow(ctx, query, orgID, guid).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to count owners: %w", err)
+	}
+	if !exists {
+		return domain.ErrLastOwner
+	}
+	return nil
+}
+
+func (r *OrganizationRepository) UpdateMemberRole(ctx context.Context, orgID, guid uuid.UUID, role domain.OrgRole) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockMember(ctx, tx, r.realm, orgID, guid)
+	if err != nil {
+		return err
+	}
+	if current == domain.OrgOwner && role != domain.OrgOwner {
+		if err := checkOtherOwner(ctx, tx, orgID, guid); err != nil {
+			return err
+		}
+	}
+
+	query := `UPDATE organization_members SET role = $3 WHERE org_id = $1 AND guid = $2`
+	if _, err := tx.Exec(ctx, query, orgID, guid, role); err != nil {
+		return fmt.Errorf("failed to update member: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit member: %w", err)
+	}
+	return nil
+}
+
+func (r *OrganizationRepository) RemoveMember(ctx context.Context, orgID, guid uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockMember(ctx, tx, r.realm, orgID, guid)
+	if err != nil {
+		return err
+	}
+	if current == domain.OrgOwner {
+		if err := checkOtherOwner(ctx, tx, orgID, guid); err != nil {
+			return err
+		}
+	}
+
+	query := `DELETE FROM organization_members WHERE org_id = $1 AND guid = $2`
+	if _, err := tx.Exec(ctx, query, orgID, guid); err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+	query = `UPDATE refresh_tokens SET org_id = NULL WHERE guid = $2 AND org_id = $1`
+	if _, err := tx.Exec(ctx, query, orgID, guid); err != nil {
+		return fmt.Errorf("failed to clear active organization: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit member: %w", err)
+	}
+	return nil
+}
+
+func (r *OrganizationRepository) StoreInvitation(ctx context.Context, invitation domain.OrgInvitation) error {
+	query := `
+		INSERT INTO organization_invitations (id, token_hash, org_id, email, role, invited_by, created_at, expires_at)
+		SELECT $1, $2, id, $4, $5, $6, $7, $8 FROM organizations WHERE id = $3 AND realm = $9
+	`
+	tag, err := r.db.Exec(ctx, query,
+		invitation.ID, invitation.TokenHash, invitation.OrgID, invitation.Email, invitation.Role,
+		invitation.InvitedBy, invitation.CreatedAt, invitation.ExpiresAt, r.realm,
+	)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to store invitation: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+const invitationColumns = `i.id, i.token_hash, i.org_id, i.email, i.role, i.invited_by, i.created_at, i.expires_at`
+
+func scanInvitation(row pgx.Row) (domain.OrgInvitation, error) {
+	var inv domain.OrgInvitation
+	err := row.Scan(&inv.ID, &inv.TokenHash, &inv.OrgID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.OrgInvitation{}, domain.ErrNotFound
+		}
+		return domain.OrgInvitation{}, fmt.Errorf("failed to scan invitation: %w", err)
+	}
+	return inv, nil
+}
+
+func (r *OrganizationRepository) GetInvitation(ctx context.Context, tokenHash string) (domain.OrgInvitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM organization_invitations i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE i.token_hash = $1 AND i.accepted_at IS NULL AND i.expires_at > NOW() AND o.realm = $2
+	`
+	return scanInvitation(r.db.QueryRow(ctx, query, tokenHash, r.realm))
+}
+
+func (r *OrganizationRepository) ListInvitations(ctx context.Context, orgID uuid.UUID) ([]domain.OrgInvitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM organization_invitations i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE i.org_id = $1 AND i.accepted_at IS NULL AND i.expires_at > NOW() AND o.realm = $2
+		ORDER BY i.created_at
+	`
+	rows, err := r.db.Query(ctx, query, orgID, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invitations: %w", err)
+	}
+	defer rows.Close()
+
+	var invitations []domain.OrgInvitation
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+func (r *OrganizationRepository) DeleteInvitation(ctx context.Context, orgID, id uuid.UUID) error {
+	query := `
+		DELETE FROM organization_invitations i
+		USING organizations o
+		WHERE i.org_id = $1 AND i.id = $2 AND i.accepted_at IS NULL
+			AND o.id = i.org_id AND o.realm = $3
+	`
+	tag, err := r.db.Exec(ctx, query, orgID, id, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to delete invitation: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *OrganizationRepository) AcceptInvitation(ctx context.Context, tokenHash string, guid uuid.UUID, create bool) (domain.OrgInvitation, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return domain.OrgInvitation{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM organization_invitations i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE i.token_hash = $1 AND i.accepted_at IS NULL AND i.expires_at > NOW() AND o.realm = $2
+		FOR UPDATE OF i
+	`
+	inv, err := scanInvitation(tx.QueryRow(ctx, query, tokenHash, r.realm))
+	if err != nil {
+		return domain.OrgInvitation{}, err
+	}
+
+	if create {
+		query = `INSERT INTO users (guid, email, verified_at, realm) VALUES ($1, $2, NOW(), $3)`
+		if _, err := tx.Exec(ctx, query, guid, inv.Email, r.realm); err != nil {
+			if isUniqueViolation(err) {
+				return domain.OrgInvitation{}, domain.ErrAlreadyExists
+			}
+			return domain.OrgInvitation{}, fmt.Errorf("failed to create user: %w", err)
+		}
+	}
+
+	query = `UPDATE organization_invitations SET accepted_at = NOW(), accepted_by = $2 WHERE id = $1`
+	if _, err := tx.Exec(ctx, query, inv.ID, guid); err != nil {
+		return domain.OrgInvitation{}, fmt.Errorf("failed to accept invitation: %w", err)
+	}
+
+	query = `
+		INSERT INTO organization_members (org_id, guid, role)
+		SELECT $1, guid, $3 FROM users WHERE guid = $2 AND realm = $4
+		ON CONFLICT DO NOTHING
+	`
+	if _, err := tx.Exec(ctx, query, inv.OrgID, guid, inv.Role, r.realm); err != nil {
+		return domain.OrgInvitation{}, fmt.Errorf("failed to add member: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return domain.OrgInvitation{}, fmt.Errorf("failed to commit invitation: %w", err)
+	}
+	return inv, nil
+}
@@ -0,0 +1,298 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/audit"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// testDB connects to TEST_DATABASE_URL and migrates it. Tests using it
+// are skipped without one.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	if err := RunMigrations(ctx, db); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+	return db
+}
+
+// testRealms returns the names of two new realms and removes their users,
+// roles and audit entries, with everything that belongs to them, after
+// the test.
+func testRealms(t *testing.T, db *pgxpool.Pool) (string, string) {
+	t.Helper()
+
+	a, b := "test-a-"+uuid.NewString(), "test-b-"+uuid.NewString()
+	t.Cleanup(func() {
+		ctx := context.Background()
+		db.Exec(ctx, `DELETE FROM organizations WHERE realm = ANY($1)`, []string{a, b})
+		db.Exec(ctx, `DELETE FROM users WHERE realm = ANY($1)`, []string{a, b})
+		db.Exec(ctx, `DELETE FROM roles WHERE realm = ANY($1)`, []string{a, b})
+		db.Exec(ctx, `DELETE FROM permissions WHERE realm = ANY($1)`, []string{a, b})
+		db.Exec(ctx, `DELETE FROM audit_log WHERE realm = ANY($1)`, []string{a, b})
+	})
+	return a, b
+}
+
+func createTestUser(t *testing.T, users *UserRepository, username string) uuid.UUID {
+	t.Helper()
+
+	guid := uuid.New()
+	if err := users.CreateUserWithPassword(context.Background(), guid, username, "", "", "hash"); err != nil {
+		t.Fatalf("CreateUserWithPassword: %v", err)
+	}
+	return guid
+}
+
+func TestUserRepositoryKeepsUsersInTheirRealm(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realmA, realmB := testRealms(t, db)
+	usersA, usersB := NewUserRepository(db, realmA), NewUserRepository(db, realmB)
+
+	guid := createTestUser(t, usersA, "alice")
+
+	if _, err := usersB.GetUser(ctx, guid); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B GetUser = %v, want ErrNotFound", err)
+	}
+	if _, err := usersB.GetUserByUsername(ctx, "alice"); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B GetUserByUsername = %v, want ErrNotFound", err)
+	}
+	if exists, err := usersB.UserExists(ctx, guid); err != nil || exists {
+		t.Errorf("realm B UserExists = %v, %v, want false", exists, err)
+	}
+	if err := usersB.UpdatePasswordHash(ctx, guid, "other"); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B UpdatePasswordHash = %v, want ErrNotFound", err)
+	}
+
+	// usernames are unique per realm only
+	createTestUser(t, usersB, "alice")
+	if user, err := usersA.GetUser(ctx, guid); err != nil || user.PasswordHash != "hash" {
+		t.Errorf("realm A GetUser = %+v, %v, want the user unchanged", user, err)
+	}
+}
+
+func TestTokenRepositoryKeepsSessionsInTheirRealm(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realmA, realmB := testRealms(t, db)
+	tokensA, tokensB := NewTokenRepository(db, realmA), NewTokenRepository(db, realmB)
+
+	guid := createTestUser(t, NewUserRepository(db, realmA), "alice")
+	session := domain.RefreshToken{
+		GUID:      guid,
+		TokenHash: "hash",
+		SessionID: uuid.NewString(),
+		AuthTime:  time.Now(),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := tokensA.StoreRefreshToken(ctx, session); err != nil {
+		t.Fatalf("StoreRefreshToken: %v", err)
+	}
+
+	if exists, err := tokensB.SessionExists(ctx, session.SessionID); err != nil || exists {
+		t.Errorf("realm B SessionExists = %v, %v, want false", exists, err)
+	}
+	if _, err := tokensB.GetSession(ctx, session.SessionID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B GetSession = %v, want ErrNotFound", err)
+	}
+	if sessions, err := tokensB.ListSessions(ctx, nil); err != nil || len(sessions) != 0 {
+		t.Errorf("realm B ListSessions = %v, %v, want none", sessions, err)
+	}
+	if _, err := tokensB.DeleteSession(ctx, session.SessionID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B DeleteSession = %v, want ErrNotFound", err)
+	}
+	if err := tokensB.UpdateSessionAuthentication(ctx, session.SessionID, []string{domain.AMRPassword}, time.Now()); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B UpdateSessionAuthentication = %v, want ErrNotFound", err)
+	}
+	if err := tokensB.StoreRefreshToken(ctx, session); err == nil {
+		t.Error("realm B stored a session of a user of realm A")
+	}
+
+	if exists, err := tokensA.SessionExists(ctx, session.SessionID); err != nil || !exists {
+		t.Errorf("realm A SessionExists = %v, %v, want the session kept", exists, err)
+	}
+}
+
+func TestOrganizationRepositoryKeepsOrganizationsInTheirRealm(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realmA, realmB := testRealms(t, db)
+	orgsA, orgsB := NewOrganizationRepository(db, realmA), NewOrganizationRepository(db, realmB)
+
+	owner := createTestUser(t, NewUserRepository(db, realmA), "alice")
+	org := domain.Organization{ID: uuid.New(), Name: "acme", CreatedAt: time.Now()}
+	if err := orgsA.CreateOrganization(ctx, org, owner); err != nil {
+		t.Fatalf("CreateOrganization: %v", err)
+	}
+
+	if _, err := orgsB.GetOrganization(ctx, org.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B GetOrganization = %v, want ErrNotFound", err)
+	}
+	if _, err := orgsB.GetMember(ctx, org.ID, owner); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B GetMember = %v, want ErrNotFound", err)
+	}
+	if orgs, err := orgsB.ListUserOrganizations(ctx, owner); err != nil || len(orgs) != 0 {
+		t.Errorf("realm B ListUserOrganizations = %v, %v, want none", orgs, err)
+	}
+	if err := orgsB.DeleteOrganization(ctx, org.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B DeleteOrganization = %v, want ErrNotFound", err)
+	}
+
+	// a user of realm A can not own an organization of realm B
+	other := domain.Organization{ID: uuid.New(), Name: "other", CreatedAt: time.Now()}
+	if err := orgsB.CreateOrganization(ctx, other, owner); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B CreateOrganization with an owner of realm A = %v, want ErrNotFound", err)
+	}
+
+	if _, err := orgsA.GetOrganization(ctx, org.ID); err != nil {
+		t.Errorf("realm A GetOrganization = %v, want the organization kept", err)
+	}
+}
+
+func TestRoleRepositoryKeepsRolesInTheirRealm(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realmA, realmB := testRealms(t, db)
+	rolesA, rolesB := NewRoleRepository(db, realmA), NewRoleRepository(db, realmB)
+
+	if err := rolesA.CreatePermission(ctx, domain.Permission{Name: "reports:read"}); err != nil {
+		t.Fatalf("CreatePermission: %v", err)
+	}
+	role := domain.Role{Name: "auditor", Permissions: []string{"reports:read"}}
+	if err := rolesA.CreateRole(ctx, role); err != nil {
+		t.Fatalf("CreateRole: %v", err)
+	}
+
+	if _, err := rolesB.GetRole(ctx, role.Name); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B GetRole = %v, want ErrNotFound", err)
+	}
+	if roles, err := rolesB.ListRoles(ctx); err != nil || len(roles) != 0 {
+		t.Errorf("realm B ListRoles = %v, %v, want none", roles, err)
+	}
+	if permissions, err := rolesB.ListPermissions(ctx); err != nil || len(permissions) != 0 {
+		t.Errorf("realm B ListPermissions = %v, %v, want none", permissions, err)
+	}
+	// the permission of realm A is unknown in realm B
+	if err := rolesB.CreateRole(ctx, role); !errors.Is(err, domain.ErrUnknownPermission) {
+		t.Errorf("realm B CreateRole = %v, want ErrUnknownPermission", err)
+	}
+	if err := rolesB.DeleteRole(ctx, role.Name); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B DeleteRole = %v, want ErrNotFound", err)
+	}
+
+	// the same names are free in realm B
+	if err := rolesB.CreatePermission(ctx, domain.Permission{Name: "reports:read"}); err != nil {
+		t.Fatalf("realm B CreatePermission: %v", err)
+	}
+	if err := rolesB.CreateRole(ctx, domain.Role{Name: role.Name}); err != nil {
+		t.Fatalf("realm B CreateRole: %v", err)
+	}
+	if got, err := rolesA.GetRole(ctx, role.Name); err != nil || !slices.Equal(got.Permissions, role.Permissions) {
+		t.Errorf("realm A GetRole = %+v, %v, want its permissions kept", got, err)
+	}
+}
+
+func TestRoleRepositoryKeepsAssignmentsInTheirRealm(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realmA, realmB := testRealms(t, db)
+	rolesA, rolesB := NewRoleRepository(db, realmA), NewRoleRepository(db, realmB)
+
+	role := domain.Role{Name: "member"}
+	if err := rolesA.CreateRole(ctx, role); err != nil {
+		t.Fatalf("CreateRole: %v", err)
+	}
+
+	guid := createTestUser(t, NewUserRepository(db, realmA), "alice")
+
+	if err := rolesB.AssignRole(ctx, guid, role.Name); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B AssignRole = %v, want ErrNotFound", err)
+	}
+	if roles, _, err := rolesA.UserRoles(ctx, guid); err != nil || len(roles) != 0 {
+		t.Fatalf("UserRoles after assigning from realm B = %v, %v, want none", roles, err)
+	}
+
+	if err := rolesA.AssignRole(ctx, guid, role.Name); err != nil {
+		t.Fatalf("AssignRole: %v", err)
+	}
+	// granting it twice is no error
+	if err := rolesA.AssignRole(ctx, guid, role.Name); err != nil {
+		t.Errorf("second AssignRole = %v", err)
+	}
+	if roles, _, err := rolesB.UserRoles(ctx, guid); err != nil || len(roles) != 0 {
+		t.Errorf("realm B UserRoles = %v, %v, want none", roles, err)
+	}
+	if err := rolesB.UnassignRole(ctx, guid, role.Name); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("realm B UnassignRole = %v, want ErrNotFound", err)
+	}
+	if roles, _, err := rolesA.UserRoles(ctx, guid); err != nil || !slices.Contains(roles, role.Name) {
+		t.Errorf("realm A UserRoles = %v, %v, want %s", roles, err, role.Name)
+	}
+
+	if err := rolesA.AssignRole(ctx, guid, "test-unknown-"+uuid.NewString()); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("AssignRole of an unknown role = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAuditRepositoryKeepsAChainPerRealm(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realmA, realmB := testRealms(t, db)
+	auditA, auditB := NewAuditRepository(db, realmA), NewAuditRepository(db, realmB)
+
+	first := domain.AuditEntry{EventType: domain.AuditEventAuthorize, Actor: "test"}
+	if err := auditA.AppendAuditEntry(ctx, &first); err != nil {
+		t.Fatalf("AppendAuditEntry: %v", err)
+	}
+	other := domain.AuditEntry{EventType: domain.AuditEventRefresh, Actor: "test"}
+	if err := auditB.AppendAuditEntry(ctx, &other); err != nil {
+		t.Fatalf("realm B AppendAuditEntry: %v", err)
+	}
+	second := domain.AuditEntry{EventType: domain.AuditEventRevoke, Actor: "test"}
+	if err := auditA.AppendAuditEntry(ctx, &second); err != nil {
+		t.Fatalf("AppendAuditEntry: %v", err)
+	}
+
+	// every realm starts a chain of its own and links past the entries of others
+	if first.PrevHash != "" || other.PrevHash != "" {
+		t.Errorf("first entries link to %q and %q, want new chains", first.PrevHash, other.PrevHash)
+	}
+	if second.PrevHash != first.Hash {
+		t.Errorf("second entry links to %q, want %q", second.PrevHash, first.Hash)
+	}
+
+	entries, err := auditB.ListAuditEntries(ctx, domain.AuditFilter{})
+	if err != nil || len(entries) != 1 || entries[0].ID != other.ID {
+		t.Errorf("realm B ListAuditEntries = %v, %v, want only its own entry", entries, err)
+	}
+	for name, repo := range map[string]*AuditRepository{realmA: auditA, realmB: auditB} {
+		if checked, breaks, err := audit.VerifyChain(ctx, repo); err != nil || len(breaks) != 0 {
+			t.Errorf("VerifyChain of %s = %d, %v, %v, want no breaks", name, checked, breaks, err)
+		}
+	}
+}
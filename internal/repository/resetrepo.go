@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+type PasswordResetRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPasswordResetRepository(db *pgxpool.Pool) *PasswordResetRepository {
+	return &PasswordResetRepository{db: db}
+}
+
+func (r *PasswordResetRepository) StorePasswordResetToken(ctx context.Context, token domain.PasswordResetToken) error {
+	query := `
+		INSERT INTO password_reset_tokens (token_hash, guid, created_at, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := r.db.Exec(ctx, query, token.TokenHash, token.GUID, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to store reset token: %w", err)
+	}
+	return nil
+}
+
+func (r *PasswordResetRepository) GetPasswordResetToken(ctx context.Context, tokenHash string) (domain.PasswordResetToken, error) {
+	query := `
+		SELECT token_hash, guid, created_at, expires_at
+		FROM password_reset_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+	`
+	var token domain.PasswordResetToken
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(&token.TokenHash, &token.GUID, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.PasswordResetToken{}, domain.ErrNotFound
+		}
+		return domain.PasswordResetToken{}, fmt.Errorf("failed to get reset token: %w", err)
+	}
+	return token, nil
+}
+
+func (r *PasswordResetRepository) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (uuid.UUID, error) {
+	query := `
+		UPDATE password_reset_tokens
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING guid
+	`
+	var guid uuid.UUID
+	if err := r.db.QueryRow(ctx, query, tokenHash).Scan(&guid); err != nil {
+		if err == pgx.ErrNoRows {
+			return uuid.Nil, domain.ErrNotFound
+		}
+		return uuid.Nil, fmt.Errorf("failed to consume reset token: %w", err)
+	}
+	return guid, nil
+}
+
+func (r *PasswordResetRepository) DeletePasswordResetTokens(ctx context.Context, guid uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM password_reset_tokens WHERE guid = $1`, guid)
+	if err != nil {
+		return fmt.Errorf("failed to delete reset tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+// RoleRepository manages the roles and permissions of a realm. Roles are
+// only assigned to and read for users of the same realm.
+type RoleRepository struct {
+	db    *pgxpool.Pool
+	realm string
+}
+
+func NewRoleRepository(db *pgxpool.Pool, realm string) *RoleRepository {
+	return &RoleRepository{db: db, realm: realm}
+}
+
+func (r *RoleRepository) CreatePermission(ctx context.Context, permission domain.Permission) error {
+	query := `INSERT INTO permissions (realm, name, description) VALUES ($1, $2, NULLIF($3, ''))`
+	_, err := r.db.Exec(ctx, query, r.realm, permission.Name, permission.Description)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to create permission: %w", err)
+	}
+	return nil
+}
+
+func (r *RoleRepository) ListPermissions(ctx context.Context) ([]domain.Permission, error) {
+	query := `SELECT name, COALESCE(description, ''), created_at FROM permissions WHERE realm = $1 ORDER BY name`
+	rows, err := r.db.Query(ctx, query, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list permissions: %w", err)
+	}
+	defer rows.Close()
+
+	var permissions []domain.Permission
+	for rows.Next() {
+		var p domain.Permission
+		if err := rows.Scan(&p.Name, &p.Description, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan permission: %w", err)
+		}
+		permissions = append(permissions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list permissions: %w", err)
+	}
+	return permissions, nil
+}
+
+func (r *RoleRepository) DeletePermission(ctx context.Context, name string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM permissions WHERE realm = $1 AND name = $2`, r.realm, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete permission: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *RoleRepository) CreateRole(ctx context.Context, role domain.Role) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO roles (realm, name, description) VALUES ($1, $2, NULLIF($3, ''))`
+	if _, err := tx.Exec(ctx, query, r.realm, role.Name, role.Description); err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to create role: %w", err)
+	}
+	if err := r.setRolePermissions(ctx, tx, role); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit role: %w", err)
+	}
+	return nil
+}
+
+func (r *RoleRepository) UpdateRole(ctx context.Context, role domain.Role) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE roles SET description = NULLIF($3, '') WHERE realm = $1 AND name = $2`
+	tag, err := tx.Exec(ctx, query, r.realm, role.Name, role.Description)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM role_permissions WHERE realm = $1 AND role = $2`, r.realm, role.Name); err != nil {
+		return fmt.Errorf("failed to update role permissions: %w", err)
+	}
+	if err := r.setRolePermissions(ctx, tx, role); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit role: %w", err)
+	}
+	return nil
+}
+
+func (r *RoleRepository) setRolePermissions(ctx context.Context, tx pgx.Tx, role domain.Role) error {
+	query := `
+		INSERT INTO role_permissions (realm, role, permission)
+		SELECT $1, $2, unnest($3::text[])
+		ON CONFLICT DO NOTHING
+	`
+	if _, err := tx.Exec(ctx, query, r.realm, role.Name, role.Permissions); err != nil {
+		if isForeignKeyViolation(err) {
+			return domain.ErrUnknownPermission
+		}
+		return fmt.Errorf("failed to set role permissions: %w", err)
+	}
+	return nil
+}
+
+const roleQuery = `
+	SELECT r.name, COALESCE(r.description, ''),
+		COALESCE(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}'),
+		r.created_at
+	FROM roles r
+	LEFT JOIN role_permissions rp ON rp.realm = r.realm AND rp.role = r.name
+`
+
+func scanRole(row pgx.Row) (domain.Role, error) {
+	var role domain.Role
+	err := row.Scan(&role.Name, &role.Description, &role.Permissions, &role.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.Role{}, domain.ErrNotFound
+		}
+		return domain.Role{}, fmt.Errorf("failed to scan role: %w", err)
+	}
+	return role, nil
+}
+
+func (r *RoleRepository) GetRole(ctx context.Context, name string) (domain.Role, error) {
+	query := roleQuery + ` WHERE r.realm = $1 AND r.name = $2 GROUP BY r.realm, r.name`
+	return scanRole(r.db.QueryRow(ctx, query, r.realm, name))
+}
+
+func (r *RoleRepository) ListRoles(ctx context.Context) ([]domain.Role, error) {
+	query := roleQuery + ` WHERE r.realm = $1 GROUP BY r.realm, r.name ORDER BY r.name`
+	rows, err := r.db.Query(ctx, query, r.realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	defer rows.Close()
+
+	var roles []domain.Role
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	return roles, nil
+}
+
+func (r *RoleRepository) DeleteRole(ctx context.Context, name string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM roles WHERE realm = $1 AND name = $2`, r.realm, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *RoleRepository) AssignRole(ctx context.Context, guid uuid.UUID, role string) error {
+	// counts the user rather than the inserted rows, a role granted
+	// already inserts none
+	query := `
+		WITH target AS (
+			SELECT guid FROM users WHERE guid = $1 AND realm = $3
+		), assigned AS (
+			INSERT INTO user_roles (guid, role, realm) SELECT guid, $2, $3 FROM target
+			ON CONFLICT DO NOTHING
+		)
+		SELECT count(*) FROM target
+	`
+	var users int
+	if err := r.db.QueryRow(ctx, query, guid, role, r.realm).Scan(&users); err != nil {
+		if isForeignKeyViolation(err) {
+			return domain.ErrNotFound
+		}
+		return fmt.Errorf("failed to assign role: %w", err)
+	}
+	if users == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *RoleRepository) UnassignRole(ctx context.Context, guid uuid.UUID, role string) error {
+	query := `DELETE FROM user_roles WHERE guid = $1 AND role = $2 AND realm = $3`
+	tag, err := r.db.Exec(ctx, query, guid, role, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to unassign role: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *RoleRepository) UserRoles(ctx context.Context, guid uuid.UUID) ([]string, []string, error) {
+	query := `
+		SELECT
+			COALESCE(array_agg(DISTINCT ur.role ORDER BY ur.role), '{}'),
+			COALESCE(array_agg(DISTINCT rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM user_roles ur
+		LEFT JOIN role_permissions rp ON rp.realm = ur.realm AND rp.role = ur.role
+		WHERE ur.guid = $1 AND ur.realm = $2
+	`
+	var roles, permissions []string
+	if err := r.db.QueryRow(ctx, query, guid, r.realm).Scan(&roles, &permissions); err != nil {
+		return nil, nil, fmt.Errorf("failed to get user roles: %w", err)
+	}
+	return roles, permissions, nil
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -10,66 +11,97 @@ import (
 	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
 )
 
+// TokenRepository only sees the sessions of its realm.
 type TokenRepository struct {
-	db *pgxpool.Pool
+	db    *pgxpool.Pool
+	realm string
 }
 
-func NewTokenRepository(db *pgxpool.Pool) *TokenRepository {
-	return &TokenRepository{db: db}
+func NewTokenRepository(db *pgxpool.Pool, realm string) *TokenRepository {
+	return &TokenRepository{db: db, realm: realm}
 }
 
+// StoreRefreshToken replaces the session of the user without a client,
+// sessions of a client are only replaced if they keep their ID.
 func (r *TokenRepository) StoreRefreshToken(ctx context.Context, token domain.RefreshToken) error {
+	conflict := `ON CONFLICT (guid) WHERE client_id IS NULL DO UPDATE`
+	if token.ClientID != "" {
+		conflict = `ON CONFLICT (session_id) DO UPDATE`
+	}
 	query := `
 
 		INSERT INTO refresh_tokens
-		(guid, token_hash, session_id, user_agent, ip_address, created_at, expires_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT (guid) DO UPDATE
+		(guid, token_hash, session_id, user_agent, ip_address, amr, auth_time, scope, org_id, client_id, created_at, expires_at, realm)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, $12, $13)
+		` + conflict + `
 		SET token_hash = EXCLUDED.token_hash,
 			session_id = EXCLUDED.session_id,
 			user_agent = EXCLUDED.user_agent,
 			ip_address = EXCLUDED.ip_address,
+			amr = EXCLUDED.amr,
+			auth_time = EXCLUDED.auth_time,
+			scope = EXCLUDED.scope,
+			org_id = EXCLUDED.org_id,
+			client_id = EXCLUDED.client_id,
 			created_at = EXCLUDED.created_at,
 			expires_at = EXCLUDED.expires_at
+		WHERE refresh_tokens.realm = EXCLUDED.realm AND refresh_tokens.guid = EXCLUDED.guid
 `
-	_, err := r.db.Exec(ctx, query, token.GUID, token.TokenHash, token.SessionID, token.UserAgent, token.IP, token.CreatedAt, token.ExpiresAt)
+	amr := token.AMR
+	if amr == nil {
+		amr = []string{}
+	}
+	tag, err := r.db.Exec(ctx, query, token.GUID, token.TokenHash, token.SessionID, token.UserAgent, token.IP, amr, token.AuthTime, token.Scope, token.OrgID, token.ClientID, token.CreatedAt, token.ExpiresAt, r.realm)
 	if err != nil {
 		return fmt.Errorf("failed to store token: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
 	return nil
 }
 
-func (r *TokenRepository) GetRefreshToken(ctx context.Context, guid uuid.UUID) (domain.RefreshToken, error) {
+func (r *TokenRepository) GetSession(ctx context.Context, sessionID string) (domain.RefreshToken, error) {
 	query := `
-			SELECT token_hash, session_id, user_agent, ip_address, created_at, expires_at
+			SELECT guid, token_hash, user_agent, ip_address, amr, auth_time, scope, org_id, COALESCE(client_id, ''), created_at, expires_at
 			FROM refresh_tokens
-			WHERE guid = $1
+			WHERE session_id = $1 AND realm = $2
 		`
-	row := r.db.QueryRow(ctx, query, guid)
+	row := r.db.QueryRow(ctx, query, sessionID, r.realm)
 
 	var token domain.RefreshToken
-	token.GUID = guid
+	token.SessionID = sessionID
 
-	if err := row.Scan(&token.TokenHash, &token.SessionID, &token.UserAgent, &token.IP, &token.CreatedAt, &token.ExpiresAt); err != nil {
-		return domain.RefreshToken{}, err
+	if err := row.Scan(&token.GUID, &token.TokenHash, &token.UserAgent, &token.IP, &token.AMR, &token.AuthTime, &token.Scope, &token.OrgID, &token.ClientID, &token.CreatedAt, &token.ExpiresAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.RefreshToken{}, domain.ErrNotFound
+		}
+		return domain.RefreshToken{}, fmt.Errorf("failed to get session: %w", err)
 	}
 
 	return token, nil
 }
 
-func (r *TokenRepository) DeleteRefreshToken(ctx context.Context, guid uuid.UUID) error {
+func (r *TokenRepository) DeleteUserSessions(ctx context.Context, guid uuid.UUID) error {
 	query := `
 			DELETE FROM refresh_tokens
-			WHERE guid = $1
+			WHERE guid = $1 AND realm = $2
 		`
 
-	_, err := r.db.Exec(ctx, query, guid)
+	_, err := r.db.Exec(ctx, query, guid, r.realm)
 	return err
 }
 
 func (r *TokenRepository) SessionExists(ctx context.Context, sessionID string) (bool, error) {
-	query := `SELECT 1 FROM refresh_tokens WHERE session_id = $1 LIMIT 1`
-	row := r.db.QueryRow(ctx, query, sessionID)
+	query := `
+		SELECT 1 FROM refresh_tokens t
+		JOIN users u ON u.guid = t.guid
+		WHERE t.session_id = $1
+			AND t.realm = $2
+			AND (u.status = 'active' OR (u.status = 'locked' AND u.locked_until <= NOW()))
+		LIMIT 1
+	`
+	row := r.db.QueryRow(ctx, query, sessionID, r.realm)
 
 	var dummy int
 	err := row.Scan(&dummy)
@@ -82,3 +114,67 @@ func (r *TokenRepository) SessionExists(ctx context.Context, sessionID string) (
 
 	return true, nil
 }
+
+func (r *TokenRepository) ListSessions(ctx context.Context, guid *uuid.UUID) ([]domain.RefreshToken, error) {
+	query := `
+			SELECT guid, token_hash, session_id, user_agent, ip_address, amr, auth_time, scope, org_id, COALESCE(client_id, ''), created_at, expires_at
+			FROM refresh_tokens
+			WHERE realm = $1
+		`
+	args := []any{r.realm}
+	if guid != nil {
+		query += ` AND guid = $2`
+		args = append(args, *guid)
+	}
+	query += ` ORDER BY created_at DESC`
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []domain.RefreshToken
+	for rows.Next() {
+		var token domain.RefreshToken
+		if err := rows.Scan(&token.GUID, &token.TokenHash, &token.SessionID, &token.UserAgent, &token.IP, &token.AMR, &token.AuthTime, &token.Scope, &token.OrgID, &token.ClientID, &token.CreatedAt, &token.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, token)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *TokenRepository) UpdateSessionAuthentication(ctx context.Context, sessionID string, amr []string, authTime time.Time) error {
+	query := `
+			UPDATE refresh_tokens
+			SET amr = $2, auth_time = $3
+			WHERE session_id = $1 AND realm = $4
+		`
+
+	tag, err := r.db.Exec(ctx, query, sessionID, amr, authTime, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *TokenRepository) DeleteSession(ctx context.Context, sessionID string) (uuid.UUID, error) {
+	query := `
+			DELETE FROM refresh_tokens
+			WHERE session_id = $1 AND realm = $2
+			RETURNING guid
+		`
+
+	var guid uuid.UUID
+	if err := r.db.QueryRow(ctx, query, sessionID, r.realm).Scan(&guid); err != nil {
+		if err == pgx.ErrNoRows {
+			return uuid.Nil, domain.ErrNotFound
+		}
+		return uuid.Nil, fmt.Errorf("failed to delete session: %w", err)
+	}
+	return guid, nil
+}
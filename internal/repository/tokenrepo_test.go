@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+func testSession(guid uuid.UUID, clientID string) domain.RefreshToken {
+	return domain.RefreshToken{
+		GUID:      guid,
+		TokenHash: "hash",
+		SessionID: uuid.NewString(),
+		ClientID:  clientID,
+		AuthTime:  time.Now(),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+}
+
+func TestTokenRepositoryKeepsClientSessionsApart(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	realm, _ := testRealms(t, db)
+	tokens := NewTokenRepository(db, realm)
+
+	client := domain.OAuthClient{
+		ID:         "test-" + uuid.NewString(),
+		Name:       "test",
+		AuthMethod: domain.ClientAuthNone,
+		GrantTypes: []string{domain.GrantAuthorizationCode},
+		CreatedAt:  time.Now(),
+	}
+	clients := NewOAuthClientRepository(db, realm)
+	if err := clients.CreateClient(ctx, client); err != nil {
+		t.Fatalf("CreateClient: %v", err)
+	}
+	t.Cleanup(func() { clients.DeleteClient(context.Background(), client.ID) })
+
+	guid := createTestUser(t, NewUserRepository(db, realm), "alice")
+	own, granted := testSession(guid, ""), testSession(guid, client.ID)
+	for _, session := range []domain.RefreshToken{own, granted} {
+		if err := tokens.StoreRefreshToken(ctx, session); err != nil {
+			t.Fatalf("StoreRefreshToken: %v", err)
+		}
+	}
+
+	if stored, err := tokens.GetSession(ctx, own.SessionID); err != nil || stored.GUID != guid || stored.ClientID != "" {
+		t.Errorf("GetSession of the own session = %+v, %v", stored, err)
+	}
+	if stored, err := tokens.GetSession(ctx, granted.SessionID); err != nil || stored.ClientID != client.ID {
+		t.Errorf("GetSession of the client session = %+v, %v", stored, err)
+	}
+
+	// rotating the own session replaces it and keeps the client session
+	rotated := testSession(guid, "")
+	if err := tokens.StoreRefreshToken(ctx, rotated); err != nil {
+		t.Fatalf("StoreRefreshToken: %v", err)
+	}
+	if _, err := tokens.GetSession(ctx, own.SessionID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("GetSession of the rotated session = %v, want ErrNotFound", err)
+	}
+	if sessions, err := tokens.ListSessions(ctx, &guid); err != nil || len(sessions) != 2 {
+		t.Errorf("ListSessions = %v, %v, want the own and the client session", sessions, err)
+	}
+
+	if _, err := tokens.DeleteSession(ctx, granted.SessionID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if _, err := tokens.GetSession(ctx, rotated.SessionID); err != nil {
+		t.Errorf("GetSession after ending the client session = %v, want the own session kept", err)
+	}
+
+	if err := tokens.DeleteUserSessions(ctx, guid); err != nil {
+		t.Fatalf("DeleteUserSessions: %v", err)
+	}
+	if sessions, err := tokens.ListSessions(ctx, &guid); err != nil || len(sessions) != 0 {
+		t.Errorf("ListSessions after DeleteUserSessions = %v, %v, want none", sessions, err)
+	}
+}
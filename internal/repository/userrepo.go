@@ -3,24 +3,28 @@ package repository
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
 )
 
+// UserRepository only sees the users of its realm.
 type UserRepository struct {
-	db *pgxpool.Pool
+	db    *pgxpool.Pool
+	realm string
 }
 
-func NewUserRepository(db *pgxpool.Pool) *UserRepository {
-	return &UserRepository{db: db}
+func NewUserRepository(db *pgxpool.Pool, realm string) *UserRepository {
+	return &UserRepository{db: db, realm: realm}
 }
 
 func (r *UserRepository) UserExists(ctx context.Context, guid uuid.UUID) (bool, error) {
-	const query = `SELECT 1 FROM users WHERE guid = $1 LIMIT 1`
+	const query = `SELECT 1 FROM users WHERE guid = $1 AND realm = $2 LIMIT 1`
 	var dummy int
-	err := r.db.QueryRow(ctx, query, guid).Scan(&dummy)
+	err := r.db.QueryRow(ctx, query, guid, r.realm).Scan(&dummy)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return false, nil
@@ -30,11 +34,206 @@ func (r *UserRepository) UserExists(ctx context.Context, guid uuid.UUID) (bool,
 	return true, nil
 }
 
-func (r *UserRepository) CreateUser(ctx context.Context, guid uuid.UUID) error {
-	const query = `INSERT INTO users (guid) VALUES ($1)`
-	_, err := r.db.Exec(ctx, query, guid)
+func (r *UserRepository) CreateUser(ctx context.Context, guid uuid.UUID, guest bool) error {
+	const query = `INSERT INTO users (guid, guest, realm) VALUES ($1, $2, $3)`
+	_, err := r.db.Exec(ctx, query, guid, guest, r.realm)
 	if err != nil {
 		return fmt.Errorf("failed to create user: %w", err)
 	}
 	return nil
 }
+
+func (r *UserRepository) GetUser(ctx context.Context, guid uuid.UUID) (domain.User, error) {
+	const query = `SELECT ` + userColumns + ` FROM users WHERE guid = $1 AND realm = $2`
+	return scanUser(r.db.QueryRow(ctx, query, guid, r.realm))
+}
+
+func (r *UserRepository) GetUserByUsername(ctx context.Context, username string) (domain.User, error) {
+	const query = `SELECT ` + userColumns + ` FROM users WHERE lower(username) = lower($1) AND realm = $2`
+	return scanUser(r.db.QueryRow(ctx, query, username, r.realm))
+}
+
+func (r *UserRepository) GetUserByEmail(ctx context.Context, email string) (domain.User, error) {
+	const query = `SELECT ` + userColumns + ` FROM users WHERE lower(email) = lower($1) AND realm = $2`
+	return scanUser(r.db.QueryRow(ctx, query, email, r.realm))
+}
+
+func (r *UserRepository) CreateUserWithPassword(ctx context.Context, guid uuid.UUID, username, email, displayName, passwordHash string) error {
+	const query = `
+		INSERT INTO users (guid, username, email, display_name, password_hash, realm)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6)
+	`
+	_, err := r.db.Exec(ctx, query, guid, username, email, displayName, passwordHash, r.realm)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) UpdatePasswordHash(ctx context.Context, guid uuid.UUID, passwordHash string) error {
+	const query = `UPDATE users SET password_hash = $2, updated_at = NOW() WHERE guid = $1 AND realm = $3`
+	tag, err := r.db.Exec(ctx, query, guid, passwordHash, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *UserRepository) UpdateProfile(ctx context.Context, guid uuid.UUID, displayName, email string) error {
+	const query = `
+		UPDATE users
+		SET display_name = NULLIF($2, ''),
+			email = NULLIF($3, ''),
+			verified_at = CASE WHEN lower(email) = lower($3) THEN verified_at END,
+			updated_at = NOW()
+		WHERE guid = $1 AND realm = $4
+	`
+	tag, err := r.db.Exec(ctx, query, guid, displayName, email, r.realm)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *UserRepository) UpgradeGuest(ctx context.Context, guid uuid.UUID, username, email, displayName, passwordHash string) error {
+	const query = `
+		UPDATE users
+		SET username = COALESCE(NULLIF($2, ''), username),
+			email = COALESCE(NULLIF($3, ''), email),
+			display_name = COALESCE(NULLIF($4, ''), display_name),
+			password_hash = COALESCE(NULLIF($5, ''), password_hash),
+			guest = FALSE,
+			updated_at = NOW()
+		WHERE guid = $1 AND realm = $6 AND guest
+	`
+	tag, err := r.db.Exec(ctx, query, guid, username, email, displayName, passwordHash, r.realm)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to upgrade guest: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// PurgeGuests relies on the cascade to remove the sessions and everything
+// else that belongs to the deleted guests.
+func (r *UserRepository) PurgeGuests(ctx context.Context, inactiveSince time.Time) (int64, error) {
+	const query = `
+		DELETE FROM users u
+		WHERE u.guest
+			AND u.realm = $2
+			AND u.created_at < $1
+			AND NOT EXISTS (
+				SELECT 1 FROM refresh_tokens t WHERE t.guid = u.guid AND t.created_at >= $1
+			)
+	`
+	tag, err := r.db.Exec(ctx, query, inactiveSince, r.realm)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge guests: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (r *UserRepository) MarkEmailVerified(ctx context.Context, guid uuid.UUID, email string) error {
+	const query = `
+		UPDATE users
+		SET verified_at = COALESCE(verified_at, NOW()), updated_at = NOW()
+		WHERE guid = $1 AND realm = $3 AND lower(email) = lower($2)
+	`
+	tag, err := r.db.Exec(ctx, query, guid, email, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+const userColumns = `
+	guid, COALESCE(username, ''), COALESCE(email, ''), COALESCE(display_name, ''), COALESCE(password_hash, ''),
+	guest, status, COALESCE(status_reason, ''), status_changed_at, locked_until,
+	created_at, updated_at, verified_at
+`
+
+func scanUser(row pgx.Row) (domain.User, error) {
+	var user domain.User
+	err := row.Scan(
+		&user.GUID, &user.Username, &user.Email, &user.DisplayName, &user.PasswordHash,
+		&user.Guest, &user.Status, &user.StatusReason, &user.StatusChangedAt, &user.LockedUntil,
+		&user.CreatedAt, &user.UpdatedAt, &user.VerifiedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.User{}, domain.ErrNotFound
+		}
+		return domain.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return user, nil
+}
+
+func (r *UserRepository) SetUserStatus(ctx context.Context, guid uuid.UUID, status domain.UserStatus, reason string, lockedUntil *time.Time) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if status != domain.UserLocked {
+		lockedUntil = nil
+	}
+
+	const update = `
+		UPDATE users
+		SET status = $2,
+			status_reason = NULLIF($3, ''),
+			status_changed_at = NOW(),
+			locked_until = $4,
+			updated_at = NOW()
+		WHERE guid = $1 AND realm = $5
+	`
+	tag, err := tx.Exec(ctx, update, guid, status, reason, lockedUntil, r.realm)
+	if err != nil {
+		return fmt.Errorf("failed to set user status: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+
+	if status != domain.UserActive {
+		if _, err := tx.Exec(ctx, `DELETE FROM refresh_tokens WHERE guid = $1`, guid); err != nil {
+			return fmt.Errorf("failed to revoke sessions: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit user status: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeletedUsers relies on the cascade like PurgeGuests.
+func (r *UserRepository) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	const query = `DELETE FROM users WHERE status = 'deleted' AND status_changed_at < $1 AND realm = $2`
+	tag, err := r.db.Exec(ctx, query, deletedBefore, r.realm)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+type EmailVerificationRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewEmailVerificationRepository(db *pgxpool.Pool) *EmailVerificationRepository {
+	return &EmailVerificationRepository{db: db}
+}
+
+func (r *EmailVerificationRepository) StoreEmailVerification(ctx context.Context, v domain.EmailVerification) error {
+	query := `
+		INSERT INTO email_verifications (guid, email, code_hash, attempts, created_at, expires_at)
+		VALUES ($1, $2, $3, 0, $4, $5)
+		ON CONFLICT (guid) DO UPDATE
+		SET email = EXCLUDED.email,
+			code_hash = EXCLUDED.code_hash,
+			attempts = 0,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+	`
+	_, err := r.db.Exec(ctx, query, v.GUID, v.Email, v.CodeHash, v.CreatedAt, v.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to store email verification: %w", err)
+	}
+	return nil
+}
+
+func (r *EmailVerificationRepository) AttemptEmailVerification(ctx context.Context, guid uuid.UUID, maxAttempts int) (domain.EmailVerification, error) {
+	query := `
+		UPDATE email_verifications
+		SET attempts = attempts + 1
+		WHERE guid = $1 AND attempts < $2 AND expires_at > NOW()
+		RETURNING guid, email, code_hash, attempts, created_at, expires_at
+	`
+	var v domain.EmailVerification
+	err := r.db.QueryRow(ctx, query, guid, maxAttempts).Scan(&v.GUID, &v.Email, &v.CodeHash, &v.Attempts, &v.CreatedAt, &v.ExpiresAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.EmailVerification{}, domain.ErrNotFound
+		}
+		return domain.EmailVerification{}, fmt.Errorf("failed to get email verification: %w", err)
+	}
+	return v, nil
+}
+
+func (r *EmailVerificationRepository) DeleteEmailVerification(ctx context.Context, guid uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM email_verifications WHERE guid = $1`, guid)
+	if err != nil {
+		return fmt.Errorf("failed to delete email verification: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nerfthisdev/go-backend-test-task/internal/domain"
+)
+
+type WebAuthnRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewWebAuthnRepository(db *pgxpool.Pool) *WebAuthnRepository {
+	return &WebAuthnRepository{db: db}
+}
+
+func (r *WebAuthnRepository) StoreCredential(ctx context.Context, cred domain.WebAuthnCredential) error {
+	query := `
+		INSERT INTO webauthn_credentials
+			(id, guid, name, public_key, attestation_type, aaguid, sign_count, transports, backup_eligible, backup_state, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+	_, err := r.db.Exec(ctx, query,
+		cred.ID, cred.GUID, cred.Name, cred.PublicKey, cred.AttestationType, cred.AAGUID,
+		int64(cred.SignCount), cred.Transports, cred.BackupEligible, cred.BackupState, cred.CreatedAt,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return domain.ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to store webauthn credential: %w", err)
+	}
+	return nil
+}
+
+func (r *WebAuthnRepository) ListCredentials(ctx context.Context, guid uuid.UUID) ([]domain.WebAuthnCredential, error) {
+	query := `
+		SELECT id, guid, name, public_key, attestation_type, aaguid, sign_count, transports,
+			backup_eligible, backup_state, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE guid = $1
+		ORDER BY created_at
+	`
+	rows, err := r.db.Query(ctx, query, guid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webauthn credentials: %w", err)
+	}
+	defer rows.Close()
+
+	var creds []domain.WebAuthnCredential
+	for rows.Next() {
+		var (
+			cred      domain.WebAuthnCredential
+			signCount int64
+		)
+		err := rows.Scan(
+			&cred.ID, &cred.GUID, &cred.Name, &cred.PublicKey, &cred.AttestationType, &cred.AAGUID, &signCount,
+			&cred.Transports, &cred.BackupEligible, &cred.BackupState, &cred.CreatedAt, &cred.LastUsedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webauthn credential: %w", err)
+		}
+		cred.SignCount = uint32(signCount)
+		creds = append(creds, cred)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webauthn credentials: %w", err)
+	}
+	return creds, nil
+}
+
+func (r *WebAuthnRepository) UseCredential(ctx context.Context, id []byte, signCount uint32, backupState bool) error {
+	// the counter check is repeated here so that two concurrent logins with
+	// the same assertion can not both pass
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = $2, backup_state = $3, last_used_at = NOW()
+		WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))
+	`
+	tag, err := r.db.Exec(ctx, query, id, int64(signCount), backupState)
+	if err != nil {
+		return fmt.Errorf("failed to update webauthn credential: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *WebAuthnRepository) DeleteCredential(ctx context.Context, guid uuid.UUID, id []byte) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM webauthn_credentials WHERE guid = $1 AND id = $2`, guid, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webauthn credential: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+func (r *WebAuthnRepository) StoreCeremony(ctx context.Context, ceremony domain.WebAuthnCeremony) error {
+	// expired ceremonies are never consumed, they are cleaned up here
+	if _, err := r.db.Exec(ctx, `DELETE FROM webauthn_ceremonies WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("failed to delete expired webauthn ceremonies: %w", err)
+	}
+
+	query := `
+		INSERT INTO webauthn_ceremonies (challenge, kind, guid, session_data, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := r.db.Exec(ctx, query,
+		ceremony.Challenge, string(ceremony.Kind), ceremony.GUID, string(ceremony.SessionData), ceremony.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store webauthn ceremony: %w", err)
+	}
+	return nil
+}
+
+func (r *WebAuthnRepository) ConsumeCeremony(ctx context.Context, challenge string, kind domain.WebAuthnCeremonyKind) (domain.WebAuthnCeremony, error) {
+	query := `
+		DELETE FROM webauthn_ceremonies
+		WHERE challenge = $1 AND kind = $2 AND expires_at > NOW()
+		RETURNING challenge, kind, guid, session_data::text, expires_at
+	`
+	var (
+		ceremony    domain.WebAuthnCeremony
+		sessionData string
+	)
+	err := r.db.QueryRow(ctx, query, challenge, string(kind)).Scan(
+		&ceremony.Challenge, &ceremony.Kind, &ceremony.GUID, &sessionData, &ceremony.ExpiresAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return domain.WebAuthnCeremony{}, domain.ErrNotFound
+		}
+		return domain.WebAuthnCeremony{}, fmt.Errorf("failed to consume webauthn ceremony: %w", err)
+	}
+	ceremony.SessionData = []byte(sessionData)
+	return ceremony, nil
+}
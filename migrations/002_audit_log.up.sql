@@ -0,0 +1,18 @@
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    guid UUID,
+
+    event_type TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    ip_address TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    details TEXT NOT NULL,
+
+    created_at TIMESTAMPTZ NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+
+CREATE INDEX audit_log_guid_idx ON audit_log (guid, id);
+CREATE INDEX audit_log_event_type_idx ON audit_log (event_type, id);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
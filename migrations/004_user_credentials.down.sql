@@ -0,0 +1,5 @@
+DROP INDEX users_username_idx;
+
+ALTER TABLE users
+    DROP COLUMN username,
+    DROP COLUMN password_hash;
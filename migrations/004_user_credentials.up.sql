@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD COLUMN username TEXT,
+    ADD COLUMN password_hash TEXT;
+
+CREATE UNIQUE INDEX users_username_idx ON users (lower(username));
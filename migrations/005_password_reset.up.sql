@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN email TEXT;
+
+CREATE UNIQUE INDEX users_email_idx ON users (lower(email));
+
+CREATE TABLE password_reset_tokens (
+    token_hash TEXT PRIMARY KEY,
+    guid UUID NOT NULL REFERENCES users(guid) ON DELETE CASCADE,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX password_reset_tokens_guid_idx ON password_reset_tokens (guid);
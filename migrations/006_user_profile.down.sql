@@ -0,0 +1,7 @@
+DROP TABLE email_verifications;
+
+ALTER TABLE users
+    DROP COLUMN display_name,
+    DROP COLUMN created_at,
+    DROP COLUMN updated_at,
+    DROP COLUMN verified_at;
@@ -0,0 +1,15 @@
+ALTER TABLE users
+    ADD COLUMN display_name TEXT,
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN verified_at TIMESTAMPTZ;
+
+CREATE TABLE email_verifications (
+    guid UUID PRIMARY KEY REFERENCES users(guid) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
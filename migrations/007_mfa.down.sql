@@ -0,0 +1,4 @@
+DROP TABLE recovery_codes;
+DROP TABLE totp_credentials;
+
+ALTER TABLE refresh_tokens DROP COLUMN amr;
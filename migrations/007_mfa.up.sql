@@ -0,0 +1,20 @@
+ALTER TABLE refresh_tokens ADD COLUMN amr TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE TABLE totp_credentials (
+    guid UUID PRIMARY KEY REFERENCES users(guid) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    -- last_used_step is the last accepted time step, codes can not be replayed
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    failed_attempts INT NOT NULL DEFAULT 0,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    confirmed_at TIMESTAMPTZ
+);
+
+CREATE TABLE recovery_codes (
+    guid UUID NOT NULL REFERENCES users(guid) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+
+    PRIMARY KEY (guid, code_hash)
+);
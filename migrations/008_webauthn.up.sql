@@ -0,0 +1,27 @@
+CREATE TABLE webauthn_credentials (
+    id BYTEA PRIMARY KEY,
+    guid UUID NOT NULL REFERENCES users(guid) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    public_key BYTEA NOT NULL,
+    attestation_type TEXT NOT NULL,
+    aaguid BYTEA,
+    -- sign_count only grows, a lower value points to a cloned authenticator
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    backup_state BOOLEAN NOT NULL DEFAULT FALSE,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_webauthn_credentials_guid ON webauthn_credentials (guid);
+
+-- pending registration and login ceremonies, keyed by their challenge
+CREATE TABLE webauthn_ceremonies (
+    challenge TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    guid UUID REFERENCES users(guid) ON DELETE CASCADE,
+    session_data JSONB NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
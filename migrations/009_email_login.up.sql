@@ -0,0 +1,13 @@
+-- a pending passwordless login, a user has at most one
+CREATE TABLE email_logins (
+    guid UUID PRIMARY KEY REFERENCES users(guid) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    code_hash TEXT NOT NULL,
+    -- the login can only be completed from the user agent that requested it
+    user_agent TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
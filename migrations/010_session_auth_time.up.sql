@@ -0,0 +1,3 @@
+-- auth_time is when the user last authenticated actively, refreshing the
+-- session keeps it
+ALTER TABLE refresh_tokens ADD COLUMN auth_time TIMESTAMPTZ NOT NULL DEFAULT NOW();
@@ -0,0 +1,2 @@
+DROP INDEX users_guest_created_at_idx;
+ALTER TABLE users DROP COLUMN guest;
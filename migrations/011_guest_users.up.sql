@@ -0,0 +1,11 @@
+-- guests are users created anonymously through /auth, they become
+-- registered once they attach a username, an email or a passkey
+ALTER TABLE users ADD COLUMN guest BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE users u SET guest = TRUE
+WHERE u.username IS NULL
+    AND u.email IS NULL
+    AND u.password_hash IS NULL
+    AND NOT EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.guid = u.guid);
+
+CREATE INDEX users_guest_created_at_idx ON users (created_at) WHERE guest;
@@ -0,0 +1,10 @@
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMPTZ;
+
+UPDATE users SET disabled_at = COALESCE(status_changed_at, NOW()) WHERE status <> 'active';
+
+DROP INDEX users_deleted_idx;
+ALTER TABLE users
+    DROP COLUMN status,
+    DROP COLUMN status_reason,
+    DROP COLUMN status_changed_at,
+    DROP COLUMN locked_until;
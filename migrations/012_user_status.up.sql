@@ -0,0 +1,14 @@
+-- status replaces disabled_at. Locked users become active again once
+-- locked_until has passed, deleted users are purged after the retention.
+ALTER TABLE users
+    ADD COLUMN status TEXT NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'disabled', 'locked', 'deleted')),
+    ADD COLUMN status_reason TEXT,
+    ADD COLUMN status_changed_at TIMESTAMPTZ,
+    ADD COLUMN locked_until TIMESTAMPTZ;
+
+UPDATE users SET status = 'disabled', status_changed_at = disabled_at WHERE disabled_at IS NOT NULL;
+
+ALTER TABLE users DROP COLUMN disabled_at;
+
+CREATE INDEX users_deleted_idx ON users (status_changed_at) WHERE status = 'deleted';
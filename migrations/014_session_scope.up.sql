@@ -0,0 +1,3 @@
+-- the scope a session was narrowed to, NULL grants every scope the user
+-- is allowed at the time a token is issued
+ALTER TABLE refresh_tokens ADD COLUMN scope TEXT[];
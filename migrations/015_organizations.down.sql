@@ -0,0 +1,5 @@
+ALTER TABLE refresh_tokens DROP COLUMN org_id;
+
+DROP TABLE organization_invitations;
+DROP TABLE organization_members;
+DROP TABLE organizations;
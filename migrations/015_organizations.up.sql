@@ -0,0 +1,34 @@
+CREATE TABLE organizations (
+    id UUID PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE organization_members (
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    guid UUID NOT NULL REFERENCES users(guid) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (org_id, guid)
+);
+
+CREATE INDEX organization_members_guid_idx ON organization_members (guid);
+
+CREATE TABLE organization_invitations (
+    id UUID PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    invited_by UUID REFERENCES users(guid) ON DELETE SET NULL,
+
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ,
+    accepted_by UUID REFERENCES users(guid) ON DELETE SET NULL
+);
+
+CREATE INDEX organization_invitations_org_idx ON organization_invitations (org_id);
+
+-- the active organization of the session, dropped with the organization
+ALTER TABLE refresh_tokens ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
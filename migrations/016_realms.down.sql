@@ -0,0 +1,47 @@
+-- entries of other realms stay, the merged chain no longer verifies
+DROP INDEX audit_log_realm_idx;
+ALTER TABLE audit_log DROP COLUMN realm;
+
+-- only the roles and permissions of the default realm are kept
+DELETE FROM user_roles WHERE realm <> 'default';
+DELETE FROM role_permissions WHERE realm <> 'default';
+DELETE FROM roles WHERE realm <> 'default';
+DELETE FROM permissions WHERE realm <> 'default';
+
+DROP INDEX user_roles_role_idx;
+CREATE INDEX user_roles_role_idx ON user_roles (role);
+ALTER TABLE user_roles DROP CONSTRAINT user_roles_guid_realm_fkey;
+ALTER TABLE user_roles DROP CONSTRAINT user_roles_role_fkey;
+ALTER TABLE user_roles DROP COLUMN realm;
+
+ALTER TABLE role_permissions DROP CONSTRAINT role_permissions_permission_fkey;
+ALTER TABLE role_permissions DROP CONSTRAINT role_permissions_role_fkey;
+ALTER TABLE role_permissions DROP CONSTRAINT role_permissions_pkey;
+ALTER TABLE role_permissions DROP COLUMN realm;
+ALTER TABLE role_permissions ADD PRIMARY KEY (role, permission);
+
+ALTER TABLE permissions DROP CONSTRAINT permissions_pkey;
+ALTER TABLE permissions DROP COLUMN realm;
+ALTER TABLE permissions ADD PRIMARY KEY (name);
+
+ALTER TABLE roles DROP CONSTRAINT roles_pkey;
+ALTER TABLE roles DROP COLUMN realm;
+ALTER TABLE roles ADD PRIMARY KEY (name);
+
+ALTER TABLE role_permissions ADD FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE;
+ALTER TABLE role_permissions ADD FOREIGN KEY (permission) REFERENCES permissions(name) ON DELETE CASCADE;
+ALTER TABLE user_roles ADD FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE;
+
+DROP INDEX organizations_realm_idx;
+ALTER TABLE organizations DROP COLUMN realm;
+
+ALTER TABLE refresh_tokens DROP CONSTRAINT refresh_tokens_guid_realm_fkey;
+ALTER TABLE refresh_tokens DROP COLUMN realm;
+
+DROP INDEX users_username_idx;
+DROP INDEX users_email_idx;
+CREATE UNIQUE INDEX users_username_idx ON users (lower(username));
+CREATE UNIQUE INDEX users_email_idx ON users (lower(email));
+
+ALTER TABLE users DROP CONSTRAINT users_guid_realm_key;
+ALTER TABLE users DROP COLUMN realm;
@@ -0,0 +1,55 @@
+-- users, sessions and organizations belong to exactly one realm, the
+-- composite key keeps a session from crossing realms
+ALTER TABLE users ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE users ADD CONSTRAINT users_guid_realm_key UNIQUE (guid, realm);
+
+DROP INDEX users_username_idx;
+DROP INDEX users_email_idx;
+CREATE UNIQUE INDEX users_username_idx ON users (realm, lower(username));
+CREATE UNIQUE INDEX users_email_idx ON users (realm, lower(email));
+
+ALTER TABLE refresh_tokens ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE refresh_tokens
+    ADD CONSTRAINT refresh_tokens_guid_realm_fkey
+    FOREIGN KEY (guid, realm) REFERENCES users (guid, realm) ON DELETE CASCADE;
+
+ALTER TABLE organizations ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX organizations_realm_idx ON organizations (realm);
+
+-- every realm has its own roles and permissions
+ALTER TABLE user_roles DROP CONSTRAINT user_roles_role_fkey;
+ALTER TABLE role_permissions DROP CONSTRAINT role_permissions_role_fkey;
+ALTER TABLE role_permissions DROP CONSTRAINT role_permissions_permission_fkey;
+
+ALTER TABLE roles ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE roles DROP CONSTRAINT roles_pkey;
+ALTER TABLE roles ADD PRIMARY KEY (realm, name);
+
+ALTER TABLE permissions ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE permissions DROP CONSTRAINT permissions_pkey;
+ALTER TABLE permissions ADD PRIMARY KEY (realm, name);
+
+ALTER TABLE role_permissions ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE role_permissions DROP CONSTRAINT role_permissions_pkey;
+ALTER TABLE role_permissions ADD PRIMARY KEY (realm, role, permission);
+ALTER TABLE role_permissions
+    ADD CONSTRAINT role_permissions_role_fkey
+    FOREIGN KEY (realm, role) REFERENCES roles (realm, name) ON DELETE CASCADE;
+ALTER TABLE role_permissions
+    ADD CONSTRAINT role_permissions_permission_fkey
+    FOREIGN KEY (realm, permission) REFERENCES permissions (realm, name) ON DELETE CASCADE;
+
+-- a role is only granted to users of its realm
+ALTER TABLE user_roles ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE user_roles
+    ADD CONSTRAINT user_roles_role_fkey
+    FOREIGN KEY (realm, role) REFERENCES roles (realm, name) ON DELETE CASCADE;
+ALTER TABLE user_roles
+    ADD CONSTRAINT user_roles_guid_realm_fkey
+    FOREIGN KEY (guid, realm) REFERENCES users (guid, realm) ON DELETE CASCADE;
+DROP INDEX user_roles_role_idx;
+CREATE INDEX user_roles_role_idx ON user_roles (realm, role);
+
+-- every realm has its own audit chain
+ALTER TABLE audit_log ADD COLUMN realm TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX audit_log_realm_idx ON audit_log (realm, id);
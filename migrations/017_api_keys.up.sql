@@ -0,0 +1,17 @@
+CREATE TABLE api_keys (
+    id UUID PRIMARY KEY,
+    guid UUID NOT NULL,
+    realm TEXT NOT NULL,
+    name TEXT NOT NULL,
+    -- the non-secret start of the key, used to look it up
+    prefix TEXT NOT NULL UNIQUE,
+    key_hash TEXT NOT NULL,
+    scope TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    last_used_ip TEXT,
+    FOREIGN KEY (guid, realm) REFERENCES users (guid, realm) ON DELETE CASCADE
+);
+
+CREATE INDEX api_keys_guid_idx ON api_keys (guid);
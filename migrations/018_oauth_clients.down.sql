@@ -0,0 +1,2 @@
+DROP TABLE oauth_client_assertions;
+DROP TABLE oauth_clients;
@@ -0,0 +1,23 @@
+CREATE TABLE oauth_clients (
+    id TEXT PRIMARY KEY,
+    realm TEXT NOT NULL,
+    name TEXT NOT NULL,
+    auth_method TEXT NOT NULL CHECK (auth_method IN ('client_secret_basic', 'client_secret_post', 'private_key_jwt')),
+    secret_hash TEXT,
+    public_key TEXT,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    audiences TEXT[] NOT NULL DEFAULT '{}',
+    grant_types TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX oauth_clients_realm_idx ON oauth_clients (realm);
+
+-- ids of used private_key_jwt assertions, kept until they expire so an
+-- assertion can not be replayed
+CREATE TABLE oauth_client_assertions (
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    jti TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (client_id, jti)
+);
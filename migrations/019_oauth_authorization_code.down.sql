@@ -0,0 +1,17 @@
+DROP TABLE oauth_authorization_codes;
+
+DELETE FROM refresh_tokens WHERE client_id IS NOT NULL;
+
+DROP INDEX refresh_tokens_first_party_idx;
+DROP INDEX refresh_tokens_guid_idx;
+
+ALTER TABLE refresh_tokens DROP CONSTRAINT refresh_tokens_pkey;
+ALTER TABLE refresh_tokens ADD PRIMARY KEY (guid);
+
+ALTER TABLE refresh_tokens DROP COLUMN client_id;
+
+DELETE FROM oauth_clients WHERE auth_method = 'none';
+ALTER TABLE oauth_clients DROP COLUMN redirect_uris;
+ALTER TABLE oauth_clients DROP CONSTRAINT oauth_clients_auth_method_check;
+ALTER TABLE oauth_clients ADD CONSTRAINT oauth_clients_auth_method_check
+    CHECK (auth_method IN ('client_secret_basic', 'client_secret_post', 'private_key_jwt'));
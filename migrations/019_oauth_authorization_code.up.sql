@@ -0,0 +1,37 @@
+-- public clients like SPAs and native apps authenticate with PKCE alone
+ALTER TABLE oauth_clients DROP CONSTRAINT oauth_clients_auth_method_check;
+ALTER TABLE oauth_clients ADD CONSTRAINT oauth_clients_auth_method_check
+    CHECK (auth_method IN ('client_secret_basic', 'client_secret_post', 'private_key_jwt', 'none'));
+ALTER TABLE oauth_clients ADD COLUMN redirect_uris TEXT[] NOT NULL DEFAULT '{}';
+
+-- sessions started through an OAuth client end with the client
+ALTER TABLE refresh_tokens ADD COLUMN client_id TEXT REFERENCES oauth_clients(id) ON DELETE CASCADE;
+
+-- every session is a row of its own, sessions started through an OAuth
+-- client live next to the one the user started without a client
+ALTER TABLE refresh_tokens DROP CONSTRAINT refresh_tokens_pkey;
+ALTER TABLE refresh_tokens ADD PRIMARY KEY (session_id);
+
+CREATE INDEX refresh_tokens_guid_idx ON refresh_tokens (guid);
+-- a user still has at most one session without a client
+CREATE UNIQUE INDEX refresh_tokens_first_party_idx ON refresh_tokens (guid) WHERE client_id IS NULL;
+
+CREATE TABLE oauth_authorization_codes (
+    code_hash TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    guid UUID NOT NULL,
+    realm TEXT NOT NULL,
+    -- redirect_uri is what the authorization request carried, empty if it
+    -- relied on the only registered one
+    redirect_uri TEXT NOT NULL,
+    scope TEXT[] NOT NULL,
+    code_challenge TEXT NOT NULL,
+    amr TEXT[] NOT NULL,
+    auth_time TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (guid, realm) REFERENCES users (guid, realm) ON DELETE CASCADE
+);
+
+CREATE INDEX oauth_authorization_codes_client_idx ON oauth_authorization_codes (client_id);
@@ -0,0 +1 @@
+ALTER TABLE oauth_authorization_codes DROP COLUMN nonce;
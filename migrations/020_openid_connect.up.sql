@@ -0,0 +1,2 @@
+-- the OpenID Connect nonce is echoed in the ID token of the code exchange
+ALTER TABLE oauth_authorization_codes ADD COLUMN nonce TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,20 @@
+CREATE TABLE oauth_device_authorizations (
+    device_code_hash TEXT PRIMARY KEY,
+    -- user codes are short, they must not be ambiguous across realms
+    user_code TEXT NOT NULL UNIQUE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    realm TEXT NOT NULL,
+    scope TEXT[] NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'denied')),
+    -- guid, amr and auth_time are set once the user approved
+    guid UUID,
+    amr TEXT[],
+    auth_time TIMESTAMPTZ,
+    interval_seconds INTEGER NOT NULL,
+    last_polled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (guid, realm) REFERENCES users (guid, realm) ON DELETE CASCADE
+);
+
+CREATE INDEX oauth_device_authorizations_expires_idx ON oauth_device_authorizations (expires_at);
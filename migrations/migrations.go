@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migrations into the binary, so they do
+// not depend on the working directory the service is started from.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS